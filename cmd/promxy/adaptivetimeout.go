@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	proxyconfig "github.com/jacksontj/promxy/config"
+	"github.com/jacksontj/promxy/logging"
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+// adaptiveTimeoutHandler sets the timeout of each query (if adaptive timeouts
+// are configured) from the recent latencies of queries covering a similar
+// range before passing it on to `next`, and records the query's latency
+type adaptiveTimeoutHandler struct {
+	next    http.Handler
+	cfg     atomic.Value // *proxyconfig.AdaptiveTimeoutConfig
+	timeout atomic.Value // *promhttputil.AdaptiveTimeout
+}
+
+func (a *adaptiveTimeoutHandler) ApplyConfig(c *proxyconfig.Config) error {
+	// The latencies are kept across reloads which don't change the config
+	if oldCfg, _ := a.cfg.Load().(*proxyconfig.AdaptiveTimeoutConfig); oldCfg != nil && reflect.DeepEqual(oldCfg, c.AdaptiveTimeout) {
+		return nil
+	}
+	a.cfg.Store(c.AdaptiveTimeout)
+	if cfg := c.AdaptiveTimeout; cfg != nil {
+		a.timeout.Store(promhttputil.NewAdaptiveTimeout(cfg.Percentile, cfg.Multiplier, time.Duration(cfg.MinTimeout), time.Duration(cfg.MaxTimeout), cfg.Window))
+	} else {
+		a.timeout.Store((*promhttputil.AdaptiveTimeout)(nil))
+	}
+	return nil
+}
+
+func (a *adaptiveTimeoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	timeout, _ := a.timeout.Load().(*promhttputil.AdaptiveTimeout)
+	if timeout == nil {
+		a.next.ServeHTTP(w, r)
+		return
+	}
+
+	var queryRange time.Duration
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/api/v1/query"):
+	case strings.HasSuffix(r.URL.Path, "/api/v1/query_range"):
+		start, err := promhttputil.ParseTime(r.FormValue("start"))
+		if err != nil {
+			a.next.ServeHTTP(w, r)
+			return
+		}
+		end, err := promhttputil.ParseTime(r.FormValue("end"))
+		if err != nil {
+			a.next.ServeHTTP(w, r)
+			return
+		}
+		queryRange = end.Sub(start)
+	default:
+		a.next.ServeHTTP(w, r)
+		return
+	}
+
+	deadline := timeout.Timeout(queryRange)
+	logging.FromContext(r.Context()).Debugf("Adaptive timeout of %s for %s covering %s", deadline, r.URL.Path, queryRange)
+	ctx, cancel := context.WithTimeout(r.Context(), deadline)
+	defer cancel()
+
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+	a.next.ServeHTTP(rec, r.WithContext(ctx))
+	// Only successful queries are recorded, failures (e.g. timeouts) say little about the latency
+	if rec.code == http.StatusOK {
+		timeout.Observe(queryRange, time.Since(start))
+	}
+}
+
+// statusRecorder records the status code of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush sends the response written so far to the client
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	proxyconfig "github.com/jacksontj/promxy/config"
+	"github.com/jacksontj/promxy/logging"
+	"github.com/jacksontj/promxy/promclient"
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+// forwardHeadersHandler attaches the configured headers of each request and its
+// request ID (to be forwarded to the downstreams) and its affinity key to its
+// context before passing it on to `next`, and sets the configured headers of
+// the downstream responses on its response. The priority of its downstream
+// requests is also taken from the configured header.
+type forwardHeadersHandler struct {
+	next           http.Handler
+	headers        atomic.Value
+	affinityHeader atomic.Value
+	priorityHeader atomic.Value
+	// responseHeaders is the *responseHeadersConfig
+	responseHeaders atomic.Value
+}
+
+// responseHeadersConfig are the downstream response headers to forward, and how
+type responseHeadersConfig struct {
+	names  []string
+	policy promhttputil.ResponseHeaderPolicy
+}
+
+func (f *forwardHeadersHandler) ApplyConfig(c *proxyconfig.Config) error {
+	f.headers.Store(c.ForwardHeaders)
+	f.affinityHeader.Store(c.AffinityHeader)
+	f.priorityHeader.Store(c.PriorityHeader)
+	f.responseHeaders.Store(&responseHeadersConfig{c.ForwardResponseHeaders, c.ForwardResponseHeaderPolicy})
+	return nil
+}
+
+func (f *forwardHeadersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var forwarded http.Header
+	if headers, _ := f.headers.Load().([]string); len(headers) > 0 {
+		forwarded = promclient.SelectHeaders(r.Header, headers)
+	}
+	if id := logging.RequestID(ctx); id != "" {
+		if forwarded == nil {
+			forwarded = make(http.Header, 1)
+		}
+		forwarded.Set(logging.RequestIDHeader, id)
+	}
+	ctx = promclient.WithForwardedHeaders(ctx, forwarded)
+	if affinityHeader, _ := f.affinityHeader.Load().(string); affinityHeader != "" {
+		ctx = promclient.WithAffinityKey(ctx, r.Header.Get(affinityHeader))
+	}
+	if priorityHeader, _ := f.priorityHeader.Load().(string); priorityHeader != "" {
+		if value := r.Header.Get(priorityHeader); value != "" {
+			priority, err := promclient.ParsePriority(value)
+			if err != nil {
+				logging.FromContext(ctx).Debugf("Ignoring the %s header: %v", priorityHeader, err)
+			}
+			ctx = promclient.WithPriority(ctx, priority)
+		}
+	}
+	if cfg, _ := f.responseHeaders.Load().(*responseHeadersConfig); cfg != nil && len(cfg.names) > 0 {
+		var headers *promhttputil.ResponseHeaders
+		ctx, headers = promhttputil.WithResponseHeaders(ctx, cfg.names, cfg.policy)
+		w = promhttputil.NewResponseHeadersWriter(w, headers)
+	}
+	f.next.ServeHTTP(w, r.WithContext(ctx))
+}
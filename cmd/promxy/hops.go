@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	proxyconfig "github.com/jacksontj/promxy/config"
+	"github.com/jacksontj/promxy/logging"
+	"github.com/jacksontj/promxy/promclient"
+)
+
+// hopsHandler rejects the requests which have passed through too many promxy
+// instances (see max_hops) or through this instance already (identified by
+// its external labels), so a loop in a promxy-of-promxy topology fails fast
+// instead of fanning out forever. Accepted requests are passed on to `next`
+// with their hops, which are sent on to the downstreams.
+type hopsHandler struct {
+	next    http.Handler
+	maxHops atomic.Value
+	self    atomic.Value
+}
+
+func (h *hopsHandler) ApplyConfig(c *proxyconfig.Config) error {
+	h.maxHops.Store(c.MaxHops)
+	self := ""
+	if len(c.PromConfig.GlobalConfig.ExternalLabels) > 0 {
+		self = c.PromConfig.GlobalConfig.ExternalLabels.String()
+	}
+	h.self.Store(self)
+	return nil
+}
+
+func (h *hopsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	count := 0
+	if s := r.Header.Get(promclient.HopsHeader); s != "" {
+		var err error
+		if count, err = strconv.Atoi(s); err != nil || count < 0 {
+			http.Error(w, fmt.Sprintf("invalid %s header %q", promclient.HopsHeader, s), http.StatusBadRequest)
+			return
+		}
+	}
+	// This instance is one more hop
+	count++
+
+	if maxHops, _ := h.maxHops.Load().(int); maxHops > 0 && count > maxHops {
+		msg := fmt.Sprintf("request has passed through %d promxy instances, exceeding the max_hops of %d (is there a loop in the promxy topology?)", count, maxHops)
+		logging.FromContext(r.Context()).Warnf("Rejecting %s: %s", r.URL.Path, msg)
+		http.Error(w, msg, http.StatusLoopDetected)
+		return
+	}
+
+	via := r.Header[promclient.ViaHeader]
+	if self, _ := h.self.Load().(string); self != "" {
+		for _, v := range via {
+			if v == self {
+				msg := fmt.Sprintf("query loop detected: request has already passed through this promxy (external labels %s)", self)
+				logging.FromContext(r.Context()).Warnf("Rejecting %s: %s", r.URL.Path, msg)
+				http.Error(w, msg, http.StatusLoopDetected)
+				return
+			}
+		}
+		via = append(via[:len(via):len(via)], self)
+	}
+
+	h.next.ServeHTTP(w, r.WithContext(promclient.WithHops(r.Context(), count, via)))
+}
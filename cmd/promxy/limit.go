@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jacksontj/promxy/promclient"
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+const (
+	// limitParam is the API parameter capping the number of results of the
+	// series, labels and label values endpoints
+	limitParam = "limit"
+	// afterParam is the API parameter of the label values endpoint with the
+	// value to return the values after, to page through them with limitParam
+	afterParam = "after"
+
+	// maxLimitedSeriesBytes is the most of a series response which is buffered
+	// to truncate its series, larger responses are passed through untruncated
+	maxLimitedSeriesBytes = 64 << 20
+)
+
+// limitHandler caps the number of results of requests with a `limit` parameter
+// and sets the cursor of the label values requests with an `after` parameter
+// (see promclient.LimitAPI) before passing them on to `next`. The series of
+// each match[] are capped by the storage, so the merged series of a series
+// request are capped here too.
+type limitHandler struct {
+	next http.Handler
+}
+
+func (l *limitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := promclient.WithAfter(r.Context(), r.FormValue(afterParam))
+	if s := r.FormValue(limitParam); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			http.Error(w, fmt.Sprintf("invalid %s %q: must be a non-negative integer", limitParam, s), http.StatusBadRequest)
+			return
+		}
+		ctx = promclient.WithLimit(ctx, limit)
+		if limit > 0 && r.URL.Path == "/api/v1/series" {
+			serveLimitedSeries(w, r.WithContext(ctx), l.next, limit)
+			return
+		}
+	}
+	l.next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// serveLimitedSeries serves the series request `r` with `next`, truncating
+// the series of the response to `limit`. Responses larger than
+// maxLimitedSeriesBytes are passed through untruncated (with a warning).
+func serveLimitedSeries(w http.ResponseWriter, r *http.Request, next http.Handler, limit int) {
+	// The response is rewritten, so it is requested uncompressed
+	header := make(http.Header, len(r.Header))
+	for k, v := range r.Header {
+		if k != "Accept-Encoding" {
+			header[k] = v
+		}
+	}
+	r.Header = header
+
+	buf := &bufferedResponseWriter{
+		ResponseWriter: w,
+		code:           http.StatusOK,
+		max:            maxLimitedSeriesBytes,
+		overflow: func() {
+			promhttputil.AddWarning(r.Context(), fmt.Sprintf("series not truncated to the limit of %d: the response is larger than %d bytes", limit, maxLimitedSeriesBytes))
+		},
+	}
+	next.ServeHTTP(buf, r)
+	if buf.overflowed {
+		return
+	}
+
+	body := buf.body.Bytes()
+	if buf.code == http.StatusOK {
+		// Only the data is replaced, any other fields are passed through as-is
+		var resp map[string]json.RawMessage
+		var data []json.RawMessage
+		if err := json.Unmarshal(body, &resp); err == nil && json.Unmarshal(resp["data"], &data) == nil && len(data) > limit {
+			promhttputil.AddWarning(r.Context(), fmt.Sprintf("results truncated: series truncated to the limit of %d of %d", limit, len(data)))
+			if d, err := json.Marshal(data[:limit]); err == nil {
+				resp["data"] = d
+				if b, err := json.Marshal(resp); err == nil {
+					body = b
+				}
+			}
+		}
+	}
+	w.WriteHeader(buf.code)
+	w.Write(body)
+}
+
+// bufferedResponseWriter buffers the response so it can be modified before it
+// is written. Once more than `max` bytes are written (if set) the response is
+// written through instead, calling `overflow` before its header is written.
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+
+	max        int
+	overflow   func()
+	overflowed bool
+}
+
+func (w *bufferedResponseWriter) WriteHeader(code int) {
+	w.code = code
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	if w.overflowed {
+		return w.ResponseWriter.Write(b)
+	}
+	if w.max > 0 && w.body.Len()+len(b) > w.max {
+		w.overflowed = true
+		if w.overflow != nil {
+			w.overflow()
+		}
+		w.ResponseWriter.WriteHeader(w.code)
+		if _, err := w.ResponseWriter.Write(w.body.Bytes()); err != nil {
+			return 0, err
+		}
+		w.body = bytes.Buffer{}
+		return w.ResponseWriter.Write(b)
+	}
+	return w.body.Write(b)
+}
+
+// Flush does nothing while the response is buffered, it is only written once
+// it is complete
+func (w *bufferedResponseWriter) Flush() {
+	if !w.overflowed {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
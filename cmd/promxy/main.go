@@ -42,35 +42,62 @@ import (
 
 	proxyconfig "github.com/jacksontj/promxy/config"
 	"github.com/jacksontj/promxy/logging"
+	"github.com/jacksontj/promxy/promclient"
+	"github.com/jacksontj/promxy/promhttputil"
+	"github.com/jacksontj/promxy/proxyapi"
 	"github.com/jacksontj/promxy/proxystorage"
+	"github.com/jacksontj/promxy/servergroup"
 )
 
+// shutdownResponseTimeout is how long the server waits to write the remaining
+// responses once the queries are drained
+const shutdownResponseTimeout = 5 * time.Second
+
 var (
 	reloadTime = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "process_reload_time_seconds",
-		Help: "Last reload (SIGHUP) time of the process since unix epoch in seconds.",
+		Help: "Last successful reload (SIGHUP) time of the process since unix epoch in seconds.",
+	})
+	reloadFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "process_reload_failures_total",
+		Help: "Number of failed reloads (SIGHUP) of the config.",
 	})
+	downstreamQueued = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "downstream_queue_requests",
+		Help: "Number of downstream requests queued for the --downstream.max-concurrency capacity, by priority.",
+	}, []string{"priority"})
+	downstreamQueueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "downstream_queue_wait_seconds",
+		Help:    "Time downstream requests waited in the queue for the --downstream.max-concurrency capacity, by priority.",
+		Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30},
+	}, []string{"priority"})
 	Version = "<version>"
 )
 
 type CLIOpts struct {
 	Version bool `long:"version" short:"v" description:"print out version and exit"`
 
-	BindAddr   string `long:"bind-addr" description:"address for promxy to listen on" default:":8082"`
-	ConfigFile string `long:"config" description:"path to the config file" default:"config.yaml"`
-	LogLevel   string `long:"log-level" description:"Log level" default:"info"`
+	BindAddr       string        `long:"bind-addr" description:"address for promxy to listen on" default:":8082"`
+	ConfigFile     string        `long:"config" description:"path to the config file" default:"config.yaml"`
+	ConfigCheck    bool          `long:"config.check" description:"validate the config file (and the files it references) and exit"`
+	ReloadDebounce time.Duration `long:"config.reload-debounce" description:"Reloads of the config (on SIGHUP) are coalesced until no other reload was requested for this long." default:"1s"`
+	LogLevel       string        `long:"log-level" description:"Log level" default:"info"`
 
 	ExternalURL     string `long:"web.external-url" description:"The URL under which Prometheus is externally reachable (for example, if Prometheus is served via a reverse proxy). Used for generating relative and absolute links back to Prometheus itself. If the URL has a path portion, it will be used to prefix all HTTP endpoints served by Prometheus. If omitted, relevant URL components will be derived automatically."`
 	EnableLifecycle bool   `long:"web.enable-lifecycle" description:"Enable shutdown and reload via HTTP request."`
+	EnableAdminAPI  bool   `long:"web.enable-admin-api" description:"Enable API endpoints for admin control actions (e.g. flushing caches)."`
 
 	QueryTimeout        time.Duration `long:"query.timeout" description:"Maximum time a query may take before being aborted." default:"2m"`
 	QueryMaxConcurrency int           `long:"query.max-concurrency" description:"Maximum number of queries executed concurrently." default:"1000"`
+	LookbackDelta       time.Duration `long:"query.lookback-delta" description:"The delta difference allowed for retrieving metrics during expression evaluations." default:"5m"`
+
+	DownstreamMaxConcurrency int `long:"downstream.max-concurrency" description:"Maximum number of concurrent requests to downstream servers (shared by all server groups, the vertical_shards of a request count as one), 0 is unlimited." default:"0"`
 
 	NotificationQueueCapacity int    `long:"alertmanager.notification-queue-capacity" description:"The capacity of the queue for pending alert manager notifications." default:"10000"`
 	AccessLogDestination      string `long:"access-log-destination" description:"where to log access logs, options (none, stderr, stdout)" default:"stdout"`
 
 	ShutdownDelay   time.Duration `long:"http.shutdown-delay" description:"time to wait before shutting down the http server, this allows for a grace period for upstreams (e.g. LoadBalancers) to discover the new stopping status through healthchecks" default:"10s"`
-	ShutdownTimeout time.Duration `long:"http.shutdown-timeout" description:"max time to wait for a graceful shutdown of the HTTP server" default:"60s"`
+	ShutdownTimeout time.Duration `long:"http.shutdown-timeout" description:"max time to wait for a graceful shutdown: for the in-flight queries to complete (the remaining ones are canceled) and the HTTP server to shut down" default:"60s"`
 }
 
 func (c *CLIOpts) ToFlags() map[string]string {
@@ -86,6 +113,7 @@ var opts CLIOpts
 func reloadConfig(rls ...proxyconfig.Reloadable) error {
 	cfg, err := proxyconfig.ConfigFromFile(opts.ConfigFile)
 	if err != nil {
+		reloadFailures.Inc()
 		return fmt.Errorf("Error loading cfg: %v", err)
 	}
 
@@ -98,6 +126,7 @@ func reloadConfig(rls ...proxyconfig.Reloadable) error {
 	}
 
 	if failed {
+		reloadFailures.Inc()
 		return fmt.Errorf("One or more errors occurred while applying new configuration")
 	}
 	reloadTime.Set(float64(time.Now().Unix()))
@@ -112,7 +141,7 @@ func main() {
 	defer close(sigs)
 	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
 
-	prometheus.MustRegister(reloadTime)
+	prometheus.MustRegister(reloadTime, reloadFailures, downstreamQueued, downstreamQueueWait)
 
 	reloadables := make([]proxyconfig.Reloadable, 0)
 
@@ -131,6 +160,16 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Validate the config without starting anything (e.g. discovery)
+	if opts.ConfigCheck {
+		if _, err := proxyconfig.ConfigFromFile(opts.ConfigFile); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("Config OK")
+		os.Exit(0)
+	}
+
 	// Use log level
 	level, err := logrus.ParseLevel(opts.LogLevel)
 	if err != nil {
@@ -144,6 +183,9 @@ func main() {
 	}
 	logrus.SetFormatter(formatter)
 
+	// Identify ourselves (with version) to the downstream servergroups
+	servergroup.DefaultUserAgent = "promxy/" + Version
+
 	// Create base context for this daemon
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -154,13 +196,22 @@ func main() {
 	// Create the proxy storag
 	var proxyStorage storage.Storage
 
-	ps, err := proxystorage.NewProxyStorage()
+	// Requests queued for the downstream capacity are sent by their priority
+	workerPool := promclient.NewWorkerPool(opts.DownstreamMaxConcurrency)
+	workerPool.SetQueueMetrics(func(p promclient.Priority, delta float64) {
+		downstreamQueued.WithLabelValues(p.String()).Add(delta)
+	}, func(p promclient.Priority, seconds float64) {
+		downstreamQueueWait.WithLabelValues(p.String()).Observe(seconds)
+	})
+	ps, err := proxystorage.NewProxyStorage(workerPool)
 	if err != nil {
 		logrus.Fatalf("Error creating proxy: %v", err)
 	}
 	reloadables = append(reloadables, ps)
 	proxyStorage = ps
 
+	// Match the staleness semantics of the downstream prometheus hosts
+	promql.LookbackDelta = opts.LookbackDelta
 	engine := promql.NewEngine(nil, prometheus.DefaultRegisterer, opts.QueryMaxConcurrency, opts.QueryTimeout)
 	engine.NodeReplacer = ps.NodeReplacer
 
@@ -170,7 +221,8 @@ func main() {
 		logrus.Fatalf("Unable to parse external URL %s", "tmp")
 	}
 
-	// Alert notifier
+	// Alert notifier -- this sends the alerts from rules evaluated by promxy to the
+	// alertmanagers in the `alerting` section of the config (see sendAlerts)
 	lvl := promlog.AllowedLevel{}
 	if err := lvl.Set("info"); err != nil {
 		panic(err)
@@ -218,7 +270,7 @@ func main() {
 	ruleManager := rules.NewManager(&rules.ManagerOptions{
 		Context:     ctx,         // base context for all background tasks
 		ExternalURL: externalUrl, // URL listed as URL for "who fired this alert"
-		QueryFunc:   rules.EngineQueryFunc(engine, proxyStorage),
+		QueryFunc:   highPriorityQueryFunc(rules.EngineQueryFunc(engine, proxyStorage)),
 		NotifyFunc:  sendAlerts(notifierManager, externalUrl.String()),
 		Appendable:  proxyStorage,
 		Logger:      logger,
@@ -303,6 +355,45 @@ func main() {
 
 	apiRouter := route.New()
 	webHandler.Getv1API().Register(apiRouter.WithPrefix("/api/v1"))
+	// Endpoints that promxy implements itself
+	proxyAPI := proxyapi.NewAPI(ps.Client, ruleManager)
+	proxyAPI.Register(apiRouter.WithPrefix("/api/v1"))
+	// Remote read is served by promxy (the upstream API registers its own handler
+	// for the path, so the requests are routed before it), merging all server groups
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/api/v1/read" {
+			proxyAPI.RemoteRead(w, r)
+			return
+		}
+		apiRouter.ServeHTTP(w, r)
+	})
+
+	// Cap the series and label requests to their limit parameter
+	limit := &limitHandler{next: api}
+	// Give queries an adaptive timeout (if configured)
+	adaptiveTimeout := &adaptiveTimeoutHandler{next: limit}
+	// Track queries while they are handled, so they can be listed and canceled
+	queries := promhttputil.NewQueryRegistry()
+	registry := promhttputil.NewQueryRegistryHandler(queries, adaptiveTimeout)
+	// Respond to queries with an explain parameter with their explain plan
+	explain := promhttputil.NewExplainHandler(registry)
+	// Add promxy's stats to the responses of queries with a stats parameter
+	stats := promhttputil.NewStatsHandler(explain)
+	// Respond to failed requests with the status their error is mapped to
+	errorStatus := promhttputil.NewErrorStatusHandler(stats)
+	// Give range queries a step of at least min_step
+	minStep := &minStepHandler{next: errorStatus}
+	// Return the warnings from handling requests as response headers
+	warnings := promhttputil.NewWarningsHandler(minStep)
+	// Restrict requests with a servergroup parameter to that server group
+	serverGroup := &serverGroupHandler{next: warnings, client: ps.ServerGroupClient}
+	// Forward the configured headers (and affinity key) to the downstreams
+	forwardHeaders := &forwardHeadersHandler{next: serverGroup}
+	// Scope requests to the requesting tenant (if tenancy is configured)
+	tenancy := &tenancyHandler{next: forwardHeaders}
+	// Reject requests looping through promxy-of-promxy topologies
+	apiHops := &hopsHandler{next: tenancy}
+	reloadables = append(reloadables, adaptiveTimeout, minStep, forwardHeaders, tenancy, apiHops)
 
 	// Create our router
 	r := httprouter.New()
@@ -310,11 +401,58 @@ func main() {
 	// TODO: configurable metrics path
 	r.HandlerFunc("GET", "/metrics", prometheus.Handler().ServeHTTP)
 
+	// Debug endpoint to see what targets all the server groups currently have
+	r.Handler("GET", "/debug/servergroups", servergroup.NewDebugHandler(ps.ServerGroups))
+
+	// Debug endpoint to see the health of all the server groups (and their targets) at a glance
+	r.Handler("GET", "/debug/health", servergroup.NewHealthHandler(ps.ServerGroups))
+
+	// Debug endpoint to see the raw (unmerged) data from each target, scoped to the tenant
+	debugQueryForwardHeaders := &forwardHeadersHandler{next: servergroup.NewDebugQueryHandler(ps.ServerGroups)}
+	debugQuery := &tenancyHandler{next: debugQueryForwardHeaders}
+	reloadables = append(reloadables, debugQueryForwardHeaders, debugQuery)
+	r.Handler("GET", "/debug/query", debugQuery)
+
+	// Federation of the aggregated view (served by the prometheus web handler
+	// from the proxy storage), scoped like the API requests
+	federateServerGroup := &serverGroupHandler{next: promhttputil.NewWarningsHandler(webHandler.GetRouter()), client: ps.ServerGroupClient}
+	federateForwardHeaders := &forwardHeadersHandler{next: federateServerGroup}
+	federateTenancy := &tenancyHandler{next: federateForwardHeaders}
+	federate := &hopsHandler{next: federateTenancy}
+	reloadables = append(reloadables, federateForwardHeaders, federateTenancy, federate)
+	r.Handler("GET", "/federate", federate)
+
+	adminOnly := func(h httprouter.Handle) httprouter.Handle {
+		return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			if !opts.EnableAdminAPI {
+				http.Error(w, "Admin APIs are disabled, enable them with --web.enable-admin-api", http.StatusForbidden)
+				return
+			}
+			h(w, r, p)
+		}
+	}
+
+	// Admin endpoint to flush the caches of the server groups
+	cacheFlush := servergroup.NewCacheFlushHandler(ps.ServerGroups)
+	r.POST("/-/cache/flush", adminOnly(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		cacheFlush.ServeHTTP(w, r)
+	}))
+
+	// Admin endpoints to exclude a target from its server group (e.g. while it
+	// is under maintenance) without a reload, and to include it again
+	r.POST("/admin/targets/:host/disable", adminOnly(servergroup.NewTargetAdminHandler(ps.ServerGroups, true)))
+	r.POST("/admin/targets/:host/enable", adminOnly(servergroup.NewTargetAdminHandler(ps.ServerGroups, false)))
+
+	// Admin endpoints to list the queries being handled, and to cancel one
+	// (by its request ID) aborting its requests to the downstreams
+	r.GET("/admin/queries", adminOnly(newQueriesHandler(queries)))
+	r.POST("/admin/queries/:id/cancel", adminOnly(newQueryCancelHandler(queries)))
+
 	stopping := false
 	r.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Have our fallback rules
 		if strings.HasPrefix(r.URL.Path, "/api/") {
-			apiRouter.ServeHTTP(w, r)
+			apiHops.ServeHTTP(w, r)
 		} else if strings.HasPrefix(r.URL.Path, "/debug") {
 			http.DefaultServeMux.ServeHTTP(w, r)
 		} else if r.URL.Path == "/-/ready" {
@@ -336,6 +474,10 @@ func main() {
 
 	close(reloadReady)
 
+	// Reloads are serialized (and the SIGHUP ones coalesced) from now on
+	reloads := newReloader(opts.ReloadDebounce, reloadables...)
+	go reloads.Run(ctx)
+
 	// Set up access logger
 	var accessLogOut io.Writer
 	switch strings.ToLower(opts.AccessLogDestination) {
@@ -354,6 +496,9 @@ func main() {
 	} else {
 		handler = logging.NewApacheLoggingHandler(r, logging.LogToWriter(accessLogOut))
 	}
+	// Every request gets an ID (or keeps the one it came with) for its log lines,
+	// which is also forwarded to the downstreams to correlate their logs with ours
+	handler = logging.NewRequestIDHandler(handler)
 
 	srv := &http.Server{
 		Addr:    opts.BindAddr,
@@ -371,20 +516,19 @@ func main() {
 	for {
 		select {
 		case rc := <-webHandler.Reload():
-			log.Infof("Reloading config")
-			if err := reloadConfig(reloadables...); err != nil {
-				log.Errorf("Error reloading config: %s", err)
+			// Reloads via the API aren't coalesced, the result is returned to the caller
+			go func() {
+				log.Infof("Reloading config")
+				err := reloads.Reload()
+				if err != nil {
+					log.Errorf("Error reloading config: %s", err)
+				}
 				rc <- err
-			} else {
-				rc <- nil
-			}
+			}()
 		case sig := <-sigs:
 			switch sig {
 			case syscall.SIGHUP:
-				log.Infof("Reloading config")
-				if err := reloadConfig(reloadables...); err != nil {
-					log.Errorf("Error reloading config: %s", err)
-				}
+				reloads.Request()
 			case syscall.SIGTERM, syscall.SIGINT:
 				log.Info("promxy recieved exit signal, starting graceful shutdown")
 
@@ -392,6 +536,11 @@ func main() {
 				stopping = true        // start failing healthchecks
 				notifierManager.Stop() // stop alert notifier
 				ruleManager.Stop()     // Stop rule manager
+				// The targets are frozen while draining, a reload would replace them
+				reloads.Stop()
+				for _, sg := range ps.ServerGroups() {
+					sg.StopDiscovery()
+				}
 
 				if opts.ShutdownDelay > 0 {
 					log.Infof("promxy delaying shutdown by %v", opts.ShutdownDelay)
@@ -403,7 +552,15 @@ func main() {
 					ctx, cancel = context.WithTimeout(ctx, opts.ShutdownTimeout)
 					defer cancel()
 				}
-				srv.Shutdown(ctx)
+				// Reject new queries and wait for the in-flight ones, before closing the server
+				log.Infof("promxy draining %d in-flight queries", len(queries.List()))
+				if canceled := queries.Drain(ctx); canceled > 0 {
+					log.Warnf("promxy canceled %d queries which didn't complete within the shutdown timeout", canceled)
+				}
+				// The drain may have used up ctx, the responses of the canceled queries still need to be written
+				shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownResponseTimeout)
+				defer shutdownCancel()
+				srv.Shutdown(shutdownCtx)
 				return
 			default:
 				log.Errorf("Uncaught signal: %v", sig)
@@ -413,6 +570,14 @@ func main() {
 	}
 }
 
+// highPriorityQueryFunc returns a rules.QueryFunc whose downstream requests
+// have a high priority, so alerting rules aren't starved by other queries
+func highPriorityQueryFunc(queryFunc rules.QueryFunc) rules.QueryFunc {
+	return func(ctx context.Context, q string, t time.Time) (promql.Vector, error) {
+		return queryFunc(promclient.WithPriority(ctx, promclient.PriorityHigh), q, t)
+	}
+}
+
 // sendAlerts implements the rules.NotifyFunc for a Notifier.
 // It filters any non-firing alerts from the input.
 func sendAlerts(n *notifier.Manager, externalURL string) rules.NotifyFunc {
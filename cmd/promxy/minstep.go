@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	proxyconfig "github.com/jacksontj/promxy/config"
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+// minStepHandler clamps the step of range queries to the configured min_step
+// (returning a warning when it does) before passing them on to `next`, so a
+// client requesting a long range at a tiny step doesn't overwhelm promxy and
+// the downstreams
+type minStepHandler struct {
+	next    http.Handler
+	minStep atomic.Value
+}
+
+func (m *minStepHandler) ApplyConfig(c *proxyconfig.Config) error {
+	m.minStep.Store(time.Duration(c.MinStep))
+	return nil
+}
+
+func (m *minStepHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	minStep, _ := m.minStep.Load().(time.Duration)
+	if minStep <= 0 || !strings.HasSuffix(r.URL.Path, "/api/v1/query_range") {
+		m.next.ServeHTTP(w, r)
+		return
+	}
+	// Invalid steps are left to the API to reject
+	step, err := parseStep(r.FormValue("step"))
+	if err != nil || step <= 0 || step >= minStep {
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	// The request is copied with its form (parsed by FormValue), so the API
+	// evaluates the query at the clamped step
+	form := make(url.Values, len(r.Form))
+	for k, values := range r.Form {
+		form[k] = append([]string(nil), values...)
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Form = form
+	r = r2
+	r.Form.Set("step", strconv.FormatFloat(minStep.Seconds(), 'f', -1, 64))
+	promhttputil.AddWarning(r.Context(), fmt.Sprintf("query step of %s is below the min_step, adjusted to %s", step, minStep))
+	m.next.ServeHTTP(w, r)
+}
+
+// parseStep parses the step of a range query, either a float number of
+// seconds or a duration (like the prometheus API)
+func parseStep(s string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	d, err := model.ParseDuration(s)
+	return time.Duration(d), err
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+// newQueriesHandler returns an httprouter.Handle listing the active queries of `queries`
+func newQueriesHandler(queries *promhttputil.QueryRegistry) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(queries.List()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// newQueryCancelHandler returns an httprouter.Handle which cancels the active
+// query of `queries` with the request ID in the `id` param
+func newQueryCancelHandler(queries *promhttputil.QueryRegistry) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		id := p.ByName("id")
+		if queries.Cancel(id) == 0 {
+			http.Error(w, fmt.Sprintf("no active query with the id %q", id), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	proxyconfig "github.com/jacksontj/promxy/config"
+)
+
+// errReloadInProgress is returned by a reload rejected because another one is in progress
+var errReloadInProgress = errors.New("a config reload is already in progress, try again once it completes")
+
+// errReloadStopped is returned by a reload rejected because the reloads were stopped
+var errReloadStopped = errors.New("config reloads are stopped, promxy is shutting down")
+
+// reloader serializes the config reloads, so the reloadables never apply two
+// configs concurrently. Reloads requested with Request (e.g. by a burst of
+// SIGHUPs) are coalesced: the config is reloaded once after no other reload
+// was requested for `debounce`, and as the config file is only read then the
+// latest config wins.
+type reloader struct {
+	reloadables []proxyconfig.Reloadable
+	debounce    time.Duration
+
+	// l guards reloading and stopped, done is signaled when a reload completes
+	l         sync.Mutex
+	done      *sync.Cond
+	reloading bool
+	stopped   bool
+	requested chan struct{}
+}
+
+func newReloader(debounce time.Duration, reloadables ...proxyconfig.Reloadable) *reloader {
+	r := &reloader{
+		reloadables: reloadables,
+		debounce:    debounce,
+		requested:   make(chan struct{}, 1),
+	}
+	r.done = sync.NewCond(&r.l)
+	return r
+}
+
+// Reload reloads the config now, unless a reload is already in progress (or
+// the reloads were stopped) in which case an error is returned
+func (r *reloader) Reload() error {
+	r.l.Lock()
+	if r.stopped {
+		r.l.Unlock()
+		return errReloadStopped
+	}
+	if r.reloading {
+		r.l.Unlock()
+		return errReloadInProgress
+	}
+	r.reloading = true
+	r.l.Unlock()
+
+	defer r.finish()
+	return reloadConfig(r.reloadables...)
+}
+
+// finish marks the reload in progress as completed
+func (r *reloader) finish() {
+	r.l.Lock()
+	r.reloading = false
+	r.l.Unlock()
+	r.done.Broadcast()
+}
+
+// Request requests a reload of the config, coalesced with any other reloads
+// requested within the debounce window (see Run)
+func (r *reloader) Request() {
+	select {
+	case r.requested <- struct{}{}:
+	default:
+		// A reload is already pending
+	}
+}
+
+// Stop waits for any reload in progress, and stops any later reloads (e.g.
+// while draining for a shutdown)
+func (r *reloader) Stop() {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.stopped = true
+	for r.reloading {
+		r.done.Wait()
+	}
+}
+
+// Run performs the requested reloads until `ctx` is done
+func (r *reloader) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.requested:
+		}
+
+		// Wait until no reload was requested for the debounce window
+		timer := time.NewTimer(r.debounce)
+	debounce:
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-r.requested:
+				timer.Reset(r.debounce)
+			case <-timer.C:
+				break debounce
+			}
+		}
+
+		// Requested reloads wait for any reload in progress instead of being rejected
+		r.l.Lock()
+		for r.reloading {
+			r.done.Wait()
+		}
+		if r.stopped {
+			r.l.Unlock()
+			return
+		}
+		r.reloading = true
+		r.l.Unlock()
+
+		logrus.Infof("Reloading config")
+		if err := reloadConfig(r.reloadables...); err != nil {
+			logrus.Errorf("Error reloading config: %s", err)
+		}
+		r.finish()
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/jacksontj/promxy/promclient"
+)
+
+const (
+	// serverGroupParam is the API parameter restricting a request to a single server group
+	serverGroupParam = "servergroup"
+	// targetsParam is the API parameter restricting a request to the targets
+	// whose labels match a selector (e.g. `{region="us-east"}`)
+	targetsParam = "targets"
+)
+
+// serverGroupHandler restricts requests with a `servergroup` parameter to the
+// named server group (bypassing the aggregation across server groups) and
+// requests with a `targets` parameter to the targets matching it before
+// passing them on to `next`
+type serverGroupHandler struct {
+	next   http.Handler
+	client func(name string) promclient.API
+}
+
+func (s *serverGroupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if name := r.FormValue(serverGroupParam); name != "" {
+		if s.client(name) == nil {
+			http.Error(w, fmt.Sprintf("unknown %s %q", serverGroupParam, name), http.StatusBadRequest)
+			return
+		}
+		ctx = promclient.WithServerGroup(ctx, name)
+	}
+	if selector := r.FormValue(targetsParam); selector != "" {
+		matchers, err := promql.ParseMetricSelector(selector)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s %q: %v", targetsParam, selector, err), http.StatusBadRequest)
+			return
+		}
+		ctx = promclient.WithTargetSelector(ctx, matchers)
+	}
+	s.next.ServeHTTP(w, r.WithContext(ctx))
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	proxyconfig "github.com/jacksontj/promxy/config"
+	"github.com/jacksontj/promxy/promclient"
+)
+
+// tenancyHandler attaches the tenant matcher (if tenancy is configured) to the
+// context of each request before passing it on to `next`
+type tenancyHandler struct {
+	next http.Handler
+	cfg  atomic.Value
+}
+
+func (t *tenancyHandler) ApplyConfig(c *proxyconfig.Config) error {
+	t.cfg.Store(c.Tenancy)
+	return nil
+}
+
+func (t *tenancyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg, _ := t.cfg.Load().(*proxyconfig.TenancyConfig)
+	if cfg == nil {
+		t.next.ServeHTTP(w, r)
+		return
+	}
+
+	matcher, err := cfg.Matcher(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	t.next.ServeHTTP(w, r.WithContext(promclient.WithRequiredMatchers(r.Context(), matcher)))
+}
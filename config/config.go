@@ -3,9 +3,18 @@ package proxyconfig
 import (
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/rulefmt"
 
+	"github.com/jacksontj/promxy/promhttputil"
 	"github.com/jacksontj/promxy/servergroup"
 
 	yaml "gopkg.in/yaml.v2"
@@ -24,6 +33,9 @@ func ConfigFromFile(path string) (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Error unmarshaling config: %v", err)
 	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("Error validating config: %v", err)
+	}
 
 	return cfg, nil
 }
@@ -43,5 +55,362 @@ type Config struct {
 // PromxyConfig is the configuration for Promxy itself
 type PromxyConfig struct {
 	// Config for each of the server groups promxy is configured to aggregate
-	ServerGroups []*servergroup.Config `yaml:"server_groups"`
+	ServerGroups ServerGroupConfigs `yaml:"server_groups"`
+
+	// UniqueServerGroupLabels treats the labels of each server group as its
+	// identity, requiring that every pair of server groups has a label with
+	// differing values. This guarantees series from different server groups
+	// can never be merged together as duplicates.
+	UniqueServerGroupLabels bool `yaml:"unique_server_group_labels"`
+
+	// MaxLookback (optionally) rejects any query which requests data from further
+	// back than this duration ago. This includes the lookback-delta and offsets
+	// so this must be larger than the lookback-delta (5m by default)
+	MaxLookback model.Duration `yaml:"max_lookback"`
+
+	// MaxLabelValues (optionally) caps the number of values returned for a label.
+	// The merged values are sorted before being truncated and a warning is
+	// returned (in the X-Promxy-Warning header) when values are dropped
+	MaxLabelValues int `yaml:"max_label_values"`
+
+	// MaxSamples (optionally) caps the number of samples a merged query result
+	// may have, the query fails once the merged results exceed it
+	MaxSamples int `yaml:"max_samples"`
+
+	// MaxSelectSeries (optionally) caps the number of series of the raw data
+	// selected by a query. The limit is pushed down to the server groups which
+	// support it (see series_limit_param), and the merged series are truncated
+	// (with a warning) to it as well.
+	MaxSelectSeries int `yaml:"max_select_series"`
+
+	// MaxQueryCost (optionally) rejects queries whose estimated cost exceeds it.
+	// The cost is the number of series selected (found with a series request
+	// before the query is sent, adding a round trip) times the hours of data
+	// covered by the query. The default of 0 disables the check (and the probe).
+	MaxQueryCost float64 `yaml:"max_query_cost"`
+
+	// MinStep (optionally) is the minimum step of range queries. Queries with a
+	// finer step are evaluated (and their data returned) at MinStep instead,
+	// with a warning, protecting promxy and the server groups from queries of
+	// long ranges at tiny steps.
+	MinStep model.Duration `yaml:"min_step"`
+
+	// ForwardHeaders are the headers of incoming API requests which are set on
+	// the requests to the downstreams (e.g. for auditing). Only the listed
+	// headers are forwarded, so sensitive headers (such as Authorization) are
+	// only sent downstream if explicitly listed here.
+	ForwardHeaders []string `yaml:"forward_headers"`
+
+	// ForwardResponseHeaders are the headers of the downstream responses which
+	// are set on the responses of API requests (e.g. deprecation warnings or
+	// rate-limit info), unless promxy sets them itself. The values from the
+	// responses of several downstreams are combined with
+	// ForwardResponseHeaderPolicy, by default those of the first are kept.
+	ForwardResponseHeaders      []string                          `yaml:"forward_response_headers"`
+	ForwardResponseHeaderPolicy promhttputil.ResponseHeaderPolicy `yaml:"forward_response_header_policy"`
+
+	// AffinityHeader is the header of incoming API requests (e.g. a dashboard
+	// UID) whose value is the affinity key of the request's queries. Server
+	// groups with affinity_replicas send queries sharing a key to the same hosts.
+	AffinityHeader string `yaml:"affinity_header"`
+
+	// PriorityHeader is the header of incoming API requests whose value (high,
+	// normal or low) is the priority of the request's downstream requests when
+	// they are queued for the --downstream.max-concurrency capacity. Requests
+	// without it (or with an unknown value) are normal, the queries of alerting
+	// rules are always high.
+	PriorityHeader string `yaml:"priority_header"`
+
+	// Tenancy (optionally) scopes all API requests to a single tenant
+	Tenancy *TenancyConfig `yaml:"tenancy,omitempty"`
+
+	// RangeRoutes (optionally) send the queries covering long time ranges to
+	// specific server groups (e.g. ones with downsampled data). Queries not
+	// covered by any route go to the server groups which have no route.
+	RangeRoutes []*RangeRouteConfig `yaml:"range_routes"`
+
+	// MergeConflictPolicy is how series with identical labels from different
+	// server groups whose values differ are handled: `first` or `last` keep the
+	// value of the first or last server group, `error` fails the query and
+	// `warn` keeps the first and returns a warning. The default keeps the first
+	// value unless it is 0.
+	MergeConflictPolicy promhttputil.ConflictPolicy `yaml:"merge_conflict_policy"`
+
+	// MergeValueEpsilon (optionally) is the max relative difference between
+	// the values of series with identical labels from different server groups
+	// for them to be deduplicated instead of being a conflict (e.g. 1e-9 to
+	// tolerate floating point noise between HA replicas). This only affects
+	// dedup decisions, the values returned are unchanged.
+	MergeValueEpsilon float64 `yaml:"merge_value_epsilon"`
+
+	// InternLabels (optionally) dedupes the label names and values of the
+	// merged results of each query, so its series share the equal strings
+	// decoded from the server groups' responses. This cuts the memory of
+	// queries returning many series, at the cost of some CPU.
+	InternLabels bool `yaml:"intern_labels"`
+
+	// CoalesceQueries (optionally) coalesces identical concurrent queries (the
+	// same query and time range, e.g. from the panels of a dashboard as it
+	// loads), so they share the downstream requests of a single query and its
+	// result. The shared query is only canceled once all the queries sharing
+	// it are canceled.
+	CoalesceQueries bool `yaml:"coalesce_queries"`
+
+	// MaxHops (optionally) rejects the requests which have passed through more
+	// than this many promxy instances (including this one) in a promxy-of-promxy
+	// topology. Regardless of this, requests which have already passed through
+	// this instance (identified by its external_labels, if set) are rejected.
+	MaxHops int `yaml:"max_hops"`
+
+	// DisablePushdown evaluates all queries in promxy from the raw data of the
+	// server groups, instead of sending the parts of queries which are safe to
+	// evaluate downstream (see proxystorage.ProxyStorage.NodeReplacer)
+	DisablePushdown bool `yaml:"disable_pushdown"`
+
+	// AdaptiveTimeout (optionally) derives the timeout of each query from the
+	// recent latencies of queries covering a similar range, instead of only
+	// the fixed --query.timeout
+	AdaptiveTimeout *AdaptiveTimeoutConfig `yaml:"adaptive_timeout,omitempty"`
+}
+
+// DefaultAdaptiveTimeoutConfig is the default adaptive timeout config
+var DefaultAdaptiveTimeoutConfig = AdaptiveTimeoutConfig{
+	Percentile: 0.99,
+	Multiplier: 2,
+	MinTimeout: model.Duration(5 * time.Second),
+	MaxTimeout: model.Duration(2 * time.Minute),
+	Window:     100,
+}
+
+// AdaptiveTimeoutConfig configures the adaptive query timeout. The timeout of
+// a query is Multiplier times the Percentile of the latencies of the last
+// Window queries covering a similar range (bucketed by the range duration),
+// bounded by MinTimeout and MaxTimeout. Until there are enough latencies for
+// a range the timeout is MaxTimeout. The fixed --query.timeout still applies,
+// so MaxTimeout should be at most that.
+type AdaptiveTimeoutConfig struct {
+	Percentile float64        `yaml:"percentile"`
+	Multiplier float64        `yaml:"multiplier"`
+	MinTimeout model.Duration `yaml:"min_timeout"`
+	MaxTimeout model.Duration `yaml:"max_timeout"`
+	Window     int            `yaml:"window"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *AdaptiveTimeoutConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultAdaptiveTimeoutConfig
+	type plain AdaptiveTimeoutConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Percentile <= 0 || c.Percentile > 1 {
+		return fmt.Errorf("adaptive_timeout percentile must be in (0, 1], got %v", c.Percentile)
+	}
+	if c.Multiplier < 1 {
+		return fmt.Errorf("adaptive_timeout multiplier must be at least 1, got %v", c.Multiplier)
+	}
+	if c.MinTimeout <= 0 || c.MaxTimeout < c.MinTimeout {
+		return fmt.Errorf("adaptive_timeout min_timeout must be positive and at most max_timeout, got %s and %s", c.MinTimeout, c.MaxTimeout)
+	}
+	if c.Window <= 0 {
+		return fmt.Errorf("adaptive_timeout window must be positive, got %d", c.Window)
+	}
+	return nil
+}
+
+// RangeRouteConfig sends the queries whose range is at least MinRange to the
+// server group named ServerGroup. If multiple routes match a query the route
+// with the largest MinRange is used.
+type RangeRouteConfig struct {
+	MinRange    model.Duration `yaml:"min_range"`
+	ServerGroup string         `yaml:"server_group"`
+}
+
+// ServerGroupConfigs is the config of each server group. Each one is
+// unmarshaled separately so that the errors of all of them are returned (as
+// ValidationErrors), instead of only the first error of the first invalid one.
+type ServerGroupConfigs []*servergroup.Config
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *ServerGroupConfigs) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw []interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	// The error of a nested unmarshaler aborts the whole unmarshal, so each
+	// server group is re-encoded and unmarshaled on its own to collect them
+	var errs ValidationErrors
+	cfgs := make(ServerGroupConfigs, len(raw))
+	for i, r := range raw {
+		b, err := yaml.Marshal(r)
+		if err == nil {
+			err = yaml.Unmarshal(b, &cfgs[i])
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("server_groups %d: %v", i, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	*c = cfgs
+	return nil
+}
+
+// ValidationErrors is all of the errors found while validating a config
+type ValidationErrors []error
+
+func (e ValidationErrors) Error() string {
+	errs := make([]string, len(e))
+	for i, err := range e {
+		errs[i] = err.Error()
+	}
+	return strings.Join(errs, "; ")
+}
+
+// Validate returns an error if the config is invalid as a whole (beyond the
+// validation of the individual sections done while unmarshaling). This checks
+// the promxy config as well as the files (rules, TLS certs, etc.) referenced by
+// the config, returning all errors found as ValidationErrors. Validate is only
+// reached once the config unmarshals, which stops at the first invalid section
+// (other than the server groups, whose errors are all returned).
+func (c *Config) Validate() error {
+	var errs ValidationErrors
+	if err := c.PromxyConfig.Validate(); err != nil {
+		errs = append(errs, err.(ValidationErrors)...)
+	}
+
+	for _, pat := range c.PromConfig.RuleFiles {
+		files, err := filepath.Glob(pat)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule_files %s: %v", pat, err))
+			continue
+		}
+		for _, file := range files {
+			if _, ruleErrs := rulefmt.ParseFile(file); ruleErrs != nil {
+				for _, err := range ruleErrs {
+					errs = append(errs, fmt.Errorf("rule_files %s: %v", file, err))
+				}
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Validate returns an error (ValidationErrors) if the promxy config is invalid
+// as a whole. This also defaults the names of any unnamed server groups.
+func (c *PromxyConfig) Validate() error {
+	var errs ValidationErrors
+
+	names := make(map[string]struct{}, len(c.ServerGroups))
+	for i, sg := range c.ServerGroups {
+		// Default the name of unnamed server groups to their index
+		if sg.Name == "" {
+			sg.Name = strconv.Itoa(i)
+		}
+		if _, ok := names[sg.Name]; ok {
+			errs = append(errs, fmt.Errorf("duplicate server_group name %q", sg.Name))
+		}
+		names[sg.Name] = struct{}{}
+
+		if err := sg.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("server_group %s: %v", sg.Name, err))
+		}
+	}
+
+	routed := make(map[string]struct{}, len(c.RangeRoutes))
+	minRanges := make(map[model.Duration]struct{}, len(c.RangeRoutes))
+	for i, route := range c.RangeRoutes {
+		if route.MinRange <= 0 {
+			errs = append(errs, fmt.Errorf("range_routes %d: min_range must be greater than 0", i))
+		}
+		if _, ok := minRanges[route.MinRange]; ok {
+			errs = append(errs, fmt.Errorf("range_routes %d: duplicate min_range %v", i, route.MinRange))
+		}
+		minRanges[route.MinRange] = struct{}{}
+		if _, ok := names[route.ServerGroup]; !ok {
+			errs = append(errs, fmt.Errorf("range_routes %d: unknown server_group %q", i, route.ServerGroup))
+		}
+		routed[route.ServerGroup] = struct{}{}
+	}
+	if len(c.RangeRoutes) > 0 && len(routed) >= len(c.ServerGroups) {
+		errs = append(errs, fmt.Errorf("range_routes: at least one server_group must have no route to query the remaining ranges"))
+	}
+
+	if err := c.ForwardResponseHeaderPolicy.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("forward_response_header_policy: %v", err))
+	}
+
+	if err := c.MergeConflictPolicy.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("merge_conflict_policy: %v", err))
+	}
+	if !(c.MergeValueEpsilon >= 0 && c.MergeValueEpsilon < 1) {
+		errs = append(errs, fmt.Errorf("merge_value_epsilon must be at least 0 and less than 1"))
+	}
+
+	if c.UniqueServerGroupLabels {
+		for i, a := range c.ServerGroups {
+			for j, b := range c.ServerGroups[i+1:] {
+				if !labelSetsDiffer(a.Labels, b.Labels) {
+					errs = append(errs, fmt.Errorf("server_groups %d (%v) and %d (%v) have overlapping labels, series from them could be merged", i, a.Labels, i+1+j, b.Labels))
+				}
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// labelSetsDiffer returns whether `a` and `b` have a label in common with
+// differing values (meaning no series with both labelsets merged in can match)
+func labelSetsDiffer(a, b model.LabelSet) bool {
+	for k, v := range a {
+		if bV, ok := b[k]; ok && bV != v {
+			return true
+		}
+	}
+	return false
+}
+
+// TenancyConfig configures label based multi-tenancy. When enabled, the tenant
+// is read from an HTTP header of each API request and a matcher of
+// `label="<tenant>"` is required on everything that request queries.
+type TenancyConfig struct {
+	// Header is the HTTP header to read the tenant from
+	Header string `yaml:"header"`
+	// Label is the label name which identifies the tenant of a series
+	Label string `yaml:"label"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *TenancyConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain TenancyConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Header == "" {
+		return fmt.Errorf("tenancy header must be set")
+	}
+	if !model.LabelName(c.Label).IsValid() {
+		return fmt.Errorf("invalid tenancy label %q", c.Label)
+	}
+	return nil
+}
+
+// Matcher returns the matcher required for requests by the tenant in `r`. If
+// the request doesn't identify a tenant an error is returned.
+func (c *TenancyConfig) Matcher(r *http.Request) (*labels.Matcher, error) {
+	tenant := r.Header.Get(c.Header)
+	if tenant == "" {
+		return nil, fmt.Errorf("missing tenant header %s", c.Header)
+	}
+	return labels.NewMatcher(labels.MatchEqual, c.Label, tenant)
 }
@@ -60,7 +60,7 @@ func FormPrefix(form url.Values) string {
 	return buf.String()
 }
 
-const ApacheFormatPattern = "%s - - [%s] \"%s %d %d\" %f %s\n"
+const ApacheFormatPattern = "%s - - [%s] \"%s %d %d\" %f %s %s\n"
 
 type ApacheLogRecord struct {
 	http.ResponseWriter
@@ -72,13 +72,18 @@ type ApacheLogRecord struct {
 	ResponseBytes         int64
 	ElapsedTime           time.Duration
 	FormPrefix            string
+	RequestID             string
 }
 
 func (r *ApacheLogRecord) Log(out io.Writer) {
 	timeFormatted := r.Time.Format("02/Jan/2006 15:04:05")
 	requestLine := fmt.Sprintf("%s %s %s", r.Method, r.URI, r.Protocol)
+	requestID := r.RequestID
+	if requestID == "" {
+		requestID = "-"
+	}
 	fmt.Fprintf(out, ApacheFormatPattern, r.IP, timeFormatted, requestLine, r.Status, r.ResponseBytes,
-		r.ElapsedTime.Seconds(), r.FormPrefix)
+		r.ElapsedTime.Seconds(), r.FormPrefix, requestID)
 }
 
 func (r *ApacheLogRecord) Write(p []byte) (int, error) {
@@ -92,6 +97,13 @@ func (r *ApacheLogRecord) WriteHeader(status int) {
 	r.ResponseWriter.WriteHeader(status)
 }
 
+// Flush sends the response written so far to the client
+func (r *ApacheLogRecord) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 type LogRecordHandler func(*ApacheLogRecord)
 
 func LogToWriter(out io.Writer) LogRecordHandler {
@@ -112,9 +124,17 @@ func NewApacheLoggingHandler(handler http.Handler, logHandlers ...LogRecordHandl
 	}
 }
 
+// errAborted is returned by runHandler when the handler aborted the response
+// (with http.ErrAbortHandler)
+var errAborted = errors.New("handler aborted the response")
+
 func (h *ApacheLoggingHandler) runHandler(rw http.ResponseWriter, r *http.Request) (err error) {
 	defer func() {
 		if rec := recover(); rec != nil {
+			if rec == http.ErrAbortHandler {
+				err = errAborted
+				return
+			}
 			// Just return a stack trace always
 			err = errors.Wrap(fmt.Errorf(string(debug.Stack())), "Error running handler")
 		}
@@ -139,10 +159,12 @@ func (h *ApacheLoggingHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request
 		Protocol:       r.Proto,
 		Status:         http.StatusOK,
 		FormPrefix:     FormPrefix(r.Form),
+		RequestID:      RequestID(r.Context()),
 	}
 
 	startTime := time.Now()
-	if err := h.runHandler(record, r); err != nil {
+	err := h.runHandler(record, r)
+	if err != nil && err != errAborted {
 		http.Error(record, err.Error(), http.StatusInternalServerError)
 	}
 	finishTime := time.Now()
@@ -153,4 +175,9 @@ func (h *ApacheLoggingHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request
 	for _, logHandler := range h.logHandlers {
 		logHandler(record)
 	}
+
+	// Aborting the response (e.g. after a failure mid-stream) is left to the server
+	if err == errAborted {
+		panic(http.ErrAbortHandler)
+	}
 }
@@ -0,0 +1,46 @@
+package logging
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDHandler(t *testing.T) {
+	var id string
+	h := NewRequestIDHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = RequestID(r.Context())
+		if entryID := FromContext(r.Context()).Data["request_id"]; entryID != id {
+			t.Fatalf("mismatch in logged request ID expected=%s actual=%v", id, entryID)
+		}
+	}))
+
+	tests := []struct {
+		header string
+		keep   bool
+	}{
+		// Requests without an ID get a new one
+		{"", false},
+		{"abc-123", true},
+		// IDs which could forge log lines (or are too long) are replaced
+		{"abc 123", false},
+		{"abc\n123", false},
+		{strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/api/v1/query?query=up", nil)
+		if test.header != "" {
+			req.Header.Set(RequestIDHeader, test.header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if id == "" || rec.Header().Get(RequestIDHeader) != id {
+			t.Fatalf("the request ID %q wasn't returned: %q", id, rec.Header().Get(RequestIDHeader))
+		}
+		if (id == test.header) != test.keep {
+			t.Fatalf("unexpected request ID for %q: %q", test.header, id)
+		}
+	}
+}
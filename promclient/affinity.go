@@ -0,0 +1,115 @@
+package promclient
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/common/model"
+)
+
+type affinityKey struct{}
+
+// WithAffinityKey returns a copy of `ctx` whose queries are sent to the
+// replicas selected for `key` (see MultiAPI.SetAffinity)
+func WithAffinityKey(ctx context.Context, key string) context.Context {
+	if key == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, affinityKey{}, key)
+}
+
+// AffinityKey returns the affinity key of `ctx` ("" if there is none)
+func AffinityKey(ctx context.Context) string {
+	key, _ := ctx.Value(affinityKey{}).(string)
+	return key
+}
+
+// rendezvousOrder returns the indexes of `names` ordered by their (rendezvous)
+// hash with `key`. Each key gets a stable order, and adding or removing a name
+// only moves the keys which that name was (or becomes) first for.
+func rendezvousOrder(key string, names []string) []int {
+	scores := make([]uint64, len(names))
+	order := make([]int, len(names))
+	for i, name := range names {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0xff})
+		h.Write([]byte(name))
+		scores[i] = h.Sum64()
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
+	})
+	return order
+}
+
+// affinityNames returns the names the apis are hashed by
+func (m *MultiAPI) affinityNames() []string {
+	if m.names != nil {
+		return m.names
+	}
+	names := make([]string, len(m.apis))
+	for i := range names {
+		names[i] = strconv.Itoa(i)
+	}
+	return names
+}
+
+// withAffinity returns the MultiAPI to send the data queries of `ctx` to. If
+// affinity is enabled and `ctx` has an affinity key this is a MultiAPI of the
+// replicas selected for the key: the first SetAffinity apis (by their hash
+// with the key) of each set of apis with the same labels.
+func (m *MultiAPI) withAffinity(ctx context.Context) *MultiAPI {
+	key := AffinityKey(ctx)
+	if m.affinityReplicas <= 0 || key == "" || m.failover {
+		return m
+	}
+
+	replicas := m.affinityReplicas
+	if replicas < m.requiredCount {
+		replicas = m.requiredCount
+	}
+
+	selected := make(map[int]struct{}, len(m.apis))
+	counts := make(map[model.Fingerprint]int)
+	for _, i := range rendezvousOrder(key, m.affinityNames()) {
+		if counts[m.apiFingerprints[i]] < replicas {
+			counts[m.apiFingerprints[i]]++
+			selected[i] = struct{}{}
+		}
+	}
+	if len(selected) == len(m.apis) {
+		return m
+	}
+
+	// Map the indexes of the subset back to those of m, for the metrics and latency
+	indexes := make([]int, 0, len(selected))
+	for i := range m.apis {
+		if _, ok := selected[i]; ok {
+			indexes = append(indexes, i)
+		}
+	}
+	sub := *m
+	sub.affinityReplicas = 0
+	sub.apis = make([]API, len(indexes))
+	sub.apiFingerprints = make([]model.Fingerprint, len(indexes))
+	if m.names != nil {
+		sub.names = make([]string, len(indexes))
+	}
+	for j, i := range indexes {
+		sub.apis[j] = m.apis[i]
+		sub.apiFingerprints[j] = m.apiFingerprints[i]
+		if m.names != nil {
+			sub.names[j] = m.names[i]
+		}
+	}
+	if m.metricFunc != nil {
+		sub.metricFunc = func(j int, api, status string, took float64) {
+			m.metricFunc(indexes[j], api, status, took)
+		}
+	}
+	return &sub
+}
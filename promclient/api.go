@@ -2,13 +2,18 @@ package promclient
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"sort"
 	"time"
 
+	"github.com/prometheus/client_golang/api"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/storage/remote"
 
 	"github.com/jacksontj/promxy/promhttputil"
@@ -18,6 +23,40 @@ import (
 // Simply wraps the prom API to fullfil our internal API interface
 type PromAPIV1 struct {
 	v1.API
+	// Client is the underlying client the v1.API is using, this is required for
+	// the endpoints the upstream client doesn't implement (such as /api/v1/labels)
+	Client api.Client
+}
+
+// LabelNames returns all the unique label names (optionally scoped by the
+// given matchers and time range)
+func (p *PromAPIV1) LabelNames(ctx context.Context, matchers []string, startTime, endTime time.Time) ([]string, error) {
+	u := p.Client.URL("/api/v1/labels", nil)
+	q := u.Query()
+	for _, m := range matchers {
+		q.Add("match[]", m)
+	}
+	if !startTime.IsZero() {
+		q.Set("start", startTime.Format(time.RFC3339Nano))
+	}
+	if !endTime.IsZero() {
+		q.Set("end", endTime.Format(time.RFC3339Nano))
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := doAPIRequest(ctx, p.Client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	err = json.Unmarshal(body, &names)
+	return names, err
 }
 
 // GetValue loads the raw data for a given set of matchers in the time range
@@ -39,16 +78,105 @@ func (p *PromAPIV1) GetValue(ctx context.Context, start, end time.Time, matchers
 // PromAPIRemoteRead implements our internal API interface using a combination of
 // the v1 HTTP API and the "experimental" remote_read API
 type PromAPIRemoteRead struct {
-	v1.API
-	*remote.Client
+	*PromAPIV1
+	*RemoteReadClient
 }
 
+// GetValue loads the raw data for a given set of matchers in the time range
 func (p *PromAPIRemoteRead) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	return p.RemoteReadClient.GetValue(ctx, start, end, matchers)
+}
+
+// ErrRemoteReadOnly is returned for the API calls that a PromAPIRemoteReadOnly can't serve
+var ErrRemoteReadOnly = fmt.Errorf("unsupported by remote_read_only server group")
+
+// PromAPIRemoteReadOnly implements our internal API interface using *only* the
+// remote_read API (e.g. for prometheus agents, which have no query API). Raw
+// data (GetValue) and Series are served through remote_read, Query, QueryRange
+// and LabelValues return ErrRemoteReadOnly and the rest return empty results.
+type PromAPIRemoteReadOnly struct {
+	*RemoteReadClient
+}
+
+// LabelValues performs a query for the values of the given label.
+func (p *PromAPIRemoteReadOnly) LabelValues(ctx context.Context, label string) (model.LabelValues, error) {
+	return nil, ErrRemoteReadOnly
+}
+
+// LabelNames returns the label names (optionally scoped by matchers and time range).
+func (p *PromAPIRemoteReadOnly) LabelNames(ctx context.Context, matchers []string, startTime, endTime time.Time) ([]string, error) {
+	if len(matchers) == 0 {
+		return []string{}, nil
+	}
+	series, err := p.Series(ctx, matchers, startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+	nameSet := make(map[model.LabelName]struct{})
+	for _, lset := range series {
+		for name := range lset {
+			nameSet[name] = struct{}{}
+		}
+	}
+	names := make([]string, 0, len(nameSet))
+	for name := range nameSet {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Query performs a query for the given time.
+func (p *PromAPIRemoteReadOnly) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	return nil, ErrRemoteReadOnly
+}
+
+// QueryRange performs a query for the given range.
+func (p *PromAPIRemoteReadOnly) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, error) {
+	return nil, ErrRemoteReadOnly
+}
+
+// Series finds series by label matchers.
+func (p *PromAPIRemoteReadOnly) Series(ctx context.Context, matches []string, startTime, endTime time.Time) ([]model.LabelSet, error) {
+	seen := make(map[model.Fingerprint]struct{})
+	series := make([]model.LabelSet, 0)
+	for _, match := range matches {
+		matchers, err := promql.ParseMetricSelector(match)
+		if err != nil {
+			return nil, err
+		}
+		v, err := p.GetValue(ctx, startTime, endTime, matchers)
+		if err != nil {
+			return nil, err
+		}
+		for _, stream := range v.(model.Matrix) {
+			fingerprint := stream.Metric.Fingerprint()
+			if _, ok := seen[fingerprint]; !ok {
+				seen[fingerprint] = struct{}{}
+				series = append(series, model.LabelSet(stream.Metric))
+			}
+		}
+	}
+	return series, nil
+}
+
+// Rules returns a list of alerting and recording rules that are currently loaded.
+func (p *PromAPIRemoteReadOnly) Rules(ctx context.Context) (v1.RulesResult, error) {
+	return v1.RulesResult{Groups: []v1.RuleGroup{}}, nil
+}
+
+// Alerts returns a list of all active alerts.
+func (p *PromAPIRemoteReadOnly) Alerts(ctx context.Context) (v1.AlertsResult, error) {
+	return v1.AlertsResult{Alerts: []v1.Alert{}}, nil
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (c *RemoteReadClient) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
 	query, err := remote.ToQuery(int64(timestamp.FromTime(start)), int64(timestamp.FromTime(end)), matchers, nil)
 	if err != nil {
 		return nil, err
 	}
-	result, err := p.Client.Read(ctx, query)
+	result, err := c.Read(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -77,3 +205,65 @@ func (p *PromAPIRemoteRead) GetValue(ctx context.Context, start, end time.Time,
 
 	return matrix, nil
 }
+
+// apiResponse is the envelope for all responses from the prometheus v1 API
+type apiResponse struct {
+	Status    string          `json:"status"`
+	Data      json.RawMessage `json:"data"`
+	ErrorType v1.ErrorType    `json:"errorType"`
+	Error     string          `json:"error"`
+}
+
+// doAPIRequest does the given request against the prometheus v1 API and returns
+// the `data` of the response. This mirrors the (private) handling in the upstream
+// client so errors come back the same as they do for the rest of the v1.API methods
+func doAPIRequest(ctx context.Context, client api.Client, req *http.Request) ([]byte, error) {
+	resp, body, err := client.Do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// These are the codes that Prometheus sends when it returns an error.
+	apiError := resp.StatusCode == http.StatusUnprocessableEntity || resp.StatusCode == http.StatusBadRequest
+
+	if resp.StatusCode/100 != 2 && !apiError {
+		errorType := v1.ErrBadResponse
+		switch resp.StatusCode / 100 {
+		case 4:
+			errorType = v1.ErrClient
+		case 5:
+			errorType = v1.ErrServer
+		}
+		return nil, &v1.Error{
+			Type:   errorType,
+			Msg:    fmt.Sprintf("bad response code %d", resp.StatusCode),
+			Detail: string(body),
+		}
+	}
+
+	var result apiResponse
+	if resp.StatusCode != http.StatusNoContent {
+		if err := json.Unmarshal(body, &result); err != nil {
+			return nil, &v1.Error{
+				Type: v1.ErrBadResponse,
+				Msg:  err.Error(),
+			}
+		}
+	}
+
+	if apiError {
+		if result.Status != "error" {
+			return nil, &v1.Error{
+				Type: v1.ErrBadResponse,
+				Msg:  "inconsistent body for response code",
+			}
+		}
+		return nil, &v1.Error{
+			Type:   result.ErrorType,
+			Msg:    result.Error,
+			Detail: string(body),
+		}
+	}
+
+	return []byte(result.Data), nil
+}
@@ -0,0 +1,206 @@
+package promclient
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// ErrBackoff is returned by a BackoffAPI for the requests made while its downstream is backing off
+var ErrBackoff = errors.New("downstream is backing off after failed requests")
+
+// Backoff tracks the failures of a downstream. After a failure no requests are
+// sent to it for an exponential backoff (doubling with each consecutive failure
+// from Min up to Max), of which a random fraction of up to Jitter is taken off
+// so downstreams which failed together don't all recover in lockstep. Once the
+// backoff has passed a single request is let through to probe the downstream,
+// which succeeding resets the backoff.
+type Backoff struct {
+	Min    time.Duration
+	Max    time.Duration
+	Jitter float64
+
+	l        sync.Mutex
+	failures int
+	until    time.Time
+	probing  bool
+}
+
+// NewBackoff returns a Backoff from `min` to `max` with `jitter` (between 0 and 1)
+func NewBackoff(min, max time.Duration, jitter float64) *Backoff {
+	return &Backoff{Min: min, Max: max, Jitter: jitter}
+}
+
+// Allow returns whether a request may be sent to the downstream now, the
+// caller must report the result of an allowed request with Done
+func (b *Backoff) Allow() bool {
+	b.l.Lock()
+	defer b.l.Unlock()
+	if b.failures == 0 {
+		return true
+	}
+	if b.probing || time.Now().Before(b.until) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// Until returns the time until which the downstream is backing off (zero if it isn't)
+func (b *Backoff) Until() time.Time {
+	b.l.Lock()
+	defer b.l.Unlock()
+	if b.failures == 0 {
+		return time.Time{}
+	}
+	return b.until
+}
+
+// Done records the result of a request allowed by Allow. Only failures of the
+// downstream itself count (see isDownstreamFailure), and requests cut short by
+// their own context don't change the backoff.
+func (b *Backoff) Done(ctx context.Context, err error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	if ctx.Err() != nil {
+		b.probing = false
+		return
+	}
+	if !isDownstreamFailure(err) {
+		b.failures = 0
+		b.probing = false
+		return
+	}
+
+	b.failures++
+	b.probing = false
+	backoff := b.Min
+	for i := 1; i < b.failures && backoff < b.Max; i++ {
+		backoff *= 2
+	}
+	if backoff > b.Max {
+		backoff = b.Max
+	}
+	backoff -= time.Duration(rand.Float64() * b.Jitter * float64(backoff))
+	b.until = time.Now().Add(backoff)
+}
+
+// isDownstreamFailure returns whether `err` means the downstream itself failed
+// (it couldn't be reached, or returned a server error or an invalid response)
+// rather than the request (e.g. a bad or timed out query)
+func isDownstreamFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch cause := errors.Cause(err).(type) {
+	case promql.ErrQueryTimeout, promql.ErrQueryCanceled:
+		return false
+	case *v1.Error:
+		return cause.Type == v1.ErrServer || cause.Type == v1.ErrBadResponse
+	}
+	return true
+}
+
+// BackoffAPI stops sending requests to API while its Backoff is backing off,
+// failing them with ErrBackoff instead
+type BackoffAPI struct {
+	API
+	Backoff *Backoff
+}
+
+// call calls `f` if the backoff allows it, recording its result
+func (b *BackoffAPI) call(ctx context.Context, f func() error) error {
+	if !b.Backoff.Allow() {
+		return ErrBackoff
+	}
+	err := f()
+	b.Backoff.Done(ctx, err)
+	return err
+}
+
+// LabelValues performs a query for the values of the given label.
+func (b *BackoffAPI) LabelValues(ctx context.Context, label string) (model.LabelValues, error) {
+	var v model.LabelValues
+	err := b.call(ctx, func() (err error) {
+		v, err = b.API.LabelValues(ctx, label)
+		return err
+	})
+	return v, err
+}
+
+// LabelNames returns the label names (optionally scoped by matchers and time range).
+func (b *BackoffAPI) LabelNames(ctx context.Context, matchers []string, startTime time.Time, endTime time.Time) ([]string, error) {
+	var v []string
+	err := b.call(ctx, func() (err error) {
+		v, err = b.API.LabelNames(ctx, matchers, startTime, endTime)
+		return err
+	})
+	return v, err
+}
+
+// Query performs a query for the given time.
+func (b *BackoffAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	var v model.Value
+	err := b.call(ctx, func() (err error) {
+		v, err = b.API.Query(ctx, query, ts)
+		return err
+	})
+	return v, err
+}
+
+// QueryRange performs a query for the given range.
+func (b *BackoffAPI) QueryRange(ctx context.Context, query string, rng v1.Range) (model.Value, error) {
+	var v model.Value
+	err := b.call(ctx, func() (err error) {
+		v, err = b.API.QueryRange(ctx, query, rng)
+		return err
+	})
+	return v, err
+}
+
+// Series finds series by label matchers.
+func (b *BackoffAPI) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, error) {
+	var v []model.LabelSet
+	err := b.call(ctx, func() (err error) {
+		v, err = b.API.Series(ctx, matches, startTime, endTime)
+		return err
+	})
+	return v, err
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (b *BackoffAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	var v model.Value
+	err := b.call(ctx, func() (err error) {
+		v, err = b.API.GetValue(ctx, start, end, matchers)
+		return err
+	})
+	return v, err
+}
+
+// Rules returns a list of alerting and recording rules that are currently loaded.
+func (b *BackoffAPI) Rules(ctx context.Context) (v1.RulesResult, error) {
+	var v v1.RulesResult
+	err := b.call(ctx, func() (err error) {
+		v, err = b.API.Rules(ctx)
+		return err
+	})
+	return v, err
+}
+
+// Alerts returns a list of all active alerts.
+func (b *BackoffAPI) Alerts(ctx context.Context) (v1.AlertsResult, error) {
+	var v v1.AlertsResult
+	err := b.call(ctx, func() (err error) {
+		v, err = b.API.Alerts(ctx)
+		return err
+	})
+	return v, err
+}
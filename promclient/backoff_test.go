@@ -0,0 +1,94 @@
+package promclient
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+func TestBackoffAPI(t *testing.T) {
+	downstream := &toggleErrorAPI{API: &stubAPI{query: func() model.Value { return model.Vector{} }}}
+	backoff := NewBackoff(50*time.Millisecond, 200*time.Millisecond, 0)
+	api := &BackoffAPI{downstream, backoff}
+
+	query := func() error {
+		_, err := api.Query(context.TODO(), "testmetric", time.Now())
+		return err
+	}
+
+	// Errors of the request (such as a bad query) don't back off
+	downstream.err = &v1.Error{Type: v1.ErrBadData, Msg: "parse error"}
+	if err := query(); err != downstream.err {
+		t.Fatalf("expected the downstream error, got: %v", err)
+	}
+	if err := query(); err != downstream.err {
+		t.Fatalf("expected the downstream error, got: %v", err)
+	}
+
+	// Failures of the downstream do, until the backoff has passed
+	downstream.err = fmt.Errorf("connection refused")
+	if err := query(); err != downstream.err {
+		t.Fatalf("expected the downstream error, got: %v", err)
+	}
+	if err := query(); err != ErrBackoff {
+		t.Fatalf("expected ErrBackoff, got: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	// A failed probe doubles the backoff
+	if err := query(); err != downstream.err {
+		t.Fatalf("expected the probe to be sent, got: %v", err)
+	}
+	if d := time.Until(backoff.Until()); d < 90*time.Millisecond || d > 100*time.Millisecond {
+		t.Fatalf("expected a backoff of 100ms, got: %v", d)
+	}
+	time.Sleep(110 * time.Millisecond)
+
+	// A successful probe resets it
+	downstream.err = nil
+	if err := query(); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if !backoff.Until().IsZero() {
+		t.Fatalf("expected no backoff, got: %v", backoff.Until())
+	}
+	if err := query(); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	backoff := NewBackoff(time.Second, time.Second, 0.5)
+	for i := 0; i < 100; i++ {
+		if !backoff.Allow() {
+			// Let the next request probe
+			backoff.until = time.Now()
+			backoff.Allow()
+		}
+		start := time.Now()
+		backoff.Done(context.TODO(), fmt.Errorf("connection refused"))
+		if d := backoff.Until().Sub(start); d < 500*time.Millisecond || d > time.Second+time.Millisecond {
+			t.Fatalf("backoff out of the jitter bounds: %v", d)
+		}
+	}
+
+	// Only a single probe is sent once the backoff has passed
+	backoff.until = time.Now()
+	if !backoff.Allow() {
+		t.Fatalf("expected a probe to be allowed")
+	}
+	if backoff.Allow() {
+		t.Fatalf("expected a single probe")
+	}
+	// A probe cut short by its context doesn't change the backoff
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	backoff.Done(ctx, ctx.Err())
+	if !backoff.Allow() {
+		t.Fatalf("expected another probe to be allowed")
+	}
+}
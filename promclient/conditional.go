@@ -0,0 +1,193 @@
+package promclient
+
+import (
+	"bytes"
+	"container/list"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var conditionalCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "conditional_cache_requests_total",
+	Help: "Number of conditional requests to downstreams, by whether the cached response was still valid",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(conditionalCacheRequests)
+}
+
+// ConditionalCacheName is the name of the conditional (metadata) cache, for flushing
+const ConditionalCacheName = "conditional"
+
+// Flusher is implemented by the caches which can be flushed (cleared)
+type Flusher interface {
+	Flush()
+}
+
+// isMetadataPath returns whether `path` is one of the (slowly changing)
+// metadata endpoints whose responses are cached
+func isMetadataPath(path string) bool {
+	if strings.HasSuffix(path, "/api/v1/series") || strings.HasSuffix(path, "/api/v1/labels") {
+		return true
+	}
+	return strings.Contains(path, "/api/v1/label/") && strings.HasSuffix(path, "/values")
+}
+
+// NewConditionalCacheRoundTripper returns an http.RoundTripper which caches
+// (up to `size`) metadata responses that have an ETag or Last-Modified validator.
+// Subsequent requests for the same URL are sent as conditional requests
+// (If-None-Match/If-Modified-Since) and if the downstream responds with a
+// 304 the cached response is returned. A size <= 0 disables the cache.
+func NewConditionalCacheRoundTripper(size int, rt http.RoundTripper) http.RoundTripper {
+	if size <= 0 {
+		return rt
+	}
+	return &conditionalCacheRoundTripper{
+		rt:      rt,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+type conditionalCacheEntry struct {
+	key          string
+	etag         string
+	lastModified string
+	header       http.Header
+	body         []byte
+}
+
+type conditionalCacheRoundTripper struct {
+	rt   http.RoundTripper
+	size int
+
+	l       sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// Flush removes all of the cached responses
+func (rt *conditionalCacheRoundTripper) Flush() {
+	rt.l.Lock()
+	defer rt.l.Unlock()
+	rt.entries = make(map[string]*list.Element)
+	rt.lru.Init()
+}
+
+func (rt *conditionalCacheRoundTripper) get(key string) *conditionalCacheEntry {
+	rt.l.Lock()
+	defer rt.l.Unlock()
+	if e, ok := rt.entries[key]; ok {
+		rt.lru.MoveToFront(e)
+		return e.Value.(*conditionalCacheEntry)
+	}
+	return nil
+}
+
+func (rt *conditionalCacheRoundTripper) add(entry *conditionalCacheEntry) {
+	rt.l.Lock()
+	defer rt.l.Unlock()
+	if e, ok := rt.entries[entry.key]; ok {
+		e.Value = entry
+		rt.lru.MoveToFront(e)
+		return
+	}
+	rt.entries[entry.key] = rt.lru.PushFront(entry)
+	for rt.lru.Len() > rt.size {
+		oldest := rt.lru.Back()
+		rt.lru.Remove(oldest)
+		delete(rt.entries, oldest.Value.(*conditionalCacheEntry).key)
+	}
+}
+
+func (rt *conditionalCacheRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || !isMetadataPath(req.URL.Path) {
+		return rt.rt.RoundTrip(req)
+	}
+
+	key := req.URL.String()
+	entry := rt.get(key)
+	if entry != nil {
+		// RoundTrippers must not modify the request, so send a copy with the validators
+		req = cloneRequest(req)
+		if entry.etag != "" {
+			req.Header.Set("If-None-Match", entry.etag)
+		}
+		if entry.lastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.lastModified)
+		}
+	}
+
+	resp, err := rt.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry != nil {
+		if resp.StatusCode == http.StatusNotModified {
+			conditionalCacheRequests.WithLabelValues("hit").Inc()
+			resp.Body.Close()
+			return &http.Response{
+				Status:        "200 OK",
+				StatusCode:    http.StatusOK,
+				Proto:         resp.Proto,
+				ProtoMajor:    resp.ProtoMajor,
+				ProtoMinor:    resp.ProtoMinor,
+				Header:        cloneHeader(entry.header),
+				Body:          ioutil.NopCloser(bytes.NewReader(entry.body)),
+				ContentLength: int64(len(entry.body)),
+				Request:       req,
+			}, nil
+		}
+		conditionalCacheRequests.WithLabelValues("miss").Inc()
+	}
+
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+	if resp.StatusCode != http.StatusOK || (etag == "" && lastModified == "") {
+		return resp, nil
+	}
+
+	// Buffer the body so we can both cache and return it
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	rt.add(&conditionalCacheEntry{
+		key:          key,
+		etag:         etag,
+		lastModified: lastModified,
+		header:       cloneHeader(resp.Header),
+		body:         body,
+	})
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// cloneRequest returns a copy of `r` which can be modified (its URL and Header)
+// without modifying `r`, as RoundTrippers must not modify their request
+func cloneRequest(r *http.Request) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	if r.URL != nil {
+		u := *r.URL
+		r2.URL = &u
+	}
+	r2.Header = cloneHeader(r.Header)
+	return r2
+}
+
+// cloneHeader returns a copy of `h` (and of its values)
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, values := range h {
+		h2[k] = append([]string(nil), values...)
+	}
+	return h2
+}
@@ -0,0 +1,94 @@
+package promclient
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestConditionalCacheRoundTripper(t *testing.T) {
+	var requests, notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("body"))
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: NewConditionalCacheRoundTripper(10, http.DefaultTransport)}
+
+	tests := []struct {
+		path        string
+		notModified int
+	}{
+		// First request populates the cache
+		{"/api/v1/label/job/values", 0},
+		// Second is revalidated and served from the cache
+		{"/api/v1/label/job/values", 1},
+		// Non-metadata endpoints aren't cached
+		{"/api/v1/query", 1},
+		{"/api/v1/query", 1},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			resp, err := client.Get(srv.URL + test.path)
+			if err != nil {
+				t.Fatalf("Unexpected Err: %v", err)
+			}
+			defer resp.Body.Close()
+			b, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Unexpected Err: %v", err)
+			}
+			if resp.StatusCode != http.StatusOK || string(b) != "body" {
+				t.Fatalf("mismatch in response: %d %s", resp.StatusCode, b)
+			}
+			if notModified != test.notModified {
+				t.Fatalf("mismatch in not modified responses expected=%d actual=%d", test.notModified, notModified)
+			}
+		})
+	}
+	if requests != len(tests) {
+		t.Fatalf("expected every request to reach the server, got %d", requests)
+	}
+}
+
+func TestConditionalCacheRoundTripperFlush(t *testing.T) {
+	var notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("body"))
+	}))
+	defer srv.Close()
+
+	rt := NewConditionalCacheRoundTripper(10, http.DefaultTransport)
+	client := &http.Client{Transport: rt}
+	get := func() {
+		resp, err := client.Get(srv.URL + "/api/v1/labels")
+		if err != nil {
+			t.Fatalf("Unexpected Err: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	get()
+	rt.(Flusher).Flush()
+	// With the cache flushed the request isn't conditional
+	get()
+	if notModified != 0 {
+		t.Fatalf("expected no conditional requests after the flush, got %d", notModified)
+	}
+}
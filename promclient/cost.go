@@ -0,0 +1,130 @@
+package promclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+// QueryCostError is returned when the estimated cost of a query exceeds the max
+type QueryCostError struct {
+	Cost    float64
+	MaxCost float64
+	Series  int
+	Range   time.Duration
+}
+
+func (e *QueryCostError) Error() string {
+	return fmt.Sprintf("query cost of %.0f series-hours (%d series over %s) exceeds the max query cost of %.0f", e.Cost, e.Series, e.Range, e.MaxCost)
+}
+
+// CostLimitAPI rejects the data queries (Query, QueryRange and GetValue) to API
+// whose estimated cost exceeds MaxCost. The cost is the number of series the
+// query selects (found with a Series request before the query is sent) times
+// the range of data the query covers in hours. As this adds a round trip to
+// every query it is only meant to guard shared promxy instances. Queries being
+// explained (see promhttputil.Explain) have their cost estimated and recorded
+// instead, also without a MaxCost (0).
+type CostLimitAPI struct {
+	API
+	MaxCost float64
+}
+
+// checkCost returns an error if the series selected by `selectors` over `r` exceed the max cost
+func (c *CostLimitAPI) checkCost(ctx context.Context, selectors []string, start, end time.Time, r time.Duration) error {
+	explain := promhttputil.GetExplain(ctx)
+	if len(selectors) == 0 || (c.MaxCost <= 0 && explain == nil) {
+		return nil
+	}
+	series, err := c.API.Series(ctx, selectors, start, end)
+	if err != nil {
+		return err
+	}
+	cost := float64(len(series)) * r.Hours()
+	if explain != nil {
+		explain.AddCost(promhttputil.ExplainCost{Selectors: selectors, Series: len(series), Range: r.Seconds(), Cost: cost})
+		return nil
+	}
+	if cost > c.MaxCost {
+		return limitError(ctx, &QueryCostError{cost, c.MaxCost, len(series), r})
+	}
+	return nil
+}
+
+// Query performs a query for the given time.
+func (c *CostLimitAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	selectors, err := querySelectors(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	r := queryRange(ctx, query)
+	if err := c.checkCost(ctx, selectors, ts.Add(-r), ts, r); err != nil {
+		return nil, err
+	}
+	return c.API.Query(ctx, query, ts)
+}
+
+// QueryRange performs a query for the given range.
+func (c *CostLimitAPI) QueryRange(ctx context.Context, query string, rng v1.Range) (model.Value, error) {
+	selectors, err := querySelectors(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	r := rng.End.Sub(rng.Start) + queryRange(ctx, query)
+	if err := c.checkCost(ctx, selectors, rng.End.Add(-r), rng.End, r); err != nil {
+		return nil, err
+	}
+	return c.API.QueryRange(ctx, query, rng)
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (c *CostLimitAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	matcherString, err := promhttputil.MatcherToString(matchers)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkCost(ctx, []string{matcherString}, start, end, end.Sub(start)); err != nil {
+		return nil, err
+	}
+	return c.API.GetValue(ctx, start, end, matchers)
+}
+
+// querySelectors returns the series selectors in `query`
+func querySelectors(ctx context.Context, query string) ([]string, error) {
+	expr, err := promql.ParseExpr(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var selectors []string
+	// Inspect parallelizes on BinaryExpr
+	l := sync.Mutex{}
+	_, err = promql.Inspect(ctx, &promql.EvalStmt{Expr: expr}, func(node promql.Node, _ []promql.Node) error {
+		var matchers []*labels.Matcher
+		switch n := node.(type) {
+		case *promql.VectorSelector:
+			matchers = n.LabelMatchers
+		case *promql.MatrixSelector:
+			matchers = n.LabelMatchers
+		default:
+			return nil
+		}
+		selector, err := promhttputil.MatcherToString(matchers)
+		if err != nil {
+			return err
+		}
+		l.Lock()
+		defer l.Unlock()
+		selectors = append(selectors, selector)
+		return nil
+	}, nil)
+	return selectors, err
+}
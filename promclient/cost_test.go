@@ -0,0 +1,56 @@
+package promclient
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+func TestCostLimitAPI(t *testing.T) {
+	stub := &stubAPI{
+		query:      func() model.Value { return model.Vector{} },
+		queryRange: func() model.Value { return model.Matrix{} },
+		series: func() []model.LabelSet {
+			return []model.LabelSet{{"a": "1"}, {"a": "2"}, {"a": "3"}, {"a": "4"}}
+		},
+	}
+	// 4 series for up to 25 hours
+	api := &CostLimitAPI{stub, 100}
+
+	tests := []struct {
+		query string
+		r     time.Duration // 0 is an instant query
+		err   bool
+	}{
+		{"testmetric", 0, false},
+		{"rate(testmetric[1d])", 0, false},
+		{"rate(testmetric[2d])", 0, true},
+		{"testmetric", 24 * time.Hour, false},
+		{"testmetric", 48 * time.Hour, true},
+		// Queries without selectors aren't probed
+		{"1", 48 * time.Hour, false},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var err error
+			if test.r == 0 {
+				_, err = api.Query(context.TODO(), test.query, time.Now())
+			} else {
+				now := time.Now()
+				_, err = api.QueryRange(context.TODO(), test.query, v1.Range{Start: now.Add(-test.r), End: now, Step: time.Minute})
+			}
+			if test.err {
+				if _, ok := err.(*QueryCostError); !ok {
+					t.Fatalf("expected QueryCostError, got: %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("Unexpected Err: %v", err)
+			}
+		})
+	}
+}
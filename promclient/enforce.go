@@ -0,0 +1,260 @@
+package promclient
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+type requiredMatchersKey struct{}
+
+// WithRequiredMatchers returns a copy of `ctx` which requires that all requests
+// made with it (through an EnforceMatchersAPI) be scoped by `matchers`. This is
+// how a tenant (e.g. `tenant="X"`) is attached to a request.
+func WithRequiredMatchers(ctx context.Context, matchers ...*labels.Matcher) context.Context {
+	return context.WithValue(ctx, requiredMatchersKey{}, append(RequiredMatchers(ctx), matchers...))
+}
+
+// RequiredMatchers returns the matchers required by `ctx` (if any)
+func RequiredMatchers(ctx context.Context) []*labels.Matcher {
+	if v, ok := ctx.Value(requiredMatchersKey{}).([]*labels.Matcher); ok {
+		return v
+	}
+	return nil
+}
+
+// EnforceMatchers returns `matchers` with all of the `required` matchers added.
+// If `matchers` already contains a matcher for a required label which can't
+// match the required value an error is returned, as the caller is asking for
+// data outside of what it is allowed to see.
+func EnforceMatchers(matchers, required []*labels.Matcher) ([]*labels.Matcher, error) {
+	ret := make([]*labels.Matcher, 0, len(matchers)+len(required))
+	ret = append(ret, matchers...)
+
+REQUIRED:
+	for _, r := range required {
+		for _, m := range matchers {
+			if m.Name != r.Name {
+				continue
+			}
+			if r.Type == labels.MatchEqual && !m.Matches(r.Value) {
+				return nil, fmt.Errorf("matcher %s conflicts with required matcher %s", m, r)
+			}
+			// Already present, no need to add it again
+			if m.Type == r.Type && m.Value == r.Value {
+				continue REQUIRED
+			}
+		}
+		ret = append(ret, r)
+	}
+
+	return ret, nil
+}
+
+// EnforceMatchersVisitor adds the required matchers to all selectors in an expression
+type EnforceMatchersVisitor struct {
+	required []*labels.Matcher
+}
+
+func (v *EnforceMatchersVisitor) Visit(node promql.Node, path []promql.Node) (promql.Visitor, error) {
+	switch nodeTyped := node.(type) {
+	case *promql.VectorSelector:
+		matchers, err := EnforceMatchers(nodeTyped.LabelMatchers, v.required)
+		if err != nil {
+			return nil, err
+		}
+		nodeTyped.LabelMatchers = matchers
+	case *promql.MatrixSelector:
+		matchers, err := EnforceMatchers(nodeTyped.LabelMatchers, v.required)
+		if err != nil {
+			return nil, err
+		}
+		nodeTyped.LabelMatchers = matchers
+	}
+
+	return v, nil
+}
+
+// EnforceMatchersAPI enforces the matchers required by the request context
+// (see WithRequiredMatchers) on all requests before passing them on to API
+type EnforceMatchersAPI struct {
+	API
+}
+
+// LabelValues performs a query for the values of the given label.
+// As the label values API can't be scoped, this is done using a series request
+// with the required matchers.
+func (e *EnforceMatchersAPI) LabelValues(ctx context.Context, label string) (model.LabelValues, error) {
+	required := RequiredMatchers(ctx)
+	if len(required) == 0 {
+		return e.API.LabelValues(ctx, label)
+	}
+
+	matcherString, err := promhttputil.MatcherToString(required)
+	if err != nil {
+		return nil, err
+	}
+	labelsets, err := e.API.Series(ctx, []string{matcherString}, time.Unix(0, 0), time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[model.LabelValue]struct{})
+	ret := make(model.LabelValues, 0)
+	for _, labelset := range labelsets {
+		if v, ok := labelset[model.LabelName(label)]; ok {
+			if _, ok := values[v]; !ok {
+				values[v] = struct{}{}
+				ret = append(ret, v)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// LabelNames returns the label names (optionally scoped by matchers and time range).
+func (e *EnforceMatchersAPI) LabelNames(ctx context.Context, matchers []string, startTime time.Time, endTime time.Time) ([]string, error) {
+	required := RequiredMatchers(ctx)
+	if len(required) == 0 {
+		return e.API.LabelNames(ctx, matchers, startTime, endTime)
+	}
+
+	// An unscoped request is scoped to everything the required matchers allow
+	if len(matchers) == 0 {
+		matcherString, err := promhttputil.MatcherToString(required)
+		if err != nil {
+			return nil, err
+		}
+		return e.API.LabelNames(ctx, []string{matcherString}, startTime, endTime)
+	}
+	enforced, err := e.enforceSelectors(matchers, required)
+	if err != nil {
+		return nil, err
+	}
+	return e.API.LabelNames(ctx, enforced, startTime, endTime)
+}
+
+// Query performs a query for the given time.
+func (e *EnforceMatchersAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	query, err := e.enforceQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return e.API.Query(ctx, query, ts)
+}
+
+// QueryRange performs a query for the given range.
+func (e *EnforceMatchersAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, error) {
+	query, err := e.enforceQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return e.API.QueryRange(ctx, query, r)
+}
+
+// Series finds series by label matchers.
+func (e *EnforceMatchersAPI) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, error) {
+	required := RequiredMatchers(ctx)
+	if len(required) == 0 {
+		return e.API.Series(ctx, matches, startTime, endTime)
+	}
+
+	enforced, err := e.enforceSelectors(matches, required)
+	if err != nil {
+		return nil, err
+	}
+	return e.API.Series(ctx, enforced, startTime, endTime)
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (e *EnforceMatchersAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	enforced, err := EnforceMatchers(matchers, RequiredMatchers(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return e.API.GetValue(ctx, start, end, enforced)
+}
+
+// Rules returns a list of alerting and recording rules that are currently loaded.
+// The rules (their queries and alerts) can't be scoped, so the request is
+// rejected if any matchers are required.
+func (e *EnforceMatchersAPI) Rules(ctx context.Context) (v1.RulesResult, error) {
+	if required := RequiredMatchers(ctx); len(required) > 0 {
+		return v1.RulesResult{}, fmt.Errorf("rules can't be scoped to the required matchers %v", required)
+	}
+	return e.API.Rules(ctx)
+}
+
+// Alerts returns a list of all active alerts.
+// As the alerts API can't be scoped, the alerts are filtered to those whose
+// labels match the required matchers (see ScopeAlerts).
+func (e *EnforceMatchersAPI) Alerts(ctx context.Context) (v1.AlertsResult, error) {
+	alerts, err := e.API.Alerts(ctx)
+	if err != nil {
+		return v1.AlertsResult{}, err
+	}
+	alerts.Alerts = ScopeAlerts(ctx, alerts.Alerts)
+	return alerts, nil
+}
+
+// ScopeAlerts returns the `alerts` whose labels match all of the matchers
+// required by `ctx` (all of them if none are required)
+func ScopeAlerts(ctx context.Context, alerts []v1.Alert) []v1.Alert {
+	required := RequiredMatchers(ctx)
+	if len(required) == 0 {
+		return alerts
+	}
+
+	scoped := make([]v1.Alert, 0, len(alerts))
+ALERTS:
+	for _, alert := range alerts {
+		for _, m := range required {
+			if !m.Matches(string(alert.Labels[model.LabelName(m.Name)])) {
+				continue ALERTS
+			}
+		}
+		scoped = append(scoped, alert)
+	}
+	return scoped
+}
+
+func (e *EnforceMatchersAPI) enforceQuery(ctx context.Context, query string) (string, error) {
+	required := RequiredMatchers(ctx)
+	if len(required) == 0 {
+		return query, nil
+	}
+
+	expr, err := promql.ParseExpr(query)
+	if err != nil {
+		return "", err
+	}
+	if _, err := promql.Walk(ctx, &EnforceMatchersVisitor{required}, &promql.EvalStmt{Expr: expr}, expr, nil, nil); err != nil {
+		return "", err
+	}
+	return expr.String(), nil
+}
+
+func (e *EnforceMatchersAPI) enforceSelectors(selectors []string, required []*labels.Matcher) ([]string, error) {
+	ret := make([]string, len(selectors))
+	for i, selector := range selectors {
+		matchers, err := promql.ParseMetricSelector(selector)
+		if err != nil {
+			return nil, err
+		}
+		enforced, err := EnforceMatchers(matchers, required)
+		if err != nil {
+			return nil, err
+		}
+		if ret[i], err = promhttputil.MatcherToString(enforced); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,135 @@
+package promclient
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestEnforceQuery(t *testing.T) {
+	tenant, err := labels.NewMatcher(labels.MatchEqual, "tenant", "a")
+	if err != nil {
+		t.Fatalf("error creating matcher: %v", err)
+	}
+
+	tests := []struct {
+		query string
+		out   string
+		err   bool
+	}{
+		// Matcher is added
+		{
+			query: `up`,
+			out:   `up{tenant="a"}`,
+		},
+		// Matcher added to all selectors
+		{
+			query: `sum(rate(http_requests_total{job="x"}[5m])) / count(up)`,
+			out:   `sum(rate(http_requests_total{job="x",tenant="a"}[5m])) / count(up{tenant="a"})`,
+		},
+		// Already scoped to the tenant
+		{
+			query: `up{tenant="a"}`,
+			out:   `up{tenant="a"}`,
+		},
+		// Compatible matcher, both are kept
+		{
+			query: `up{tenant=~"a|b"}`,
+			out:   `up{tenant="a",tenant=~"a|b"}`,
+		},
+		// Conflicting value
+		{
+			query: `up{tenant="b"}`,
+			err:   true,
+		},
+		{
+			query: `up{tenant!="a"}`,
+			err:   true,
+		},
+	}
+
+	ctx := WithRequiredMatchers(context.TODO(), tenant)
+	api := &EnforceMatchersAPI{}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			out, err := api.enforceQuery(ctx, test.query)
+			if err != nil != test.err {
+				t.Fatalf("mismatch in err expected=%v actual=%v", test.err, err)
+			}
+			if err == nil && out != test.out {
+				t.Fatalf("mismatch in query expected=%s actual=%s", test.out, out)
+			}
+		})
+	}
+}
+
+func TestEnforceNoRequiredMatchers(t *testing.T) {
+	api := &EnforceMatchersAPI{}
+	out, err := api.enforceQuery(context.TODO(), `up{tenant="b"}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != `up{tenant="b"}` {
+		t.Fatalf("query shouldn't be changed: %s", out)
+	}
+}
+
+func TestEnforceAlerts(t *testing.T) {
+	tenant, err := labels.NewMatcher(labels.MatchEqual, "tenant", "a")
+	if err != nil {
+		t.Fatalf("error creating matcher: %v", err)
+	}
+	alerts := []v1.Alert{
+		{Labels: model.LabelSet{"alertname": "Down", "tenant": "a"}},
+		{Labels: model.LabelSet{"alertname": "Down", "tenant": "b"}},
+		{Labels: model.LabelSet{"alertname": "Down"}},
+	}
+	api := &EnforceMatchersAPI{&stubAPI{alerts: func() v1.AlertsResult { return v1.AlertsResult{Alerts: alerts} }}}
+
+	// Only the tenant's alerts are returned
+	result, err := api.Alerts(WithRequiredMatchers(context.TODO(), tenant))
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if !reflect.DeepEqual(result.Alerts, alerts[:1]) {
+		t.Fatalf("mismatch in alerts expected=%v actual=%v", alerts[:1], result.Alerts)
+	}
+
+	// Without required matchers all alerts are returned
+	result, err = api.Alerts(context.TODO())
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if !reflect.DeepEqual(result.Alerts, alerts) {
+		t.Fatalf("mismatch in alerts expected=%v actual=%v", alerts, result.Alerts)
+	}
+}
+
+func TestEnforceRules(t *testing.T) {
+	tenant, err := labels.NewMatcher(labels.MatchEqual, "tenant", "a")
+	if err != nil {
+		t.Fatalf("error creating matcher: %v", err)
+	}
+	rules := v1.RulesResult{Groups: []v1.RuleGroup{{Name: "a", Rules: v1.Rules{v1.RecordingRule{Name: "b", Query: `up{tenant="b"}`}}}}}
+	api := &EnforceMatchersAPI{&stubAPI{rules: func() v1.RulesResult { return rules }}}
+
+	// The rules can't be scoped to the tenant
+	if _, err := api.Rules(WithRequiredMatchers(context.TODO(), tenant)); err == nil {
+		t.Fatalf("expected an error for a tenant's rules")
+	}
+
+	// Without required matchers all rules are returned
+	result, err := api.Rules(context.TODO())
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if !reflect.DeepEqual(result, rules) {
+		t.Fatalf("mismatch in rules expected=%v actual=%v", rules, result)
+	}
+}
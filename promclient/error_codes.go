@@ -0,0 +1,77 @@
+package promclient
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/jacksontj/promxy/logging"
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+// retryDelay is the delay before the first retry of a request, which doubles
+// with each further retry
+const retryDelay = 100 * time.Millisecond
+
+// ErrorCode is how the error responses with an HTTP status code from a
+// downstream are handled: the request is retried up to Retries times, and if
+// it still fails the query which failed with it is responded to with Status
+// (if set) instead of the status of the error (see promhttputil.ErrorStatus)
+type ErrorCode struct {
+	Status  int
+	Retries int
+}
+
+// NewErrorCodesRoundTripper returns an http.RoundTripper which handles the
+// error responses of `rt` with a status code in `codes` as configured. This
+// is where all backend-specific error semantics are applied, no other part of
+// promxy interprets the status codes of the downstreams.
+func NewErrorCodesRoundTripper(codes map[int]ErrorCode, rt http.RoundTripper) http.RoundTripper {
+	if len(codes) == 0 {
+		return rt
+	}
+	return &errorCodesRoundTripper{codes, rt}
+}
+
+type errorCodesRoundTripper struct {
+	codes map[int]ErrorCode
+	rt    http.RoundTripper
+}
+
+func (rt *errorCodesRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.rt.RoundTrip(req)
+	for attempt := 0; err == nil; attempt++ {
+		code, ok := rt.codes[resp.StatusCode]
+		if !ok {
+			return resp, nil
+		}
+		// Requests whose body can't be sent again aren't retried
+		if attempt >= code.Retries || (req.Body != nil && req.GetBody == nil) {
+			if code.Status != 0 {
+				promhttputil.SetErrorStatus(req.Context(), code.Status)
+			}
+			return resp, nil
+		}
+
+		logging.FromContext(req.Context()).Debugf("Retrying %s after a %d response (attempt %d of %d)", req.URL.Path, resp.StatusCode, attempt+1, code.Retries)
+		// Drain the body so the connection can be reused
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		select {
+		case <-time.After(retryDelay << uint(attempt)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+
+		// RoundTrippers must not modify the request, so send a copy (with a new body)
+		retry := cloneRequest(req)
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		resp, err = rt.rt.RoundTrip(retry)
+	}
+	return resp, err
+}
@@ -0,0 +1,81 @@
+package promclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+func TestErrorCodesRoundTripper(t *testing.T) {
+	var requests int
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		r.ParseForm()
+		bodies = append(bodies, r.Form.Get("query"))
+		switch r.URL.Path {
+		case "/unavailable":
+			// Only the first request fails
+			if requests == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		case "/unprocessable":
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: NewErrorCodesRoundTripper(map[int]ErrorCode{
+		http.StatusServiceUnavailable:  {Retries: 2},
+		http.StatusUnprocessableEntity: {Status: http.StatusBadRequest, Retries: 1},
+	}, http.DefaultTransport)}
+
+	tests := []struct {
+		path     string
+		code     int
+		requests int
+		status   int
+	}{
+		// Retried until it succeeds
+		{"/unavailable", http.StatusOK, 2, 0},
+		// Retried until the retries run out, then mapped
+		{"/unprocessable", http.StatusUnprocessableEntity, 2, http.StatusBadRequest},
+		// Codes which aren't configured are untouched
+		{"/error", http.StatusInternalServerError, 1, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			requests = 0
+			bodies = nil
+			ctx, status := promhttputil.WithErrorStatus(context.TODO())
+			req, _ := http.NewRequest("POST", srv.URL+test.path, strings.NewReader("query=up"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			resp, err := client.Do(req.WithContext(ctx))
+			if err != nil {
+				t.Fatalf("Unexpected Err: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.code {
+				t.Fatalf("mismatch in code: expected=%d actual=%d", test.code, resp.StatusCode)
+			}
+			if requests != test.requests {
+				t.Fatalf("mismatch in requests: expected=%d actual=%d", test.requests, requests)
+			}
+			// Retries send the same body
+			for _, body := range bodies {
+				if body != "up" {
+					t.Fatalf("mismatch in retried body: %v", bodies)
+				}
+			}
+			if status.Code() != test.status {
+				t.Fatalf("mismatch in status: expected=%d actual=%d", test.status, status.Code())
+			}
+		})
+	}
+}
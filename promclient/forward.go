@@ -0,0 +1,71 @@
+package promclient
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+type forwardedHeadersKey struct{}
+
+// WithForwardedHeaders returns a copy of `ctx` whose downstream requests (made
+// through a ForwardHeadersRoundTripper) will have `headers` set on them
+func WithForwardedHeaders(ctx context.Context, headers http.Header) context.Context {
+	if len(headers) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, forwardedHeadersKey{}, headers)
+}
+
+// ForwardedHeaders returns the headers to forward to downstreams for `ctx`
+func ForwardedHeaders(ctx context.Context) http.Header {
+	headers, _ := ctx.Value(forwardedHeadersKey{}).(http.Header)
+	return headers
+}
+
+// SelectHeaders returns the headers in `names` from `header`. Only headers
+// which are explicitly listed are selected, so sensitive headers (such as
+// Authorization or Cookie) are never forwarded unless configured to be.
+func SelectHeaders(header http.Header, names []string) http.Header {
+	var selected http.Header
+	for _, name := range names {
+		if values := header[http.CanonicalHeaderKey(name)]; len(values) > 0 {
+			if selected == nil {
+				selected = make(http.Header, len(names))
+			}
+			selected[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	return selected
+}
+
+// NewForwardHeadersRoundTripper returns an http.RoundTripper which sets the
+// ForwardedHeaders of each request's context on the request before passing
+// it on to `rt`, and adds the headers of the responses to the ResponseHeaders
+// of the context (see promhttputil.WithResponseHeaders). This applies to all
+// clients sharing the RoundTripper, so both the v1 API and remote_read
+// requests carry the headers.
+func NewForwardHeadersRoundTripper(rt http.RoundTripper) http.RoundTripper {
+	return &forwardHeadersRoundTripper{rt}
+}
+
+type forwardHeadersRoundTripper struct {
+	rt http.RoundTripper
+}
+
+func (rt *forwardHeadersRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if headers := ForwardedHeaders(req.Context()); len(headers) > 0 {
+		// RoundTrippers must not modify the request, so send a copy with the headers
+		req = cloneRequest(req)
+		for k, values := range headers {
+			req.Header[k] = values
+		}
+	}
+
+	resp, err := rt.rt.RoundTrip(req)
+	if err == nil {
+		promhttputil.AddResponseHeaders(req.Context(), resp.Header)
+	}
+	return resp, err
+}
@@ -0,0 +1,77 @@
+package promclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+func TestSelectHeaders(t *testing.T) {
+	header := http.Header{
+		"X-Tenant":      []string{"a"},
+		"Authorization": []string{"Bearer secret"},
+	}
+
+	// Only the listed headers are selected
+	if selected := SelectHeaders(header, []string{"x-tenant", "X-Forwarded-User"}); !reflect.DeepEqual(selected, http.Header{"X-Tenant": []string{"a"}}) {
+		t.Fatalf("mismatch in selected headers: %v", selected)
+	}
+	if selected := SelectHeaders(header, nil); selected != nil {
+		t.Fatalf("expected no headers, got: %v", selected)
+	}
+}
+
+func TestForwardHeadersRoundTripper(t *testing.T) {
+	var tenants []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenants = append(tenants, r.Header.Get("X-Tenant"))
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	rt := NewForwardHeadersRoundTripper(http.DefaultTransport)
+	ctx := WithForwardedHeaders(context.TODO(), http.Header{"X-Tenant": []string{"a"}})
+
+	// v1 API
+	client, err := api.NewClient(api.Config{Address: srv.URL, RoundTripper: rt})
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	v1.NewAPI(client).LabelValues(ctx, "job")
+
+	// remote_read
+	NewRemoteReadClient(srv.URL, &http.Client{Transport: rt}, time.Second).Read(ctx, &prompb.Query{})
+
+	// Requests without forwarded headers are unchanged
+	v1.NewAPI(client).LabelValues(context.TODO(), "job")
+
+	if !reflect.DeepEqual(tenants, []string{"a", "a", ""}) {
+		t.Fatalf("mismatch in forwarded headers: %v", tenants)
+	}
+}
+
+func TestForwardHeadersRoundTripperResponseHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+	}))
+	defer srv.Close()
+
+	ctx, headers := promhttputil.WithResponseHeaders(context.TODO(), []string{"Deprecation"}, promhttputil.ResponseHeaderPolicyFirst)
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	client := &http.Client{Transport: NewForwardHeadersRoundTripper(http.DefaultTransport)}
+	if _, err := client.Do(req.WithContext(ctx)); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if deprecation := headers.Header().Get("Deprecation"); deprecation != "true" {
+		t.Fatalf("the response header wasn't collected: %v", headers.Header())
+	}
+}
@@ -0,0 +1,58 @@
+package promclient
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+)
+
+// HopsHeader is the header of requests from promxy with the number of promxy
+// instances the request has passed through (for promxy-of-promxy topologies)
+const HopsHeader = "X-Promxy-Hops"
+
+// ViaHeader is the header of requests from promxy listing the external labels
+// of each promxy instance the request has passed through, so an instance can
+// detect a request it sent coming back to it
+const ViaHeader = "X-Promxy-Via"
+
+type hopsKey struct{}
+
+// hops is the position of a request in a promxy topology
+type hops struct {
+	count int
+	via   []string
+}
+
+// WithHops returns a copy of `ctx` whose downstream requests (made through a
+// HopsRoundTripper) carry `count` as the number of promxy instances the
+// request has passed through and `via` as the external labels of those instances
+func WithHops(ctx context.Context, count int, via []string) context.Context {
+	return context.WithValue(ctx, hopsKey{}, hops{count, via})
+}
+
+// NewHopsRoundTripper returns an http.RoundTripper which sets the HopsHeader
+// and ViaHeader of each request whose context has hops (see WithHops) before
+// passing it on to `rt`
+func NewHopsRoundTripper(rt http.RoundTripper) http.RoundTripper {
+	return &hopsRoundTripper{rt}
+}
+
+type hopsRoundTripper struct {
+	rt http.RoundTripper
+}
+
+func (rt *hopsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	h, ok := req.Context().Value(hopsKey{}).(hops)
+	if !ok {
+		return rt.rt.RoundTrip(req)
+	}
+
+	// RoundTrippers must not modify the request, so send a copy with the headers
+	req = cloneRequest(req)
+	req.Header.Set(HopsHeader, strconv.Itoa(h.count))
+	req.Header.Del(ViaHeader)
+	for _, via := range h.via {
+		req.Header.Add(ViaHeader, via)
+	}
+	return rt.rt.RoundTrip(req)
+}
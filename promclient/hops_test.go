@@ -0,0 +1,45 @@
+package promclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestHopsRoundTripper(t *testing.T) {
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: NewHopsRoundTripper(http.DefaultTransport)}
+
+	// Requests without hops don't get the headers
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	if _, err := client.Do(req); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if header.Get(HopsHeader) != "" || len(header[ViaHeader]) != 0 {
+		t.Fatalf("unexpected hops headers: %v", header)
+	}
+
+	ctx := WithHops(context.TODO(), 2, []string{`{promxy="a"}`, `{promxy="b"}`})
+	req, _ = http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set(ViaHeader, "stale")
+	if _, err := client.Do(req.WithContext(ctx)); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if header.Get(HopsHeader) != "2" {
+		t.Fatalf("mismatch in hops: %v", header.Get(HopsHeader))
+	}
+	if !reflect.DeepEqual(header[ViaHeader], []string{`{promxy="a"}`, `{promxy="b"}`}) {
+		t.Fatalf("mismatch in via: %v", header[ViaHeader])
+	}
+	// The original request is unmodified
+	if req.Header.Get(HopsHeader) != "" {
+		t.Fatalf("request was modified: %v", req.Header)
+	}
+}
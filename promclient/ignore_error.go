@@ -2,52 +2,84 @@ package promclient
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/jacksontj/promxy/promhttputil"
 )
 
 // OptionalAPI simply swallows all errors from the given API. This allows the API to
 // be used with all the regular error merging logic and effectively have its errors
-// not considered
+// not considered. Each swallowed error is added as a warning to the context, so
+// the missing data of a failure can be told apart from the API having no data.
 type IgnoreErrorAPI struct {
 	API
 }
 
+// warnIgnoredError adds a warning for the ignored `err` (if any) to `ctx`
+func warnIgnoredError(ctx context.Context, err error) {
+	if err != nil {
+		promhttputil.AddWarning(ctx, fmt.Sprintf("ignoring downstream error: %v", err))
+	}
+}
+
 // LabelValues performs a query for the values of the given label.
 func (n *IgnoreErrorAPI) LabelValues(ctx context.Context, label string) (model.LabelValues, error) {
-	v, _ := n.API.LabelValues(ctx, label)
+	v, err := n.API.LabelValues(ctx, label)
+	warnIgnoredError(ctx, err)
+	return v, nil
+}
 
+// LabelNames returns the label names (optionally scoped by matchers and time range).
+func (n *IgnoreErrorAPI) LabelNames(ctx context.Context, matchers []string, startTime time.Time, endTime time.Time) ([]string, error) {
+	v, err := n.API.LabelNames(ctx, matchers, startTime, endTime)
+	warnIgnoredError(ctx, err)
 	return v, nil
 }
 
 // Query performs a query for the given time.
 func (n *IgnoreErrorAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
-	v, _ := n.API.Query(ctx, query, ts)
-
+	v, err := n.API.Query(ctx, query, ts)
+	warnIgnoredError(ctx, err)
 	return v, nil
 }
 
 // QueryRange performs a query for the given range.
 func (n *IgnoreErrorAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, error) {
-	v, _ := n.API.QueryRange(ctx, query, r)
-
+	v, err := n.API.QueryRange(ctx, query, r)
+	warnIgnoredError(ctx, err)
 	return v, nil
 }
 
 // Series finds series by label matchers.
 func (n *IgnoreErrorAPI) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, error) {
-	v, _ := n.API.Series(ctx, matches, startTime, endTime)
-
+	v, err := n.API.Series(ctx, matches, startTime, endTime)
+	warnIgnoredError(ctx, err)
 	return v, nil
 }
 
 // GetValue loads the raw data for a given set of matchers in the time range
 func (n *IgnoreErrorAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
-	v, _ := n.API.GetValue(ctx, start, end, matchers)
+	v, err := n.API.GetValue(ctx, start, end, matchers)
+	warnIgnoredError(ctx, err)
+	return v, nil
+}
+
+// Rules returns a list of alerting and recording rules that are currently loaded.
+func (n *IgnoreErrorAPI) Rules(ctx context.Context) (v1.RulesResult, error) {
+	v, err := n.API.Rules(ctx)
+	warnIgnoredError(ctx, err)
+	return v, nil
+}
 
+// Alerts returns a list of all active alerts.
+func (n *IgnoreErrorAPI) Alerts(ctx context.Context) (v1.AlertsResult, error) {
+	v, err := n.API.Alerts(ctx)
+	warnIgnoredError(ctx, err)
 	return v, nil
 }
 
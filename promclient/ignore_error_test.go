@@ -0,0 +1,31 @@
+package promclient
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+func TestIgnoreErrorAPI(t *testing.T) {
+	stub := &toggleErrorAPI{API: &stubAPI{query: func() model.Value { return model.Vector{} }}}
+	api := &IgnoreErrorAPI{stub}
+
+	ctx, warnings := promhttputil.WithWarnings(context.TODO())
+	if _, err := api.Query(ctx, "up", time.Now()); err != nil || len(warnings.Warnings()) != 0 {
+		t.Fatalf("unexpected error or warnings: %v %v", err, warnings.Warnings())
+	}
+
+	// Errors are ignored, but flagged with a warning
+	stub.err = fmt.Errorf("connection refused")
+	if _, err := api.Query(ctx, "up", time.Now()); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if w := warnings.Warnings(); len(w) != 1 || w[0] != "ignoring downstream error: connection refused" {
+		t.Fatalf("expected a warning for the ignored error, got: %v", w)
+	}
+}
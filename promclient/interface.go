@@ -13,6 +13,8 @@ import (
 type API interface {
 	// LabelValues performs a query for the values of the given label.
 	LabelValues(ctx context.Context, label string) (model.LabelValues, error)
+	// LabelNames returns the label names (optionally scoped by matchers and time range).
+	LabelNames(ctx context.Context, matchers []string, startTime time.Time, endTime time.Time) ([]string, error)
 	// Query performs a query for the given time.
 	Query(ctx context.Context, query string, ts time.Time) (model.Value, error)
 	// QueryRange performs a query for the given range.
@@ -21,6 +23,10 @@ type API interface {
 	Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, error)
 	// GetValue loads the raw data for a given set of matchers in the time range
 	GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error)
+	// Rules returns a list of alerting and recording rules that are currently loaded.
+	Rules(ctx context.Context) (v1.RulesResult, error)
+	// Alerts returns a list of all active alerts.
+	Alerts(ctx context.Context) (v1.AlertsResult, error)
 }
 
 // APILabels includes a Key() mechanism to differentiate which APIs are "the same"
@@ -9,30 +9,69 @@ import (
 	"github.com/prometheus/prometheus/pkg/labels"
 )
 
+// IteratorsForValue returns a SeriesIterator for each series of `v`
 func IteratorsForValue(v model.Value) []*SeriesIterator {
-	switch valueTyped := v.(type) {
-	case *model.Scalar:
-		return []*SeriesIterator{NewSeriesIterator(v)}
+	valueIterators := NewValueIterators(v)
+	iterators := make([]*SeriesIterator, 0, valueIterators.Len())
+	for valueIterators.Next() {
+		iterators = append(iterators, valueIterators.At())
+	}
+	return iterators
+}
+
+// NewValueIterators returns a ValueIterators over the series of `v`
+func NewValueIterators(v model.Value) *ValueIterators {
+	switch v.(type) {
+	case *model.Scalar, model.Vector, model.Matrix, nil:
+		return &ValueIterators{v: v, offset: -1}
 	case *model.String:
 		panic("Not implemented")
-	case model.Vector:
-		iterators := make([]*SeriesIterator, len(valueTyped))
-		for i, sample := range valueTyped {
-			iterators[i] = NewSeriesIterator(sample)
-		}
-		return iterators
-	case model.Matrix:
-		iterators := make([]*SeriesIterator, len(valueTyped))
-		for i, stream := range valueTyped {
-			iterators[i] = NewSeriesIterator(stream)
-		}
-		return iterators
-	case nil:
-		return nil
 	default:
 		msg := fmt.Sprintf("Unknown type %v", reflect.TypeOf(v))
 		panic(msg)
-		return nil
+	}
+}
+
+// ValueIterators iterates over the series of a model.Value, creating the
+// SeriesIterator of each series as it is reached. Unlike IteratorsForValue
+// this doesn't allocate the iterators of all series upfront, so consumers
+// which process one series at a time only hold the one they are at.
+type ValueIterators struct {
+	v      model.Value
+	offset int
+}
+
+// Len returns the number of series of the value
+func (v *ValueIterators) Len() int {
+	switch valueTyped := v.v.(type) {
+	case *model.Scalar:
+		return 1
+	case model.Vector:
+		return len(valueTyped)
+	case model.Matrix:
+		return len(valueTyped)
+	default:
+		return 0
+	}
+}
+
+// Next advances to the next series, returning false once there are none left
+func (v *ValueIterators) Next() bool {
+	if v.offset < v.Len() {
+		v.offset++
+	}
+	return v.offset < v.Len()
+}
+
+// At returns a SeriesIterator for the current series
+func (v *ValueIterators) At() *SeriesIterator {
+	switch valueTyped := v.v.(type) {
+	case model.Vector:
+		return NewSeriesIterator(valueTyped[v.offset])
+	case model.Matrix:
+		return NewSeriesIterator(valueTyped[v.offset])
+	default:
+		return NewSeriesIterator(v.v)
 	}
 }
 
@@ -0,0 +1,94 @@
+package promclient
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestValueIterators(t *testing.T) {
+	tests := []struct {
+		v     model.Value
+		count int
+	}{
+		{v: nil},
+		{v: model.Vector{}},
+		{v: &model.Scalar{Value: 1}, count: 1},
+		{
+			v: model.Vector{
+				{Metric: model.Metric{"a": "1"}},
+				{Metric: model.Metric{"a": "2"}},
+			},
+			count: 2,
+		},
+		{
+			v:     model.Matrix{{Metric: model.Metric{"a": "1"}}},
+			count: 1,
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			iterators := NewValueIterators(test.v)
+			count := 0
+			for iterators.Next() {
+				if iterators.At() == nil {
+					t.Fatalf("nil iterator at %d", count)
+				}
+				count++
+			}
+			if count != test.count {
+				t.Fatalf("mismatch in count expected=%d actual=%d", test.count, count)
+			}
+			// An exhausted ValueIterators stays exhausted
+			if iterators.Next() {
+				t.Fatalf("Next after the end")
+			}
+			if len(IteratorsForValue(test.v)) != test.count {
+				t.Fatalf("mismatch in IteratorsForValue count")
+			}
+		})
+	}
+}
+
+// benchmarkMatrix returns a matrix of `n` series
+func benchmarkMatrix(n int) model.Matrix {
+	m := make(model.Matrix, n)
+	for i := range m {
+		m[i] = &model.SampleStream{
+			Metric: model.Metric{"__name__": "up", "instance": model.LabelValue(strconv.Itoa(i))},
+			Values: []model.SamplePair{{Timestamp: 1, Value: 1}},
+		}
+	}
+	return m
+}
+
+// The allocations (B/op) of these are what iterating a 100k series result
+// holds in memory on top of the result: all iterators for IteratorsForValue,
+// only the current one for ValueIterators.
+func BenchmarkIteratorsForValue(b *testing.B) {
+	m := benchmarkMatrix(100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, it := range IteratorsForValue(m) {
+			for it.Next() {
+			}
+		}
+	}
+}
+
+func BenchmarkValueIterators(b *testing.B) {
+	m := benchmarkMatrix(100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		iterators := NewValueIterators(m)
+		for iterators.Next() {
+			it := iterators.At()
+			for it.Next() {
+			}
+		}
+	}
+}
@@ -2,6 +2,7 @@ package promclient
 
 import (
 	"context"
+	"sort"
 	"time"
 
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
@@ -27,6 +28,23 @@ func MergeLabelValues(a, b []model.LabelValue) []model.LabelValue {
 	return a
 }
 
+// MergeLabelNames merges the label names in `b` into `a` (de-duplicating)
+func MergeLabelNames(a, b []string) []string {
+	names := make(map[string]struct{}, len(a))
+	for _, item := range a {
+		names[item] = struct{}{}
+	}
+
+	for _, item := range b {
+		if _, ok := names[item]; !ok {
+			a = append(a, item)
+			names[item] = struct{}{}
+		}
+	}
+
+	return a
+}
+
 func MergeLabelSets(a, b []model.LabelSet) []model.LabelSet {
 	added := make(map[model.Fingerprint]struct{})
 	for _, item := range a {
@@ -68,24 +86,71 @@ func (c *AddLabelClient) LabelValues(ctx context.Context, label string) (model.L
 	return val, nil
 }
 
-// Query performs a query for the given time.
-func (c *AddLabelClient) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
-	// Parse out the promql query into expressions etc.
-	e, err := promql.ParseExpr(query)
+// LabelNames returns the label names (optionally scoped by matchers and time range).
+func (c *AddLabelClient) LabelNames(ctx context.Context, matchers []string, startTime time.Time, endTime time.Time) ([]string, error) {
+	// Filter the matchers for the labels associated with this client
+	filteredMatchers := make([]string, 0, len(matchers))
+	unscoped := len(matchers) == 0
+	for _, matcher := range matchers {
+		selector, err := promql.ParseMetricSelector(matcher)
+		if err != nil {
+			return nil, err
+		}
+
+		filtered, ok := FilterMatchers(c.Labels, selector)
+		// If we didn't match, lets skip
+		if !ok {
+			continue
+		}
+
+		// If our labels satisfied the entire selector then all of our series match
+		// so there is no need to scope the downstream request
+		if len(filtered) == 0 {
+			unscoped = true
+			break
+		}
+
+		matcherString, err := promhttputil.MatcherToString(filtered)
+		if err != nil {
+			return nil, err
+		}
+		filteredMatchers = append(filteredMatchers, matcherString)
+	}
+
+	if unscoped {
+		filteredMatchers = nil
+	} else if len(filteredMatchers) == 0 {
+		// If no matchers remain, then we don't have anything -- so skip
+		return nil, nil
+	}
+
+	names, err := c.API.LabelNames(ctx, filteredMatchers, startTime, endTime)
 	if err != nil {
 		return nil, err
 	}
 
-	// Walk the expression, to filter out any LabelMatchers that match etc.
-	filterVisitor := &LabelFilterVisitor{c.Labels, true}
-	if _, err := promql.Walk(ctx, filterVisitor, &promql.EvalStmt{Expr: e}, e, nil, nil); err != nil {
+	// Add the names of the labels we add to all series
+	labelNames := make([]string, 0, len(c.Labels))
+	for name := range c.Labels {
+		labelNames = append(labelNames, string(name))
+	}
+	names = MergeLabelNames(names, labelNames)
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Query performs a query for the given time.
+func (c *AddLabelClient) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	filtered, ok, err := FilterQuery(ctx, c.Labels, query)
+	if err != nil {
 		return nil, err
 	}
-	if !filterVisitor.filterMatch {
+	if !ok {
 		return nil, nil
 	}
 
-	val, err := c.API.Query(ctx, e.String(), ts)
+	val, err := c.API.Query(ctx, filtered, ts)
 	if err != nil {
 		return nil, err
 	}
@@ -97,22 +162,15 @@ func (c *AddLabelClient) Query(ctx context.Context, query string, ts time.Time)
 
 // QueryRange performs a query for the given range.
 func (c *AddLabelClient) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, error) {
-	// Parse out the promql query into expressions etc.
-	e, err := promql.ParseExpr(query)
+	filtered, ok, err := FilterQuery(ctx, c.Labels, query)
 	if err != nil {
 		return nil, err
 	}
-
-	// Walk the expression, to filter out any LabelMatchers that match etc.
-	filterVisitor := &LabelFilterVisitor{c.Labels, true}
-	if _, err := promql.Walk(ctx, filterVisitor, &promql.EvalStmt{Expr: e}, e, nil, nil); err != nil {
-		return nil, err
-	}
-	if !filterVisitor.filterMatch {
+	if !ok {
 		return nil, nil
 	}
 
-	val, err := c.API.QueryRange(ctx, e.String(), r)
+	val, err := c.API.QueryRange(ctx, filtered, r)
 	if err != nil {
 		return nil, err
 	}
@@ -184,3 +242,32 @@ func (c *AddLabelClient) GetValue(ctx context.Context, start, end time.Time, mat
 
 	return val, nil
 }
+
+// Rules returns a list of alerting and recording rules that are currently loaded.
+func (c *AddLabelClient) Rules(ctx context.Context) (v1.RulesResult, error) {
+	result, err := c.API.Rules(ctx)
+	if err != nil {
+		return result, err
+	}
+	// Tag the rules with our labels so it is clear where they came from
+	RulesAddLabelSet(result, c.Labels)
+	return result, nil
+}
+
+// Alerts returns a list of all active alerts.
+func (c *AddLabelClient) Alerts(ctx context.Context) (v1.AlertsResult, error) {
+	result, err := c.API.Alerts(ctx)
+	if err != nil {
+		return result, err
+	}
+	for i, alert := range result.Alerts {
+		if alert.Labels == nil {
+			alert.Labels = make(model.LabelSet, len(c.Labels))
+		}
+		for k, v := range c.Labels {
+			alert.Labels[k] = v
+		}
+		result.Alerts[i] = alert
+	}
+	return result, nil
+}
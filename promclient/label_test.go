@@ -1,9 +1,11 @@
 package promclient
 
 import (
+	"context"
 	"reflect"
 	"strconv"
 	"testing"
+	"time"
 
 	model "github.com/prometheus/common/model"
 )
@@ -85,3 +87,114 @@ func TestMergeLabelSets(t *testing.T) {
 		})
 	}
 }
+
+func TestAddLabelClientLabelNames(t *testing.T) {
+	tests := []struct {
+		matchers           []string
+		downstreamCalled   bool
+		downstreamMatchers []string
+		names              []string
+	}{
+		// No matchers, we should get all names (including the ones we add)
+		{
+			matchers:         nil,
+			downstreamCalled: true,
+			names:            []string{model.MetricNameLabel, "az"},
+		},
+		// Our labels are stripped before sending downstream
+		{
+			matchers:           []string{`{az="a",job="x"}`},
+			downstreamCalled:   true,
+			downstreamMatchers: []string{`{job="x"}`},
+			names:              []string{model.MetricNameLabel, "az"},
+		},
+		// Matcher that doesn't match our labels shouldn't be sent downstream
+		{
+			matchers:         []string{`{az="b"}`},
+			downstreamCalled: false,
+		},
+		// Matcher that is entirely satisfied by our labels is the same as no matchers
+		{
+			matchers:         []string{`{az="a"}`},
+			downstreamCalled: true,
+			names:            []string{model.MetricNameLabel, "az"},
+		},
+		// Only the matching subset is sent downstream
+		{
+			matchers:           []string{`{az="b"}`, `{job="y"}`},
+			downstreamCalled:   true,
+			downstreamMatchers: []string{`{job="y"}`},
+			names:              []string{model.MetricNameLabel, "az"},
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			called := false
+			var downstreamMatchers []string
+			stub := &stubAPI{
+				labelNames: func(matchers []string) []string {
+					called = true
+					downstreamMatchers = matchers
+					return []string{model.MetricNameLabel}
+				},
+			}
+			c := &AddLabelClient{stub, model.LabelSet{"az": "a"}}
+
+			names, err := c.LabelNames(context.TODO(), test.matchers, time.Time{}, time.Time{})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if called != test.downstreamCalled {
+				t.Fatalf("mismatch in downstream called expected=%v actual=%v", test.downstreamCalled, called)
+			}
+			if !reflect.DeepEqual(downstreamMatchers, test.downstreamMatchers) {
+				t.Fatalf("mismatch in downstream matchers\nexpected=%v\nactual=%v", test.downstreamMatchers, downstreamMatchers)
+			}
+			if !reflect.DeepEqual(names, test.names) {
+				t.Fatalf("mismatch in names\nexpected=%v\nactual=%v", test.names, names)
+			}
+		})
+	}
+}
+
+func TestAddLabelClientUTF8Names(t *testing.T) {
+	// Prometheus 3.0 downstreams can return metric and label names which
+	// aren't valid in the classic syntax
+	getStub := func(host string) API {
+		return &stubAPI{
+			query: func() model.Value {
+				return model.Vector{{
+					Metric:    model.Metric{model.MetricNameLabel: "my.metric", "my.label": model.LabelValue(host)},
+					Value:     1,
+					Timestamp: 100,
+				}}
+			},
+		}
+	}
+
+	m := NewMultiAPI([]API{
+		&AddLabelClient{getStub("a"), model.LabelSet{"replica": "a"}},
+		&AddLabelClient{getStub("b"), model.LabelSet{"replica": "b"}},
+	}, model.Time(0), nil, 1)
+
+	// The dotted metric name can be selected with the __name__ matcher
+	v, err := m.Query(context.TODO(), `{__name__="my.metric"}`, time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+
+	expected := map[model.Fingerprint]struct{}{
+		model.Metric{model.MetricNameLabel: "my.metric", "my.label": "a", "replica": "a"}.Fingerprint(): {},
+		model.Metric{model.MetricNameLabel: "my.metric", "my.label": "b", "replica": "b"}.Fingerprint(): {},
+	}
+	vector := v.(model.Vector)
+	if len(vector) != len(expected) {
+		t.Fatalf("mismatch in value: %v", v)
+	}
+	for _, sample := range vector {
+		if _, ok := expected[sample.Metric.Fingerprint()]; !ok {
+			t.Fatalf("unexpected series: %v", sample.Metric)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package promclient
 
 import (
+	"context"
+
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql"
@@ -48,6 +50,26 @@ func (l *LabelFilterVisitor) Visit(node promql.Node, path []promql.Node) (w prom
 	return l, nil
 }
 
+// FilterQuery returns `query` without the matchers satisfied by the labels
+// `ls`, and whether the series with those labels can match the query at all
+func FilterQuery(ctx context.Context, ls model.LabelSet, query string) (string, bool, error) {
+	// Parse out the promql query into expressions etc.
+	e, err := promql.ParseExpr(query)
+	if err != nil {
+		return "", false, err
+	}
+
+	// Walk the expression, to filter out any LabelMatchers that match etc.
+	filterVisitor := &LabelFilterVisitor{ls, true}
+	if _, err := promql.Walk(ctx, filterVisitor, &promql.EvalStmt{Expr: e}, e, nil, nil); err != nil {
+		return "", false, err
+	}
+	if !filterVisitor.filterMatch {
+		return "", false, nil
+	}
+	return e.String(), true, nil
+}
+
 func FilterMatchers(ls model.LabelSet, matchers []*labels.Matcher) ([]*labels.Matcher, bool) {
 	filteredMatchers := make([]*labels.Matcher, 0, len(matchers))
 
@@ -0,0 +1,43 @@
+package promclient
+
+import "sync"
+
+// LatencyEMA tracks the exponential moving average of the latency of each key
+// (e.g. a downstream host). It is safe for concurrent use.
+type LatencyEMA struct {
+	alpha float64
+
+	l      sync.Mutex
+	values map[string]float64
+}
+
+// NewLatencyEMA returns a LatencyEMA which weights each new observation by
+// `alpha` (0 < alpha <= 1), higher values react faster to changes in latency
+func NewLatencyEMA(alpha float64) *LatencyEMA {
+	return &LatencyEMA{
+		alpha:  alpha,
+		values: make(map[string]float64),
+	}
+}
+
+// Observe adds an observation of `took` seconds for `key` and returns the updated average
+func (e *LatencyEMA) Observe(key string, took float64) float64 {
+	e.l.Lock()
+	defer e.l.Unlock()
+	v, ok := e.values[key]
+	if !ok {
+		v = took
+	} else {
+		v = e.alpha*took + (1-e.alpha)*v
+	}
+	e.values[key] = v
+	return v
+}
+
+// Get returns the average latency of `key`, keys without any observations
+// return 0 so they are preferred (and get measured) by any ordering on latency
+func (e *LatencyEMA) Get(key string) float64 {
+	e.l.Lock()
+	defer e.l.Unlock()
+	return e.values[key]
+}
@@ -0,0 +1,94 @@
+package promclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+// ResponseTooLargeError is returned when reading a downstream response which
+// is larger than the configured limit
+type ResponseTooLargeError struct {
+	Limit int64
+}
+
+func (e *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("response exceeded the max response size of %d bytes", e.Limit)
+}
+
+// limitError returns `err`, the error of a query exceeding a limit, setting the
+// ErrorStatus of the request to a 422 with an execution errorType so the query
+// fails the same as with one of prometheus' own limits (see
+// promhttputil.NewErrorStatusHandler)
+func limitError(ctx context.Context, err error) error {
+	promhttputil.SetErrorStatus(ctx, http.StatusUnprocessableEntity)
+	promhttputil.SetErrorType(ctx, promhttputil.ErrorExec)
+	return err
+}
+
+// NewMaxResponseSizeRoundTripper returns an http.RoundTripper which fails
+// reading any response body larger than `limit` bytes.
+// The prometheus API client buffers the entire response before decoding it,
+// so this is what bounds the memory a single (pathological) downstream
+// response can use -- the read is aborted as soon as the limit is exceeded.
+// A limit <= 0 disables the check.
+func NewMaxResponseSizeRoundTripper(limit int64, rt http.RoundTripper) http.RoundTripper {
+	if limit <= 0 {
+		return rt
+	}
+	return &maxResponseSizeRoundTripper{limit, rt}
+}
+
+type maxResponseSizeRoundTripper struct {
+	limit int64
+	rt    http.RoundTripper
+}
+
+func (rt *maxResponseSizeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// If the server told us the size up front, no need to read any of it
+	if resp.ContentLength > rt.limit {
+		resp.Body.Close()
+		return nil, limitError(req.Context(), &ResponseTooLargeError{rt.limit})
+	}
+	resp.Body = &maxBytesReadCloser{resp.Body, req.Context(), rt.limit, rt.limit}
+	return resp, nil
+}
+
+// maxBytesReadCloser returns an error once more than `limit` bytes are read
+type maxBytesReadCloser struct {
+	io.ReadCloser
+	ctx       context.Context
+	limit     int64
+	remaining int64
+}
+
+func (r *maxBytesReadCloser) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// If we've read up to the limit, check whether there is anything beyond it
+	if r.remaining <= 0 {
+		var b [1]byte
+		n, err := r.ReadCloser.Read(b[:])
+		if n > 0 {
+			return 0, limitError(r.ctx, &ResponseTooLargeError{r.limit})
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,52 @@
+package promclient
+
+import (
+	"context"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMaxBytesReadCloser(t *testing.T) {
+	tests := []struct {
+		body  string
+		limit int64
+		err   bool
+	}{
+		{
+			body:  "",
+			limit: 1,
+		},
+		{
+			body:  "abc",
+			limit: 3,
+		},
+		{
+			body:  "abc",
+			limit: 10,
+		},
+		{
+			body:  "abcd",
+			limit: 3,
+			err:   true,
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			r := &maxBytesReadCloser{ioutil.NopCloser(strings.NewReader(test.body)), context.TODO(), test.limit, test.limit}
+			b, err := ioutil.ReadAll(r)
+			if err != nil != test.err {
+				t.Fatalf("mismatch in err expected=%v actual=%v", test.err, err)
+			}
+			if err != nil {
+				if _, ok := err.(*ResponseTooLargeError); !ok {
+					t.Fatalf("unexpected error type: %v", err)
+				}
+			} else if string(b) != test.body {
+				t.Fatalf("mismatch in body expected=%s actual=%s", test.body, b)
+			}
+		})
+	}
+}
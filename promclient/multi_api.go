@@ -3,11 +3,17 @@ package promclient
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"net/url"
+	"runtime"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql"
@@ -15,6 +21,41 @@ import (
 	"github.com/jacksontj/promxy/promhttputil"
 )
 
+var (
+	mergeSeriesMerged = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "multiapi_merge_series_merged_total",
+		Help: "Number of series returned by multiple downstreams whose points were merged into a single series",
+	})
+	mergeSeriesDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "multiapi_merge_series_dropped_total",
+		Help: "Number of series returned by multiple downstreams that were dropped as duplicates",
+	})
+	mergeConflicts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "multiapi_merge_conflicts_total",
+		Help: "Number of duplicate series/values with differing values where one had to be picked during a merge",
+	})
+	mergeSeries = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "multiapi_merge_series",
+		Help:    "Number of series held in memory (the results of all downstreams) by a merge",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 11), // 1 to ~1M
+	}, []string{"call"})
+	mergeSamples = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "multiapi_merge_samples",
+		Help:    "Number of samples held in memory (the results of all downstreams) by a merge",
+		Buckets: prometheus.ExponentialBuckets(100, 4, 11), // 100 to ~100M
+	}, []string{"call"})
+	mergeAllocatedBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "multiapi_merge_allocated_bytes",
+		Help:    "Bytes allocated (by the whole process) while merging, sampled once every 100 merges",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 11), // 1KiB to 1GiB
+	}, []string{"call"})
+)
+
+func init() {
+	prometheus.MustRegister(mergeSeriesMerged, mergeSeriesDropped, mergeConflicts)
+	prometheus.MustRegister(mergeSeries, mergeSamples, mergeAllocatedBytes)
+}
+
 // Since these error types magically add in their own prefixes, we need to get
 // the prefix so it doesn't get added twice
 var (
@@ -22,6 +63,40 @@ var (
 	canceledPrefix = promql.ErrQueryCanceled("").Error()
 )
 
+// DownstreamError is an error returned by a downstream, annotated with which
+// downstream returned it. The underlying error is available through
+// errors.Cause (and Unwrap).
+type DownstreamError struct {
+	Call   string
+	Target string
+	Err    error
+}
+
+func (e *DownstreamError) Error() string {
+	return fmt.Sprintf("querying %s (%s): %v", e.Target, e.Call, e.Err)
+}
+
+// Cause returns the underlying error (for github.com/pkg/errors)
+func (e *DownstreamError) Cause() error { return e.Err }
+
+// Unwrap returns the underlying error (for the standard library's errors.Is/As)
+func (e *DownstreamError) Unwrap() error { return e.Err }
+
+// PromError returns `err` as the error to return to the prometheus engine and
+// API. Errors which the API returns a specific error type for (timeouts etc.)
+// must be of that type so they are unwrapped, all others keep their context
+// (such as which downstream failed).
+func PromError(err error) error {
+	switch cause := errors.Cause(err).(type) {
+	case promql.ErrQueryTimeout, promql.ErrQueryCanceled:
+		return cause
+	}
+	return err
+}
+
+// ErrTooManySamples is returned when a merged result has more than the max samples
+var ErrTooManySamples = errors.New("query processing would load too many samples into memory in downstream merge")
+
 // NormalizePromError converts the errors that the prometheus API client returns
 // into errors that the prometheus API server actually handles and returns proper
 // error codes for
@@ -51,14 +126,71 @@ func NormalizePromError(err error) error {
 		}
 	}
 
+	// If the request was aborted by its context (e.g. the query timeout) return
+	// the matching promql error
+	cause := errors.Cause(err)
+	if urlErr, ok := cause.(*url.Error); ok {
+		cause = urlErr.Err
+	}
+	if promErr := contextErrorToPromError(cause, "downstream request"); promErr != cause {
+		return promErr
+	}
+
 	// If all else fails, return the original error
 	return err
 }
 
+// ContextError returns the error for the (done) context `ctx` as the promql
+// error the API server returns the proper error type (e.g. timeout) for
+func ContextError(ctx context.Context) error {
+	return contextErrorToPromError(ctx.Err(), "downstream requests")
+}
+
+func contextErrorToPromError(err error, env string) error {
+	switch err {
+	case context.DeadlineExceeded:
+		return promql.ErrQueryTimeout(env)
+	case context.Canceled:
+		return promql.ErrQueryCanceled(env)
+	}
+	return err
+}
+
+// The statuses MultiAPIMetricFunc is called with
+const (
+	MetricStatusSuccess  = "success"
+	MetricStatusError    = "error"
+	MetricStatusTimeout  = "timeout"
+	MetricStatusCanceled = "canceled"
+)
+
+// MetricStatus returns the status (one of MetricStatus*) of a call which
+// returned the (normalized) error `err`
+func MetricStatus(err error) string {
+	switch errors.Cause(err).(type) {
+	case nil:
+		return MetricStatusSuccess
+	case promql.ErrQueryTimeout:
+		return MetricStatusTimeout
+	case promql.ErrQueryCanceled:
+		return MetricStatusCanceled
+	default:
+		return MetricStatusError
+	}
+}
+
 // MultiAPIMetricFunc defines a method where a client can record metrics about
-// the specific API calls made through this multi client
+// the specific API calls made through this multi client. The status is one of
+// the MetricStatus* values: "success", "error", "timeout" (the request hit its
+// deadline, e.g. the query timeout) or "canceled" (the request was no longer
+// needed, e.g. the query was canceled or a quorum was already reached)
 type MultiAPIMetricFunc func(i int, api, status string, took float64)
 
+// MultiAPIErrorFunc defines a method where a client can record the errors of
+// the specific API calls made through this multi client (those with an "error"
+// or "timeout" MetricStatus)
+type MultiAPIErrorFunc func(i int, api string, err error)
+
 // NewMultiAPI returns a MultiAPI
 func NewMultiAPI(apis []API, antiAffinity model.Time, metricFunc MultiAPIMetricFunc, requiredCount int) *MultiAPI {
 	fingerprintCounts := make(map[model.Fingerprint]int)
@@ -92,21 +224,354 @@ func NewMultiAPI(apis []API, antiAffinity model.Time, metricFunc MultiAPIMetricF
 
 // MultiAPI implements the API interface while merging the results from the apis it wraps
 type MultiAPI struct {
-	apis            []API
-	apiFingerprints []model.Fingerprint
-	antiAffinity    model.Time
-	metricFunc      MultiAPIMetricFunc
-	requiredCount   int // number "per key" that we require to respond
+	apis             []API
+	apiFingerprints  []model.Fingerprint
+	antiAffinity     model.Time
+	metricFunc       MultiAPIMetricFunc
+	errorFunc        MultiAPIErrorFunc
+	requiredCount    int // number "per key" that we require to respond
+	quorum           int // number "per key" after which we stop waiting for the rest
+	maxLabelValues   int // max number of (merged) label values to return
+	maxSamples       int // max number of (merged) samples to return
+	conflictPolicy   promhttputil.ConflictPolicy
+	valueEpsilon     float64 // max relative difference of duplicate values (see SetValueEpsilon)
+	internLabels     bool    // intern the label strings of merged results (see SetInternLabels)
+	pool             *WorkerPool
+	failover         bool                // query the apis one at a time until one succeeds
+	failoverLatency  func(i int) float64 // (optional) latency to order the apis by for failover
+	names            []string            // (optional) name of each api for errors
+	affinityReplicas int                 // number of apis (per key) to send queries with an affinity key to
+}
+
+// SetQuorum sets the number of successful responses (per key) after which the
+// MultiAPI will return the merged result without waiting for the remaining
+// apis (cancelling their requests). A quorum of 0 (the default) waits for all.
+func (m *MultiAPI) SetQuorum(quorum int) {
+	m.quorum = quorum
+}
+
+// SetFailover switches the MultiAPI from querying all apis and merging the
+// results to querying the apis (in order, see SetFailoverLatency) until one succeeds. This is only
+// correct if all of the apis are replicas with the same data.
+func (m *MultiAPI) SetFailover(failover bool) {
+	m.failover = failover
+}
+
+// SetFailoverLatency sets the function returning the (historical) latency of
+// each api. With failover enabled the apis are tried in order of their latency
+// (fastest first) instead of in order, which reduces tail latency when some
+// replicas are slower than others.
+func (m *MultiAPI) SetFailoverLatency(latency func(i int) float64) {
+	m.failoverLatency = latency
+}
+
+// SetAffinity enables sending the data queries (Query, QueryRange and
+// GetValue) with an affinity key (see WithAffinityKey) to only `replicas` of
+// the apis with the same labels, chosen by consistent hashing of the key. The
+// queries sharing a key (e.g. the panels of a dashboard) are sent to the same
+// replicas, improving the hit rate of the downstreams' caches. With failover
+// enabled all apis are still tried, in the order chosen for the key. A
+// `replicas` of 0 (the default) disables affinity.
+func (m *MultiAPI) SetAffinity(replicas int) {
+	m.affinityReplicas = replicas
+}
+
+// failoverOrder returns the indexes of the apis in the order they are tried for failover
+func (m *MultiAPI) failoverOrder(ctx context.Context) []int {
+	if key := AffinityKey(ctx); m.affinityReplicas > 0 && key != "" {
+		return rendezvousOrder(key, m.affinityNames())
+	}
+	order := make([]int, len(m.apis))
+	for i := range order {
+		order[i] = i
+	}
+	if m.failoverLatency != nil {
+		latencies := make([]float64, len(m.apis))
+		for i := range latencies {
+			latencies[i] = m.failoverLatency(i)
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return latencies[order[i]] < latencies[order[j]]
+		})
+	}
+	return order
+}
+
+// failoverCall calls `f` with each api in turn until one succeeds
+func (m *MultiAPI) failoverCall(ctx context.Context, apiName string, f func(api API) error) error {
+	var lastError error
+	for _, i := range m.failoverOrder(ctx) {
+		api := m.apis[i]
+		if err := m.pool.Acquire(ctx); err != nil {
+			return err
+		}
+		start := time.Now()
+		err := NormalizePromError(f(api))
+		took := time.Now().Sub(start)
+		m.pool.Release()
+		m.recordMetric(i, apiName, err, took.Seconds())
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ContextError(ctx)
+		}
+		lastError = m.wrapError(i, apiName, err)
+	}
+	return errors.Wrap(lastError, "Unable to fetch from downstream servers")
+}
+
+// SetErrorFunc sets the func the errors of the calls to the apis are recorded with
+func (m *MultiAPI) SetErrorFunc(f MultiAPIErrorFunc) {
+	m.errorFunc = f
+}
+
+// SetNames sets the name (e.g. the URL of the target) of each api, which the
+// errors returned by the apis are annotated with (see DownstreamError)
+func (m *MultiAPI) SetNames(names []string) {
+	m.names = names
+}
+
+// wrapError annotates the error returned by the `api` call to api `i` with its name
+func (m *MultiAPI) wrapError(i int, api string, err error) error {
+	if err == nil || m.names == nil {
+		return err
+	}
+	return &DownstreamError{Call: api, Target: m.names[i], Err: err}
+}
+
+// SetWorkerPool sets the pool bounding the concurrent requests to the apis.
+// Only MultiAPIs whose apis don't fan out themselves (e.g. the targets of a
+// server group) should share a pool, otherwise requests holding the pool
+// could deadlock waiting on their own sub-requests.
+func (m *MultiAPI) SetWorkerPool(pool *WorkerPool) {
+	m.pool = pool
+}
+
+// SetMaxLabelValues sets the max number of label values LabelValues returns.
+// The merged values are sorted before truncation, so the result is deterministic
+// and a warning is added to the context when values are dropped.
+// A max of 0 (the default) returns all values.
+func (m *MultiAPI) SetMaxLabelValues(max int) {
+	m.maxLabelValues = max
 }
 
-func (m *MultiAPI) recordMetric(i int, api, status string, took float64) {
+// SetMaxSamples sets the max number of samples a (merged) Query, QueryRange or
+// GetValue result may have. The count is checked as each downstream result is
+// merged in, and ErrTooManySamples is returned once it exceeds `max`.
+// A max of 0 (the default) disables the check.
+func (m *MultiAPI) SetMaxSamples(max int) {
+	m.maxSamples = max
+}
+
+// SetConflictPolicy sets how duplicate series whose values differ are handled
+// when merging the results of the apis (see promhttputil.ConflictPolicy). With
+// ConflictPolicyWarn a warning is added to the context of the merge.
+func (m *MultiAPI) SetConflictPolicy(policy promhttputil.ConflictPolicy) {
+	m.conflictPolicy = policy
+}
+
+// SetValueEpsilon sets the max relative difference between the values of
+// duplicate series for them to be deduplicated rather than conflict when
+// merging the results of the apis. This only affects the dedup decisions, the
+// values returned are unchanged. An epsilon of 0 (the default) requires the
+// values to be identical.
+func (m *MultiAPI) SetValueEpsilon(epsilon float64) {
+	m.valueEpsilon = epsilon
+}
+
+// SetInternLabels sets whether the label names and values of the merged
+// Query, QueryRange and GetValue results are interned (see
+// promhttputil.Interner), so the series share their equal label strings
+// instead of each holding the copy decoded from its own response. This trades
+// CPU for memory on queries returning many series.
+func (m *MultiAPI) SetInternLabels(intern bool) {
+	m.internLabels = intern
+}
+
+// checkMaxSamples returns ErrTooManySamples if `v` has more than maxSamples samples
+func (m *MultiAPI) checkMaxSamples(ctx context.Context, v model.Value) error {
+	if m.maxSamples > 0 && countSamples(v) > m.maxSamples {
+		return limitError(ctx, ErrTooManySamples)
+	}
+	return nil
+}
+
+// countSamples returns the number of samples in `v`
+func countSamples(v model.Value) int {
+	switch valueTyped := v.(type) {
+	case model.Vector:
+		return len(valueTyped)
+	case model.Matrix:
+		count := 0
+		for _, stream := range valueTyped {
+			count += len(stream.Values)
+		}
+		return count
+	case *model.Scalar, *model.String:
+		return 1
+	}
+	return 0
+}
+
+// countSeries returns the number of series in `v`
+func countSeries(v model.Value) int {
+	switch valueTyped := v.(type) {
+	case model.Vector:
+		return len(valueTyped)
+	case model.Matrix:
+		return len(valueTyped)
+	}
+	return 0
+}
+
+// quorumReached returns whether all keys have at least `quorum` successes
+func (m *MultiAPI) quorumReached(outstandingRequests, successMap map[model.Fingerprint]int) bool {
+	if m.quorum <= 0 {
+		return false
+	}
+	for k := range outstandingRequests {
+		if successMap[k] < m.quorum || successMap[k] < m.requiredCount {
+			return false
+		}
+	}
+	return true
+}
+
+// recordMetric records the result of a call to api `i` (see MultiAPIMetricFunc
+// and MultiAPIErrorFunc)
+func (m *MultiAPI) recordMetric(i int, api string, err error, took float64) {
+	status := MetricStatus(err)
 	if m.metricFunc != nil {
 		m.metricFunc(i, api, status, took)
 	}
+	if m.errorFunc != nil && (status == MetricStatusError || status == MetricStatusTimeout) {
+		m.errorFunc(i, api, err)
+	}
+}
+
+// mergeValues merges `a` and `b` recording the dedup work done in the merge
+// metrics (and the time taken in the stats of `ctx`)
+func (m *MultiAPI) mergeValues(ctx context.Context, a, b model.Value) (model.Value, error) {
+	start := time.Now()
+	stats := &promhttputil.MergeStats{}
+	result, err := promhttputil.MergeValuesWithPolicy(m.antiAffinity, a, b, m.conflictPolicy, m.valueEpsilon, stats)
+	promhttputil.AddMergeTime(ctx, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	if m.conflictPolicy == promhttputil.ConflictPolicyWarn && stats.Conflicts > 0 {
+		promhttputil.AddWarning(ctx, fmt.Sprintf("merge conflict: %d duplicate series values differed, the first was kept", stats.Conflicts))
+	}
+	mergeSeriesMerged.Add(float64(stats.SeriesMerged))
+	mergeSeriesDropped.Add(float64(stats.SeriesDropped))
+	mergeConflicts.Add(float64(stats.Conflicts))
+	return result, nil
+}
+
+// mergeAllocSampleInterval is how many merges there are between the merges
+// whose allocations are measured
+var mergeAllocSampleInterval uint64 = 100
+
+// merges counts the merges, to sample the ones whose allocations are measured
+var merges uint64
+
+// heapAllocBytes returns the cumulative bytes allocated on the heap (by the
+// whole process). Reading it stops the world, which is why only a sample of
+// the merges is measured.
+func heapAllocBytes() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.TotalAlloc
+}
+
+// mergeResults merges the `results` of the downstreams of `call` in order (so
+// the result doesn't depend on response timing), recording the series and
+// samples held in memory by the merge and (for a sample of the merges) the
+// bytes allocated by it. The allocations are those of the whole process, so
+// they include any concurrent ones.
+func (m *MultiAPI) mergeResults(ctx context.Context, call string, results []model.Value) (model.Value, error) {
+	var series, samples int
+	for _, v := range results {
+		series += countSeries(v)
+		samples += countSamples(v)
+	}
+	mergeSeries.WithLabelValues(call).Observe(float64(series))
+	mergeSamples.WithLabelValues(call).Observe(float64(samples))
+	if atomic.AddUint64(&merges, 1)%mergeAllocSampleInterval == 0 {
+		allocated := heapAllocBytes()
+		defer func() {
+			mergeAllocatedBytes.WithLabelValues(call).Observe(float64(heapAllocBytes() - allocated))
+		}()
+	}
+
+	var result model.Value
+	for _, v := range results {
+		if result == nil {
+			result = v
+		} else {
+			var err error
+			result, err = m.mergeValues(ctx, result, v)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// Check as we go so we stop merging as soon as the limit is exceeded
+		if err := m.checkMaxSamples(ctx, result); err != nil {
+			return nil, err
+		}
+	}
+	m.internValue(ctx, result)
+
+	return sortValueByFingerprint(result), nil
+}
+
+// internValue interns the label strings of the merged `v` with internLabels,
+// adding the time taken to the merge time in the stats of `ctx`
+func (m *MultiAPI) internValue(ctx context.Context, v model.Value) {
+	if !m.internLabels {
+		return
+	}
+	start := time.Now()
+	promhttputil.NewInterner().InternValue(v)
+	promhttputil.AddMergeTime(ctx, time.Since(start))
+}
+
+// sortValueByFingerprint sorts the series in `v` by their label-set fingerprint
+// so that the merged output doesn't depend on the order downstreams return series in
+func sortValueByFingerprint(v model.Value) model.Value {
+	switch valueTyped := v.(type) {
+	case model.Vector:
+		fingerprints := make(map[*model.Sample]model.Fingerprint, len(valueTyped))
+		for _, s := range valueTyped {
+			fingerprints[s] = s.Metric.Fingerprint()
+		}
+		sort.SliceStable(valueTyped, func(i, j int) bool {
+			return fingerprints[valueTyped[i]] < fingerprints[valueTyped[j]]
+		})
+	case model.Matrix:
+		fingerprints := make(map[*model.SampleStream]model.Fingerprint, len(valueTyped))
+		for _, s := range valueTyped {
+			fingerprints[s] = s.Metric.Fingerprint()
+		}
+		sort.SliceStable(valueTyped, func(i, j int) bool {
+			return fingerprints[valueTyped[i]] < fingerprints[valueTyped[j]]
+		})
+	}
+	return v
 }
 
 // LabelValues performs a query for the values of the given label.
 func (m *MultiAPI) LabelValues(ctx context.Context, label string) (model.LabelValues, error) {
+	if m.failover {
+		var result model.LabelValues
+		err := m.failoverCall(ctx, "label_values", func(api API) (err error) {
+			result, err = api.LabelValues(ctx, label)
+			return err
+		})
+		return result, err
+	}
+
 	childContext, childContextCancel := context.WithCancel(ctx)
 	defer childContextCancel()
 
@@ -114,42 +579,52 @@ func (m *MultiAPI) LabelValues(ctx context.Context, label string) (model.LabelVa
 		v   model.LabelValues
 		err error
 		ls  model.Fingerprint
+		i   int
 	}
 
-	resultChans := make([]chan chanResult, len(m.apis))
+	resultChan := make(chan chanResult, len(m.apis))
 	outstandingRequests := make(map[model.Fingerprint]int) // fingerprint -> outstanding
 
 	for i, api := range m.apis {
-		resultChans[i] = make(chan chanResult, 1)
+		if err := m.pool.Acquire(childContext); err != nil {
+			return nil, err
+		}
 		outstandingRequests[m.apiFingerprints[i]]++
 		go func(i int, retChan chan chanResult, api API, label string) {
+			defer m.pool.Release()
 			start := time.Now()
 			result, err := api.LabelValues(childContext, label)
 			took := time.Now().Sub(start)
-			if err != nil {
-				m.recordMetric(i, "label_values", "error", took.Seconds())
-			} else {
-				m.recordMetric(i, "label_values", "success", took.Seconds())
-			}
+			err = NormalizePromError(err)
+			m.recordMetric(i, "label_values", err, took.Seconds())
 			retChan <- chanResult{
 				v:   result,
-				err: NormalizePromError(err),
+				err: m.wrapError(i, "label_values", err),
 				ls:  m.apiFingerprints[i],
+				i:   i,
 			}
-		}(i, resultChans[i], api, label)
+		}(i, resultChan, api, label)
 	}
 
 	// Wait for results as we get them
 	var result []model.LabelValue
+	results := make([][]model.LabelValue, len(m.apis))
 	var lastError error
 	successMap := make(map[model.Fingerprint]int) // fingerprint -> success
-	for i := 0; i < len(m.apis); i++ {
+	skipped := 0
+	for i := 0; i < len(m.apis) && !m.quorumReached(outstandingRequests, successMap); i++ {
 		select {
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			return nil, ContextError(ctx)
 
-		case ret := <-resultChans[i]:
+		case ret := <-resultChan:
 			outstandingRequests[ret.ls]--
+			// remote_read_only apis can't list label values, they are skipped
+			// (with a warning) rather than failing the request
+			if ret.err != nil && errors.Cause(ret.err) == ErrRemoteReadOnly {
+				skipped++
+				ret.err = nil
+			}
 			if ret.err != nil {
 				// If there aren't enough outstanding requests to possibly succeed, no reason to wait
 				if (outstandingRequests[ret.ls] + successMap[ret.ls]) < m.requiredCount {
@@ -158,11 +633,105 @@ func (m *MultiAPI) LabelValues(ctx context.Context, label string) (model.LabelVa
 				lastError = ret.err
 			} else {
 				successMap[ret.ls]++
-				if result == nil {
-					result = ret.v
-				} else {
-					result = MergeLabelValues(result, ret.v)
+				results[ret.i] = ret.v
+			}
+		}
+	}
+
+	// Verify that we hit the requiredCount for all of the buckets
+	for k := range outstandingRequests {
+		if successMap[k] < m.requiredCount {
+			return nil, errors.Wrap(lastError, "Unable to fetch from downstream servers")
+		}
+	}
+
+	// Merge the results in order, so the result doesn't depend on response timing
+	for _, v := range results {
+		if result == nil {
+			result = v
+		} else {
+			result = MergeLabelValues(result, v)
+		}
+	}
+	if skipped > 0 {
+		promhttputil.AddWarning(ctx, fmt.Sprintf("label values of %q don't include %d remote_read_only servers, which can't list them", label, skipped))
+	}
+
+	if m.maxLabelValues > 0 && len(result) > m.maxLabelValues {
+		sort.Sort(model.LabelValues(result))
+		promhttputil.AddWarning(ctx, fmt.Sprintf("label values of %q truncated to %d of %d values", label, m.maxLabelValues, len(result)))
+		result = result[:m.maxLabelValues]
+	}
+
+	return result, nil
+}
+
+// LabelNames returns the label names (optionally scoped by matchers and time range).
+func (m *MultiAPI) LabelNames(ctx context.Context, matchers []string, startTime time.Time, endTime time.Time) ([]string, error) {
+	if m.failover {
+		var result []string
+		err := m.failoverCall(ctx, "label_names", func(api API) (err error) {
+			result, err = api.LabelNames(ctx, matchers, startTime, endTime)
+			return err
+		})
+		return result, err
+	}
+
+	childContext, childContextCancel := context.WithCancel(ctx)
+	defer childContextCancel()
+
+	type chanResult struct {
+		v   []string
+		err error
+		ls  model.Fingerprint
+		i   int
+	}
+
+	resultChan := make(chan chanResult, len(m.apis))
+	outstandingRequests := make(map[model.Fingerprint]int) // fingerprint -> outstanding
+
+	for i, api := range m.apis {
+		if err := m.pool.Acquire(childContext); err != nil {
+			return nil, err
+		}
+		outstandingRequests[m.apiFingerprints[i]]++
+		go func(i int, retChan chan chanResult, api API) {
+			defer m.pool.Release()
+			start := time.Now()
+			result, err := api.LabelNames(childContext, matchers, startTime, endTime)
+			took := time.Now().Sub(start)
+			err = NormalizePromError(err)
+			m.recordMetric(i, "label_names", err, took.Seconds())
+			retChan <- chanResult{
+				v:   result,
+				err: m.wrapError(i, "label_names", err),
+				ls:  m.apiFingerprints[i],
+				i:   i,
+			}
+		}(i, resultChan, api)
+	}
+
+	// Wait for results as we get them
+	var result []string
+	results := make([][]string, len(m.apis))
+	var lastError error
+	successMap := make(map[model.Fingerprint]int) // fingerprint -> success
+	for i := 0; i < len(m.apis) && !m.quorumReached(outstandingRequests, successMap); i++ {
+		select {
+		case <-ctx.Done():
+			return nil, ContextError(ctx)
+
+		case ret := <-resultChan:
+			outstandingRequests[ret.ls]--
+			if ret.err != nil {
+				// If there aren't enough outstanding requests to possibly succeed, no reason to wait
+				if (outstandingRequests[ret.ls] + successMap[ret.ls]) < m.requiredCount {
+					return nil, ret.err
 				}
+				lastError = ret.err
+			} else {
+				successMap[ret.ls]++
+				results[ret.i] = ret.v
 			}
 		}
 	}
@@ -174,11 +743,39 @@ func (m *MultiAPI) LabelValues(ctx context.Context, label string) (model.LabelVa
 		}
 	}
 
+	// Merge the results in order, so the result doesn't depend on response timing
+	for _, v := range results {
+		if result == nil {
+			result = v
+		} else {
+			result = MergeLabelNames(result, v)
+		}
+	}
+
+	sort.Strings(result)
 	return result, nil
 }
 
 // Query performs a query for the given time.
 func (m *MultiAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	if sub := m.withAffinity(ctx); sub != m {
+		return sub.Query(ctx, query, ts)
+	}
+	if m.failover {
+		var result model.Value
+		err := m.failoverCall(ctx, "query", func(api API) (err error) {
+			result, err = api.Query(ctx, query, ts)
+			return err
+		})
+		if err == nil {
+			err = m.checkMaxSamples(ctx, result)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return sortValueByFingerprint(result), nil
+	}
+
 	childContext, childContextCancel := context.WithCancel(ctx)
 	defer childContextCancel()
 
@@ -186,41 +783,43 @@ func (m *MultiAPI) Query(ctx context.Context, query string, ts time.Time) (model
 		v   model.Value
 		err error
 		ls  model.Fingerprint
+		i   int
 	}
 
-	resultChans := make([]chan chanResult, len(m.apis))
+	resultChan := make(chan chanResult, len(m.apis))
 	outstandingRequests := make(map[model.Fingerprint]int) // fingerprint -> outstanding
 
 	for i, api := range m.apis {
-		resultChans[i] = make(chan chanResult, 1)
+		if err := m.pool.Acquire(childContext); err != nil {
+			return nil, err
+		}
 		outstandingRequests[m.apiFingerprints[i]]++
 		go func(i int, retChan chan chanResult, api API, query string, ts time.Time) {
+			defer m.pool.Release()
 			start := time.Now()
 			result, err := api.Query(childContext, query, ts)
 			took := time.Now().Sub(start)
-			if err != nil {
-				m.recordMetric(i, "query", "error", took.Seconds())
-			} else {
-				m.recordMetric(i, "query", "success", took.Seconds())
-			}
+			err = NormalizePromError(err)
+			m.recordMetric(i, "query", err, took.Seconds())
 			retChan <- chanResult{
 				v:   result,
-				err: NormalizePromError(err),
+				err: m.wrapError(i, "query", err),
 				ls:  m.apiFingerprints[i],
+				i:   i,
 			}
-		}(i, resultChans[i], api, query, ts)
+		}(i, resultChan, api, query, ts)
 	}
 
 	// Wait for results as we get them
-	var result model.Value
+	results := make([]model.Value, len(m.apis))
 	var lastError error
 	successMap := make(map[model.Fingerprint]int) // fingerprint -> success
-	for i := 0; i < len(m.apis); i++ {
+	for i := 0; i < len(m.apis) && !m.quorumReached(outstandingRequests, successMap); i++ {
 		select {
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			return nil, ContextError(ctx)
 
-		case ret := <-resultChans[i]:
+		case ret := <-resultChan:
 			outstandingRequests[ret.ls]--
 			if ret.err != nil {
 				// If there aren't enough outstanding requests to possibly succeed, no reason to wait
@@ -230,15 +829,7 @@ func (m *MultiAPI) Query(ctx context.Context, query string, ts time.Time) (model
 				lastError = ret.err
 			} else {
 				successMap[ret.ls]++
-				if result == nil {
-					result = ret.v
-				} else {
-					var err error
-					result, err = promhttputil.MergeValues(m.antiAffinity, result, ret.v)
-					if err != nil {
-						return nil, err
-					}
-				}
+				results[ret.i] = ret.v
 			}
 		}
 	}
@@ -250,11 +841,29 @@ func (m *MultiAPI) Query(ctx context.Context, query string, ts time.Time) (model
 		}
 	}
 
-	return result, nil
+	return m.mergeResults(ctx, "query", results)
 }
 
 // QueryRange performs a query for the given range.
 func (m *MultiAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, error) {
+	if sub := m.withAffinity(ctx); sub != m {
+		return sub.QueryRange(ctx, query, r)
+	}
+	if m.failover {
+		var result model.Value
+		err := m.failoverCall(ctx, "query_range", func(api API) (err error) {
+			result, err = api.QueryRange(ctx, query, r)
+			return err
+		})
+		if err == nil {
+			err = m.checkMaxSamples(ctx, result)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return sortValueByFingerprint(result), nil
+	}
+
 	childContext, childContextCancel := context.WithCancel(ctx)
 	defer childContextCancel()
 
@@ -262,41 +871,43 @@ func (m *MultiAPI) QueryRange(ctx context.Context, query string, r v1.Range) (mo
 		v   model.Value
 		err error
 		ls  model.Fingerprint
+		i   int
 	}
 
-	resultChans := make([]chan chanResult, len(m.apis))
+	resultChan := make(chan chanResult, len(m.apis))
 	outstandingRequests := make(map[model.Fingerprint]int) // fingerprint -> outstanding
 
 	for i, api := range m.apis {
-		resultChans[i] = make(chan chanResult, 1)
+		if err := m.pool.Acquire(childContext); err != nil {
+			return nil, err
+		}
 		outstandingRequests[m.apiFingerprints[i]]++
 		go func(i int, retChan chan chanResult, api API, query string, r v1.Range) {
+			defer m.pool.Release()
 			start := time.Now()
 			result, err := api.QueryRange(childContext, query, r)
 			took := time.Now().Sub(start)
-			if err != nil {
-				m.recordMetric(i, "query_range", "error", took.Seconds())
-			} else {
-				m.recordMetric(i, "query_range", "success", took.Seconds())
-			}
+			err = NormalizePromError(err)
+			m.recordMetric(i, "query_range", err, took.Seconds())
 			retChan <- chanResult{
 				v:   result,
-				err: NormalizePromError(err),
+				err: m.wrapError(i, "query_range", err),
 				ls:  m.apiFingerprints[i],
+				i:   i,
 			}
-		}(i, resultChans[i], api, query, r)
+		}(i, resultChan, api, query, r)
 	}
 
 	// Wait for results as we get them
-	var result model.Value
+	results := make([]model.Value, len(m.apis))
 	var lastError error
 	successMap := make(map[model.Fingerprint]int) // fingerprint -> success
-	for i := 0; i < len(m.apis); i++ {
+	for i := 0; i < len(m.apis) && !m.quorumReached(outstandingRequests, successMap); i++ {
 		select {
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			return nil, ContextError(ctx)
 
-		case ret := <-resultChans[i]:
+		case ret := <-resultChan:
 			outstandingRequests[ret.ls]--
 			if ret.err != nil {
 				// If there aren't enough outstanding requests to possibly succeed, no reason to wait
@@ -306,15 +917,7 @@ func (m *MultiAPI) QueryRange(ctx context.Context, query string, r v1.Range) (mo
 				lastError = ret.err
 			} else {
 				successMap[ret.ls]++
-				if result == nil {
-					result = ret.v
-				} else {
-					var err error
-					result, err = promhttputil.MergeValues(m.antiAffinity, result, ret.v)
-					if err != nil {
-						return nil, err
-					}
-				}
+				results[ret.i] = ret.v
 			}
 		}
 	}
@@ -326,11 +929,20 @@ func (m *MultiAPI) QueryRange(ctx context.Context, query string, r v1.Range) (mo
 		}
 	}
 
-	return result, nil
+	return m.mergeResults(ctx, "query_range", results)
 }
 
 // Series finds series by label matchers.
 func (m *MultiAPI) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, error) {
+	if m.failover {
+		var result []model.LabelSet
+		err := m.failoverCall(ctx, "series", func(api API) (err error) {
+			result, err = api.Series(ctx, matches, startTime, endTime)
+			return err
+		})
+		return result, err
+	}
+
 	childContext, childContextCancel := context.WithCancel(ctx)
 	defer childContextCancel()
 
@@ -338,41 +950,44 @@ func (m *MultiAPI) Series(ctx context.Context, matches []string, startTime time.
 		v   []model.LabelSet
 		err error
 		ls  model.Fingerprint
+		i   int
 	}
 
-	resultChans := make([]chan chanResult, len(m.apis))
+	resultChan := make(chan chanResult, len(m.apis))
 	outstandingRequests := make(map[model.Fingerprint]int) // fingerprint -> outstanding
 
 	for i, api := range m.apis {
-		resultChans[i] = make(chan chanResult, 1)
+		if err := m.pool.Acquire(childContext); err != nil {
+			return nil, err
+		}
 		outstandingRequests[m.apiFingerprints[i]]++
 		go func(i int, retChan chan chanResult, api API) {
+			defer m.pool.Release()
 			start := time.Now()
 			result, err := api.Series(childContext, matches, startTime, endTime)
 			took := time.Now().Sub(start)
-			if err != nil {
-				m.recordMetric(i, "series", "error", took.Seconds())
-			} else {
-				m.recordMetric(i, "series", "success", took.Seconds())
-			}
+			err = NormalizePromError(err)
+			m.recordMetric(i, "series", err, took.Seconds())
 			retChan <- chanResult{
 				v:   result,
-				err: NormalizePromError(err),
+				err: m.wrapError(i, "series", err),
 				ls:  m.apiFingerprints[i],
+				i:   i,
 			}
-		}(i, resultChans[i], api)
+		}(i, resultChan, api)
 	}
 
 	// Wait for results as we get them
 	var result []model.LabelSet
+	results := make([][]model.LabelSet, len(m.apis))
 	var lastError error
 	successMap := make(map[model.Fingerprint]int) // fingerprint -> success
-	for i := 0; i < len(m.apis); i++ {
+	for i := 0; i < len(m.apis) && !m.quorumReached(outstandingRequests, successMap); i++ {
 		select {
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			return nil, ContextError(ctx)
 
-		case ret := <-resultChans[i]:
+		case ret := <-resultChan:
 			outstandingRequests[ret.ls]--
 			if ret.err != nil {
 				// If there aren't enough outstanding requests to possibly succeed, no reason to wait
@@ -382,11 +997,7 @@ func (m *MultiAPI) Series(ctx context.Context, matches []string, startTime time.
 				lastError = ret.err
 			} else {
 				successMap[ret.ls]++
-				if result == nil {
-					result = ret.v
-				} else {
-					result = MergeLabelSets(result, ret.v)
-				}
+				results[ret.i] = ret.v
 			}
 		}
 	}
@@ -398,11 +1009,38 @@ func (m *MultiAPI) Series(ctx context.Context, matches []string, startTime time.
 		}
 	}
 
+	// Merge the results in order, so the result doesn't depend on response timing
+	for _, v := range results {
+		if result == nil {
+			result = v
+		} else {
+			result = MergeLabelSets(result, v)
+		}
+	}
+
 	return result, nil
 }
 
 // GetValue fetches a `model.Value` which represents the actual collected data
 func (m *MultiAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	if sub := m.withAffinity(ctx); sub != m {
+		return sub.GetValue(ctx, start, end, matchers)
+	}
+	if m.failover {
+		var result model.Value
+		err := m.failoverCall(ctx, "get_value", func(api API) (err error) {
+			result, err = api.GetValue(ctx, start, end, matchers)
+			return err
+		})
+		if err == nil {
+			err = m.checkMaxSamples(ctx, result)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return sortValueByFingerprint(result), nil
+	}
+
 	childContext, childContextCancel := context.WithCancel(ctx)
 	defer childContextCancel()
 
@@ -410,60 +1048,219 @@ func (m *MultiAPI) GetValue(ctx context.Context, start, end time.Time, matchers
 		v   model.Value
 		err error
 		ls  model.Fingerprint
+		i   int
 	}
 
-	resultChans := make([]chan chanResult, len(m.apis))
+	resultChan := make(chan chanResult, len(m.apis))
 	outstandingRequests := make(map[model.Fingerprint]int) // fingerprint -> outstanding
 
 	// Scatter out all the queries
 	for i, api := range m.apis {
-		resultChans[i] = make(chan chanResult, 1)
+		if err := m.pool.Acquire(childContext); err != nil {
+			return nil, err
+		}
 		outstandingRequests[m.apiFingerprints[i]]++
 		go func(i int, retChan chan chanResult, api API) {
+			defer m.pool.Release()
 			queryStart := time.Now()
 			result, err := api.GetValue(childContext, start, end, matchers)
 			took := time.Now().Sub(queryStart)
-			if err != nil {
-				m.recordMetric(i, "get_value", "error", took.Seconds())
+			err = NormalizePromError(err)
+			m.recordMetric(i, "get_value", err, took.Seconds())
+			retChan <- chanResult{
+				v:   result,
+				err: m.wrapError(i, "get_value", err),
+				ls:  m.apiFingerprints[i],
+				i:   i,
+			}
+		}(i, resultChan, api)
+	}
+
+	// Wait for results as we get them
+	results := make([]model.Value, len(m.apis))
+	var lastError error
+	successMap := make(map[model.Fingerprint]int) // fingerprint -> success
+	for i := 0; i < len(m.apis) && !m.quorumReached(outstandingRequests, successMap); i++ {
+		select {
+		case <-ctx.Done():
+			return nil, ContextError(ctx)
+
+		case ret := <-resultChan:
+			outstandingRequests[ret.ls]--
+			if ret.err != nil {
+				// If there aren't enough outstanding requests to possibly succeed, no reason to wait
+				if (outstandingRequests[ret.ls] + successMap[ret.ls]) < m.requiredCount {
+					return nil, ret.err
+				}
+				lastError = ret.err
 			} else {
-				m.recordMetric(i, "get_value", "success", took.Seconds())
+				successMap[ret.ls]++
+				results[ret.i] = ret.v
 			}
+		}
+	}
+
+	// Verify that we hit the requiredCount for all of the buckets
+	for k := range outstandingRequests {
+		if successMap[k] < m.requiredCount {
+			return nil, errors.Wrap(lastError, "Unable to fetch from downstream servers")
+		}
+	}
+
+	return m.mergeResults(ctx, "get_value", results)
+}
+
+// Rules returns a list of alerting and recording rules that are currently loaded.
+func (m *MultiAPI) Rules(ctx context.Context) (v1.RulesResult, error) {
+	if m.failover {
+		var result v1.RulesResult
+		err := m.failoverCall(ctx, "rules", func(api API) (err error) {
+			result, err = api.Rules(ctx)
+			return err
+		})
+		return result, err
+	}
+
+	childContext, childContextCancel := context.WithCancel(ctx)
+	defer childContextCancel()
+
+	type chanResult struct {
+		v   v1.RulesResult
+		err error
+		ls  model.Fingerprint
+		i   int
+	}
+
+	resultChan := make(chan chanResult, len(m.apis))
+	outstandingRequests := make(map[model.Fingerprint]int) // fingerprint -> outstanding
+
+	for i, api := range m.apis {
+		if err := m.pool.Acquire(childContext); err != nil {
+			return v1.RulesResult{}, err
+		}
+		outstandingRequests[m.apiFingerprints[i]]++
+		go func(i int, retChan chan chanResult, api API) {
+			defer m.pool.Release()
+			start := time.Now()
+			result, err := api.Rules(childContext)
+			took := time.Now().Sub(start)
+			err = NormalizePromError(err)
+			m.recordMetric(i, "rules", err, took.Seconds())
 			retChan <- chanResult{
 				v:   result,
-				err: NormalizePromError(err),
+				err: m.wrapError(i, "rules", err),
 				ls:  m.apiFingerprints[i],
+				i:   i,
 			}
-		}(i, resultChans[i], api)
+		}(i, resultChan, api)
 	}
 
 	// Wait for results as we get them
-	var result model.Value
+	var result v1.RulesResult
+	results := make([]v1.RulesResult, len(m.apis))
 	var lastError error
 	successMap := make(map[model.Fingerprint]int) // fingerprint -> success
-	for i := 0; i < len(m.apis); i++ {
+	for i := 0; i < len(m.apis) && !m.quorumReached(outstandingRequests, successMap); i++ {
 		select {
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			return v1.RulesResult{}, ContextError(ctx)
 
-		case ret := <-resultChans[i]:
+		case ret := <-resultChan:
 			outstandingRequests[ret.ls]--
 			if ret.err != nil {
 				// If there aren't enough outstanding requests to possibly succeed, no reason to wait
 				if (outstandingRequests[ret.ls] + successMap[ret.ls]) < m.requiredCount {
-					return nil, ret.err
+					return v1.RulesResult{}, ret.err
 				}
 				lastError = ret.err
 			} else {
 				successMap[ret.ls]++
-				if result == nil {
-					result = ret.v
-				} else {
-					var err error
-					result, err = promhttputil.MergeValues(m.antiAffinity, result, ret.v)
-					if err != nil {
-						return nil, err
-					}
+				results[ret.i] = ret.v
+			}
+		}
+	}
+
+	// Verify that we hit the requiredCount for all of the buckets
+	for k := range outstandingRequests {
+		if successMap[k] < m.requiredCount {
+			return v1.RulesResult{}, errors.Wrap(lastError, "Unable to fetch from downstream servers")
+		}
+	}
+
+	// Merge the results in order, so the result doesn't depend on response timing
+	for _, v := range results {
+		result.Groups = MergeRuleGroups(result.Groups, v.Groups)
+	}
+
+	return result, nil
+}
+
+// Alerts returns a list of all active alerts.
+func (m *MultiAPI) Alerts(ctx context.Context) (v1.AlertsResult, error) {
+	if m.failover {
+		var result v1.AlertsResult
+		err := m.failoverCall(ctx, "alerts", func(api API) (err error) {
+			result, err = api.Alerts(ctx)
+			return err
+		})
+		return result, err
+	}
+
+	childContext, childContextCancel := context.WithCancel(ctx)
+	defer childContextCancel()
+
+	type chanResult struct {
+		v   v1.AlertsResult
+		err error
+		ls  model.Fingerprint
+		i   int
+	}
+
+	resultChan := make(chan chanResult, len(m.apis))
+	outstandingRequests := make(map[model.Fingerprint]int) // fingerprint -> outstanding
+
+	for i, api := range m.apis {
+		if err := m.pool.Acquire(childContext); err != nil {
+			return v1.AlertsResult{}, err
+		}
+		outstandingRequests[m.apiFingerprints[i]]++
+		go func(i int, retChan chan chanResult, api API) {
+			defer m.pool.Release()
+			start := time.Now()
+			result, err := api.Alerts(childContext)
+			took := time.Now().Sub(start)
+			err = NormalizePromError(err)
+			m.recordMetric(i, "alerts", err, took.Seconds())
+			retChan <- chanResult{
+				v:   result,
+				err: m.wrapError(i, "alerts", err),
+				ls:  m.apiFingerprints[i],
+				i:   i,
+			}
+		}(i, resultChan, api)
+	}
+
+	// Wait for results as we get them
+	var result v1.AlertsResult
+	results := make([]v1.AlertsResult, len(m.apis))
+	var lastError error
+	successMap := make(map[model.Fingerprint]int) // fingerprint -> success
+	for i := 0; i < len(m.apis) && !m.quorumReached(outstandingRequests, successMap); i++ {
+		select {
+		case <-ctx.Done():
+			return v1.AlertsResult{}, ContextError(ctx)
+
+		case ret := <-resultChan:
+			outstandingRequests[ret.ls]--
+			if ret.err != nil {
+				// If there aren't enough outstanding requests to possibly succeed, no reason to wait
+				if (outstandingRequests[ret.ls] + successMap[ret.ls]) < m.requiredCount {
+					return v1.AlertsResult{}, ret.err
 				}
+				lastError = ret.err
+			} else {
+				successMap[ret.ls]++
+				results[ret.i] = ret.v
 			}
 		}
 	}
@@ -471,9 +1268,14 @@ func (m *MultiAPI) GetValue(ctx context.Context, start, end time.Time, matchers
 	// Verify that we hit the requiredCount for all of the buckets
 	for k := range outstandingRequests {
 		if successMap[k] < m.requiredCount {
-			return nil, errors.Wrap(lastError, "Unable to fetch from downstream servers")
+			return v1.AlertsResult{}, errors.Wrap(lastError, "Unable to fetch from downstream servers")
 		}
 	}
 
+	// Merge the results in order, so the result doesn't depend on response timing
+	for _, v := range results {
+		result.Alerts = MergeAlerts(result.Alerts, v.Alerts)
+	}
+
 	return result, nil
 }
@@ -3,21 +3,35 @@ package promclient
 import (
 	"context"
 	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"reflect"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/jacksontj/promxy/promhttputil"
 )
 
 type stubAPI struct {
 	labelValues func() model.LabelValues
+	labelNames  func(matchers []string) []string
 	query       func() model.Value
 	queryRange  func() model.Value
 	series      func() []model.LabelSet
 	getValue    func() model.Value
+	rules       func() v1.RulesResult
+	alerts      func() v1.AlertsResult
 }
 
 // LabelValues performs a query for the values of the given label.
@@ -25,6 +39,11 @@ func (s *stubAPI) LabelValues(ctx context.Context, label string) (model.LabelVal
 	return s.labelValues(), nil
 }
 
+// LabelNames returns the label names (optionally scoped by matchers and time range).
+func (s *stubAPI) LabelNames(ctx context.Context, matchers []string, startTime time.Time, endTime time.Time) ([]string, error) {
+	return s.labelNames(matchers), nil
+}
+
 // Query performs a query for the given time.
 func (s *stubAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
 	return s.query(), nil
@@ -45,6 +64,16 @@ func (s *stubAPI) GetValue(ctx context.Context, start, end time.Time, matchers [
 	return s.getValue(), nil
 }
 
+// Rules returns a list of alerting and recording rules that are currently loaded.
+func (s *stubAPI) Rules(ctx context.Context) (v1.RulesResult, error) {
+	return s.rules(), nil
+}
+
+// Alerts returns a list of all active alerts.
+func (s *stubAPI) Alerts(ctx context.Context) (v1.AlertsResult, error) {
+	return s.alerts(), nil
+}
+
 type errorAPI struct {
 	API
 	err error
@@ -65,6 +94,14 @@ func (s *errorAPI) LabelValues(ctx context.Context, label string) (model.LabelVa
 	return s.LabelValues(ctx, label)
 }
 
+// LabelNames returns the label names (optionally scoped by matchers and time range).
+func (s *errorAPI) LabelNames(ctx context.Context, matchers []string, startTime time.Time, endTime time.Time) ([]string, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.LabelNames(ctx, matchers, startTime, endTime)
+}
+
 // Query performs a query for the given time.
 func (s *errorAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
 	if s.err != nil {
@@ -97,6 +134,22 @@ func (s *errorAPI) GetValue(ctx context.Context, start, end time.Time, matchers
 	return s.GetValue(ctx, start, end, matchers)
 }
 
+// Rules returns a list of alerting and recording rules that are currently loaded.
+func (s *errorAPI) Rules(ctx context.Context) (v1.RulesResult, error) {
+	if s.err != nil {
+		return v1.RulesResult{}, s.err
+	}
+	return s.API.Rules(ctx)
+}
+
+// Alerts returns a list of all active alerts.
+func (s *errorAPI) Alerts(ctx context.Context) (v1.AlertsResult, error) {
+	if s.err != nil {
+		return v1.AlertsResult{}, s.err
+	}
+	return s.API.Alerts(ctx)
+}
+
 func TestMultiAPIMerging(t *testing.T) {
 	getSample := func(ls model.LabelSet) *model.Sample {
 		return &model.Sample{
@@ -110,6 +163,9 @@ func TestMultiAPIMerging(t *testing.T) {
 		labelValues: func() model.LabelValues {
 			return model.LabelValues{}
 		},
+		labelNames: func(matchers []string) []string {
+			return []string{model.MetricNameLabel}
+		},
 		query: func() model.Value {
 			return model.Vector{
 				getSample(model.LabelSet{model.MetricNameLabel: "testmetric"}),
@@ -133,14 +189,16 @@ func TestMultiAPIMerging(t *testing.T) {
 	tests := []struct {
 		a           API
 		labelValues model.LabelValues
+		labelNames  []string
 		v           model.Value
 		series      []model.LabelSet
 		err         bool
 	}{
 		// simple passthrough
 		{
-			a: stub,
-			v: stub.query(),
+			a:          stub,
+			labelNames: []string{model.MetricNameLabel},
+			v:          stub.query(),
 			series: []model.LabelSet{
 				{model.MetricNameLabel: "testmetric"},
 			},
@@ -149,6 +207,7 @@ func TestMultiAPIMerging(t *testing.T) {
 		{
 			a:           &AddLabelClient{stub, model.LabelSet{"a": "b"}},
 			labelValues: []model.LabelValue{"b"},
+			labelNames:  []string{model.MetricNameLabel, "a"},
 			v: model.Vector{
 				getSample(model.LabelSet{model.MetricNameLabel: "testmetric", "a": "b"}),
 			},
@@ -163,6 +222,7 @@ func TestMultiAPIMerging(t *testing.T) {
 				&AddLabelClient{stub, model.LabelSet{"a": "2"}},
 			}, model.Time(0), nil, 1),
 			labelValues: []model.LabelValue{"1", "2"},
+			labelNames:  []string{model.MetricNameLabel, "a"},
 			v: model.Vector{
 				getSample(model.LabelSet{model.MetricNameLabel: "testmetric", "a": "1"}),
 				getSample(model.LabelSet{model.MetricNameLabel: "testmetric", "a": "2"}),
@@ -185,6 +245,7 @@ func TestMultiAPIMerging(t *testing.T) {
 				}, model.Time(0), nil, 1),
 			}, model.Time(0), nil, 2),
 			labelValues: []model.LabelValue{"1", "2"},
+			labelNames:  []string{model.MetricNameLabel, "a"},
 			v: model.Vector{
 				getSample(model.LabelSet{model.MetricNameLabel: "testmetric", "a": "1"}),
 				getSample(model.LabelSet{model.MetricNameLabel: "testmetric", "a": "2"}),
@@ -219,11 +280,13 @@ func TestMultiAPIMerging(t *testing.T) {
 				}, model.Time(0), nil, 2),
 			}, model.Time(0), nil, 2),
 			labelValues: []model.LabelValue{"1", "2"},
+			labelNames:  []string{model.MetricNameLabel, "a", "b"},
+			// merged series are ordered by fingerprint
 			v: model.Vector{
+				getSample(model.LabelSet{model.MetricNameLabel: "testmetric", "b": "2"}),
+				getSample(model.LabelSet{model.MetricNameLabel: "testmetric", "b": "1"}),
 				getSample(model.LabelSet{model.MetricNameLabel: "testmetric", "a": "1"}),
 				getSample(model.LabelSet{model.MetricNameLabel: "testmetric", "a": "2"}),
-				getSample(model.LabelSet{model.MetricNameLabel: "testmetric", "b": "1"}),
-				getSample(model.LabelSet{model.MetricNameLabel: "testmetric", "b": "2"}),
 			},
 			series: []model.LabelSet{
 				{model.MetricNameLabel: "testmetric", "a": "1"},
@@ -252,6 +315,7 @@ func TestMultiAPIMerging(t *testing.T) {
 				}, model.Time(0), nil, 1),
 			}, model.Time(0), nil, 2),
 			labelValues: []model.LabelValue{"1", "2"},
+			labelNames:  []string{model.MetricNameLabel, "a"},
 			v: model.Vector{
 				getSample(model.LabelSet{model.MetricNameLabel: "testmetric", "a": "1"}),
 				getSample(model.LabelSet{model.MetricNameLabel: "testmetric", "a": "2"}),
@@ -291,6 +355,7 @@ func TestMultiAPIMerging(t *testing.T) {
 				&AddLabelClient{stub, model.LabelSet{"a": "2"}},
 			}, model.Time(0), nil, 1),
 			labelValues: []model.LabelValue{"1", "2"},
+			labelNames:  []string{model.MetricNameLabel, "a"},
 			v: model.Vector{
 				getSample(model.LabelSet{model.MetricNameLabel: "testmetric", "a": "1"}),
 				getSample(model.LabelSet{model.MetricNameLabel: "testmetric", "a": "2"}),
@@ -308,6 +373,7 @@ func TestMultiAPIMerging(t *testing.T) {
 				&AddLabelClient{stub, model.LabelSet{"a": "2"}},
 			}, model.Time(0), nil, 1),
 			labelValues: []model.LabelValue{"1", "2"},
+			labelNames:  []string{model.MetricNameLabel, "a"},
 			v: model.Vector{
 				getSample(model.LabelSet{model.MetricNameLabel: "testmetric"}),
 				getSample(model.LabelSet{model.MetricNameLabel: "testmetric", "a": "1"}),
@@ -349,6 +415,26 @@ func TestMultiAPIMerging(t *testing.T) {
 				}
 			})
 
+			t.Run("LabelNames", func(t *testing.T) {
+				v, err := test.a.LabelNames(context.TODO(), nil, time.Time{}, time.Time{})
+				if err != nil != test.err {
+					if test.err {
+						t.Fatalf("missing expected err")
+					} else {
+						t.Fatalf("Unexpected Err: %v", err)
+					}
+				}
+				if err == nil {
+					if !reflect.DeepEqual(v, test.labelNames) {
+						t.Fatalf("mismatch in value: \nexpected=%v\nactual=%v", test.labelNames, v)
+					}
+				} else {
+					if test.v != nil {
+						panic("tests that expect errors shouldn't have value set")
+					}
+				}
+			})
+
 			t.Run("Query", func(t *testing.T) {
 				v, err := test.a.Query(context.TODO(), "testmetric", time.Now())
 				if err != nil != test.err {
@@ -441,3 +527,457 @@ func TestMultiAPIMerging(t *testing.T) {
 		})
 	}
 }
+
+// blockingAPI blocks all requests until the context is done
+type blockingAPI struct {
+	API
+}
+
+// Query performs a query for the given time.
+func (s *blockingAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestMultiAPIQuorum(t *testing.T) {
+	stub := &stubAPI{
+		query: func() model.Value {
+			return model.Vector{{Metric: model.Metric{model.MetricNameLabel: "testmetric"}}}
+		},
+	}
+
+	m := NewMultiAPI([]API{&blockingAPI{stub}, stub}, model.Time(0), nil, 1)
+	m.SetQuorum(1)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+	defer cancel()
+
+	v, err := m.Query(ctx, "testmetric", time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if len(v.(model.Vector)) != 1 {
+		t.Fatalf("mismatch in value: %v", v)
+	}
+}
+
+func TestMultiAPITimeout(t *testing.T) {
+	m := NewMultiAPI([]API{&blockingAPI{}}, model.Time(0), nil, 1)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Millisecond)
+	defer cancel()
+
+	_, err := m.Query(ctx, "testmetric", time.Now())
+	if _, ok := err.(promql.ErrQueryTimeout); !ok {
+		t.Fatalf("expected timeout error, got: %v", err)
+	}
+}
+
+func TestMultiAPIMaxLabelValues(t *testing.T) {
+	m := NewMultiAPI([]API{
+		&stubAPI{labelValues: func() model.LabelValues { return model.LabelValues{"d", "b"} }},
+		&stubAPI{labelValues: func() model.LabelValues { return model.LabelValues{"c", "a", "b"} }},
+	}, model.Time(0), nil, 1)
+	m.SetMaxLabelValues(2)
+
+	ctx, warnings := promhttputil.WithWarnings(context.TODO())
+	v, err := m.LabelValues(ctx, "a")
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if !reflect.DeepEqual(v, model.LabelValues{"a", "b"}) {
+		t.Fatalf("mismatch in value: %v", v)
+	}
+	if len(warnings.Warnings()) != 1 {
+		t.Fatalf("expected a truncation warning, got: %v", warnings.Warnings())
+	}
+}
+
+func TestMultiAPIRemoteReadOnlyLabelValues(t *testing.T) {
+	m := NewMultiAPI([]API{
+		&stubAPI{labelValues: func() model.LabelValues { return model.LabelValues{"a"} }},
+		&PromAPIRemoteReadOnly{},
+	}, model.Time(0), nil, 1)
+	m.SetNames([]string{"http://a", "http://b"})
+
+	// The remote_read_only api is skipped with a warning, rather than failing the request
+	ctx, warnings := promhttputil.WithWarnings(context.TODO())
+	v, err := m.LabelValues(ctx, "a")
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if !reflect.DeepEqual(v, model.LabelValues{"a"}) {
+		t.Fatalf("mismatch in value: %v", v)
+	}
+	if len(warnings.Warnings()) != 1 {
+		t.Fatalf("expected a warning, got: %v", warnings.Warnings())
+	}
+}
+
+func TestMultiAPIMaxSamples(t *testing.T) {
+	getMatrix := func(ls model.LabelSet) func() model.Value {
+		return func() model.Value {
+			return model.Matrix{{
+				Metric: model.Metric(ls),
+				Values: []model.SamplePair{{Timestamp: 100, Value: 1}, {Timestamp: 200, Value: 1}},
+			}}
+		}
+	}
+
+	tests := []struct {
+		maxSamples int
+		err        bool
+	}{
+		// disabled
+		{maxSamples: 0},
+		// the merged result has exactly 4 samples
+		{maxSamples: 4},
+		{maxSamples: 3, err: true},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			m := NewMultiAPI([]API{
+				&stubAPI{queryRange: getMatrix(model.LabelSet{"a": "1"})},
+				&stubAPI{queryRange: getMatrix(model.LabelSet{"a": "2"})},
+			}, model.Time(0), nil, 1)
+			m.SetMaxSamples(test.maxSamples)
+
+			ctx, status := promhttputil.WithErrorStatus(context.TODO())
+			_, err := m.QueryRange(ctx, "testmetric", v1.Range{})
+			if test.err {
+				if err != ErrTooManySamples {
+					t.Fatalf("expected ErrTooManySamples, got: %v", err)
+				}
+				// The limit is exceeded by the merge, failing the request as prometheus would
+				if status.Code() != http.StatusUnprocessableEntity || status.Type() != promhttputil.ErrorExec {
+					t.Fatalf("mismatch in error status: code=%d type=%s", status.Code(), status.Type())
+				}
+			} else if err != nil {
+				t.Fatalf("Unexpected Err: %v", err)
+			}
+		})
+	}
+}
+
+func TestMultiAPIWorkerPool(t *testing.T) {
+	pool := NewWorkerPool(1)
+
+	// With the pool's only slot held no requests can be made
+	if err := pool.Acquire(context.TODO()); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+
+	stub := &stubAPI{
+		query: func() model.Value {
+			return model.Vector{{Metric: model.Metric{model.MetricNameLabel: "testmetric"}}}
+		},
+	}
+	m := NewMultiAPI([]API{stub, stub}, model.Time(0), nil, 1)
+	m.SetWorkerPool(pool)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := m.Query(ctx, "testmetric", time.Now()); err == nil {
+		t.Fatalf("expected an error waiting on the pool")
+	}
+
+	// Once released the requests are made, one at a time
+	pool.Release()
+	v, err := m.Query(context.TODO(), "testmetric", time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if len(v.(model.Vector)) != 1 {
+		t.Fatalf("mismatch in value: %v", v)
+	}
+}
+
+func TestMetricStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status string
+	}{
+		{nil, MetricStatusSuccess},
+		{fmt.Errorf("some error"), MetricStatusError},
+		{context.DeadlineExceeded, MetricStatusTimeout},
+		{context.Canceled, MetricStatusCanceled},
+		{&url.Error{Op: "Get", URL: "http://localhost", Err: context.DeadlineExceeded}, MetricStatusTimeout},
+		{promql.ErrQueryCanceled("query"), MetricStatusCanceled},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if status := MetricStatus(NormalizePromError(test.err)); status != test.status {
+				t.Fatalf("mismatch in status expected=%s actual=%s", test.status, status)
+			}
+		})
+	}
+}
+
+func TestMultiAPIDownstreamError(t *testing.T) {
+	downstreamErr := fmt.Errorf("connection refused")
+	m := NewMultiAPI([]API{&errorAPI{err: downstreamErr}}, model.Time(0), nil, 1)
+	m.SetNames([]string{"https://prom-a"})
+
+	_, err := m.Query(context.TODO(), "testmetric", time.Now())
+	if err == nil || err.Error() != "querying https://prom-a (query): connection refused" {
+		t.Fatalf("mismatch in error: %v", err)
+	}
+	if errors.Cause(err) != downstreamErr {
+		t.Fatalf("underlying error not preserved: %v", err)
+	}
+
+	// Typed errors are unwrapped so the API returns the proper error type
+	timeoutErr := &DownstreamError{"query", "https://prom-a", promql.ErrQueryTimeout("downstream request")}
+	if _, ok := PromError(errors.Wrap(timeoutErr, "Unable to fetch from downstream servers")).(promql.ErrQueryTimeout); !ok {
+		t.Fatalf("expected timeout error")
+	}
+	if PromError(err) != err {
+		t.Fatalf("expected error to keep its context")
+	}
+}
+
+func TestMultiAPIFailover(t *testing.T) {
+	var calls int
+	stub := &stubAPI{
+		query: func() model.Value {
+			calls++
+			return model.Vector{{Metric: model.Metric{model.MetricNameLabel: "testmetric"}}}
+		},
+	}
+
+	tests := []struct {
+		apis  []API
+		calls int
+		err   bool
+	}{
+		// The first success is returned without querying the rest
+		{[]API{stub, stub}, 1, false},
+		// Errors failover to the next api
+		{[]API{&errorAPI{err: fmt.Errorf("error")}, stub, stub}, 1, false},
+		{[]API{&errorAPI{err: fmt.Errorf("error")}, &errorAPI{err: fmt.Errorf("error")}}, 0, true},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			calls = 0
+			m := NewMultiAPI(test.apis, model.Time(0), nil, 1)
+			m.SetFailover(true)
+
+			v, err := m.Query(context.TODO(), "testmetric", time.Now())
+			if err != nil != test.err {
+				t.Fatalf("mismatch in err expected=%v actual=%v", test.err, err)
+			}
+			if calls != test.calls {
+				t.Fatalf("mismatch in calls expected=%d actual=%d", test.calls, calls)
+			}
+			if err == nil && len(v.(model.Vector)) != 1 {
+				t.Fatalf("mismatch in value: %v", v)
+			}
+		})
+	}
+}
+
+func TestMultiAPIFailoverLatency(t *testing.T) {
+	var called []string
+	getStub := func(name string) API {
+		return &stubAPI{
+			query: func() model.Value {
+				called = append(called, name)
+				return model.Vector{}
+			},
+		}
+	}
+
+	latency := NewLatencyEMA(0.5)
+	latency.Observe("a", 2)
+	latency.Observe("b", 1)
+	latency.Observe("b", 3) // the average of b is now slower than a
+	names := []string{"a", "b", "c"}
+
+	m := NewMultiAPI([]API{getStub("a"), getStub("b"), getStub("c")}, model.Time(0), nil, 1)
+	m.SetFailover(true)
+	m.SetFailoverLatency(func(i int) float64 { return latency.Get(names[i]) })
+
+	// c has no observations so it is tried first, then the fastest
+	if order := m.failoverOrder(context.TODO()); !reflect.DeepEqual(order, []int{2, 0, 1}) {
+		t.Fatalf("mismatch in failover order: %v", order)
+	}
+	if _, err := m.Query(context.TODO(), "testmetric", time.Now()); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if !reflect.DeepEqual(called, []string{"c"}) {
+		t.Fatalf("mismatch in apis called: %v", called)
+	}
+}
+
+// shuffleAPI returns the series from `API` in a random order
+type shuffleAPI struct {
+	API
+}
+
+// Query performs a query for the given time.
+func (s *shuffleAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	v, err := s.API.Query(ctx, query, ts)
+	if err != nil {
+		return nil, err
+	}
+	vector := v.(model.Vector)
+	rand.Shuffle(len(vector), func(i, j int) { vector[i], vector[j] = vector[j], vector[i] })
+	return vector, nil
+}
+
+func TestMultiAPISortByFingerprint(t *testing.T) {
+	stub := &stubAPI{
+		query: func() model.Value {
+			v := make(model.Vector, 20)
+			for i := range v {
+				v[i] = &model.Sample{Metric: model.Metric{model.MetricNameLabel: "testmetric", "i": model.LabelValue(strconv.Itoa(i))}}
+			}
+			return v
+		},
+	}
+
+	m := NewMultiAPI([]API{
+		&shuffleAPI{&AddLabelClient{stub, model.LabelSet{"a": "1"}}},
+		&shuffleAPI{&AddLabelClient{stub, model.LabelSet{"a": "2"}}},
+	}, model.Time(0), nil, 1)
+
+	var first model.Vector
+	for i := 0; i < 10; i++ {
+		v, err := m.Query(context.TODO(), "testmetric", time.Now())
+		if err != nil {
+			t.Fatalf("Unexpected Err: %v", err)
+		}
+		vector := v.(model.Vector)
+		if len(vector) != 40 {
+			t.Fatalf("mismatch in value: %v", v)
+		}
+		if first == nil {
+			first = vector
+			continue
+		}
+		for j := range vector {
+			if vector[j].Metric.Fingerprint() != first[j].Metric.Fingerprint() {
+				t.Fatalf("series order differs between queries\nfirst=%v\nactual=%v", first, vector)
+			}
+		}
+	}
+}
+
+func TestMultiAPIAffinity(t *testing.T) {
+	var l sync.Mutex
+	called := make(map[string]struct{})
+	getStub := func(name string) API {
+		return &stubAPI{
+			query: func() model.Value {
+				l.Lock()
+				defer l.Unlock()
+				called[name] = struct{}{}
+				return model.Vector{}
+			},
+		}
+	}
+	names := []string{"a", "b", "c", "d"}
+	apis := make([]API, len(names))
+	for i, name := range names {
+		apis[i] = getStub(name)
+	}
+
+	metricCalled := make(map[string]struct{})
+	m := NewMultiAPI(apis, model.Time(0), func(i int, api, status string, took float64) {
+		l.Lock()
+		defer l.Unlock()
+		metricCalled[names[i]] = struct{}{}
+	}, 1)
+	m.SetNames(names)
+	m.SetAffinity(2)
+
+	query := func(ctx context.Context) map[string]struct{} {
+		called = make(map[string]struct{})
+		metricCalled = make(map[string]struct{})
+		if _, err := m.Query(ctx, "testmetric", time.Now()); err != nil {
+			t.Fatalf("Unexpected Err: %v", err)
+		}
+		// The metrics must be recorded against the (original) index of the api
+		if !reflect.DeepEqual(called, metricCalled) {
+			t.Fatalf("mismatch in metrics recorded: %v != %v", metricCalled, called)
+		}
+		return called
+	}
+
+	// Queries without a key go to all apis
+	if selected := query(context.TODO()); len(selected) != len(names) {
+		t.Fatalf("expected all apis to be queried, got: %v", selected)
+	}
+
+	// Queries with a key go to the same replicas each time
+	ctx := WithAffinityKey(context.TODO(), "dashboard")
+	selected := query(ctx)
+	if len(selected) != 2 {
+		t.Fatalf("expected 2 apis to be queried, got: %v", selected)
+	}
+	for i := 0; i < 5; i++ {
+		if again := query(ctx); !reflect.DeepEqual(again, selected) {
+			t.Fatalf("mismatch in apis queried for the same key: %v != %v", again, selected)
+		}
+	}
+
+	// Different keys are spread across the replicas
+	all := make(map[string]struct{})
+	for i := 0; i < 20; i++ {
+		for name := range query(WithAffinityKey(context.TODO(), strconv.Itoa(i))) {
+			all[name] = struct{}{}
+		}
+	}
+	if len(all) != len(names) {
+		t.Fatalf("expected keys to be spread across all apis, got: %v", all)
+	}
+}
+
+// histogram returns the sample count and sum of the `call` histogram of `vec`
+func histogram(t *testing.T, vec *prometheus.HistogramVec, call string) (uint64, float64) {
+	var m dto.Metric
+	if err := vec.WithLabelValues(call).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestMultiAPIMergeMetrics(t *testing.T) {
+	stub := &stubAPI{
+		queryRange: func() model.Value {
+			return model.Matrix{
+				{Metric: model.Metric{"i": "1"}, Values: []model.SamplePair{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 1}}},
+				{Metric: model.Metric{"i": "2"}, Values: []model.SamplePair{{Timestamp: 1, Value: 1}}},
+			}
+		},
+	}
+	m := NewMultiAPI([]API{
+		&AddLabelClient{stub, model.LabelSet{"a": "1"}},
+		&AddLabelClient{stub, model.LabelSet{"a": "2"}},
+	}, model.Time(0), nil, 1)
+
+	// Measure the allocations of every merge
+	defer func(interval uint64) { mergeAllocSampleInterval = interval }(mergeAllocSampleInterval)
+	mergeAllocSampleInterval = 1
+
+	seriesCount, seriesSum := histogram(t, mergeSeries, "query_range")
+	samplesCount, samplesSum := histogram(t, mergeSamples, "query_range")
+	allocatedCount, _ := histogram(t, mergeAllocatedBytes, "query_range")
+	if _, err := m.QueryRange(context.TODO(), "testmetric", v1.Range{Start: time.Unix(0, 0), End: time.Unix(2, 0), Step: time.Second}); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+
+	// The results of both downstreams are held by the merge
+	if count, sum := histogram(t, mergeSeries, "query_range"); count != seriesCount+1 || sum != seriesSum+4 {
+		t.Fatalf("mismatch in merge series: count=%d sum=%v", count-seriesCount, sum-seriesSum)
+	}
+	if count, sum := histogram(t, mergeSamples, "query_range"); count != samplesCount+1 || sum != samplesSum+6 {
+		t.Fatalf("mismatch in merge samples: count=%d sum=%v", count-samplesCount, sum-samplesSum)
+	}
+	if count, _ := histogram(t, mergeAllocatedBytes, "query_range"); count != allocatedCount+1 {
+		t.Fatalf("merge allocations weren't measured")
+	}
+}
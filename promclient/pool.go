@@ -0,0 +1,151 @@
+package promclient
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// WorkerPool bounds the number of concurrent downstream requests. A single
+// pool is meant to be shared (process-wide) by the MultiAPIs of all server
+// groups so bursts of queries can't spawn an unbounded number of requests.
+// A nil *WorkerPool is unbounded.
+//
+// Requests waiting for capacity are queued by their priority (see
+// WithPriority): capacity that frees up always goes to the highest priority
+// request waiting (in the order they were queued), so high priority requests
+// skip ahead of a queue of lower priority ones. Requests already running are
+// never interrupted.
+type WorkerPool struct {
+	size int
+
+	l       sync.Mutex
+	running int
+	// queues are the requests waiting for capacity, by priority
+	queues map[Priority][]*poolWaiter
+
+	queued func(p Priority, delta float64)
+	waited func(p Priority, seconds float64)
+}
+
+// poolWaiter is a request queued for capacity, `ready` is closed once it has
+// been granted capacity
+type poolWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// NewWorkerPool returns a WorkerPool allowing `size` concurrent requests. A
+// size <= 0 returns a nil (unbounded) pool.
+func NewWorkerPool(size int) *WorkerPool {
+	if size <= 0 {
+		return nil
+	}
+	return &WorkerPool{size: size, queues: make(map[Priority][]*poolWaiter)}
+}
+
+// SetQueueMetrics sets the funcs the pool's queue is instrumented with: `queued`
+// is called with +1 and -1 as requests enter and leave the queue, and `waited`
+// with the time a request waited in the queue (both by the request's priority)
+func (p *WorkerPool) SetQueueMetrics(queued, waited func(p Priority, v float64)) {
+	if p == nil {
+		return
+	}
+	p.queued = queued
+	p.waited = waited
+}
+
+// Acquire blocks until there is capacity for a request (or the context is done)
+func (p *WorkerPool) Acquire(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	p.l.Lock()
+	if p.tryAcquire() {
+		p.l.Unlock()
+		return nil
+	}
+	priority := PriorityFromContext(ctx)
+	w := &poolWaiter{ready: make(chan struct{})}
+	p.queues[priority] = append(p.queues[priority], w)
+	p.l.Unlock()
+
+	if p.queued != nil {
+		p.queued(priority, 1)
+		defer p.queued(priority, -1)
+	}
+	if p.waited != nil {
+		defer func(start time.Time) { p.waited(priority, time.Since(start).Seconds()) }(time.Now())
+	}
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		p.l.Lock()
+		defer p.l.Unlock()
+		// The capacity may have been granted as the context was done, if so pass it on
+		if w.granted {
+			p.release()
+		} else {
+			queue := p.queues[priority]
+			for i, waiter := range queue {
+				if waiter == w {
+					p.queues[priority] = append(queue[:i:i], queue[i+1:]...)
+					break
+				}
+			}
+		}
+		return ContextError(ctx)
+	}
+}
+
+// TryAcquire takes capacity for a request if there is any, without blocking
+func (p *WorkerPool) TryAcquire() bool {
+	if p == nil {
+		return true
+	}
+	p.l.Lock()
+	defer p.l.Unlock()
+	return p.tryAcquire()
+}
+
+// tryAcquire takes capacity if there is any and no request is queued for it,
+// the caller must hold l
+func (p *WorkerPool) tryAcquire() bool {
+	if p.running >= p.size {
+		return false
+	}
+	for _, queue := range p.queues {
+		if len(queue) > 0 {
+			return false
+		}
+	}
+	p.running++
+	return true
+}
+
+// Release releases the capacity taken by a successful Acquire
+func (p *WorkerPool) Release() {
+	if p == nil {
+		return
+	}
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.release()
+}
+
+// release hands the capacity of a finished request to the highest priority
+// request queued, or frees it if none is, the caller must hold l
+func (p *WorkerPool) release() {
+	for _, priority := range priorities {
+		if queue := p.queues[priority]; len(queue) > 0 {
+			w := queue[0]
+			p.queues[priority] = queue[1:]
+			w.granted = true
+			close(w.ready)
+			return
+		}
+	}
+	p.running--
+}
@@ -0,0 +1,65 @@
+package promclient
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolPriority(t *testing.T) {
+	pool := NewWorkerPool(1)
+	var queued int64
+	pool.SetQueueMetrics(func(p Priority, delta float64) { atomic.AddInt64(&queued, int64(delta)) }, nil)
+	if err := pool.Acquire(context.TODO()); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+
+	// Queue a request of each priority (lowest first), and one which gives up
+	acquired := make(chan Priority, 3)
+	for i, p := range []Priority{PriorityLow, PriorityNormal, PriorityHigh} {
+		go func(p Priority) {
+			if err := pool.Acquire(WithPriority(context.TODO(), p)); err != nil {
+				t.Errorf("Unexpected Err: %v", err)
+			}
+			acquired <- p
+		}(p)
+		for atomic.LoadInt64(&queued) != int64(i+1) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	ctx, cancel := context.WithTimeout(WithPriority(context.TODO(), PriorityHigh), 10*time.Millisecond)
+	defer cancel()
+	if err := pool.Acquire(ctx); err == nil {
+		t.Fatalf("expected the queued request to time out")
+	}
+	if pool.TryAcquire() {
+		t.Fatalf("capacity was taken ahead of the queued requests")
+	}
+
+	// The capacity goes to the queued requests by priority
+	for _, expected := range []Priority{PriorityHigh, PriorityNormal, PriorityLow} {
+		pool.Release()
+		if p := <-acquired; p != expected {
+			t.Fatalf("expected the %s priority request to acquire the capacity, got %s", expected, p)
+		}
+	}
+	pool.Release()
+	if !pool.TryAcquire() {
+		t.Fatalf("the capacity wasn't released")
+	}
+	if q := atomic.LoadInt64(&queued); q != 0 {
+		t.Fatalf("unexpected queue depth: %d", q)
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	for _, p := range []Priority{PriorityHigh, PriorityNormal, PriorityLow} {
+		if parsed, err := ParsePriority(p.String()); err != nil || parsed != p {
+			t.Fatalf("mismatch in parsed priority %s: %s %v", p, parsed, err)
+		}
+	}
+	if _, err := ParsePriority("urgent"); err == nil {
+		t.Fatalf("expected an error for an unknown priority")
+	}
+}
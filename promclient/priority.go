@@ -0,0 +1,66 @@
+package promclient
+
+import (
+	"context"
+	"fmt"
+)
+
+// Priority is the priority class of a request, which orders the requests
+// queued for the capacity of a WorkerPool
+type Priority int
+
+const (
+	// PriorityLow is for requests which can wait (e.g. batch or ad-hoc queries)
+	PriorityLow Priority = iota - 1
+	// PriorityNormal is the priority of requests without a priority
+	PriorityNormal
+	// PriorityHigh is for requests which must not be starved (e.g. the
+	// queries of alerting rules)
+	PriorityHigh
+)
+
+// priorities are all the priorities, highest first
+var priorities = []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+// ParsePriority returns the Priority named `s` (high, normal or low)
+func ParsePriority(s string) (Priority, error) {
+	for _, p := range priorities {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return PriorityNormal, fmt.Errorf("unknown priority %q, must be one of high, normal or low", s)
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityHigh:
+		return "high"
+	case PriorityLow:
+		return "low"
+	default:
+		return "normal"
+	}
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a copy of `ctx` whose requests have priority `p`
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityFromContext returns the priority of the requests of `ctx`
+// (PriorityNormal if it has none)
+func PriorityFromContext(ctx context.Context) Priority {
+	p, ok := ctx.Value(priorityKey{}).(Priority)
+	switch {
+	case !ok:
+		return PriorityNormal
+	case p > PriorityHigh:
+		return PriorityHigh
+	case p < PriorityLow:
+		return PriorityLow
+	}
+	return p
+}
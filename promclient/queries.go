@@ -0,0 +1,24 @@
+package promclient
+
+import (
+	"net/http"
+
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+// NewActiveQueryRoundTripper returns an http.RoundTripper which records the
+// requests to the downstreams in the active query of the request's context
+// (see promhttputil.QueryRegistry), so the queries listed show their fan-out
+func NewActiveQueryRoundTripper(rt http.RoundTripper) http.RoundTripper {
+	return &activeQueryRoundTripper{rt}
+}
+
+type activeQueryRoundTripper struct {
+	rt http.RoundTripper
+}
+
+func (rt *activeQueryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	done := promhttputil.AddDownstreamRequest(req.Context(), req.URL.Host)
+	defer done()
+	return rt.rt.RoundTrip(req)
+}
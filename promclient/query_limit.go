@@ -0,0 +1,61 @@
+package promclient
+
+import (
+	"context"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// QueryLimitAPI bounds the number of concurrent data queries (Query,
+// QueryRange and GetValue) to API with Pool, e.g. to protect a small cluster.
+// Each query takes one slot regardless of how many requests it fans out to.
+// Queries over the limit are queued until there is capacity (or their context
+// is done), Queued (if set) is called with +1 and -1 as queries enter and
+// leave the queue.
+type QueryLimitAPI struct {
+	API
+	Pool   *WorkerPool
+	Queued func(delta float64)
+}
+
+// acquire waits for capacity for a query, which must be released with Pool.Release
+func (q *QueryLimitAPI) acquire(ctx context.Context) error {
+	if q.Pool.TryAcquire() {
+		return nil
+	}
+	if q.Queued != nil {
+		q.Queued(1)
+		defer q.Queued(-1)
+	}
+	return q.Pool.Acquire(ctx)
+}
+
+// Query performs a query for the given time.
+func (q *QueryLimitAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	if err := q.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer q.Pool.Release()
+	return q.API.Query(ctx, query, ts)
+}
+
+// QueryRange performs a query for the given range.
+func (q *QueryLimitAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, error) {
+	if err := q.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer q.Pool.Release()
+	return q.API.QueryRange(ctx, query, r)
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (q *QueryLimitAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	if err := q.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer q.Pool.Release()
+	return q.API.GetValue(ctx, start, end, matchers)
+}
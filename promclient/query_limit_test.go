@@ -0,0 +1,62 @@
+package promclient
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestQueryLimitAPI(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	var queued int64
+	api := &QueryLimitAPI{
+		API: &stubAPI{query: func() model.Value {
+			started <- struct{}{}
+			<-release
+			return model.Vector{}
+		}},
+		Pool:   NewWorkerPool(1),
+		Queued: func(delta float64) { atomic.AddInt64(&queued, int64(delta)) },
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err := api.Query(context.TODO(), "up", time.Now())
+		errs <- err
+	}()
+	<-started
+
+	// Queries over the limit are queued until their context is done
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := api.Query(ctx, "up", time.Now()); err == nil {
+		t.Fatalf("expected the queued query to time out")
+	}
+	if q := atomic.LoadInt64(&queued); q != 0 {
+		t.Fatalf("the queue depth wasn't decremented: %d", q)
+	}
+
+	// A queued query runs once the running one is done
+	go func() {
+		_, err := api.Query(context.TODO(), "up", time.Now())
+		errs <- err
+	}()
+	for atomic.LoadInt64(&queued) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	release <- struct{}{}
+	<-started
+	release <- struct{}{}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Unexpected Err: %v", err)
+		}
+	}
+	if q := atomic.LoadInt64(&queued); q != 0 {
+		t.Fatalf("unexpected queue depth: %d", q)
+	}
+}
@@ -0,0 +1,95 @@
+package promclient
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// RangeRoute sends the data queries covering at least MinRange to API
+type RangeRoute struct {
+	MinRange time.Duration
+	API      API
+}
+
+// NewRangeRouterAPI returns a RangeRouterAPI which sends metadata requests to
+// `api`, data queries to the route with the largest MinRange the query covers
+// and any data queries not covered by a route to `defaultAPI`
+func NewRangeRouterAPI(api, defaultAPI API, routes []RangeRoute) *RangeRouterAPI {
+	sorted := make([]RangeRoute, len(routes))
+	copy(sorted, routes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].MinRange > sorted[j].MinRange
+	})
+	return &RangeRouterAPI{api, defaultAPI, sorted}
+}
+
+// RangeRouterAPI routes data queries (Query, QueryRange and GetValue) by the
+// time range of data they cover, e.g. sending long range queries to a server
+// group with downsampled data. The range of a query is its end - start plus
+// the longest range selector (or the lookback delta) in the query.
+type RangeRouterAPI struct {
+	API
+	defaultAPI API
+	routes     []RangeRoute // sorted by MinRange (largest first)
+}
+
+// route returns the API to send a data query covering `r` to
+func (a *RangeRouterAPI) route(r time.Duration) API {
+	for _, route := range a.routes {
+		if r >= route.MinRange {
+			return route.API
+		}
+	}
+	return a.defaultAPI
+}
+
+// Query performs a query for the given time.
+func (a *RangeRouterAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	return a.route(queryRange(ctx, query)).Query(ctx, query, ts)
+}
+
+// QueryRange performs a query for the given range.
+func (a *RangeRouterAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, error) {
+	return a.route(r.End.Sub(r.Start)+queryRange(ctx, query)).QueryRange(ctx, query, r)
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (a *RangeRouterAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	return a.route(end.Sub(start)).GetValue(ctx, start, end, matchers)
+}
+
+// queryRange returns the longest range selected by any selector in `query`,
+// queries which can't be parsed have a range of 0
+func queryRange(ctx context.Context, query string) time.Duration {
+	expr, err := promql.ParseExpr(query)
+	if err != nil {
+		return 0
+	}
+
+	var maxRange time.Duration
+	// Inspect parallelizes on BinaryExpr
+	l := sync.Mutex{}
+	promql.Inspect(ctx, &promql.EvalStmt{Expr: expr}, func(node promql.Node, _ []promql.Node) error {
+		l.Lock()
+		defer l.Unlock()
+		switch n := node.(type) {
+		case *promql.VectorSelector:
+			if maxRange < promql.LookbackDelta {
+				maxRange = promql.LookbackDelta
+			}
+		case *promql.MatrixSelector:
+			if maxRange < n.Range {
+				maxRange = n.Range
+			}
+		}
+		return nil
+	}, nil)
+	return maxRange
+}
@@ -0,0 +1,59 @@
+package promclient
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+func TestRangeRouterAPI(t *testing.T) {
+	getStub := func(name string) API {
+		value := func() model.Value {
+			return model.Vector{{Metric: model.Metric{"api": model.LabelValue(name)}}}
+		}
+		return &stubAPI{query: value, queryRange: value}
+	}
+
+	day := 24 * time.Hour
+	router := NewRangeRouterAPI(getStub("all"), getStub("raw"), []RangeRoute{
+		{MinRange: 7 * day, API: getStub("7d")},
+		{MinRange: 30 * day, API: getStub("30d")},
+	})
+
+	tests := []struct {
+		query string
+		r     time.Duration // 0 is an instant query
+		api   string
+	}{
+		{"testmetric", 0, "raw"},
+		{"testmetric", day, "raw"},
+		{"testmetric", 7 * day, "7d"},
+		{"testmetric", 60 * day, "30d"},
+		// Range selectors are part of the range
+		{"rate(testmetric[14d])", 0, "7d"},
+		{"rate(testmetric[14d])", 20 * day, "30d"},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var v model.Value
+			var err error
+			if test.r == 0 {
+				v, err = router.Query(context.TODO(), test.query, time.Now())
+			} else {
+				now := time.Now()
+				v, err = router.QueryRange(context.TODO(), test.query, v1.Range{Start: now.Add(-test.r), End: now, Step: time.Hour})
+			}
+			if err != nil {
+				t.Fatalf("Unexpected Err: %v", err)
+			}
+			if api := string(v.(model.Vector)[0].Metric["api"]); api != test.api {
+				t.Fatalf("mismatch in api expected=%s actual=%s", test.api, api)
+			}
+		})
+	}
+}
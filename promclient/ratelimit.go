@@ -0,0 +1,122 @@
+package promclient
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"golang.org/x/time/rate"
+)
+
+// ErrRateLimited is returned by a (fail fast) RateLimitAPI when its rate limit is exhausted
+var ErrRateLimited = errors.New("downstream request rate limit exceeded")
+
+// NewRateLimiter returns a token bucket limiter allowing `requestsPerSecond`
+// (with a burst of a second's worth of requests)
+func NewRateLimiter(requestsPerSecond float64) *rate.Limiter {
+	burst := int(requestsPerSecond)
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(requestsPerSecond), burst)
+}
+
+// RateLimitAPI limits the rate of requests to API with Limiter. When the limit
+// is exhausted requests either wait for capacity (until their context is done)
+// or, if FailFast is set, fail immediately with ErrRateLimited. Throttled (if
+// set) is called for each request which couldn't be sent immediately.
+type RateLimitAPI struct {
+	API
+	Limiter   *rate.Limiter
+	FailFast  bool
+	Throttled func()
+}
+
+// wait waits until a request is allowed by the limiter
+func (r *RateLimitAPI) wait(ctx context.Context) error {
+	if r.Limiter.Allow() {
+		return nil
+	}
+	if r.Throttled != nil {
+		r.Throttled()
+	}
+	if r.FailFast {
+		return ErrRateLimited
+	}
+	if err := r.Limiter.Wait(ctx); err != nil {
+		if ctx.Err() != nil {
+			return ContextError(ctx)
+		}
+		// The wait would exceed the context's deadline
+		return promql.ErrQueryTimeout("rate limited downstream request")
+	}
+	return nil
+}
+
+// LabelValues performs a query for the values of the given label.
+func (r *RateLimitAPI) LabelValues(ctx context.Context, label string) (model.LabelValues, error) {
+	if err := r.wait(ctx); err != nil {
+		return nil, err
+	}
+	return r.API.LabelValues(ctx, label)
+}
+
+// LabelNames returns the label names (optionally scoped by matchers and time range).
+func (r *RateLimitAPI) LabelNames(ctx context.Context, matchers []string, startTime time.Time, endTime time.Time) ([]string, error) {
+	if err := r.wait(ctx); err != nil {
+		return nil, err
+	}
+	return r.API.LabelNames(ctx, matchers, startTime, endTime)
+}
+
+// Query performs a query for the given time.
+func (r *RateLimitAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	if err := r.wait(ctx); err != nil {
+		return nil, err
+	}
+	return r.API.Query(ctx, query, ts)
+}
+
+// QueryRange performs a query for the given range.
+func (r *RateLimitAPI) QueryRange(ctx context.Context, query string, rng v1.Range) (model.Value, error) {
+	if err := r.wait(ctx); err != nil {
+		return nil, err
+	}
+	return r.API.QueryRange(ctx, query, rng)
+}
+
+// Series finds series by label matchers.
+func (r *RateLimitAPI) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, error) {
+	if err := r.wait(ctx); err != nil {
+		return nil, err
+	}
+	return r.API.Series(ctx, matches, startTime, endTime)
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (r *RateLimitAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	if err := r.wait(ctx); err != nil {
+		return nil, err
+	}
+	return r.API.GetValue(ctx, start, end, matchers)
+}
+
+// Rules returns a list of alerting and recording rules that are currently loaded.
+func (r *RateLimitAPI) Rules(ctx context.Context) (v1.RulesResult, error) {
+	if err := r.wait(ctx); err != nil {
+		return v1.RulesResult{}, err
+	}
+	return r.API.Rules(ctx)
+}
+
+// Alerts returns a list of all active alerts.
+func (r *RateLimitAPI) Alerts(ctx context.Context) (v1.AlertsResult, error) {
+	if err := r.wait(ctx); err != nil {
+		return v1.AlertsResult{}, err
+	}
+	return r.API.Alerts(ctx)
+}
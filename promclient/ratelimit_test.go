@@ -0,0 +1,43 @@
+package promclient
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+)
+
+func TestRateLimitAPI(t *testing.T) {
+	stub := &stubAPI{
+		query: func() model.Value { return model.Vector{} },
+	}
+
+	var throttled int
+	// 1 request per hour, so only the burst of 1 is allowed
+	limiter := NewRateLimiter(1.0 / 3600)
+
+	// Fail fast returns an error once the limit is exhausted
+	api := &RateLimitAPI{stub, limiter, true, func() { throttled++ }}
+	if _, err := api.Query(context.TODO(), "testmetric", time.Now()); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if _, err := api.Query(context.TODO(), "testmetric", time.Now()); err != ErrRateLimited {
+		t.Fatalf("expected ErrRateLimited, got: %v", err)
+	}
+
+	// Otherwise requests wait for capacity until their context is done
+	api.FailFast = false
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := api.Query(ctx, "testmetric", time.Now()); err == nil {
+		t.Fatalf("expected a timeout error")
+	} else if _, ok := err.(promql.ErrQueryTimeout); !ok {
+		t.Fatalf("expected a timeout error, got: %v", err)
+	}
+
+	if throttled != 2 {
+		t.Fatalf("mismatch in throttled requests expected=2 actual=%d", throttled)
+	}
+}
@@ -0,0 +1,102 @@
+package promclient
+
+import (
+	"context"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/relabel"
+)
+
+// RelabelClient proxies a client and applies the given relabel configs to the
+// labelsets of all results (dropping any series the relabeling drops)
+type RelabelClient struct {
+	API
+	RelabelConfigs []*config.RelabelConfig
+}
+
+// Key returns a labelset used to determine other api clients that are the "same"
+func (c *RelabelClient) Key() model.LabelSet {
+	if apiLabels, ok := c.API.(APILabels); ok {
+		return apiLabels.Key()
+	}
+	return nil
+}
+
+// Query performs a query for the given time.
+func (c *RelabelClient) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	val, err := c.API.Query(ctx, query, ts)
+	if err != nil {
+		return nil, err
+	}
+	return RelabelValue(val, c.RelabelConfigs), nil
+}
+
+// QueryRange performs a query for the given range.
+func (c *RelabelClient) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, error) {
+	val, err := c.API.QueryRange(ctx, query, r)
+	if err != nil {
+		return nil, err
+	}
+	return RelabelValue(val, c.RelabelConfigs), nil
+}
+
+// Series finds series by label matchers.
+func (c *RelabelClient) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, error) {
+	v, err := c.API.Series(ctx, matches, startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]model.LabelSet, 0, len(v))
+	for _, lset := range v {
+		if lset = relabel.Process(lset, c.RelabelConfigs...); lset != nil {
+			ret = append(ret, lset)
+		}
+	}
+	return ret, nil
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (c *RelabelClient) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	val, err := c.API.GetValue(ctx, start, end, matchers)
+	if err != nil {
+		return nil, err
+	}
+	return RelabelValue(val, c.RelabelConfigs), nil
+}
+
+// RelabelValue applies the relabel configs to the metric of each series in `a`
+// removing any series which were dropped
+func RelabelValue(a model.Value, cfgs []*config.RelabelConfig) model.Value {
+	switch aTyped := a.(type) {
+	case model.Vector:
+		ret := make(model.Vector, 0, len(aTyped))
+		for _, item := range aTyped {
+			lset := relabel.Process(model.LabelSet(item.Metric), cfgs...)
+			if lset == nil {
+				continue
+			}
+			item.Metric = model.Metric(lset)
+			ret = append(ret, item)
+		}
+		return ret
+
+	case model.Matrix:
+		ret := make(model.Matrix, 0, len(aTyped))
+		for _, item := range aTyped {
+			lset := relabel.Process(model.LabelSet(item.Metric), cfgs...)
+			if lset == nil {
+				continue
+			}
+			item.Metric = model.Metric(lset)
+			ret = append(ret, item)
+		}
+		return ret
+	}
+
+	return a
+}
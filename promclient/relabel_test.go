@@ -0,0 +1,69 @@
+package promclient
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/config"
+)
+
+func TestRelabelValue(t *testing.T) {
+	cfgs := []*config.RelabelConfig{
+		// Normalize instance
+		{
+			SourceLabels: model.LabelNames{"instance"},
+			Separator:    ";",
+			Regex:        config.MustNewRegexp(`([^.]+)\..*`),
+			TargetLabel:  "instance",
+			Replacement:  "$1",
+			Action:       config.RelabelReplace,
+		},
+		// Drop anything from the "drop" job
+		{
+			SourceLabels: model.LabelNames{"job"},
+			Separator:    ";",
+			Regex:        config.MustNewRegexp("drop"),
+			Action:       config.RelabelDrop,
+		},
+	}
+
+	tests := []struct {
+		in  model.Value
+		out model.Value
+	}{
+		{
+			in: model.Vector{
+				{Metric: model.Metric{"instance": "a.cluster1", "job": "keep"}},
+				{Metric: model.Metric{"instance": "a.cluster2", "job": "drop"}},
+			},
+			out: model.Vector{
+				{Metric: model.Metric{"instance": "a", "job": "keep"}},
+			},
+		},
+		{
+			in: model.Matrix{
+				{Metric: model.Metric{"instance": "a.cluster1", "job": "keep"}},
+				{Metric: model.Metric{"instance": "b", "job": "keep"}},
+			},
+			out: model.Matrix{
+				{Metric: model.Metric{"instance": "a", "job": "keep"}},
+				{Metric: model.Metric{"instance": "b", "job": "keep"}},
+			},
+		},
+		{
+			in:  &model.Scalar{Value: 1},
+			out: &model.Scalar{Value: 1},
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			out := RelabelValue(test.in, cfgs)
+			if !reflect.DeepEqual(out, test.out) {
+				t.Fatalf("doesn't match\nexpected=%v\nactual=%v", test.out, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package promclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// NewRemoteReadClient returns a RemoteReadClient for the given URL which will
+// use `client` to make all of its requests
+func NewRemoteReadClient(url string, client *http.Client, timeout time.Duration) *RemoteReadClient {
+	return &RemoteReadClient{
+		url:     url,
+		client:  client,
+		timeout: timeout,
+	}
+}
+
+// RemoteReadClient is a client for the prometheus remote_read API.
+// This is a copy of the read path of upstream's remote.Client, the difference
+// being that upstream creates its own http.Client from config -- which means
+// none of our RoundTripper chain (TLS, auth, headers, etc.) would be applied.
+type RemoteReadClient struct {
+	url     string
+	client  *http.Client
+	timeout time.Duration
+	// sampledOnly is set once the downstream rejected a request accepting
+	// streamed responses (see Read)
+	sampledOnly int32
+}
+
+// The response types a remote read client may accept (the ResponseType enum
+// of prometheus' remote.proto, which is newer than our vendored prompb)
+const (
+	remoteReadSamples           = 0
+	remoteReadStreamedXORChunks = 1
+)
+
+const (
+	// streamedReadContentType is the content type of a streamed (chunked) response
+	streamedReadContentType = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+	// maxFrameSize is the max size of a frame of a streamed response (the
+	// default of prometheus' chunked reader)
+	maxFrameSize = 50 * 1024 * 1024
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Read reads from a remote endpoint. The request accepts both a streamed
+// response (XOR chunks, which are decoded frame by frame rather than
+// buffering a whole compressed response) and a sampled one, the downstream
+// picks the one it supports (prometheus 2.13+ streams). Should a downstream
+// reject the request accepting streamed responses (with a client error), it is
+// retried sampled-only and only sampled responses are requested from then on.
+func (c *RemoteReadClient) Read(ctx context.Context, query *prompb.Query) (*prompb.QueryResult, error) {
+	streamed := atomic.LoadInt32(&c.sampledOnly) == 0
+	result, status, err := c.read(ctx, query, streamed)
+	if err != nil && streamed && status/100 == 4 && status != http.StatusTooManyRequests {
+		if result, _, err = c.read(ctx, query, false); err == nil {
+			logrus.Infof("Remote read of %s rejected a request accepting streamed responses, requesting sampled responses only", c.url)
+			atomic.StoreInt32(&c.sampledOnly, 1)
+		}
+	}
+	return result, err
+}
+
+// read sends the remote read request for `query` (accepting a streamed
+// response if `streamed`), returning its result and the response status
+func (c *RemoteReadClient) read(ctx context.Context, query *prompb.Query, streamed bool) (*prompb.QueryResult, int, error) {
+	req := &prompb.ReadRequest{
+		Queries: []*prompb.Query{
+			query,
+		},
+	}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to marshal read request: %v", err)
+	}
+	if streamed {
+		// The accepted_response_types (field 2) our vendored prompb predates, in order of preference
+		var buf [binary.MaxVarintLen64]byte
+		for _, responseType := range []uint64{remoteReadStreamedXORChunks, remoteReadSamples} {
+			data = append(data, buf[:binary.PutUvarint(buf[:], 2<<3)]...)
+			data = append(data, buf[:binary.PutUvarint(buf[:], responseType)]...)
+		}
+	}
+
+	compressed := snappy.Encode(nil, data)
+	httpReq, err := http.NewRequest("POST", c.url, bytes.NewReader(compressed))
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to create request: %v", err)
+	}
+	httpReq.Header.Add("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("X-Prometheus-Remote-Read-Version", "0.1.0")
+
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	httpResp, err := ctxhttp.Do(ctx, c.client, httpReq)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error sending request: %v", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode/100 != 2 {
+		return nil, httpResp.StatusCode, fmt.Errorf("server returned HTTP status %s", httpResp.Status)
+	}
+
+	if httpResp.Header.Get("Content-Type") == streamedReadContentType {
+		result, err := readChunkedResponse(httpResp.Body)
+		return result, httpResp.StatusCode, err
+	}
+
+	compressed, err = ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, httpResp.StatusCode, fmt.Errorf("error reading response: %v", err)
+	}
+
+	uncompressed, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, httpResp.StatusCode, fmt.Errorf("error reading response: %v", err)
+	}
+
+	var resp prompb.ReadResponse
+	if err := proto.Unmarshal(uncompressed, &resp); err != nil {
+		return nil, httpResp.StatusCode, fmt.Errorf("unable to unmarshal response body: %v", err)
+	}
+
+	if len(resp.Results) != len(req.Queries) {
+		return nil, httpResp.StatusCode, fmt.Errorf("responses: want %d, got %d", len(req.Queries), len(resp.Results))
+	}
+
+	return resp.Results[0], httpResp.StatusCode, nil
+}
+
+// readChunkedResponse returns the QueryResult of the streamed response `body`
+// of a single query: frames of the size of a ChunkedReadResponse message
+// (uvarint) and its CRC32 (castagnoli, big endian) followed by the message.
+// Our vendored prompb predates the messages, so they are decoded from the
+// wire format.
+func readChunkedResponse(body io.Reader) (*prompb.QueryResult, error) {
+	r := bufio.NewReader(body)
+	result := &prompb.QueryResult{}
+	var frame []byte
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading response: %v", err)
+		}
+		if size > maxFrameSize {
+			return nil, fmt.Errorf("response frame of %d bytes exceeds the max of %d bytes", size, maxFrameSize)
+		}
+		var checksum [4]byte
+		if _, err := io.ReadFull(r, checksum[:]); err != nil {
+			return nil, fmt.Errorf("error reading response: %v", err)
+		}
+		if uint64(cap(frame)) < size {
+			frame = make([]byte, size)
+		}
+		frame = frame[:size]
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return nil, fmt.Errorf("error reading response: %v", err)
+		}
+		if crc32.Checksum(frame, castagnoliTable) != binary.BigEndian.Uint32(checksum[:]) {
+			return nil, fmt.Errorf("error reading response: frame checksum mismatch")
+		}
+
+		// ChunkedReadResponse: chunked_series (1), query_index (2)
+		err = forEachProtoField(frame, func(field int, value uint64, data []byte) error {
+			switch field {
+			case 1:
+				series, err := decodeChunkedSeries(data)
+				if err != nil {
+					return err
+				}
+				// Long series may be split across frames
+				if n := len(result.Timeseries); n > 0 && labelProtosEqual(result.Timeseries[n-1].Labels, series.Labels) {
+					result.Timeseries[n-1].Samples = append(result.Timeseries[n-1].Samples, series.Samples...)
+				} else {
+					result.Timeseries = append(result.Timeseries, series)
+				}
+			case 2:
+				if value != 0 {
+					return fmt.Errorf("unexpected query index %d in response", value)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error decoding response: %v", err)
+		}
+	}
+}
+
+// decodeChunkedSeries returns the TimeSeries of the ChunkedSeries message `b`:
+// labels (1) and chunks (2) of which the XOR chunks are decoded
+func decodeChunkedSeries(b []byte) (*prompb.TimeSeries, error) {
+	series := &prompb.TimeSeries{}
+	err := forEachProtoField(b, func(field int, _ uint64, data []byte) error {
+		switch field {
+		case 1:
+			label := &prompb.Label{}
+			if err := forEachProtoField(data, func(field int, _ uint64, data []byte) error {
+				switch field {
+				case 1:
+					label.Name = string(data)
+				case 2:
+					label.Value = string(data)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			series.Labels = append(series.Labels, label)
+		case 2:
+			// Chunk: min_time_ms (1), max_time_ms (2), type (3), data (4)
+			var chunkType uint64
+			var chunkData []byte
+			if err := forEachProtoField(data, func(field int, value uint64, data []byte) error {
+				switch field {
+				case 3:
+					chunkType = value
+				case 4:
+					chunkData = data
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			if chunkenc.Encoding(chunkType) != chunkenc.EncXOR {
+				return fmt.Errorf("unsupported chunk encoding %d", chunkType)
+			}
+			chunk, err := chunkenc.FromData(chunkenc.EncXOR, chunkData)
+			if err != nil {
+				return err
+			}
+			it := chunk.Iterator()
+			for it.Next() {
+				ts, v := it.At()
+				series.Samples = append(series.Samples, &prompb.Sample{Timestamp: ts, Value: v})
+			}
+			return it.Err()
+		}
+		return nil
+	})
+	return series, err
+}
+
+// forEachProtoField calls `f` with each field of the protobuf message `b`,
+// with the value of varint fields or the data of length-delimited fields
+// (the only wire types of the remote read messages)
+func forEachProtoField(b []byte, f func(field int, value uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("invalid message")
+		}
+		b = b[n:]
+		var value uint64
+		var data []byte
+		switch key & 7 {
+		case 0:
+			if value, n = binary.Uvarint(b); n <= 0 {
+				return fmt.Errorf("invalid message")
+			}
+			b = b[n:]
+		case 2:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return fmt.Errorf("invalid message")
+			}
+			data = b[n : n+int(length)]
+			b = b[n+int(length):]
+		default:
+			return fmt.Errorf("invalid message: unsupported wire type %d", key&7)
+		}
+		if err := f(int(key>>3), value, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// labelProtosEqual returns whether the labels `a` and `b` are equal
+func labelProtosEqual(a, b []*prompb.Label) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Value != b[i].Value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package promclient
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestPromAPIRemoteReadOnly(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := proto.Marshal(&prompb.ReadResponse{
+			Results: []*prompb.QueryResult{{
+				Timeseries: []*prompb.TimeSeries{
+					{
+						Labels:  []*prompb.Label{{Name: "__name__", Value: "testmetric"}, {Name: "job", Value: "a"}},
+						Samples: []*prompb.Sample{{Value: 1, Timestamp: 1000}},
+					},
+				},
+			}},
+		})
+		if err != nil {
+			t.Fatalf("Unexpected Err: %v", err)
+		}
+		w.Write(snappy.Encode(nil, data))
+	}))
+	defer srv.Close()
+
+	p := &PromAPIRemoteReadOnly{NewRemoteReadClient(srv.URL, http.DefaultClient, time.Second)}
+
+	// Series is served through remote_read (de-duplicating across matchers)
+	series, err := p.Series(context.TODO(), []string{"testmetric", `{job="a"}`}, time.Unix(0, 0), time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	expected := []model.LabelSet{{"__name__": "testmetric", "job": "a"}}
+	if !reflect.DeepEqual(series, expected) {
+		t.Fatalf("mismatch in series expected=%v actual=%v", expected, series)
+	}
+
+	names, err := p.LabelNames(context.TODO(), []string{"testmetric"}, time.Unix(0, 0), time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"__name__", "job"}) {
+		t.Fatalf("mismatch in label names: %v", names)
+	}
+
+	if _, err := p.Query(context.TODO(), "testmetric", time.Now()); err != ErrRemoteReadOnly {
+		t.Fatalf("expected ErrRemoteReadOnly, got: %v", err)
+	}
+	if _, err := p.LabelValues(context.TODO(), "job"); err != ErrRemoteReadOnly {
+		t.Fatalf("expected ErrRemoteReadOnly, got: %v", err)
+	}
+}
+
+func TestRemoteReadClientSampledFallback(t *testing.T) {
+	var requests, rejected int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		compressed, _ := ioutil.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Fatalf("Unexpected Err: %v", err)
+		}
+		// Reject the requests with accepted_response_types (field 2)
+		accepts := false
+		if err := forEachProtoField(data, func(field int, _ uint64, _ []byte) error {
+			accepts = accepts || field == 2
+			return nil
+		}); err != nil {
+			t.Fatalf("Unexpected Err: %v", err)
+		}
+		if accepts {
+			rejected++
+			http.Error(w, "unknown field", http.StatusBadRequest)
+			return
+		}
+		data, _ = proto.Marshal(&prompb.ReadResponse{Results: []*prompb.QueryResult{{}}})
+		w.Write(snappy.Encode(nil, data))
+	}))
+	defer srv.Close()
+
+	client := NewRemoteReadClient(srv.URL, http.DefaultClient, time.Second)
+	for i := 0; i < 2; i++ {
+		if _, err := client.Read(context.TODO(), &prompb.Query{}); err != nil {
+			t.Fatalf("Unexpected Err: %v", err)
+		}
+	}
+	// Once rejected only sampled responses are requested
+	if requests != 3 || rejected != 1 {
+		t.Fatalf("mismatch in requests: requests=%d rejected=%d", requests, rejected)
+	}
+}
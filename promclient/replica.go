@@ -0,0 +1,232 @@
+package promclient
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+// ReplicaKeyAPI proxies a client whose Key (see APILabels) has the labels of
+// the replica it queries, excluding ReplicaLabels from the Key so a MultiAPI
+// treats the replicas as the "same" and only requires one of them to respond
+type ReplicaKeyAPI struct {
+	API
+	ReplicaLabels []model.LabelName
+}
+
+// Key returns a labelset used to determine other api clients that are the "same"
+func (r *ReplicaKeyAPI) Key() model.LabelSet {
+	apiLabels, ok := r.API.(APILabels)
+	if !ok {
+		return nil
+	}
+	return withoutLabels(apiLabels.Key(), r.ReplicaLabels)
+}
+
+// ReplicaDedupAPI dedups the results of API by their ReplicaLabels (like the
+// replica labels of thanos): the series which are the same once the replica
+// labels are removed are grouped, and a single series of each group is kept
+// (without the replica labels). Of a range, the points of the replicas are
+// unioned, so the gaps of one replica are filled by the others (points closer
+// than AntiAffinity to a point already kept are considered the same scrape).
+// This is an alternative to merging the series of all the hosts by the timing
+// of their points for replicas tagged with a label.
+type ReplicaDedupAPI struct {
+	API
+	ReplicaLabels []model.LabelName
+	AntiAffinity  model.Time
+}
+
+// isReplicaLabel returns whether `name` is one of the ReplicaLabels
+func (r *ReplicaDedupAPI) isReplicaLabel(name string) bool {
+	for _, replicaLabel := range r.ReplicaLabels {
+		if string(replicaLabel) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// LabelValues performs a query for the values of the given label.
+func (r *ReplicaDedupAPI) LabelValues(ctx context.Context, label string) (model.LabelValues, error) {
+	// The replica labels are removed from all results
+	if r.isReplicaLabel(label) {
+		return nil, nil
+	}
+	return r.API.LabelValues(ctx, label)
+}
+
+// LabelNames returns the label names (optionally scoped by matchers and time range).
+func (r *ReplicaDedupAPI) LabelNames(ctx context.Context, matchers []string, startTime time.Time, endTime time.Time) ([]string, error) {
+	v, err := r.API.LabelNames(ctx, matchers, startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(v))
+	for _, name := range v {
+		if !r.isReplicaLabel(name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Query performs a query for the given time.
+func (r *ReplicaDedupAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	v, err := r.API.Query(ctx, query, ts)
+	if err != nil {
+		return nil, err
+	}
+	return DedupReplicas(v, r.ReplicaLabels, r.AntiAffinity), nil
+}
+
+// QueryRange performs a query for the given range.
+func (r *ReplicaDedupAPI) QueryRange(ctx context.Context, query string, rng v1.Range) (model.Value, error) {
+	v, err := r.API.QueryRange(ctx, query, rng)
+	if err != nil {
+		return nil, err
+	}
+	return DedupReplicas(v, r.ReplicaLabels, r.AntiAffinity), nil
+}
+
+// Series finds series by label matchers.
+func (r *ReplicaDedupAPI) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, error) {
+	v, err := r.API.Series(ctx, matches, startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[model.Fingerprint]struct{}, len(v))
+	ret := make([]model.LabelSet, 0, len(v))
+	for _, lset := range v {
+		lset = withoutLabels(lset, r.ReplicaLabels)
+		fp := lset.Fingerprint()
+		if _, ok := seen[fp]; !ok {
+			seen[fp] = struct{}{}
+			ret = append(ret, lset)
+		}
+	}
+	return ret, nil
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (r *ReplicaDedupAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	v, err := r.API.GetValue(ctx, start, end, matchers)
+	if err != nil {
+		return nil, err
+	}
+	return DedupReplicas(v, r.ReplicaLabels, r.AntiAffinity), nil
+}
+
+// Key returns a labelset used to determine other api clients that are the "same"
+func (r *ReplicaDedupAPI) Key() model.LabelSet {
+	if apiLabels, ok := r.API.(APILabels); ok {
+		return withoutLabels(apiLabels.Key(), r.ReplicaLabels)
+	}
+	return nil
+}
+
+// DedupReplicas keeps a single series of the series in `v` which are the same
+// without `replicaLabels` (see ReplicaDedupAPI). The result doesn't depend on
+// the order of the series: of a vector, of the replicas' samples the one whose
+// labels (with the replica labels) have the lowest fingerprint is kept. Of a
+// matrix the replicas' points are merged (with `antiAffinityBuffer`) starting
+// from the replica with the most points, ties broken by the same fingerprint
+// order, and filling its gaps with the points of the others in that order.
+func DedupReplicas(v model.Value, replicaLabels []model.LabelName, antiAffinityBuffer model.Time) model.Value {
+	switch vTyped := v.(type) {
+	case model.Vector:
+		kept := make(map[model.Fingerprint]int, len(vTyped))
+		keptFingerprints := make(map[model.Fingerprint]model.Fingerprint, len(vTyped))
+		ret := make(model.Vector, 0, len(vTyped))
+		for _, sample := range vTyped {
+			fp := sample.Metric.Fingerprint()
+			metric := model.Metric(withoutLabels(model.LabelSet(sample.Metric), replicaLabels))
+			groupFp := metric.Fingerprint()
+			deduped := &model.Sample{Metric: metric, Value: sample.Value, Timestamp: sample.Timestamp}
+			if i, ok := kept[groupFp]; !ok {
+				kept[groupFp] = len(ret)
+				keptFingerprints[groupFp] = fp
+				ret = append(ret, deduped)
+			} else if fp < keptFingerprints[groupFp] {
+				keptFingerprints[groupFp] = fp
+				ret[i] = deduped
+			}
+		}
+		return ret
+
+	case model.Matrix:
+		type replica struct {
+			fp     model.Fingerprint
+			stream *model.SampleStream
+		}
+		groups := make(map[model.Fingerprint]int, len(vTyped))
+		replicas := make([][]replica, 0, len(vTyped))
+		metrics := make([]model.Metric, 0, len(vTyped))
+		for _, stream := range vTyped {
+			metric := model.Metric(withoutLabels(model.LabelSet(stream.Metric), replicaLabels))
+			groupFp := metric.Fingerprint()
+			i, ok := groups[groupFp]
+			if !ok {
+				i = len(replicas)
+				groups[groupFp] = i
+				replicas = append(replicas, nil)
+				metrics = append(metrics, metric)
+			}
+			replicas[i] = append(replicas[i], replica{stream.Metric.Fingerprint(), stream})
+		}
+
+		ret := make(model.Matrix, len(replicas))
+		for i, group := range replicas {
+			sort.Slice(group, func(a, b int) bool {
+				if len(group[a].stream.Values) != len(group[b].stream.Values) {
+					return len(group[a].stream.Values) > len(group[b].stream.Values)
+				}
+				return group[a].fp < group[b].fp
+			})
+			deduped := &model.SampleStream{Metric: metrics[i], Values: group[0].stream.Values}
+			for _, r := range group[1:] {
+				if len(r.stream.Values) == 0 {
+					continue
+				}
+				// The streams have the same labels once the replica labels are removed
+				merged, err := promhttputil.MergeSampleStream(antiAffinityBuffer, deduped, &model.SampleStream{Metric: metrics[i], Values: r.stream.Values})
+				if err != nil {
+					continue
+				}
+				deduped = merged
+			}
+			ret[i] = deduped
+		}
+		return ret
+	}
+	return v
+}
+
+// withoutLabels returns a copy of `lset` without the labels `names` (or
+// `lset` itself if it has none of them)
+func withoutLabels(lset model.LabelSet, names []model.LabelName) model.LabelSet {
+	found := false
+	for _, name := range names {
+		if _, ok := lset[name]; ok {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return lset
+	}
+	ret := make(model.LabelSet, len(lset))
+	for k, v := range lset {
+		ret[k] = v
+	}
+	for _, name := range names {
+		delete(ret, name)
+	}
+	return ret
+}
@@ -0,0 +1,120 @@
+package promclient
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+func TestDedupReplicas(t *testing.T) {
+	replicaLabels := []model.LabelName{"replica"}
+	stream := func(replica string, points int) *model.SampleStream {
+		values := make([]model.SamplePair, points)
+		for i := range values {
+			values[i] = model.SamplePair{Timestamp: model.Time(i * 1000), Value: model.SampleValue(i)}
+		}
+		return &model.SampleStream{Metric: model.Metric{"__name__": "up", "replica": model.LabelValue(replica)}, Values: values}
+	}
+
+	// The points of a series without gaps cover those of the others, whatever the order of the series
+	a, b := stream("a", 2), stream("b", 3)
+	expected := model.Matrix{{Metric: model.Metric{"__name__": "up"}, Values: b.Values}}
+	for _, m := range []model.Matrix{{a, b}, {b, a}} {
+		if v := DedupReplicas(m, replicaLabels, 500); !reflect.DeepEqual(v, expected) {
+			t.Fatalf("mismatch in deduped matrix: expected=%v actual=%v", expected, v)
+		}
+	}
+
+	// Of equally good series, the choice doesn't depend on the order either
+	a, b = stream("a", 3), stream("b", 3)
+	first := DedupReplicas(model.Matrix{a, b}, replicaLabels, 500)
+	if v := DedupReplicas(model.Matrix{b, a}, replicaLabels, 500); !reflect.DeepEqual(v, first) {
+		t.Fatalf("the kept series depends on the order: %v %v", first, v)
+	}
+
+	// Complementary gaps of the replicas (with a skew of their scrapes) are filled
+	withGap := func(replica string, skew model.Time, missed model.Time) *model.SampleStream {
+		s := &model.SampleStream{Metric: model.Metric{"__name__": "up", "replica": model.LabelValue(replica)}}
+		for ts := model.Time(0); ts < 5000; ts += 1000 {
+			if ts != missed {
+				s.Values = append(s.Values, model.SamplePair{Timestamp: ts + skew, Value: model.SampleValue(ts)})
+			}
+		}
+		return s
+	}
+	a, b = withGap("a", 0, 1000), withGap("b", 100, 3000)
+	first = DedupReplicas(model.Matrix{a, b}, replicaLabels, 500)
+	if v := DedupReplicas(model.Matrix{b, a}, replicaLabels, 500); !reflect.DeepEqual(v, first) {
+		t.Fatalf("the merged series depends on the order: %v %v", first, v)
+	}
+	merged := first.(model.Matrix)
+	if len(merged) != 1 || len(merged[0].Values) != 5 {
+		t.Fatalf("the gaps of the replicas weren't filled: %v", merged)
+	}
+	for i, point := range merged[0].Values {
+		if point.Value != model.SampleValue(i*1000) {
+			t.Fatalf("mismatch in merged points: %v", merged[0].Values)
+		}
+	}
+
+	// Replicas missing the same scrape leave a gap
+	a, b = withGap("a", 0, 2000), withGap("b", 100, 2000)
+	if merged := DedupReplicas(model.Matrix{a, b}, replicaLabels, 500).(model.Matrix); len(merged[0].Values) != 4 {
+		t.Fatalf("mismatch in merged points: %v", merged[0].Values)
+	}
+
+	// Series without the replica labels are kept as-is
+	other := &model.Sample{Metric: model.Metric{"__name__": "other"}, Value: 1}
+	vector := model.Vector{
+		{Metric: model.Metric{"__name__": "up", "replica": "a"}, Value: 1},
+		{Metric: model.Metric{"__name__": "up", "replica": "b"}, Value: 1},
+		other,
+	}
+	v := DedupReplicas(vector, replicaLabels, 500).(model.Vector)
+	if len(v) != 2 || !reflect.DeepEqual(v[0].Metric, model.Metric{"__name__": "up"}) || !reflect.DeepEqual(v[1], other) {
+		t.Fatalf("mismatch in deduped vector: %v", v)
+	}
+}
+
+func TestReplicaDedupAPI(t *testing.T) {
+	api := &ReplicaDedupAPI{
+		API: &stubAPI{
+			labelNames: func([]string) []string { return []string{"__name__", "replica"} },
+			series: func() []model.LabelSet {
+				return []model.LabelSet{{"__name__": "up", "replica": "a"}, {"__name__": "up", "replica": "b"}}
+			},
+			queryRange: func() model.Value { return model.Matrix{} },
+		},
+		ReplicaLabels: []model.LabelName{"replica"},
+	}
+
+	names, err := api.LabelNames(context.TODO(), nil, time.Time{}, time.Time{})
+	if err != nil || !reflect.DeepEqual(names, []string{"__name__"}) {
+		t.Fatalf("mismatch in label names: %v %v", names, err)
+	}
+	if values, err := api.LabelValues(context.TODO(), "replica"); err != nil || len(values) != 0 {
+		t.Fatalf("mismatch in replica label values: %v %v", values, err)
+	}
+	series, err := api.Series(context.TODO(), nil, time.Time{}, time.Time{})
+	if err != nil || !reflect.DeepEqual(series, []model.LabelSet{{"__name__": "up"}}) {
+		t.Fatalf("mismatch in series: %v %v", series, err)
+	}
+	if _, err := api.QueryRange(context.TODO(), "up", v1.Range{}); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+}
+
+func TestReplicaKeyAPI(t *testing.T) {
+	replicaLabels := []model.LabelName{"replica"}
+	a := &ReplicaKeyAPI{&AddLabelClient{&stubAPI{}, model.LabelSet{"dc": "x", "replica": "a"}}, replicaLabels}
+	b := &ReplicaKeyAPI{&AddLabelClient{&stubAPI{}, model.LabelSet{"dc": "x", "replica": "b"}}, replicaLabels}
+
+	// The replicas are the "same" to a MultiAPI
+	if !reflect.DeepEqual(a.Key(), model.LabelSet{"dc": "x"}) || a.Key().Fingerprint() != b.Key().Fingerprint() {
+		t.Fatalf("mismatch in keys: %v %v", a.Key(), b.Key())
+	}
+}
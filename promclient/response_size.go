@@ -0,0 +1,92 @@
+package promclient
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var responseBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "server_group_response_bytes",
+	Help:    "Size (in bytes) of the responses of servergroup instances",
+	Buckets: prometheus.ExponentialBuckets(1024, 4, 11), // 1KiB to 1GiB
+}, []string{"host", "call"})
+
+func init() {
+	prometheus.MustRegister(responseBytes)
+}
+
+// responseCall returns the call (named like the calls of the
+// server_group_request_duration_seconds metric) of a request to `path`. The
+// raw data of a GetValue is fetched with a query_range (or remote_read).
+func responseCall(path string) string {
+	switch {
+	case strings.HasSuffix(path, "/api/v1/query"):
+		return "query"
+	case strings.HasSuffix(path, "/api/v1/query_range"):
+		return "query_range"
+	case strings.HasSuffix(path, "/api/v1/series"):
+		return "series"
+	case strings.HasSuffix(path, "/api/v1/labels"):
+		return "label_names"
+	case strings.Contains(path, "/api/v1/label/") && strings.HasSuffix(path, "/values"):
+		return "label_values"
+	case strings.HasSuffix(path, "/api/v1/read"):
+		return "remote_read"
+	case strings.HasSuffix(path, "/api/v1/rules"):
+		return "rules"
+	case strings.HasSuffix(path, "/api/v1/alerts"):
+		return "alerts"
+	}
+	return "other"
+}
+
+// NewResponseSizeRoundTripper returns an http.RoundTripper which records the
+// size of the responses of `rt` (the bytes read from their bodies, once they
+// are closed) in the server_group_response_bytes histogram, by host and call.
+// This catches a downstream returning abnormally large responses.
+func NewResponseSizeRoundTripper(rt http.RoundTripper) http.RoundTripper {
+	return &responseSizeRoundTripper{rt, func(host, call string, size float64) {
+		responseBytes.WithLabelValues(host, call).Observe(size)
+	}}
+}
+
+type responseSizeRoundTripper struct {
+	rt      http.RoundTripper
+	observe func(host, call string, size float64)
+}
+
+func (rt *responseSizeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	host, call := req.URL.Host, responseCall(req.URL.Path)
+	resp.Body = &countingReadCloser{ReadCloser: resp.Body, done: func(size int64) {
+		rt.observe(host, call, float64(size))
+	}}
+	return resp, nil
+}
+
+// countingReadCloser counts the bytes read, calling `done` with the count once
+// it is closed
+type countingReadCloser struct {
+	io.ReadCloser
+	n    int64
+	done func(n int64)
+	once sync.Once
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *countingReadCloser) Close() error {
+	r.once.Do(func() { r.done(r.n) })
+	return r.ReadCloser.Close()
+}
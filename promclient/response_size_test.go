@@ -0,0 +1,47 @@
+package promclient
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponseSizeRoundTripper(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("a", 1000)))
+	}))
+	defer srv.Close()
+
+	type observation struct {
+		host, call string
+		size       float64
+	}
+	var observed []observation
+	client := &http.Client{Transport: &responseSizeRoundTripper{http.DefaultTransport, func(host, call string, size float64) {
+		observed = append(observed, observation{host, call, size})
+	}}}
+
+	for _, path := range []string{"/api/v1/query_range", "/prefix/api/v1/label/job/values"} {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("Unexpected Err: %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		// Closing the body again doesn't record it again
+		resp.Body.Close()
+	}
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	expected := []observation{{host, "query_range", 1000}, {host, "label_values", 1000}}
+	if len(observed) != len(expected) {
+		t.Fatalf("mismatch in observations: expected=%v actual=%v", expected, observed)
+	}
+	for i := range expected {
+		if observed[i] != expected[i] {
+			t.Fatalf("mismatch in observations: expected=%v actual=%v", expected, observed)
+		}
+	}
+}
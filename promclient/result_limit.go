@@ -0,0 +1,111 @@
+package promclient
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+type limitKey struct{}
+
+// WithLimit returns a copy of `ctx` whose Series, LabelNames and LabelValues
+// requests return at most `limit` results (see LimitAPI)
+func WithLimit(ctx context.Context, limit int) context.Context {
+	if limit <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, limitKey{}, limit)
+}
+
+// Limit returns the max number of results of the requests of `ctx` (0 if there is none)
+func Limit(ctx context.Context) int {
+	limit, _ := ctx.Value(limitKey{}).(int)
+	return limit
+}
+
+type afterKey struct{}
+
+// WithAfter returns a copy of `ctx` whose LabelValues requests only return the
+// values after (sorting after) `after`, the cursor of the previous page when
+// paging through the values with WithLimit (see LimitAPI)
+func WithAfter(ctx context.Context, after string) context.Context {
+	if after == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, afterKey{}, after)
+}
+
+// After returns the label value cursor of the requests of `ctx` ("" if there is none)
+func After(ctx context.Context) string {
+	after, _ := ctx.Value(afterKey{}).(string)
+	return after
+}
+
+// LimitAPI truncates the results of the Series, LabelNames and LabelValues
+// requests to API to the limit of their context (see WithLimit). API is
+// expected to be the merged view of all server groups, so the limit bounds
+// the number of results returned rather than the number from each target.
+// The results are sorted before truncation, so the result is deterministic,
+// and a warning is added to the context when results are dropped.
+// LabelValues are paginated with the cursor of their context (see WithAfter):
+// the values after it are returned, so the last value of a truncated page is
+// the cursor of the next page.
+type LimitAPI struct {
+	API
+}
+
+// LabelNames returns the label names (optionally scoped by matchers and time range).
+func (l *LimitAPI) LabelNames(ctx context.Context, matchers []string, startTime time.Time, endTime time.Time) ([]string, error) {
+	v, err := l.API.LabelNames(ctx, matchers, startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+	if limit := Limit(ctx); limit > 0 && len(v) > limit {
+		sort.Strings(v)
+		promhttputil.AddWarning(ctx, truncatedWarning("label names", limit, len(v)))
+		v = v[:limit]
+	}
+	return v, nil
+}
+
+// LabelValues performs a query for the values of the given label.
+func (l *LimitAPI) LabelValues(ctx context.Context, label string) (model.LabelValues, error) {
+	v, err := l.API.LabelValues(ctx, label)
+	if err != nil {
+		return nil, err
+	}
+	if after := After(ctx); after != "" {
+		sort.Sort(v)
+		v = v[sort.Search(len(v), func(i int) bool { return v[i] > model.LabelValue(after) }):]
+	}
+	if limit := Limit(ctx); limit > 0 && len(v) > limit {
+		sort.Sort(v)
+		promhttputil.AddWarning(ctx, truncatedWarning(fmt.Sprintf("label values of %q", label), limit, len(v)))
+		v = v[:limit]
+	}
+	return v, nil
+}
+
+// Series finds series by label matchers.
+func (l *LimitAPI) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, error) {
+	v, err := l.API.Series(ctx, matches, startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+	if limit := Limit(ctx); limit > 0 && len(v) > limit {
+		sort.Slice(v, func(i, j int) bool { return v[i].Before(v[j]) })
+		promhttputil.AddWarning(ctx, truncatedWarning("series", limit, len(v)))
+		v = v[:limit]
+	}
+	return v, nil
+}
+
+// truncatedWarning returns the warning for `what` having been truncated to `limit` of `count` results
+func truncatedWarning(what string, limit, count int) string {
+	return fmt.Sprintf("results truncated: %s truncated to the limit of %d of %d", what, limit, count)
+}
@@ -0,0 +1,96 @@
+package promclient
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+func TestLimitAPI(t *testing.T) {
+	api := &LimitAPI{&stubAPI{
+		labelValues: func() model.LabelValues { return model.LabelValues{"c", "a", "b"} },
+		labelNames:  func([]string) []string { return []string{"job", "__name__", "instance"} },
+		series: func() []model.LabelSet {
+			return []model.LabelSet{{"__name__": "b"}, {"__name__": "a"}}
+		},
+	}}
+
+	// Without a limit everything is returned
+	ctx, warnings := promhttputil.WithWarnings(context.TODO())
+	values, err := api.LabelValues(ctx, "a")
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if len(values) != 3 || len(warnings.Warnings()) != 0 {
+		t.Fatalf("unexpected truncation without a limit: %v %v", values, warnings.Warnings())
+	}
+
+	ctx, warnings = promhttputil.WithWarnings(WithLimit(context.TODO(), 2))
+	values, err = api.LabelValues(ctx, "a")
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if !reflect.DeepEqual(values, model.LabelValues{"a", "b"}) {
+		t.Fatalf("mismatch in label values: %v", values)
+	}
+
+	names, err := api.LabelNames(ctx, nil, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"__name__", "instance"}) {
+		t.Fatalf("mismatch in label names: %v", names)
+	}
+
+	// Series at the limit aren't truncated
+	series, err := api.Series(ctx, nil, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if len(series) != 2 {
+		t.Fatalf("mismatch in series: %v", series)
+	}
+
+	if len(warnings.Warnings()) != 2 {
+		t.Fatalf("expected 2 truncation warnings, got: %v", warnings.Warnings())
+	}
+}
+
+func TestLimitAPIAfter(t *testing.T) {
+	api := &LimitAPI{&stubAPI{
+		labelValues: func() model.LabelValues { return model.LabelValues{"e", "c", "a", "d", "b"} },
+	}}
+
+	// Page through the values, 2 at a time
+	var pages []model.LabelValues
+	after := ""
+	for {
+		values, err := api.LabelValues(WithAfter(WithLimit(context.TODO(), 2), after), "a")
+		if err != nil {
+			t.Fatalf("Unexpected Err: %v", err)
+		}
+		if len(values) == 0 {
+			break
+		}
+		pages = append(pages, values)
+		after = string(values[len(values)-1])
+	}
+	expected := []model.LabelValues{{"a", "b"}, {"c", "d"}, {"e"}}
+	if !reflect.DeepEqual(pages, expected) {
+		t.Fatalf("mismatch in pages expected=%v actual=%v", expected, pages)
+	}
+
+	// A cursor which isn't a value returns the values after it
+	values, err := api.LabelValues(WithAfter(context.TODO(), "bb"), "a")
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if !reflect.DeepEqual(values, model.LabelValues{"c", "d", "e"}) {
+		t.Fatalf("mismatch in label values: %v", values)
+	}
+}
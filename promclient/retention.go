@@ -0,0 +1,65 @@
+package promclient
+
+import (
+	"context"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// RetentionAPI skips the requests to API (which only has data for the last
+// Retention) for time ranges ending before its retention window. Having no
+// data from before the retention is expected, so those requests return an
+// empty result (without a warning) instead of reaching the downstream, where
+// a failure could not be told apart from the missing data.
+type RetentionAPI struct {
+	API
+	Retention time.Duration
+}
+
+// beforeRetention returns whether a time range ending at `end` is entirely before the retention window
+func (r *RetentionAPI) beforeRetention(end time.Time) bool {
+	return !end.IsZero() && end.Before(time.Now().Add(-r.Retention))
+}
+
+// LabelNames returns the label names (optionally scoped by matchers and time range).
+func (r *RetentionAPI) LabelNames(ctx context.Context, matchers []string, startTime time.Time, endTime time.Time) ([]string, error) {
+	if r.beforeRetention(endTime) {
+		return nil, nil
+	}
+	return r.API.LabelNames(ctx, matchers, startTime, endTime)
+}
+
+// Query performs a query for the given time.
+func (r *RetentionAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	if r.beforeRetention(ts) {
+		return nil, nil
+	}
+	return r.API.Query(ctx, query, ts)
+}
+
+// QueryRange performs a query for the given range.
+func (r *RetentionAPI) QueryRange(ctx context.Context, query string, rng v1.Range) (model.Value, error) {
+	if r.beforeRetention(rng.End) {
+		return nil, nil
+	}
+	return r.API.QueryRange(ctx, query, rng)
+}
+
+// Series finds series by label matchers.
+func (r *RetentionAPI) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, error) {
+	if r.beforeRetention(endTime) {
+		return nil, nil
+	}
+	return r.API.Series(ctx, matches, startTime, endTime)
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (r *RetentionAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	if r.beforeRetention(end) {
+		return nil, nil
+	}
+	return r.API.GetValue(ctx, start, end, matchers)
+}
@@ -0,0 +1,44 @@
+package promclient
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+func TestRetentionAPI(t *testing.T) {
+	requests := 0
+	api := &RetentionAPI{
+		API: &stubAPI{
+			query: func() model.Value {
+				requests++
+				return model.Vector{}
+			},
+			queryRange: func() model.Value {
+				requests++
+				return model.Matrix{}
+			},
+		},
+		Retention: time.Hour,
+	}
+
+	now := time.Now()
+	// Requests before the retention window aren't sent
+	if v, err := api.Query(context.TODO(), "up", now.Add(-2*time.Hour)); v != nil || err != nil || requests != 0 {
+		t.Fatalf("unexpected request before the retention: %v %v %d", v, err, requests)
+	}
+	if v, err := api.QueryRange(context.TODO(), "up", v1.Range{Start: now.Add(-3 * time.Hour), End: now.Add(-2 * time.Hour), Step: time.Minute}); v != nil || err != nil || requests != 0 {
+		t.Fatalf("unexpected request before the retention: %v %v %d", v, err, requests)
+	}
+
+	// Requests within (or overlapping) the retention window are
+	if _, err := api.Query(context.TODO(), "up", now); err != nil || requests != 1 {
+		t.Fatalf("expected a request within the retention: %v %d", err, requests)
+	}
+	if _, err := api.QueryRange(context.TODO(), "up", v1.Range{Start: now.Add(-2 * time.Hour), End: now, Step: time.Minute}); err != nil || requests != 2 {
+		t.Fatalf("expected a request overlapping the retention: %v %d", err, requests)
+	}
+}
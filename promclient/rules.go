@@ -0,0 +1,99 @@
+package promclient
+
+import (
+	"bytes"
+	"fmt"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// MergeRuleGroups merges the rule groups in `b` into `a`, de-duplicating any
+// groups that are defined identically (e.g. on both hosts of an HA pair)
+func MergeRuleGroups(a, b []v1.RuleGroup) []v1.RuleGroup {
+	added := make(map[string]struct{}, len(a))
+	for _, group := range a {
+		added[ruleGroupKey(group)] = struct{}{}
+	}
+
+	for _, group := range b {
+		key := ruleGroupKey(group)
+		if _, ok := added[key]; !ok {
+			added[key] = struct{}{}
+			a = append(a, group)
+		}
+	}
+
+	return a
+}
+
+// ruleGroupKey returns a key identifying the definition of the rule group. This
+// intentionally doesn't include the state (alerts, health, etc.) of the rules
+// as that will differ between hosts evaluating the same rules
+func ruleGroupKey(group v1.RuleGroup) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s\xff%s\xff%v", group.Name, group.File, group.Interval)
+	for _, rule := range group.Rules {
+		switch r := rule.(type) {
+		case v1.AlertingRule:
+			fmt.Fprintf(&buf, "\xffalerting\xff%s\xff%s\xff%v\xff%d", r.Name, r.Query, r.Duration, r.Labels.Fingerprint())
+		case v1.RecordingRule:
+			fmt.Fprintf(&buf, "\xffrecording\xff%s\xff%s\xff%d", r.Name, r.Query, r.Labels.Fingerprint())
+		}
+	}
+	return buf.String()
+}
+
+// RulesAddLabelSet adds the labelset `l` to all rules (and alerts) in `result`
+func RulesAddLabelSet(result v1.RulesResult, l model.LabelSet) {
+	addLabels := func(ls model.LabelSet) model.LabelSet {
+		if ls == nil {
+			ls = make(model.LabelSet, len(l))
+		}
+		for k, v := range l {
+			ls[k] = v
+		}
+		return ls
+	}
+
+	for _, group := range result.Groups {
+		for i, rule := range group.Rules {
+			switch r := rule.(type) {
+			case v1.AlertingRule:
+				r.Labels = addLabels(r.Labels)
+				for _, alert := range r.Alerts {
+					alert.Labels = addLabels(alert.Labels)
+				}
+				group.Rules[i] = r
+			case v1.RecordingRule:
+				r.Labels = addLabels(r.Labels)
+				group.Rules[i] = r
+			}
+		}
+	}
+}
+
+// MergeAlerts merges the alerts in `b` into `a`, de-duplicating alerts which
+// are the same (same labels and active at the same time) e.g. an alert firing
+// on both hosts of an HA pair
+func MergeAlerts(a, b []v1.Alert) []v1.Alert {
+	type alertKey struct {
+		fp       model.Fingerprint
+		activeAt int64
+	}
+
+	added := make(map[alertKey]struct{}, len(a))
+	for _, alert := range a {
+		added[alertKey{alert.Labels.Fingerprint(), alert.ActiveAt.UnixNano()}] = struct{}{}
+	}
+
+	for _, alert := range b {
+		key := alertKey{alert.Labels.Fingerprint(), alert.ActiveAt.UnixNano()}
+		if _, ok := added[key]; !ok {
+			added[key] = struct{}{}
+			a = append(a, alert)
+		}
+	}
+
+	return a
+}
@@ -0,0 +1,105 @@
+package promclient
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+func TestMultiAPIRules(t *testing.T) {
+	stub := &stubAPI{
+		rules: func() v1.RulesResult {
+			return v1.RulesResult{Groups: []v1.RuleGroup{
+				{
+					Name: "group",
+					File: "file.rule",
+					Rules: v1.Rules{
+						v1.AlertingRule{
+							Name:   "alert",
+							Query:  "up == 0",
+							Labels: model.LabelSet{"severity": "page"},
+							Alerts: []*v1.Alert{
+								{Labels: model.LabelSet{"instance": "a"}},
+							},
+						},
+						v1.RecordingRule{
+							Name:  "job:up",
+							Query: "sum(up) by (job)",
+						},
+					},
+				},
+			}}
+		},
+	}
+
+	// 2 HA pairs, each pair should be de-duplicated and the pairs tagged with their labels
+	api := NewMultiAPI([]API{
+		&AddLabelClient{stub, model.LabelSet{"sg": "1"}},
+		&AddLabelClient{stub, model.LabelSet{"sg": "1"}},
+		&AddLabelClient{stub, model.LabelSet{"sg": "2"}},
+		&AddLabelClient{stub, model.LabelSet{"sg": "2"}},
+	}, model.Time(0), nil, 1)
+
+	result, err := api.Rules(context.TODO())
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+
+	if len(result.Groups) != 2 {
+		t.Fatalf("expected 2 groups, got %d: %v", len(result.Groups), result.Groups)
+	}
+	for i, group := range result.Groups {
+		sg := model.LabelValue(strconv.Itoa(i + 1))
+		alertingRule := group.Rules[0].(v1.AlertingRule)
+		if !reflect.DeepEqual(alertingRule.Labels, model.LabelSet{"severity": "page", "sg": sg}) {
+			t.Fatalf("mismatch in rule labels: %v", alertingRule.Labels)
+		}
+		if !reflect.DeepEqual(alertingRule.Alerts[0].Labels, model.LabelSet{"instance": "a", "sg": sg}) {
+			t.Fatalf("mismatch in alert labels: %v", alertingRule.Alerts[0].Labels)
+		}
+		recordingRule := group.Rules[1].(v1.RecordingRule)
+		if !reflect.DeepEqual(recordingRule.Labels, model.LabelSet{"sg": sg}) {
+			t.Fatalf("mismatch in rule labels: %v", recordingRule.Labels)
+		}
+	}
+}
+
+func TestMultiAPIAlerts(t *testing.T) {
+	activeAt := time.Unix(100, 0)
+	stub := &stubAPI{
+		alerts: func() v1.AlertsResult {
+			return v1.AlertsResult{Alerts: []v1.Alert{
+				{Labels: model.LabelSet{"alertname": "a"}, ActiveAt: activeAt},
+				{Labels: model.LabelSet{"alertname": "b"}, ActiveAt: activeAt},
+			}}
+		},
+	}
+
+	// 2 HA pairs, each pair should be de-duplicated and the pairs tagged with their labels
+	api := NewMultiAPI([]API{
+		&AddLabelClient{stub, model.LabelSet{"sg": "1"}},
+		&AddLabelClient{stub, model.LabelSet{"sg": "1"}},
+		&AddLabelClient{stub, model.LabelSet{"sg": "2"}},
+		&AddLabelClient{stub, model.LabelSet{"sg": "2"}},
+	}, model.Time(0), nil, 1)
+
+	result, err := api.Alerts(context.TODO())
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+
+	expected := []v1.Alert{
+		{Labels: model.LabelSet{"alertname": "a", "sg": "1"}, ActiveAt: activeAt},
+		{Labels: model.LabelSet{"alertname": "b", "sg": "1"}, ActiveAt: activeAt},
+		{Labels: model.LabelSet{"alertname": "a", "sg": "2"}, ActiveAt: activeAt},
+		{Labels: model.LabelSet{"alertname": "b", "sg": "2"}, ActiveAt: activeAt},
+	}
+	if !reflect.DeepEqual(result.Alerts, expected) {
+		t.Fatalf("mismatch in alerts\nexpected=%v\nactual=%v", expected, result.Alerts)
+	}
+}
@@ -0,0 +1,73 @@
+package promclient
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+type selectLimitKey struct{}
+
+// WithSelectLimit returns a copy of `ctx` whose raw data (GetValue) requests
+// should return at most `limit` series from each downstream. This is a hint
+// for the server groups whose downstreams support a series limit (see the
+// series_limit_param of the servergroups), others ignore it.
+func WithSelectLimit(ctx context.Context, limit int) context.Context {
+	if limit <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, selectLimitKey{}, limit)
+}
+
+// SelectLimit returns the max number of series of each downstream's raw data
+// for the requests of `ctx` (0 if there is none)
+func SelectLimit(ctx context.Context) int {
+	limit, _ := ctx.Value(selectLimitKey{}).(int)
+	return limit
+}
+
+// SelectLimitAPI caps the number of series of the raw data (the GetValue
+// requests promql's Select is served with) of API to MaxSeries. The limit is
+// pushed down to the downstreams which support it (see WithSelectLimit), so
+// they return at most MaxSeries series each instead of everything. As the
+// downstreams' series are merged (and not all downstreams support the limit)
+// the merged result is then truncated in memory, with a warning, if it still
+// has more than MaxSeries series. API is expected to be the merged view of
+// all server groups, a MaxSeries of 0 disables the limit.
+type SelectLimitAPI struct {
+	API
+	MaxSeries int
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (s *SelectLimitAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	if s.MaxSeries <= 0 {
+		return s.API.GetValue(ctx, start, end, matchers)
+	}
+	v, err := s.API.GetValue(WithSelectLimit(ctx, s.MaxSeries), start, end, matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	// The series are sorted before truncation, so the result is deterministic
+	switch vTyped := v.(type) {
+	case model.Matrix:
+		if len(vTyped) > s.MaxSeries {
+			sort.Sort(vTyped)
+			promhttputil.AddWarning(ctx, truncatedWarning("selected series", s.MaxSeries, len(vTyped)))
+			v = vTyped[:s.MaxSeries]
+		}
+	case model.Vector:
+		if len(vTyped) > s.MaxSeries {
+			sort.Sort(vTyped)
+			promhttputil.AddWarning(ctx, truncatedWarning("selected series", s.MaxSeries, len(vTyped)))
+			v = vTyped[:s.MaxSeries]
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,74 @@
+package promclient
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+// selectLimitStubAPI records the select limit of its GetValue requests
+type selectLimitStubAPI struct {
+	*stubAPI
+	limit int
+}
+
+func (s *selectLimitStubAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	s.limit = SelectLimit(ctx)
+	return s.stubAPI.GetValue(ctx, start, end, matchers)
+}
+
+func TestSelectLimitAPI(t *testing.T) {
+	stub := &selectLimitStubAPI{stubAPI: &stubAPI{
+		getValue: func() model.Value {
+			return model.Matrix{
+				{Metric: model.Metric{"__name__": "c"}},
+				{Metric: model.Metric{"__name__": "a"}},
+				{Metric: model.Metric{"__name__": "b"}},
+			}
+		},
+	}}
+
+	// Without a limit everything is returned
+	ctx, warnings := promhttputil.WithWarnings(context.TODO())
+	v, err := (&SelectLimitAPI{stub, 0}).GetValue(ctx, time.Time{}, time.Time{}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if len(v.(model.Matrix)) != 3 || stub.limit != 0 || len(warnings.Warnings()) != 0 {
+		t.Fatalf("unexpected limit without a max: %v %d %v", v, stub.limit, warnings.Warnings())
+	}
+
+	// Series at the limit aren't truncated
+	v, err = (&SelectLimitAPI{stub, 3}).GetValue(ctx, time.Time{}, time.Time{}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if len(v.(model.Matrix)) != 3 || stub.limit != 3 || len(warnings.Warnings()) != 0 {
+		t.Fatalf("unexpected truncation at the limit: %v %d %v", v, stub.limit, warnings.Warnings())
+	}
+
+	// The limit is pushed down, and the merged series are sorted and truncated
+	v, err = (&SelectLimitAPI{stub, 2}).GetValue(ctx, time.Time{}, time.Time{}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if stub.limit != 2 {
+		t.Fatalf("limit not pushed down, got: %d", stub.limit)
+	}
+	expected := model.Matrix{
+		{Metric: model.Metric{"__name__": "a"}},
+		{Metric: model.Metric{"__name__": "b"}},
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Fatalf("mismatch in series: %v", v)
+	}
+	if len(warnings.Warnings()) != 1 {
+		t.Fatalf("expected a truncation warning, got: %v", warnings.Warnings())
+	}
+}
@@ -0,0 +1,141 @@
+package promclient
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+type serverGroupKey struct{}
+
+// WithServerGroup returns a copy of `ctx` whose requests are sent to only the
+// server group named `name` (see ServerGroupRouterAPI)
+func WithServerGroup(ctx context.Context, name string) context.Context {
+	if name == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, serverGroupKey{}, name)
+}
+
+// ServerGroup returns the name of the server group the requests of `ctx` are
+// restricted to ("" if they aren't)
+func ServerGroup(ctx context.Context) string {
+	name, _ := ctx.Value(serverGroupKey{}).(string)
+	return name
+}
+
+type targetSelectorKey struct{}
+
+// WithTargetSelector returns a copy of `ctx` whose requests are sent to only
+// the targets (of any server group) whose labels match all of `matchers`
+func WithTargetSelector(ctx context.Context, matchers []*labels.Matcher) context.Context {
+	if len(matchers) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, targetSelectorKey{}, matchers)
+}
+
+// TargetSelector returns the matchers the labels of the targets the requests
+// of `ctx` are restricted to must match (nil if they aren't)
+func TargetSelector(ctx context.Context) []*labels.Matcher {
+	matchers, _ := ctx.Value(targetSelectorKey{}).([]*labels.Matcher)
+	return matchers
+}
+
+// ServerGroupRouterAPI sends the requests whose context names a server group
+// (see WithServerGroup) to only that group in ServerGroups, bypassing the
+// aggregation across groups (e.g. to find which group returns bad data).
+// Requests without a server group are sent to API.
+type ServerGroupRouterAPI struct {
+	API
+	ServerGroups map[string]API
+}
+
+// route returns the API to send the requests of `ctx` to
+func (s *ServerGroupRouterAPI) route(ctx context.Context) (API, error) {
+	name := ServerGroup(ctx)
+	if name == "" {
+		return s.API, nil
+	}
+	api, ok := s.ServerGroups[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown server_group %q", name)
+	}
+	return api, nil
+}
+
+// LabelNames returns the label names (optionally scoped by matchers and time range).
+func (s *ServerGroupRouterAPI) LabelNames(ctx context.Context, matchers []string, startTime time.Time, endTime time.Time) ([]string, error) {
+	api, err := s.route(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return api.LabelNames(ctx, matchers, startTime, endTime)
+}
+
+// LabelValues performs a query for the values of the given label.
+func (s *ServerGroupRouterAPI) LabelValues(ctx context.Context, label string) (model.LabelValues, error) {
+	api, err := s.route(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return api.LabelValues(ctx, label)
+}
+
+// Query performs a query for the given time.
+func (s *ServerGroupRouterAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	api, err := s.route(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return api.Query(ctx, query, ts)
+}
+
+// QueryRange performs a query for the given range.
+func (s *ServerGroupRouterAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, error) {
+	api, err := s.route(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return api.QueryRange(ctx, query, r)
+}
+
+// Series finds series by label matchers.
+func (s *ServerGroupRouterAPI) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, error) {
+	api, err := s.route(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return api.Series(ctx, matches, startTime, endTime)
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (s *ServerGroupRouterAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	api, err := s.route(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return api.GetValue(ctx, start, end, matchers)
+}
+
+// Rules returns a list of alerting and recording rules that are currently loaded.
+func (s *ServerGroupRouterAPI) Rules(ctx context.Context) (v1.RulesResult, error) {
+	api, err := s.route(ctx)
+	if err != nil {
+		return v1.RulesResult{}, err
+	}
+	return api.Rules(ctx)
+}
+
+// Alerts returns a list of all active alerts.
+func (s *ServerGroupRouterAPI) Alerts(ctx context.Context) (v1.AlertsResult, error) {
+	api, err := s.route(ctx)
+	if err != nil {
+		return v1.AlertsResult{}, err
+	}
+	return api.Alerts(ctx)
+}
@@ -0,0 +1,52 @@
+package promclient
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestServerGroupRouterAPI(t *testing.T) {
+	getStub := func(name string) API {
+		return &stubAPI{
+			query: func() model.Value {
+				return model.Vector{{Metric: model.Metric{"sg": model.LabelValue(name)}}}
+			},
+		}
+	}
+	api := &ServerGroupRouterAPI{getStub("all"), map[string]API{
+		"a": getStub("a"),
+		"b": getStub("b"),
+	}}
+
+	tests := []struct {
+		serverGroup string
+		sg          string // "" is an error
+	}{
+		{"", "all"},
+		{"a", "a"},
+		{"b", "b"},
+		{"c", ""},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			v, err := api.Query(WithServerGroup(context.TODO(), test.serverGroup), "testmetric", time.Now())
+			if test.sg == "" {
+				if err == nil {
+					t.Fatalf("expected an error for an unknown server group")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected Err: %v", err)
+			}
+			if sg := v.(model.Vector)[0].Metric["sg"]; string(sg) != test.sg {
+				t.Fatalf("expected the query to go to %s, went to %s", test.sg, sg)
+			}
+		})
+	}
+}
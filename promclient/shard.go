@@ -0,0 +1,117 @@
+package promclient
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// shardAlphabet are the characters the values of a shard label are assigned to
+// the shards by (see ShardMatchers)
+const shardAlphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// MaxShards is the max number of shards ShardMatchers can partition a label in
+const MaxShards = len(shardAlphabet)
+
+// ShardMatchers returns the matchers partitioning the values of `label` into
+// `shards` disjoint shards which cover all of its values, each series matches
+// exactly one of them. A hash of the values can't be expressed as a matcher,
+// so the values are partitioned by their last character, which varies the
+// most in typical values (e.g. the addresses of instances or the names of
+// pods). Series without the label are in the last shard.
+func ShardMatchers(label model.LabelName, shards int) ([]*labels.Matcher, error) {
+	if shards < 2 || shards > MaxShards {
+		return nil, fmt.Errorf("the number of shards must be between 2 and %d, got %d", MaxShards, shards)
+	}
+	sets := make([]string, shards)
+	for i, c := range shardAlphabet {
+		sets[i%shards] += string(c)
+	}
+
+	matchers := make([]*labels.Matcher, shards)
+	for i := range sets[:shards-1] {
+		matcher, err := labels.NewMatcher(labels.MatchRegexp, string(label), "(?s:.*)["+sets[i]+"]")
+		if err != nil {
+			return nil, err
+		}
+		matchers[i] = matcher
+	}
+	// The last shard has the values ending with any other character (and the empty value)
+	matcher, err := labels.NewMatcher(labels.MatchRegexp, string(label), "|(?s:.*)[^"+strings.Join(sets[:shards-1], "")+"]")
+	if err != nil {
+		return nil, err
+	}
+	matchers[shards-1] = matcher
+	return matchers, nil
+}
+
+// VerticalShardAPI splits the raw data requests (GetValue) to API by series:
+// each is sent as a request per shard (with the shard's matcher, see
+// ShardMatchers) in parallel, and the series of the shards are combined. This
+// reduces the latency of selecting huge numbers of series from a single host,
+// as the host encodes (and we decode) the shards concurrently. Queries aren't
+// split, as their results (e.g. a sum) can't be combined by series. The shards
+// share the WorkerPool capacity taken by the caller (a MultiAPI) for the
+// request, taking more while holding it could deadlock the pool.
+type VerticalShardAPI struct {
+	API
+	Shards []*labels.Matcher
+}
+
+// Key returns a labelset used to determine other api clients that are the "same"
+func (v *VerticalShardAPI) Key() model.LabelSet {
+	if apiLabels, ok := v.API.(APILabels); ok {
+		return apiLabels.Key()
+	}
+	return nil
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (v *VerticalShardAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	if len(v.Shards) == 0 {
+		return v.API.GetValue(ctx, start, end, matchers)
+	}
+
+	// The other shards are canceled once one fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type shardResult struct {
+		i   int
+		v   model.Value
+		err error
+	}
+	resultChan := make(chan shardResult, len(v.Shards))
+	for i, shard := range v.Shards {
+		shardMatchers := make([]*labels.Matcher, 0, len(matchers)+1)
+		shardMatchers = append(append(shardMatchers, matchers...), shard)
+		go func(i int, shardMatchers []*labels.Matcher) {
+			result, err := v.API.GetValue(ctx, start, end, shardMatchers)
+			resultChan <- shardResult{i, result, err}
+		}(i, shardMatchers)
+	}
+
+	results := make([]model.Matrix, len(v.Shards))
+	for range v.Shards {
+		result := <-resultChan
+		if result.err != nil {
+			return nil, result.err
+		}
+		matrix, ok := result.v.(model.Matrix)
+		if !ok {
+			return nil, fmt.Errorf("unexpected result type %T for a shard", result.v)
+		}
+		results[result.i] = matrix
+	}
+
+	// The shards are disjoint, so their series are combined in shard order
+	var matrix model.Matrix
+	for _, shardMatrix := range results {
+		matrix = append(matrix, shardMatrix...)
+	}
+	return matrix, nil
+}
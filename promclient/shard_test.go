@@ -0,0 +1,102 @@
+package promclient
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestShardMatchers(t *testing.T) {
+	values := []string{"", "a", "Z", "10.0.0.1:9090", "pod-7f9c", "host.example.com", "ends-with-_", "ünïcödé", "new\nline"}
+	for shards := 2; shards <= MaxShards; shards++ {
+		matchers, err := ShardMatchers("instance", shards)
+		if err != nil {
+			t.Fatalf("Unexpected Err: %v", err)
+		}
+		// The shards are disjoint and cover all values
+		for _, value := range values {
+			matched := 0
+			for _, matcher := range matchers {
+				if matcher.Matches(value) {
+					matched++
+				}
+			}
+			if matched != 1 {
+				t.Fatalf("value %q matched %d of %d shards", value, matched, shards)
+			}
+		}
+	}
+
+	for _, shards := range []int{0, 1, MaxShards + 1} {
+		if _, err := ShardMatchers("instance", shards); err == nil {
+			t.Fatalf("no error for %d shards", shards)
+		}
+	}
+}
+
+// matcherAPI is a promclient.API whose GetValue returns the series matching the matchers
+type matcherAPI struct {
+	API
+	series   model.Matrix
+	requests chan []*labels.Matcher
+}
+
+func (m *matcherAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	m.requests <- matchers
+	matrix := model.Matrix{}
+SERIES:
+	for _, stream := range m.series {
+		for _, matcher := range matchers {
+			if !matcher.Matches(string(stream.Metric[model.LabelName(matcher.Name)])) {
+				continue SERIES
+			}
+		}
+		matrix = append(matrix, stream)
+	}
+	return matrix, nil
+}
+
+func TestVerticalShardAPI(t *testing.T) {
+	api := &matcherAPI{requests: make(chan []*labels.Matcher, 10)}
+	for i := 0; i < 100; i++ {
+		api.series = append(api.series, &model.SampleStream{Metric: model.Metric{"__name__": "up", "instance": model.LabelValue(fmt.Sprintf("host-%d", i))}})
+	}
+	// A series without the label is in a shard too
+	api.series = append(api.series, &model.SampleStream{Metric: model.Metric{"__name__": "up"}})
+
+	shards, err := ShardMatchers("instance", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharded := &VerticalShardAPI{api, shards}
+	matchers := []*labels.Matcher{{Type: labels.MatchEqual, Name: "__name__", Value: "up"}}
+	v, err := sharded.GetValue(context.TODO(), time.Unix(0, 0), time.Unix(100, 0), matchers)
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+
+	// A request is sent per shard, with the matchers and the shard's matcher
+	if len(api.requests) != 4 {
+		t.Fatalf("expected 4 requests, got %d", len(api.requests))
+	}
+	for len(api.requests) > 0 {
+		if request := <-api.requests; len(request) != 2 || request[0] != matchers[0] {
+			t.Fatalf("mismatch in shard request: %v", request)
+		}
+	}
+
+	// The shards have all the series (once)
+	matrix := v.(model.Matrix)
+	sort.Slice(matrix, func(i, j int) bool { return matrix[i].Metric.Before(matrix[j].Metric) })
+	expected := append(model.Matrix{}, api.series...)
+	sort.Slice(expected, func(i, j int) bool { return expected[i].Metric.Before(expected[j].Metric) })
+	if !reflect.DeepEqual(matrix, expected) {
+		t.Fatalf("mismatch in sharded series expected=%v actual=%v", expected, matrix)
+	}
+}
@@ -0,0 +1,217 @@
+package promclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/jacksontj/promxy/logging"
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+var coalescedCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "coalesced_calls_total",
+	Help: "Number of data calls which shared the downstream requests of an identical concurrent call",
+}, []string{"call"})
+
+func init() {
+	prometheus.MustRegister(coalescedCalls)
+}
+
+// SingleFlight coalesces identical concurrent calls, so they share a single
+// call (a flight) and its result
+type SingleFlight struct {
+	l       sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a call shared by its waiters. Its waiters are guarded by the
+// SingleFlight's lock, its result is set before done is closed.
+type flight struct {
+	done    chan struct{}
+	value   model.Value
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+
+	// The request-scoped state of the call, copied to each waiter (see finish)
+	warnings *promhttputil.Warnings
+	status   *promhttputil.ErrorStatus
+	stats    *promhttputil.Stats
+}
+
+// finish copies the warnings, error status and stats of the (done) flight to
+// the request context `ctx` of a waiter
+func (fl *flight) finish(ctx context.Context) {
+	for _, warning := range fl.warnings.Warnings() {
+		promhttputil.AddWarning(ctx, warning)
+	}
+	if code := fl.status.Code(); code != 0 {
+		promhttputil.SetErrorStatus(ctx, code)
+	}
+	if typ := fl.status.Type(); typ != promhttputil.ErrorNone {
+		promhttputil.SetErrorType(ctx, typ)
+	}
+	if stats := promhttputil.GetStats(ctx); stats != nil && fl.stats != nil {
+		stats.Add(fl.stats)
+	}
+}
+
+// detachedContext has the values of its Context, but not its deadline or
+// cancellation
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// NewSingleFlight returns a SingleFlight with no calls in flight
+func NewSingleFlight() *SingleFlight {
+	return &SingleFlight{flights: make(map[string]*flight)}
+}
+
+// do returns the result of `f`, which is called once for the concurrent calls
+// with the same `key`. The flight doesn't end when a waiter's context is done
+// (e.g. a canceled dashboard panel) as long as there are other waiters, it is
+// canceled once all of them are gone. Explained calls aren't coalesced, they
+// send no data requests and their explain plan is their own.
+func (s *SingleFlight) do(ctx context.Context, call, key string, f func(ctx context.Context) (model.Value, error)) (model.Value, error) {
+	if promhttputil.GetExplain(ctx) != nil {
+		return f(ctx)
+	}
+
+	key = call + "\xff" + key
+	s.l.Lock()
+	fl, ok := s.flights[key]
+	if ok {
+		coalescedCalls.WithLabelValues(call).Inc()
+	} else {
+		// The flight has the values of the first waiter's context (e.g. the
+		// forwarded headers, which are part of the key), but not its cancellation
+		// or its warnings, error status and stats, which it collects for all the waiters
+		flightCtx, cancel := context.WithCancel(detachedContext{ctx})
+		fl = &flight{done: make(chan struct{}), cancel: cancel}
+		flightCtx, fl.warnings = promhttputil.WithWarnings(flightCtx)
+		flightCtx, fl.status = promhttputil.WithErrorStatus(flightCtx)
+		if promhttputil.GetStats(ctx) != nil {
+			flightCtx, fl.stats = promhttputil.WithStats(flightCtx)
+		}
+		s.flights[key] = fl
+		go func() {
+			defer cancel()
+			value, err := f(flightCtx)
+			s.l.Lock()
+			s.remove(key, fl)
+			s.l.Unlock()
+			fl.value, fl.err = value, err
+			close(fl.done)
+		}()
+	}
+	fl.waiters++
+	s.l.Unlock()
+
+	select {
+	case <-fl.done:
+		fl.finish(ctx)
+		if fl.err != nil {
+			return nil, fl.err
+		}
+		// The result is shared, so each waiter gets its own copy of the series
+		return copySeries(fl.value), nil
+	case <-ctx.Done():
+		s.l.Lock()
+		fl.waiters--
+		if fl.waiters == 0 {
+			// Nobody is waiting for the result anymore, later calls start a new flight
+			s.remove(key, fl)
+			fl.cancel()
+		}
+		s.l.Unlock()
+		return nil, ContextError(ctx)
+	}
+}
+
+// remove removes the flight `fl` of `key` (unless it was already replaced).
+// The caller must hold the lock.
+func (s *SingleFlight) remove(key string, fl *flight) {
+	if s.flights[key] == fl {
+		delete(s.flights, key)
+	}
+}
+
+// SingleFlightAPI coalesces the identical concurrent data calls (Query,
+// QueryRange and GetValue) to API with Flights, so they share the downstream
+// requests of a single call (e.g. the panels of a dashboard issuing the same
+// query as it loads). Calls are identical if they have the same query (or
+// matchers) and time range, and their contexts send the same requests
+// downstream (server group, target selector, forwarded headers other than the
+// request ID, and whether stats are requested).
+type SingleFlightAPI struct {
+	API
+	Flights *SingleFlight
+}
+
+// contextKey returns the key of the request context `ctx`, the parts of the
+// context which change what is sent downstream
+func contextKey(ctx context.Context) string {
+	var b strings.Builder
+	b.WriteString(ServerGroup(ctx))
+	for _, matcher := range TargetSelector(ctx) {
+		b.WriteString("\xff" + matcher.String())
+	}
+	headers := ForwardedHeaders(ctx)
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		if name != http.CanonicalHeaderKey(logging.RequestIDHeader) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "\xff%s=%q", name, headers[name])
+	}
+	// The downstream requests of calls with stats request their stats too
+	if promhttputil.GetStats(ctx) != nil {
+		b.WriteString("\xffstats")
+	}
+	return b.String()
+}
+
+// Query performs a query for the given time.
+func (s *SingleFlightAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	key := fmt.Sprintf("%s\xff%s\xff%d", contextKey(ctx), query, ts.UnixNano())
+	return s.Flights.do(ctx, "query", key, func(ctx context.Context) (model.Value, error) {
+		return s.API.Query(ctx, query, ts)
+	})
+}
+
+// QueryRange performs a query for the given range.
+func (s *SingleFlightAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, error) {
+	key := fmt.Sprintf("%s\xff%s\xff%d\xff%d\xff%s", contextKey(ctx), query, r.Start.UnixNano(), r.End.UnixNano(), r.Step)
+	return s.Flights.do(ctx, "query_range", key, func(ctx context.Context) (model.Value, error) {
+		return s.API.QueryRange(ctx, query, r)
+	})
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (s *SingleFlightAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	matcherString, err := promhttputil.MatcherToString(matchers)
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%s\xff%s\xff%d\xff%d", contextKey(ctx), matcherString, start.UnixNano(), end.UnixNano())
+	return s.Flights.do(ctx, "get_value", key, func(ctx context.Context) (model.Value, error) {
+		return s.API.GetValue(ctx, start, end, matchers)
+	})
+}
@@ -0,0 +1,258 @@
+package promclient
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+// flightAPI is a promclient.API whose Query blocks until release is closed
+type flightAPI struct {
+	API
+	calls   int32
+	release chan struct{}
+	// canceled is closed if the context of a Query is canceled
+	canceled chan struct{}
+}
+
+func (b *flightAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	atomic.AddInt32(&b.calls, 1)
+	select {
+	case <-b.release:
+		return model.Vector{{Metric: model.Metric{"__name__": "up"}, Value: 1}}, nil
+	case <-ctx.Done():
+		close(b.canceled)
+		return nil, ctx.Err()
+	}
+}
+
+func newFlightAPI() *flightAPI {
+	return &flightAPI{release: make(chan struct{}), canceled: make(chan struct{})}
+}
+
+// waitForWaiters waits until the flight of `f` has `n` waiters
+func waitForWaiters(t *testing.T, f *SingleFlight, n int) {
+	for i := 0; i < 1000; i++ {
+		f.l.Lock()
+		waiters := 0
+		for _, fl := range f.flights {
+			waiters += fl.waiters
+		}
+		f.l.Unlock()
+		if waiters == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d waiters", n)
+}
+
+func TestSingleFlightAPI(t *testing.T) {
+	stub := newFlightAPI()
+	flights := NewSingleFlight()
+	api := &SingleFlightAPI{stub, flights}
+
+	var wg sync.WaitGroup
+	results := make([]model.Value, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, err := api.Query(context.TODO(), "up", time.Unix(100, 0))
+			if err != nil {
+				t.Errorf("Unexpected Err: %v", err)
+			}
+			results[i] = v
+		}(i)
+	}
+	waitForWaiters(t, flights, len(results))
+	close(stub.release)
+	wg.Wait()
+
+	if stub.calls != 1 {
+		t.Fatalf("expected the queries to share a single call, got %d", stub.calls)
+	}
+	for _, v := range results {
+		if vector, ok := v.(model.Vector); !ok || len(vector) != 1 {
+			t.Fatalf("mismatch in result: %v", v)
+		}
+	}
+
+	// Once the flight is done identical queries make a new call
+	if _, err := api.Query(context.TODO(), "up", time.Unix(100, 0)); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if stub.calls != 2 {
+		t.Fatalf("expected a new call, got %d calls", stub.calls)
+	}
+}
+
+func TestSingleFlightAPICancel(t *testing.T) {
+	stub := newFlightAPI()
+	flights := NewSingleFlight()
+	api := &SingleFlightAPI{stub, flights}
+
+	// The first query (which started the flight) is canceled, the second one
+	// still gets the result
+	ctx, cancel := context.WithCancel(context.TODO())
+	errCh := make(chan error)
+	go func() {
+		_, err := api.Query(ctx, "up", time.Unix(100, 0))
+		errCh <- err
+	}()
+	waitForWaiters(t, flights, 1)
+	resultCh := make(chan error)
+	go func() {
+		_, err := api.Query(context.TODO(), "up", time.Unix(100, 0))
+		resultCh <- err
+	}()
+	waitForWaiters(t, flights, 2)
+
+	cancel()
+	if err := <-errCh; err == nil {
+		t.Fatalf("expected an error for the canceled query")
+	}
+	close(stub.release)
+	if err := <-resultCh; err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if stub.calls != 1 {
+		t.Fatalf("expected the queries to share a single call, got %d", stub.calls)
+	}
+
+	// Once all the queries are canceled the flight is canceled
+	stub = newFlightAPI()
+	api = &SingleFlightAPI{stub, flights}
+	ctx, cancel = context.WithCancel(context.TODO())
+	go api.Query(ctx, "up", time.Unix(100, 0))
+	waitForWaiters(t, flights, 1)
+	cancel()
+	select {
+	case <-stub.canceled:
+	case <-time.After(time.Second):
+		t.Fatalf("the flight wasn't canceled")
+	}
+}
+
+// stateFlightAPI is a flightAPI whose Query adds a warning, an error status and
+// server group stats to its context, as the downstream requests do
+type stateFlightAPI struct {
+	*flightAPI
+}
+
+func (s *stateFlightAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	promhttputil.AddWarning(ctx, "results truncated")
+	promhttputil.SetErrorStatus(ctx, http.StatusUnprocessableEntity)
+	promhttputil.SetErrorType(ctx, promhttputil.ErrorExec)
+	if stats := promhttputil.GetStats(ctx); stats != nil {
+		stats.AddServerGroup("sg", time.Second, 0, 0)
+	}
+	return s.flightAPI.Query(ctx, query, ts)
+}
+
+func TestSingleFlightAPIRequestState(t *testing.T) {
+	stub := newFlightAPI()
+	flights := NewSingleFlight()
+	api := &SingleFlightAPI{&stateFlightAPI{stub}, flights}
+
+	// Each waiter gets the warnings, error status and stats of the shared call
+	type waiterState struct {
+		warnings *promhttputil.Warnings
+		status   *promhttputil.ErrorStatus
+		stats    *promhttputil.Stats
+	}
+	states := make([]waiterState, 2)
+	var wg sync.WaitGroup
+	for i := range states {
+		ctx, warnings := promhttputil.WithWarnings(context.TODO())
+		ctx, status := promhttputil.WithErrorStatus(ctx)
+		ctx, stats := promhttputil.WithStats(ctx)
+		states[i] = waiterState{warnings, status, stats}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := api.Query(ctx, "up", time.Unix(100, 0)); err != nil {
+				t.Errorf("Unexpected Err: %v", err)
+			}
+		}()
+		waitForWaiters(t, flights, i+1)
+	}
+	close(stub.release)
+	wg.Wait()
+
+	if stub.calls != 1 {
+		t.Fatalf("expected the queries to share a single call, got %d", stub.calls)
+	}
+	for i, state := range states {
+		if warnings := state.warnings.Warnings(); len(warnings) != 1 || warnings[0] != "results truncated" {
+			t.Fatalf("waiter %d: mismatch in warnings: %v", i, warnings)
+		}
+		if state.status.Code() != http.StatusUnprocessableEntity || state.status.Type() != promhttputil.ErrorExec {
+			t.Fatalf("waiter %d: mismatch in error status: code=%d type=%s", i, state.status.Code(), state.status.Type())
+		}
+		if sg := state.stats.ServerGroups()["sg"]; sg.Requests != 1 {
+			t.Fatalf("waiter %d: mismatch in stats: %v", i, state.stats.ServerGroups())
+		}
+	}
+
+	// Calls with and without stats (which send different requests) don't share a flight
+	stub = newFlightAPI()
+	api = &SingleFlightAPI{&stateFlightAPI{stub}, flights}
+	statsCtx, _ := promhttputil.WithStats(context.TODO())
+	for _, ctx := range []context.Context{context.TODO(), statsCtx} {
+		wg.Add(1)
+		go func(ctx context.Context) {
+			defer wg.Done()
+			api.Query(ctx, "up", time.Unix(100, 0))
+		}(ctx)
+	}
+	waitForWaiters(t, flights, 2)
+	close(stub.release)
+	wg.Wait()
+	if stub.calls != 2 {
+		t.Fatalf("expected a call each, got %d", stub.calls)
+	}
+}
+
+func TestSingleFlightAPICopies(t *testing.T) {
+	stub := newFlightAPI()
+	flights := NewSingleFlight()
+	api := &SingleFlightAPI{stub, flights}
+
+	// The waiters modify their results concurrently (as merging them does),
+	// which races (see -race) unless each has its own copy of the series
+	var wg sync.WaitGroup
+	results := make([]model.Value, 2)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, err := api.Query(context.TODO(), "up", time.Unix(100, 0))
+			if err != nil {
+				t.Errorf("Unexpected Err: %v", err)
+				return
+			}
+			sample := v.(model.Vector)[0]
+			sample.Value = model.SampleValue(i)
+			sample.Metric["waiter"] = model.LabelValue(strconv.Itoa(i))
+			results[i] = v
+		}(i)
+	}
+	waitForWaiters(t, flights, len(results))
+	close(stub.release)
+	wg.Wait()
+
+	for i, v := range results {
+		if sample := v.(model.Vector)[0]; sample.Value != model.SampleValue(i) || sample.Metric["waiter"] != model.LabelValue(strconv.Itoa(i)) {
+			t.Fatalf("waiter %d: result modified by another waiter: %v", i, sample)
+		}
+	}
+}
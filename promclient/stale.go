@@ -0,0 +1,192 @@
+package promclient
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+// StaleCacheName is the name of the stale-while-error cache, for flushing
+const StaleCacheName = "stale_while_error"
+
+// NewStaleCache returns a StaleCache holding (up to `size`) results which are
+// served for up to `maxStaleness` after they were fetched
+func NewStaleCache(size int, maxStaleness time.Duration) *StaleCache {
+	return &StaleCache{
+		size:         size,
+		maxStaleness: maxStaleness,
+		entries:      make(map[string]*list.Element),
+		lru:          list.New(),
+	}
+}
+
+// StaleCache is an LRU of the last successful result of each query
+type StaleCache struct {
+	size         int
+	maxStaleness time.Duration
+
+	l       sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type staleCacheEntry struct {
+	key     string
+	fetched time.Time
+	value   model.Value
+}
+
+func (c *StaleCache) add(key string, value model.Value) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	entry := &staleCacheEntry{key, time.Now(), value}
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*staleCacheEntry).key)
+	}
+}
+
+// get returns the entry for `key` if there is one within the max staleness
+func (c *StaleCache) get(key string) *staleCacheEntry {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*staleCacheEntry)
+		if time.Since(entry.fetched) <= c.maxStaleness {
+			return entry
+		}
+	}
+	return nil
+}
+
+// Flush removes all of the cached results
+func (c *StaleCache) Flush() {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// StaleCacheAPI caches the last successful result of the (data) calls to API
+// in Cache, and if a call fails because the downstream did (see
+// isStaleFallback) returns the cached result of the same call (if it is within
+// the max staleness) along with a warning. Calls are the same if they have the
+// same query (or matchers), range duration and step, not the same absolute
+// time -- a dashboard refreshing gets its previous result -- and their
+// contexts send the same requests downstream (see contextKey). Calls is the
+// set of calls ("query", "query_range", "get_value") which are cached.
+type StaleCacheAPI struct {
+	API
+	Cache *StaleCache
+	Calls map[string]struct{}
+}
+
+// fallback returns the result of `call` (caching it) or the cached result for `key`
+func (s *StaleCacheAPI) fallback(ctx context.Context, call, key string, f func() (model.Value, error)) (model.Value, error) {
+	if _, ok := s.Calls[call]; !ok {
+		return f()
+	}
+
+	key = call + "\xff" + contextKey(ctx) + "\xff" + key
+	v, err := f()
+	if err == nil {
+		s.Cache.add(key, copySeries(v))
+		return v, nil
+	}
+
+	// If the request itself is done (e.g. timed out) there is no one to serve a
+	// stale result to, and if the request is what failed (e.g. a bad query) the
+	// stale result isn't what was asked for
+	if ctx.Err() != nil || !isStaleFallback(err) {
+		return nil, err
+	}
+	entry := s.Cache.get(key)
+	if entry == nil {
+		return nil, err
+	}
+	promhttputil.AddWarning(ctx, fmt.Sprintf("serving a result from %s ago as the downstream failed: %v", time.Since(entry.fetched).Round(time.Second), err))
+	return copySeries(entry.value), nil
+}
+
+// isStaleFallback returns whether a stale result is served for `err`: a failure
+// of the downstream (see isDownstreamFailure) or a downstream timeout
+func isStaleFallback(err error) bool {
+	switch cause := errors.Cause(err).(type) {
+	case promql.ErrQueryTimeout:
+		return true
+	case *v1.Error:
+		if cause.Type == v1.ErrTimeout {
+			return true
+		}
+	}
+	return isDownstreamFailure(err)
+}
+
+// copySeries returns a deep copy of the series of `v`. Cached (and coalesced)
+// results are shared by requests, so each gets its own series, metrics and
+// values (which callers such as MultiAPI sort and merge in place).
+func copySeries(v model.Value) model.Value {
+	switch valueTyped := v.(type) {
+	case model.Vector:
+		vector := make(model.Vector, len(valueTyped))
+		for i, sample := range valueTyped {
+			vector[i] = &model.Sample{Metric: sample.Metric.Clone(), Value: sample.Value, Timestamp: sample.Timestamp}
+		}
+		return vector
+	case model.Matrix:
+		matrix := make(model.Matrix, len(valueTyped))
+		for i, stream := range valueTyped {
+			matrix[i] = &model.SampleStream{Metric: stream.Metric.Clone(), Values: append([]model.SamplePair(nil), stream.Values...)}
+		}
+		return matrix
+	case *model.Scalar:
+		scalar := *valueTyped
+		return &scalar
+	case *model.String:
+		str := *valueTyped
+		return &str
+	}
+	return v
+}
+
+// Query performs a query for the given time.
+func (s *StaleCacheAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	return s.fallback(ctx, "query", query, func() (model.Value, error) {
+		return s.API.Query(ctx, query, ts)
+	})
+}
+
+// QueryRange performs a query for the given range.
+func (s *StaleCacheAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, error) {
+	return s.fallback(ctx, "query_range", fmt.Sprintf("%s\xff%s\xff%s", query, r.End.Sub(r.Start), r.Step), func() (model.Value, error) {
+		return s.API.QueryRange(ctx, query, r)
+	})
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (s *StaleCacheAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	matcherString, err := promhttputil.MatcherToString(matchers)
+	if err != nil {
+		return nil, err
+	}
+	return s.fallback(ctx, "get_value", fmt.Sprintf("%s\xff%s", matcherString, end.Sub(start)), func() (model.Value, error) {
+		return s.API.GetValue(ctx, start, end, matchers)
+	})
+}
@@ -0,0 +1,92 @@
+package promclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+// toggleErrorAPI returns err (if set) instead of calling API
+type toggleErrorAPI struct {
+	API
+	err error
+}
+
+// Query performs a query for the given time.
+func (s *toggleErrorAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.API.Query(ctx, query, ts)
+}
+
+func TestStaleCacheAPI(t *testing.T) {
+	value := model.Vector{{Metric: model.Metric{model.MetricNameLabel: "testmetric"}}}
+	downstream := &toggleErrorAPI{API: &stubAPI{query: func() model.Value { return value }}}
+	cache := NewStaleCache(10, time.Minute)
+	api := &StaleCacheAPI{downstream, cache, map[string]struct{}{"query": {}}}
+
+	// Nothing cached yet, so the error is returned
+	downstream.err = fmt.Errorf("connection refused")
+	if _, err := api.Query(context.TODO(), "testmetric", time.Now()); err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	downstream.err = nil
+	if _, err := api.Query(context.TODO(), "testmetric", time.Now()); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+
+	// Once cached the last result is served (with a warning) on error
+	downstream.err = fmt.Errorf("connection refused")
+	ctx, warnings := promhttputil.WithWarnings(context.TODO())
+	v, err := api.Query(ctx, "testmetric", time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if !reflect.DeepEqual(v, value) {
+		t.Fatalf("mismatch in value: %v", v)
+	}
+	if len(warnings.Warnings()) != 1 {
+		t.Fatalf("expected a staleness warning, got: %v", warnings.Warnings())
+	}
+
+	// Other queries aren't served the cached result
+	if _, err := api.Query(context.TODO(), "othermetric", time.Now()); err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	// Nor are the same queries sending other requests downstream
+	if _, err := api.Query(WithServerGroup(context.TODO(), "other"), "testmetric", time.Now()); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if _, err := api.Query(WithForwardedHeaders(context.TODO(), http.Header{"X-Tenant": {"b"}}), "testmetric", time.Now()); err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	// Nor are the queries which failed rather than the downstream
+	downstream.err = &v1.Error{Type: v1.ErrBadData, Msg: "parse error"}
+	if _, err := api.Query(context.TODO(), "testmetric", time.Now()); err == nil {
+		t.Fatalf("expected an error")
+	}
+	// But downstream timeouts are
+	downstream.err = &v1.Error{Type: v1.ErrTimeout, Msg: "query timed out"}
+	if _, err := api.Query(context.TODO(), "testmetric", time.Now()); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	downstream.err = fmt.Errorf("connection refused")
+
+	// Nor is anything once flushed
+	cache.Flush()
+	if _, err := api.Query(context.TODO(), "testmetric", time.Now()); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
@@ -0,0 +1,85 @@
+package promclient
+
+import (
+	"context"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/value"
+)
+
+// DropStaleMarkersAPI drops the staleness markers from the data returned by API.
+// Staleness markers are NaNs with a specific bit pattern (value.StaleNaN) which
+// prometheus uses to mark series as stale, they are returned in raw data (e.g.
+// over remote_read) and confuse some clients. Other NaN values are legitimate
+// data and are kept. Series left with no samples are dropped.
+type DropStaleMarkersAPI struct {
+	API
+}
+
+// Query performs a query for the given time.
+func (d *DropStaleMarkersAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	v, err := d.API.Query(ctx, query, ts)
+	if err != nil {
+		return nil, err
+	}
+	return dropStaleMarkers(v), nil
+}
+
+// QueryRange performs a query for the given range.
+func (d *DropStaleMarkersAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, error) {
+	v, err := d.API.QueryRange(ctx, query, r)
+	if err != nil {
+		return nil, err
+	}
+	return dropStaleMarkers(v), nil
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (d *DropStaleMarkersAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	v, err := d.API.GetValue(ctx, start, end, matchers)
+	if err != nil {
+		return nil, err
+	}
+	return dropStaleMarkers(v), nil
+}
+
+// Key returns a labelset used to determine other api clients that are the "same"
+func (d *DropStaleMarkersAPI) Key() model.LabelSet {
+	if apiLabels, ok := d.API.(APILabels); ok {
+		return apiLabels.Key()
+	}
+	return nil
+}
+
+// dropStaleMarkers returns `v` without any staleness markers. The series (and
+// their values) are copied rather than filtered in place, as `v` may be shared.
+func dropStaleMarkers(v model.Value) model.Value {
+	switch valueTyped := v.(type) {
+	case model.Vector:
+		vector := make(model.Vector, 0, len(valueTyped))
+		for _, sample := range valueTyped {
+			if !value.IsStaleNaN(float64(sample.Value)) {
+				vector = append(vector, sample)
+			}
+		}
+		return vector
+	case model.Matrix:
+		matrix := make(model.Matrix, 0, len(valueTyped))
+		for _, stream := range valueTyped {
+			values := make([]model.SamplePair, 0, len(stream.Values))
+			for _, pair := range stream.Values {
+				if !value.IsStaleNaN(float64(pair.Value)) {
+					values = append(values, pair)
+				}
+			}
+			if len(values) > 0 {
+				matrix = append(matrix, &model.SampleStream{Metric: stream.Metric, Values: values})
+			}
+		}
+		return matrix
+	}
+	return v
+}
@@ -0,0 +1,57 @@
+package promclient
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/value"
+)
+
+func TestDropStaleMarkersAPI(t *testing.T) {
+	staleNaN := model.SampleValue(math.Float64frombits(value.StaleNaN))
+	normalNaN := model.SampleValue(math.NaN())
+
+	stub := &stubAPI{
+		query: func() model.Value {
+			return model.Vector{
+				{Metric: model.Metric{"a": "stale"}, Value: staleNaN},
+				{Metric: model.Metric{"a": "nan"}, Value: normalNaN},
+				{Metric: model.Metric{"a": "value"}, Value: 1},
+			}
+		},
+		queryRange: func() model.Value {
+			return model.Matrix{
+				{Metric: model.Metric{"a": "mixed"}, Values: []model.SamplePair{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: staleNaN}, {Timestamp: 3, Value: normalNaN}}},
+				// Series with only staleness markers are dropped
+				{Metric: model.Metric{"a": "stale"}, Values: []model.SamplePair{{Timestamp: 1, Value: staleNaN}}},
+			}
+		},
+	}
+	api := &DropStaleMarkersAPI{stub}
+
+	v, err := api.Query(context.TODO(), "testmetric", time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	vector := v.(model.Vector)
+	if len(vector) != 2 || vector[0].Metric["a"] != "nan" || !math.IsNaN(float64(vector[0].Value)) || vector[1].Value != 1 {
+		t.Fatalf("unexpected vector: %v", vector)
+	}
+
+	v, err = api.QueryRange(context.TODO(), "testmetric", v1.Range{})
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	matrix := v.(model.Matrix)
+	if len(matrix) != 1 {
+		t.Fatalf("unexpected matrix: %v", matrix)
+	}
+	values := matrix[0].Values
+	if len(values) != 2 || values[0].Value != 1 || !math.IsNaN(float64(values[1].Value)) || value.IsStaleNaN(float64(values[1].Value)) {
+		t.Fatalf("unexpected values: %v", values)
+	}
+}
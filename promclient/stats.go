@@ -0,0 +1,73 @@
+package promclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+// downstreamStats is the part of a query response holding the downstream's timings
+type downstreamStats struct {
+	Data struct {
+		Stats struct {
+			Timings struct {
+				EvalTotalTime float64 `json:"evalTotalTime"`
+				ExecQueueTime float64 `json:"execQueueTime"`
+			} `json:"timings"`
+		} `json:"stats"`
+	} `json:"data"`
+}
+
+// NewStatsRoundTripper returns an http.RoundTripper which records the stats of
+// the query requests to server group `serverGroup` if the request's context
+// has promhttputil.Stats. These requests are sent with stats=all so the
+// downstream returns its own timings, which are recorded along with the time
+// the request took.
+func NewStatsRoundTripper(serverGroup string, rt http.RoundTripper) http.RoundTripper {
+	return &statsRoundTripper{serverGroup, rt}
+}
+
+type statsRoundTripper struct {
+	serverGroup string
+	rt          http.RoundTripper
+}
+
+func (rt *statsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	stats := promhttputil.GetStats(req.Context())
+	if stats == nil || !promhttputil.IsQueryPath(req.URL.Path) {
+		return rt.rt.RoundTrip(req)
+	}
+
+	// RoundTrippers must not modify the request, so send a copy requesting the stats
+	req = cloneRequest(req)
+	q := req.URL.Query()
+	q.Set(promhttputil.StatsParam, "all")
+	req.URL.RawQuery = q.Encode()
+
+	start := time.Now()
+	resp, err := rt.rt.RoundTrip(req)
+	if err != nil {
+		stats.AddServerGroup(rt.serverGroup, time.Since(start), 0, 0)
+		return nil, err
+	}
+
+	// Buffer the body so we can both parse the stats and return it
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	took := time.Since(start)
+	if err != nil {
+		stats.AddServerGroup(rt.serverGroup, took, 0, 0)
+		return nil, err
+	}
+	var ds downstreamStats
+	// Responses without (valid) stats just have no downstream timings
+	json.Unmarshal(body, &ds)
+	stats.AddServerGroup(rt.serverGroup, took, ds.Data.Stats.Timings.ExecQueueTime, ds.Data.Stats.Timings.EvalTotalTime)
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
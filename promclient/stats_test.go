@@ -0,0 +1,58 @@
+package promclient
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+func TestStatsRoundTripper(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("stats") == "" {
+			w.Write([]byte(`{"status":"success","data":{}}`))
+			return
+		}
+		w.Write([]byte(`{"status":"success","data":{"stats":{"timings":{"evalTotalTime":0.5,"execQueueTime":0.25}}}}`))
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: NewStatsRoundTripper("sg", http.DefaultTransport)}
+	get := func(ctx context.Context, path string) string {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if err != nil {
+			t.Fatalf("Unexpected Err: %v", err)
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			t.Fatalf("Unexpected Err: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Unexpected Err: %v", err)
+		}
+		return string(body)
+	}
+
+	// Without stats requested the request is untouched
+	if body := get(context.TODO(), "/api/v1/query"); body != `{"status":"success","data":{}}` {
+		t.Fatalf("unexpected body: %s", body)
+	}
+
+	ctx, stats := promhttputil.WithStats(context.TODO())
+	// The body is still returned after parsing the stats
+	if body := get(ctx, "/api/v1/query_range"); body != `{"status":"success","data":{"stats":{"timings":{"evalTotalTime":0.5,"execQueueTime":0.25}}}}` {
+		t.Fatalf("unexpected body: %s", body)
+	}
+	// Only the query endpoints have stats
+	get(ctx, "/api/v1/series")
+
+	sg, ok := stats.ServerGroups()["sg"]
+	if !ok || sg.Requests != 1 || sg.EvalTotalTime != 0.5 || sg.ExecQueueTime != 0.25 || sg.RequestTime <= 0 {
+		t.Fatalf("mismatch in server group stats: %+v", sg)
+	}
+}
@@ -0,0 +1,62 @@
+package promclient
+
+import (
+	"context"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// MinStepAPI queries API with a step of at least MinStep. A QueryRange with a
+// finer step is sent downstream with MinStep and the result is forward-filled
+// into the requested step: the value at each requested timestamp is the value
+// of the latest downstream point at or before it, provided that point is less
+// than MinStep old (the downstream would have returned a newer point otherwise).
+// Requested timestamps with no such point are left empty, so gaps in the
+// downstream data remain gaps.
+type MinStepAPI struct {
+	API
+	MinStep time.Duration
+}
+
+// QueryRange performs a query for the given range.
+func (m *MinStepAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, error) {
+	if r.Step <= 0 || r.Step >= m.MinStep {
+		return m.API.QueryRange(ctx, query, r)
+	}
+
+	coarse := r
+	coarse.Step = m.MinStep
+	v, err := m.API.QueryRange(ctx, query, coarse)
+	if err != nil {
+		return nil, err
+	}
+	matrix, ok := v.(model.Matrix)
+	if !ok {
+		return v, nil
+	}
+
+	start := model.TimeFromUnixNano(r.Start.UnixNano())
+	end := model.TimeFromUnixNano(r.End.UnixNano())
+	for _, stream := range matrix {
+		stream.Values = forwardFill(stream.Values, start, end, r.Step, m.MinStep)
+	}
+	return matrix, nil
+}
+
+// forwardFill resamples `values` (sorted by time) to every `step` from `start`
+// to `end`, using the latest value less than `maxAge` old at each timestamp
+func forwardFill(values []model.SamplePair, start, end model.Time, step, maxAge time.Duration) []model.SamplePair {
+	filled := make([]model.SamplePair, 0, int(end.Sub(start)/step)+1)
+	i := -1 // index of the latest value at or before ts
+	for ts := start; !ts.After(end); ts = ts.Add(step) {
+		for i+1 < len(values) && !values[i+1].Timestamp.After(ts) {
+			i++
+		}
+		if i >= 0 && ts.Sub(values[i].Timestamp) < maxAge {
+			filled = append(filled, model.SamplePair{Timestamp: ts, Value: values[i].Value})
+		}
+	}
+	return filled
+}
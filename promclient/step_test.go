@@ -0,0 +1,74 @@
+package promclient
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+func TestMinStepAPI(t *testing.T) {
+	var steps []time.Duration
+	stub := &stubAPI{
+		queryRange: func() model.Value {
+			return model.Matrix{{
+				Metric: model.Metric{model.MetricNameLabel: "testmetric"},
+				// 60s points with the point at 120s missing
+				Values: []model.SamplePair{{Timestamp: 0, Value: 1}, {Timestamp: 60000, Value: 2}, {Timestamp: 180000, Value: 4}},
+			}}
+		},
+	}
+	api := &MinStepAPI{&stepRecordingAPI{stub, &steps}, time.Minute}
+
+	tests := []struct {
+		step   time.Duration
+		values []model.SamplePair
+	}{
+		// Steps at least the min step are passed through as-is
+		{
+			step:   time.Minute,
+			values: []model.SamplePair{{Timestamp: 0, Value: 1}, {Timestamp: 60000, Value: 2}, {Timestamp: 180000, Value: 4}},
+		},
+		// Finer steps are forward-filled, but not across the missing point
+		{
+			step: 30 * time.Second,
+			values: []model.SamplePair{
+				{Timestamp: 0, Value: 1}, {Timestamp: 30000, Value: 1},
+				{Timestamp: 60000, Value: 2}, {Timestamp: 90000, Value: 2},
+				{Timestamp: 180000, Value: 4},
+			},
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			steps = nil
+			v, err := api.QueryRange(context.TODO(), "testmetric", v1.Range{Start: time.Unix(0, 0), End: time.Unix(180, 0), Step: test.step})
+			if err != nil {
+				t.Fatalf("Unexpected Err: %v", err)
+			}
+			if !reflect.DeepEqual(steps, []time.Duration{time.Minute}) {
+				t.Fatalf("expected the downstream to be queried with the min step, got: %v", steps)
+			}
+			if values := v.(model.Matrix)[0].Values; !reflect.DeepEqual(values, test.values) {
+				t.Fatalf("mismatch in values\nexpected=%v\nactual=%v", test.values, values)
+			}
+		})
+	}
+}
+
+// stepRecordingAPI records the step of each QueryRange
+type stepRecordingAPI struct {
+	API
+	steps *[]time.Duration
+}
+
+// QueryRange performs a query for the given range.
+func (s *stepRecordingAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, error) {
+	*s.steps = append(*s.steps, r.Step)
+	return s.API.QueryRange(ctx, query, r)
+}
@@ -0,0 +1,215 @@
+package promclient
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/value"
+)
+
+// ValueExpr is an arithmetic expression of a sample's `value` (e.g.
+// `value * 1024` or `(value - 32) / 1.8`). Only numbers, `value`, the + - * /
+// operators and parentheses are supported, so an expression can't do anything
+// but compute a new value.
+type ValueExpr struct {
+	expr string
+	eval func(v float64) float64
+}
+
+// ParseValueExpr parses the ValueExpr `expr`
+func ParseValueExpr(expr string) (*ValueExpr, error) {
+	node, err := parser.ParseExpr(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value expression %q: %v", expr, err)
+	}
+	eval, err := compileValueExpr(node)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value expression %q: %v", expr, err)
+	}
+	return &ValueExpr{expr: expr, eval: eval}, nil
+}
+
+// compileValueExpr returns the func evaluating the (parsed) expression `node`,
+// or an error if it isn't supported
+func compileValueExpr(node ast.Expr) (func(v float64) float64, error) {
+	switch n := node.(type) {
+	case *ast.ParenExpr:
+		return compileValueExpr(n.X)
+	case *ast.Ident:
+		if n.Name != "value" {
+			return nil, fmt.Errorf("unknown identifier %s, only value is supported", n.Name)
+		}
+		return func(v float64) float64 { return v }, nil
+	case *ast.BasicLit:
+		if n.Kind != token.INT && n.Kind != token.FLOAT {
+			return nil, fmt.Errorf("unsupported literal %s, only numbers are supported", n.Value)
+		}
+		f, err := strconv.ParseFloat(n.Value, 64)
+		if err != nil {
+			return nil, err
+		}
+		return func(float64) float64 { return f }, nil
+	case *ast.UnaryExpr:
+		x, err := compileValueExpr(n.X)
+		if err != nil {
+			return nil, err
+		}
+		switch n.Op {
+		case token.ADD:
+			return x, nil
+		case token.SUB:
+			return func(v float64) float64 { return -x(v) }, nil
+		}
+		return nil, fmt.Errorf("unsupported operator %s", n.Op)
+	case *ast.BinaryExpr:
+		x, err := compileValueExpr(n.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := compileValueExpr(n.Y)
+		if err != nil {
+			return nil, err
+		}
+		switch n.Op {
+		case token.ADD:
+			return func(v float64) float64 { return x(v) + y(v) }, nil
+		case token.SUB:
+			return func(v float64) float64 { return x(v) - y(v) }, nil
+		case token.MUL:
+			return func(v float64) float64 { return x(v) * y(v) }, nil
+		case token.QUO:
+			return func(v float64) float64 { return x(v) / y(v) }, nil
+		}
+		return nil, fmt.Errorf("unsupported operator %s", n.Op)
+	}
+	return nil, fmt.Errorf("unsupported expression %T", node)
+}
+
+// Eval returns the result of the expression for the value `v`
+func (e *ValueExpr) Eval(v float64) float64 {
+	return e.eval(v)
+}
+
+func (e *ValueExpr) String() string {
+	return e.expr
+}
+
+// ValueTransform transforms the values of the series matching Matchers (all
+// the series if there are none) with Expr
+type ValueTransform struct {
+	Matchers []*labels.Matcher
+	Expr     *ValueExpr
+}
+
+// matches returns whether the series `metric` matches the transform's matchers
+func (t *ValueTransform) matches(metric model.Metric) bool {
+	for _, matcher := range t.Matchers {
+		if !matcher.Matches(string(metric[model.LabelName(matcher.Name)])) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValueTransformAPI transforms the values returned by API (e.g. to normalize
+// units across clusters, one reporting bytes and another kilobytes), so they
+// are comparable once merged. Each series is transformed by the first of the
+// Transforms it matches, if any. Staleness markers are kept as they are.
+type ValueTransformAPI struct {
+	API
+	Transforms []*ValueTransform
+}
+
+// Key returns a labelset used to determine other api clients that are the "same"
+func (t *ValueTransformAPI) Key() model.LabelSet {
+	if apiLabels, ok := t.API.(APILabels); ok {
+		return apiLabels.Key()
+	}
+	return nil
+}
+
+// Query performs a query for the given time.
+func (t *ValueTransformAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	v, err := t.API.Query(ctx, query, ts)
+	if err != nil {
+		return nil, err
+	}
+	return TransformValue(v, t.Transforms), nil
+}
+
+// QueryRange performs a query for the given range.
+func (t *ValueTransformAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, error) {
+	v, err := t.API.QueryRange(ctx, query, r)
+	if err != nil {
+		return nil, err
+	}
+	return TransformValue(v, t.Transforms), nil
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (t *ValueTransformAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	v, err := t.API.GetValue(ctx, start, end, matchers)
+	if err != nil {
+		return nil, err
+	}
+	return TransformValue(v, t.Transforms), nil
+}
+
+// transformFor returns the first of `transforms` the series `metric` matches
+// (nil if there is none)
+func transformFor(metric model.Metric, transforms []*ValueTransform) *ValueTransform {
+	for _, transform := range transforms {
+		if transform.matches(metric) {
+			return transform
+		}
+	}
+	return nil
+}
+
+// transformSample returns the sample value `v` transformed by `transform`,
+// keeping staleness markers (see value.StaleNaN) as they are
+func transformSample(v model.SampleValue, transform *ValueTransform) model.SampleValue {
+	if value.IsStaleNaN(float64(v)) {
+		return v
+	}
+	return model.SampleValue(transform.Expr.Eval(float64(v)))
+}
+
+// TransformValue returns `v` with the values of its series transformed by the
+// first of `transforms` they match. The transformed series (and their values)
+// are copied rather than transformed in place, as `v` may be shared.
+func TransformValue(v model.Value, transforms []*ValueTransform) model.Value {
+	switch valueTyped := v.(type) {
+	case model.Vector:
+		vector := make(model.Vector, len(valueTyped))
+		for i, sample := range valueTyped {
+			if transform := transformFor(sample.Metric, transforms); transform != nil {
+				sample = &model.Sample{Metric: sample.Metric, Value: transformSample(sample.Value, transform), Timestamp: sample.Timestamp}
+			}
+			vector[i] = sample
+		}
+		return vector
+	case model.Matrix:
+		matrix := make(model.Matrix, len(valueTyped))
+		for i, stream := range valueTyped {
+			if transform := transformFor(stream.Metric, transforms); transform != nil {
+				values := make([]model.SamplePair, len(stream.Values))
+				for j, pair := range stream.Values {
+					values[j] = model.SamplePair{Timestamp: pair.Timestamp, Value: transformSample(pair.Value, transform)}
+				}
+				stream = &model.SampleStream{Metric: stream.Metric, Values: values}
+			}
+			matrix[i] = stream
+		}
+		return matrix
+	}
+	return v
+}
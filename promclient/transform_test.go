@@ -0,0 +1,83 @@
+package promclient
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/value"
+)
+
+func TestParseValueExpr(t *testing.T) {
+	for _, test := range []struct {
+		expr   string
+		result float64
+		err    bool
+	}{
+		{expr: "value", result: 10},
+		{expr: "value * 1024", result: 10240},
+		{expr: "(value - 32) / 1.8 + -1", result: -13.222222222222221},
+		{expr: "-value", result: -10},
+		// Only arithmetic of value is supported
+		{expr: "other * 2", err: true},
+		{expr: "value % 3", err: true},
+		{expr: `"1"`, err: true},
+		{expr: "math.Sqrt(value)", err: true},
+		{expr: "value *", err: true},
+	} {
+		expr, err := ParseValueExpr(test.expr)
+		if (err != nil) != test.err {
+			t.Fatalf("%s: mismatch in err expected=%v actual=%v", test.expr, test.err, err)
+		}
+		if err == nil && expr.Eval(10) != test.result {
+			t.Fatalf("%s: mismatch in result expected=%v actual=%v", test.expr, test.result, expr.Eval(10))
+		}
+	}
+}
+
+func TestTransformValue(t *testing.T) {
+	kilobytes, err := ParseValueExpr("value * 1024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	double, err := ParseValueExpr("value * 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transforms := []*ValueTransform{
+		{Matchers: []*labels.Matcher{{Type: labels.MatchEqual, Name: "unit", Value: "kb"}}, Expr: kilobytes},
+		{Matchers: []*labels.Matcher{{Type: labels.MatchNotEqual, Name: "unit", Value: "bytes"}}, Expr: double},
+	}
+
+	in := model.Matrix{
+		{Metric: model.Metric{"unit": "kb"}, Values: []model.SamplePair{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: model.SampleValue(math.Float64frombits(value.StaleNaN))}}},
+		{Metric: model.Metric{"unit": "bytes"}, Values: []model.SamplePair{{Timestamp: 1, Value: 1}}},
+		{Metric: model.Metric{}, Values: []model.SamplePair{{Timestamp: 1, Value: 1}}},
+	}
+	out := TransformValue(in, transforms).(model.Matrix)
+
+	// Each series is transformed by the first transform it matches, staleness markers are kept
+	if out[0].Values[0].Value != 1024 || !value.IsStaleNaN(float64(out[0].Values[1].Value)) {
+		t.Fatalf("mismatch in transformed series: %v", out[0])
+	}
+	if !reflect.DeepEqual(out[1], in[1]) || out[2].Values[0].Value != 2 {
+		t.Fatalf("mismatch in transformed series: %v", out)
+	}
+	// The input isn't modified
+	if in[0].Values[0].Value != 1 || in[2].Values[0].Value != 1 {
+		t.Fatalf("input was modified: %v", in)
+	}
+
+	vector := TransformValue(model.Vector{{Metric: model.Metric{"unit": "kb"}, Value: 2}}, transforms).(model.Vector)
+	if vector[0].Value != 2048 {
+		t.Fatalf("mismatch in transformed vector: %v", vector)
+	}
+
+	// Scalars have no labels to match, they are returned as they are
+	scalar := &model.Scalar{Value: model.SampleValue(math.Pi)}
+	if TransformValue(scalar, transforms) != scalar {
+		t.Fatalf("scalar was transformed")
+	}
+}
@@ -0,0 +1,186 @@
+package promhttputil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+type errorStatusKey struct{}
+
+// ErrorStatus is the HTTP status (and optionally the errorType) to respond to
+// a request with if it fails, as set by the first downstream error response
+// mapped to one (see the error_codes of a server group) or the first limit
+// the request exceeded
+type ErrorStatus struct {
+	l    sync.Mutex
+	code int
+	typ  ErrorType
+}
+
+// Set sets the status to `code`, unless one was already set
+func (s *ErrorStatus) Set(code int) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.code == 0 {
+		s.code = code
+	}
+}
+
+// Code returns the status set (0 if none was)
+func (s *ErrorStatus) Code() int {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.code
+}
+
+// SetType sets the errorType to `typ`, unless one was already set
+func (s *ErrorStatus) SetType(typ ErrorType) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.typ == ErrorNone {
+		s.typ = typ
+	}
+}
+
+// Type returns the errorType set (ErrorNone if none was)
+func (s *ErrorStatus) Type() ErrorType {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.typ
+}
+
+// WithErrorStatus returns a copy of `ctx` which collects the status to respond with on failure
+func WithErrorStatus(ctx context.Context) (context.Context, *ErrorStatus) {
+	s := &ErrorStatus{}
+	return context.WithValue(ctx, errorStatusKey{}, s), s
+}
+
+// SetErrorStatus sets the ErrorStatus of `ctx` (if there is one) to `code`
+func SetErrorStatus(ctx context.Context, code int) {
+	if s, ok := ctx.Value(errorStatusKey{}).(*ErrorStatus); ok {
+		s.Set(code)
+	}
+}
+
+// SetErrorType sets the errorType of the ErrorStatus of `ctx` (if there is one) to `typ`
+func SetErrorType(ctx context.Context, typ ErrorType) {
+	if s, ok := ctx.Value(errorStatusKey{}).(*ErrorStatus); ok {
+		s.SetType(typ)
+	}
+}
+
+// NewErrorStatusHandler returns an http.Handler which responds to the failed
+// requests (those with a 4xx or 5xx status) with their ErrorStatus, if one
+// was set while handling them. If an errorType was set too, it replaces that
+// of the error response's body.
+func NewErrorStatusHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, status := WithErrorStatus(r.Context())
+		sw := &errorStatusResponseWriter{ResponseWriter: w, status: status}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		sw.writeBody()
+	})
+}
+
+// errorStatusResponseWriter replaces the status of error responses with the
+// ErrorStatus. The error responses whose errorType is replaced are buffered,
+// to be rewritten once they are complete.
+type errorStatusResponseWriter struct {
+	http.ResponseWriter
+	status *ErrorStatus
+
+	typ  ErrorType
+	code int
+	body bytes.Buffer
+}
+
+func (w *errorStatusResponseWriter) WriteHeader(code int) {
+	if code >= 400 {
+		if override := w.status.Code(); override != 0 {
+			code = override
+		}
+		if w.typ = w.status.Type(); w.typ != ErrorNone {
+			w.code = code
+			return
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *errorStatusResponseWriter) Write(b []byte) (int, error) {
+	if w.typ != ErrorNone {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// writeBody writes the buffered error response (if any) with its errorType
+// replaced, or as it is if its body can't be decoded
+func (w *errorStatusResponseWriter) writeBody() {
+	if w.typ == ErrorNone {
+		return
+	}
+	body := w.body.Bytes()
+	if b, err := rewriteErrorType(w.Header().Get("Content-Encoding"), body, w.typ); err == nil {
+		w.Header().Del("Content-Encoding")
+		w.Header().Del("Content-Length")
+		body = b
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+	w.ResponseWriter.Write(body)
+}
+
+// rewriteErrorType returns the (uncompressed) error response `body` with its
+// errorType replaced by `typ`, the other fields (e.g. the data) are kept as
+// they are
+func rewriteErrorType(encoding string, body []byte, typ ErrorType) ([]byte, error) {
+	var r io.Reader
+	var err error
+	switch encoding {
+	case "":
+		r = bytes.NewReader(body)
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(body))
+	default:
+		err = fmt.Errorf("unsupported encoding %s", encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The prometheus API's compression only flushes the stream, without its
+	// trailer, any truncation is caught decoding the JSON
+	b, err := ioutil.ReadAll(r)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return nil, err
+	}
+	if resp["errorType"], err = json.Marshal(typ); err != nil {
+		return nil, err
+	}
+	return json.Marshal(resp)
+}
+
+// Flush sends the response written so far to the client (error responses
+// whose body is rewritten are only sent once complete)
+func (w *errorStatusResponseWriter) Flush() {
+	if w.typ != ErrorNone {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,59 @@
+package promhttputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrorStatusHandler(t *testing.T) {
+	tests := []struct {
+		code     int
+		status   int
+		expected int
+	}{
+		// Errors are responded to with the (first) status set
+		{http.StatusUnprocessableEntity, http.StatusBadRequest, http.StatusBadRequest},
+		// Unless none was set
+		{http.StatusUnprocessableEntity, 0, http.StatusUnprocessableEntity},
+		// Successful responses are untouched
+		{http.StatusOK, http.StatusBadRequest, http.StatusOK},
+	}
+	for _, test := range tests {
+		h := NewErrorStatusHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.status != 0 {
+				SetErrorStatus(r.Context(), test.status)
+				SetErrorStatus(r.Context(), http.StatusServiceUnavailable)
+			}
+			w.WriteHeader(test.code)
+		}))
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/query", nil))
+		if rec.Code != test.expected {
+			t.Fatalf("mismatch in status: expected=%d actual=%d", test.expected, rec.Code)
+		}
+	}
+}
+
+func TestErrorStatusHandlerType(t *testing.T) {
+	h := NewErrorStatusHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetErrorStatus(r.Context(), http.StatusUnprocessableEntity)
+		SetErrorType(r.Context(), ErrorExec)
+		SetErrorType(r.Context(), ErrorTimeout)
+		// As the prometheus API responds to an error it misclassifies
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"status":"error","errorType":"internal","error":"too many samples","warnings":["w"]}`))
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/query", nil))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("mismatch in status: expected=%d actual=%d", http.StatusUnprocessableEntity, rec.Code)
+	}
+	// Only the errorType is replaced (by the first one set)
+	expected := `{"error":"too many samples","errorType":"execution","status":"error","warnings":["w"]}`
+	if rec.Body.String() != expected {
+		t.Fatalf("mismatch in body expected=%s actual=%s", expected, rec.Body.String())
+	}
+}
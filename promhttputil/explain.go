@@ -0,0 +1,188 @@
+package promhttputil
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExplainParam is the API parameter requesting the explain plan of a query
+// instead of its result
+const ExplainParam = "explain"
+
+type explainKey struct{}
+
+// IsQueryPath returns whether `path` is one of the query endpoints
+func IsQueryPath(path string) bool {
+	return strings.HasSuffix(path, "/api/v1/query") || strings.HasSuffix(path, "/api/v1/query_range")
+}
+
+// ExplainTarget is a target a request would be sent to, with the query (or
+// selector) sent to it once the matchers satisfied by its labels are removed
+type ExplainTarget struct {
+	URL   string `json:"url"`
+	Query string `json:"query"`
+}
+
+// ExplainRequest is a data request to a server group (for get_value the
+// Query is the selector of the raw data). The Targets are those whose labels
+// can match the query.
+type ExplainRequest struct {
+	API     string          `json:"api"`
+	Query   string          `json:"query"`
+	Start   time.Time       `json:"start"`
+	End     time.Time       `json:"end"`
+	Step    float64         `json:"step,omitempty"`
+	Targets []ExplainTarget `json:"targets"`
+}
+
+// ExplainServerGroup is how the requests to a server group are sent to its
+// targets and merged: deduplicated (within AntiAffinity seconds) when sent to
+// more than one target, or to one target at a time with Failover
+type ExplainServerGroup struct {
+	Name         string           `json:"name"`
+	Targets      int              `json:"targets"`
+	Failover     bool             `json:"failover"`
+	Quorum       int              `json:"quorum,omitempty"`
+	AntiAffinity float64          `json:"antiAffinity"`
+	Requests     []ExplainRequest `json:"requests"`
+}
+
+// ExplainCost is the estimated cost of a data query in series-hours (see
+// max_query_cost), the number of series it selects times the hours it covers
+type ExplainCost struct {
+	Selectors []string `json:"selectors"`
+	Series    int      `json:"series"`
+	Range     float64  `json:"range"`
+	Cost      float64  `json:"cost"`
+}
+
+// Explain collects the routing decisions made while handling a query: the
+// parts of the query pushed down to the downstreams, the requests to each
+// server group and their estimated cost. No data requests are sent while
+// explaining, the server groups return empty results instead.
+type Explain struct {
+	l            sync.Mutex
+	query        string
+	pushdowns    []string
+	costs        []ExplainCost
+	serverGroups map[string]*ExplainServerGroup
+}
+
+// AddPushdown adds `query`, a part of the query sent to the downstreams to evaluate
+func (e *Explain) AddPushdown(query string) {
+	e.l.Lock()
+	defer e.l.Unlock()
+	e.pushdowns = append(e.pushdowns, query)
+}
+
+// AddCost adds the estimated `cost` of a data query
+func (e *Explain) AddCost(cost ExplainCost) {
+	e.l.Lock()
+	defer e.l.Unlock()
+	e.costs = append(e.costs, cost)
+}
+
+// AddRequest adds the request `req` to the server group `sg` (whose Requests are ignored)
+func (e *Explain) AddRequest(sg ExplainServerGroup, req ExplainRequest) {
+	e.l.Lock()
+	defer e.l.Unlock()
+	existing, ok := e.serverGroups[sg.Name]
+	if !ok {
+		sg.Requests = nil
+		existing = &sg
+		e.serverGroups[sg.Name] = existing
+	}
+	existing.Requests = append(existing.Requests, req)
+}
+
+// MarshalJSON implements the json.Marshaler interface
+func (e *Explain) MarshalJSON() ([]byte, error) {
+	e.l.Lock()
+	defer e.l.Unlock()
+	serverGroups := make([]*ExplainServerGroup, 0, len(e.serverGroups))
+	for _, sg := range e.serverGroups {
+		serverGroups = append(serverGroups, sg)
+	}
+	sort.Slice(serverGroups, func(i, j int) bool {
+		return serverGroups[i].Name < serverGroups[j].Name
+	})
+	var cost float64
+	for _, c := range e.costs {
+		cost += c.Cost
+	}
+	return json.Marshal(struct {
+		Query        string                `json:"query"`
+		Pushdowns    []string              `json:"pushdowns"`
+		ServerGroups []*ExplainServerGroup `json:"serverGroups"`
+		Dedup        bool                  `json:"dedup"`
+		Costs        []ExplainCost         `json:"costs,omitempty"`
+		Cost         float64               `json:"cost"`
+	}{
+		Query:        e.query,
+		Pushdowns:    append([]string{}, e.pushdowns...),
+		ServerGroups: serverGroups,
+		// The results of the server groups are merged (deduplicating the series they share)
+		Dedup: len(serverGroups) > 1,
+		Costs: e.costs,
+		Cost:  cost,
+	})
+}
+
+// WithExplain returns a copy of `ctx` which explains the handling of `query`
+func WithExplain(ctx context.Context, query string) (context.Context, *Explain) {
+	e := &Explain{query: query, serverGroups: make(map[string]*ExplainServerGroup)}
+	return context.WithValue(ctx, explainKey{}, e), e
+}
+
+// GetExplain returns the Explain of `ctx` (nil if no explain plan was requested)
+func GetExplain(ctx context.Context) *Explain {
+	e, _ := ctx.Value(explainKey{}).(*Explain)
+	return e
+}
+
+// AddPushdown adds `query` to the pushdowns of the Explain of `ctx` (if there is one)
+func AddPushdown(ctx context.Context, query string) {
+	if e := GetExplain(ctx); e != nil {
+		e.AddPushdown(query)
+	}
+}
+
+// NewExplainHandler returns an http.Handler which, for the queries with the
+// ExplainParam set, responds with the Explain of handling the query as data
+// instead of its result
+func NewExplainHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue(ExplainParam) == "" || !IsQueryPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, explain := WithExplain(r.Context(), r.FormValue("query"))
+		buf := &bufferedResponseWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(buf, r.WithContext(ctx))
+
+		// Errors (e.g. the query can't be parsed) are returned as-is
+		if buf.code != http.StatusOK {
+			w.WriteHeader(buf.code)
+			w.Write(buf.body.Bytes())
+			return
+		}
+		b, err := json.Marshal(struct {
+			Status string   `json:"status"`
+			Data   *Explain `json:"data"`
+		}{"success", explain})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Del("Content-Encoding")
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
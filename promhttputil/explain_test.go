@@ -0,0 +1,68 @@
+package promhttputil
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExplainHandler(t *testing.T) {
+	h := NewExplainHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("query") == "bad(" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"parse error"}`))
+			return
+		}
+		if e := GetExplain(r.Context()); e != nil {
+			AddPushdown(r.Context(), "sum(up)")
+			e.AddRequest(ExplainServerGroup{Name: "b", Targets: 1}, ExplainRequest{API: "query", Query: "sum(up)"})
+			e.AddRequest(ExplainServerGroup{Name: "a", Targets: 2}, ExplainRequest{API: "query", Query: "sum(up)"})
+			e.AddRequest(ExplainServerGroup{Name: "a", Targets: 2}, ExplainRequest{API: "get_value", Query: `{__name__="up"}`})
+			e.AddCost(ExplainCost{Series: 2, Range: time.Hour.Seconds(), Cost: 2})
+			e.AddCost(ExplainCost{Series: 1, Range: time.Hour.Seconds(), Cost: 1})
+		}
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+
+	// Without the explain param (or on other endpoints) the response is untouched
+	for _, target := range []string{"/api/v1/query?query=sum(up)", "/api/v1/series?match[]=up&explain=1"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		if body := rec.Body.String(); body != `{"status":"success","data":{"resultType":"vector","result":[]}}` {
+			t.Fatalf("unexpected body for %s: %s", target, body)
+		}
+	}
+
+	// Errors are returned as-is
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/query?query=bad(&explain=1", nil))
+	if rec.Code != http.StatusBadRequest || rec.Body.String() != `{"status":"error","errorType":"bad_data","error":"parse error"}` {
+		t.Fatalf("unexpected error response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/query_range?query=sum(up)&explain=1", nil))
+	var resp struct {
+		Status string `json:"status"`
+		Data   struct {
+			Query        string               `json:"query"`
+			Pushdowns    []string             `json:"pushdowns"`
+			ServerGroups []ExplainServerGroup `json:"serverGroups"`
+			Dedup        bool                 `json:"dedup"`
+			Cost         float64              `json:"cost"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	data := resp.Data
+	if resp.Status != "success" || data.Query != "sum(up)" || len(data.Pushdowns) != 1 || !data.Dedup || data.Cost != 3 {
+		t.Fatalf("unexpected explain plan: %s", rec.Body.String())
+	}
+	// The server groups are sorted by name, with their requests
+	if len(data.ServerGroups) != 2 || data.ServerGroups[0].Name != "a" || data.ServerGroups[0].Targets != 2 || len(data.ServerGroups[0].Requests) != 2 || len(data.ServerGroups[1].Requests) != 1 {
+		t.Fatalf("unexpected server groups: %+v", data.ServerGroups)
+	}
+}
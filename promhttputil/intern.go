@@ -0,0 +1,48 @@
+package promhttputil
+
+import (
+	"github.com/prometheus/common/model"
+)
+
+// Interner dedupes strings, so the equal label names and values of the series
+// in a (merged) result share their backing storage instead of each series
+// holding the copy decoded from its own response. An Interner isn't safe for
+// concurrent use and grows with the distinct strings it has seen, so it is
+// meant to be scoped to a single request.
+type Interner map[string]string
+
+// NewInterner returns an empty Interner
+func NewInterner() Interner {
+	return make(Interner)
+}
+
+// Intern returns the copy of `s` shared by the Interner
+func (in Interner) Intern(s string) string {
+	if interned, ok := in[s]; ok {
+		return interned
+	}
+	in[s] = s
+	return s
+}
+
+// InternMetric interns the label names and values of `m` in place
+func (in Interner) InternMetric(m model.Metric) {
+	for k, v := range m {
+		// Assigning an equal key replaces the map's copy of the key as well
+		m[model.LabelName(in.Intern(string(k)))] = model.LabelValue(in.Intern(string(v)))
+	}
+}
+
+// InternValue interns the label names and values of all the series in `v` in place
+func (in Interner) InternValue(v model.Value) {
+	switch vTyped := v.(type) {
+	case model.Vector:
+		for _, sample := range vTyped {
+			in.InternMetric(sample.Metric)
+		}
+	case model.Matrix:
+		for _, stream := range vTyped {
+			in.InternMetric(stream.Metric)
+		}
+	}
+}
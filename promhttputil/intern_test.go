@@ -0,0 +1,36 @@
+package promhttputil
+
+import (
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestInterner(t *testing.T) {
+	// Equal strings with their own backing storage, as if decoded separately
+	newMetric := func() model.Metric {
+		return model.Metric{
+			model.LabelName(strings.Repeat("j", 3)): model.LabelValue(strings.Repeat("b", 5)),
+		}
+	}
+	v := model.Matrix{{Metric: newMetric()}, {Metric: newMetric()}}
+
+	NewInterner().InternValue(v)
+
+	data := func(m model.Metric) (*byte, *byte) {
+		for k, v := range m {
+			return unsafe.StringData(string(k)), unsafe.StringData(string(v))
+		}
+		return nil, nil
+	}
+	aName, aValue := data(v[0].Metric)
+	bName, bValue := data(v[1].Metric)
+	if aName != bName || aValue != bValue {
+		t.Fatalf("the label strings aren't shared")
+	}
+	if v[1].Metric["jjj"] != "bbbbb" {
+		t.Fatalf("mismatch in metric: %v", v[1].Metric)
+	}
+}
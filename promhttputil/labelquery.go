@@ -1,19 +1,31 @@
 package promhttputil
 
 import (
+	"fmt"
+	"strconv"
+
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/labels"
 )
 
 // convert list of labelMatchers to a promql string
 // MatcherToString converts a []*labels.Matcher into the actual matcher you would
-// see on the wire (such as `metricname{label="value"}`)
+// see on the wire (such as `metricname{label="value"}`).
+// Label names which aren't valid in the classic syntax (e.g. the UTF-8 names
+// of prometheus 3.0 such as `my.label`) are quoted as `{"my.label"="value"}`.
+// The metric name is always matched as `__name__="my.metric"` which both old
+// and new downstreams accept.
 func MatcherToString(matchers []*labels.Matcher) (string, error) {
 	ret := "{"
 	for i, matcher := range matchers {
 		if i > 0 {
 			ret += ","
 		}
-		ret += matcher.String()
+		if model.LabelName(matcher.Name).IsValid() {
+			ret += matcher.String()
+		} else {
+			ret += fmt.Sprintf("%s%s%q", strconv.Quote(matcher.Name), matcher.Type, matcher.Value)
+		}
 	}
 	ret += "}"
 
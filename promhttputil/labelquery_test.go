@@ -47,6 +47,22 @@ func TestMatcherToString(t *testing.T) {
 			},
 			result: `{__name__=~".+"}`,
 		},
+		// UTF-8 (prometheus 3.0) names
+		{
+			matchers: []*labels.Matcher{
+				{
+					Type:  labels.MatchEqual,
+					Name:  labels.MetricName,
+					Value: "my.metric",
+				},
+				{
+					Type:  labels.MatchEqual,
+					Name:  "my.label",
+					Value: "value",
+				},
+			},
+			result: `{__name__="my.metric","my.label"="value"}`,
+		},
 	}
 
 	for _, test := range tests {
@@ -2,6 +2,7 @@ package promhttputil
 
 import (
 	"fmt"
+	"math"
 	"reflect"
 
 	"github.com/prometheus/common/model"
@@ -33,9 +34,117 @@ func ValueAddLabelSet(a model.Value, l model.LabelSet) error {
 
 }
 
+// MergeStats records the deduplication work done while merging values
+type MergeStats struct {
+	// SeriesMerged is the number of series that existed in both values and
+	// whose points were merged into a single series
+	SeriesMerged int
+	// SeriesDropped is the number of series that existed in both values where
+	// only one of them was kept
+	SeriesDropped int
+	// Conflicts is the number of duplicates whose values differed, meaning
+	// one of the values had to be picked over the other
+	Conflicts int
+}
+
+// ConflictPolicy is how duplicate series (with identical label sets) whose
+// values differ are handled when merging values
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyDefault keeps the value of the first series unless it is 0
+	ConflictPolicyDefault ConflictPolicy = ""
+	// ConflictPolicyFirst keeps the value of the first series
+	ConflictPolicyFirst ConflictPolicy = "first"
+	// ConflictPolicyLast keeps the value of the last series
+	ConflictPolicyLast ConflictPolicy = "last"
+	// ConflictPolicyError fails the merge
+	ConflictPolicyError ConflictPolicy = "error"
+	// ConflictPolicyWarn keeps the value of the first series, the caller is
+	// expected to warn about the conflicts (see MergeStats)
+	ConflictPolicyWarn ConflictPolicy = "warn"
+)
+
+// Validate returns an error if the policy isn't a known ConflictPolicy
+func (p ConflictPolicy) Validate() error {
+	switch p {
+	case ConflictPolicyDefault, ConflictPolicyFirst, ConflictPolicyLast, ConflictPolicyError, ConflictPolicyWarn:
+		return nil
+	}
+	return fmt.Errorf("unknown conflict policy %q, must be one of first, last, error or warn", string(p))
+}
+
+// MergeConflictError is returned when merging duplicate series whose values
+// differ with ConflictPolicyError
+type MergeConflictError struct {
+	Metric model.Metric
+}
+
+func (e *MergeConflictError) Error() string {
+	if e.Metric == nil {
+		return "merge conflict: duplicate results have differing values"
+	}
+	return fmt.Sprintf("merge conflict: duplicate series %v have differing values", e.Metric)
+}
+
+// valuesDiffer returns whether sample values `a` and `b` differ (NaNs are equal).
+// Finite values whose relative difference is at most `epsilon` are equal.
+func valuesDiffer(a, b model.SampleValue, epsilon float64) bool {
+	af, bf := float64(a), float64(b)
+	if af == bf || (math.IsNaN(af) && math.IsNaN(bf)) {
+		return false
+	}
+	if epsilon <= 0 || math.IsInf(af, 0) || math.IsInf(bf, 0) {
+		return true
+	}
+	return math.Abs(af-bf) > epsilon*math.Max(math.Abs(af), math.Abs(bf))
+}
+
+// countConflicts returns the number of timestamps at which `a` and `b` (which
+// must be the same series) have differing values (see valuesDiffer)
+func countConflicts(a, b *model.SampleStream, epsilon float64) int {
+	conflicts := 0
+	i, j := 0, 0
+	for i < len(a.Values) && j < len(b.Values) {
+		switch {
+		case a.Values[i].Timestamp < b.Values[j].Timestamp:
+			i++
+		case a.Values[i].Timestamp > b.Values[j].Timestamp:
+			j++
+		default:
+			if valuesDiffer(a.Values[i].Value, b.Values[j].Value, epsilon) {
+				conflicts++
+			}
+			i++
+			j++
+		}
+	}
+	return conflicts
+}
+
 // MergeValues merges values `a` and `b` with the given antiAffinityBuffer
 // TODO: always make copies? Now we sometimes return one, or make a copy, or do nothing
 func MergeValues(antiAffinityBuffer model.Time, a, b model.Value) (model.Value, error) {
+	return MergeValuesWithStats(antiAffinityBuffer, a, b, nil)
+}
+
+// MergeValuesWithStats merges values `a` and `b` (same as MergeValues) adding
+// the work done to `stats` (if non-nil)
+func MergeValuesWithStats(antiAffinityBuffer model.Time, a, b model.Value, stats *MergeStats) (model.Value, error) {
+	return MergeValuesWithPolicy(antiAffinityBuffer, a, b, ConflictPolicyDefault, 0, stats)
+}
+
+// MergeValuesWithPolicy merges values `a` and `b` (same as MergeValuesWithStats)
+// handling duplicate series whose values differ with `policy`. For matrices
+// the values of duplicate series only conflict at identical timestamps, and
+// with ConflictPolicyLast the points of `b` take precedence over those of `a`.
+// Values within a relative difference of `epsilon` (e.g. floating point noise
+// between HA replicas) are duplicates rather than conflicts, this only changes
+// which values are deduplicated: the values returned are always one of the inputs.
+func MergeValuesWithPolicy(antiAffinityBuffer model.Time, a, b model.Value, policy ConflictPolicy, epsilon float64, stats *MergeStats) (model.Value, error) {
+	if stats == nil {
+		stats = &MergeStats{}
+	}
 	if a == nil {
 		return b, nil
 	}
@@ -52,6 +161,17 @@ func MergeValues(antiAffinityBuffer model.Time, a, b model.Value) (model.Value,
 	// either is valid, we just need one
 	case *model.Scalar:
 		bTyped := b.(*model.Scalar)
+		if valuesDiffer(aTyped.Value, bTyped.Value, epsilon) {
+			stats.Conflicts++
+			switch policy {
+			case ConflictPolicyError:
+				return nil, &MergeConflictError{}
+			case ConflictPolicyFirst, ConflictPolicyWarn:
+				return aTyped, nil
+			case ConflictPolicyLast:
+				return bTyped, nil
+			}
+		}
 
 		if aTyped.Value != 0 && aTyped.Timestamp != 0 {
 			return aTyped, nil
@@ -63,6 +183,17 @@ func MergeValues(antiAffinityBuffer model.Time, a, b model.Value) (model.Value,
 	// either is valid, we just need one
 	case *model.String:
 		bTyped := b.(*model.String)
+		if aTyped.Value != bTyped.Value {
+			stats.Conflicts++
+			switch policy {
+			case ConflictPolicyError:
+				return nil, &MergeConflictError{}
+			case ConflictPolicyFirst, ConflictPolicyWarn:
+				return aTyped, nil
+			case ConflictPolicyLast:
+				return bTyped, nil
+			}
+		}
 
 		if aTyped.Value != "" && aTyped.Timestamp != 0 {
 			return aTyped, nil
@@ -75,29 +206,46 @@ func MergeValues(antiAffinityBuffer model.Time, a, b model.Value) (model.Value,
 		bTyped := b.(model.Vector)
 
 		newValue := make(model.Vector, 0, len(aTyped)+len(bTyped))
-		fingerPrintMap := make(map[model.Fingerprint]int)
+		fingerPrintMap := make(map[model.Fingerprint]int, len(aTyped))
 
-		addItem := func(item *model.Sample) {
+		addItem := func(item *model.Sample) error {
 			finger := item.Metric.Fingerprint()
 
 			// If we've seen this fingerPrint before, lets make sure that a value exists
 			if index, ok := fingerPrintMap[finger]; ok {
-				// TODO: better? For now we only replace if we have no value (which seems reasonable)
-				if newValue[index].Value == model.SampleValue(0) {
-					newValue[index].Value = item.Value
+				stats.SeriesDropped++
+				if !valuesDiffer(newValue[index].Value, item.Value, epsilon) {
+					return nil
+				}
+				stats.Conflicts++
+				switch policy {
+				case ConflictPolicyError:
+					return &MergeConflictError{item.Metric}
+				case ConflictPolicyLast:
+					newValue[index] = item
+				case ConflictPolicyDefault:
+					// TODO: better? For now we only replace if we have no value (which seems reasonable)
+					if newValue[index].Value == model.SampleValue(0) {
+						newValue[index].Value = item.Value
+					}
 				}
 			} else {
 				newValue = append(newValue, item)
 				fingerPrintMap[finger] = len(newValue) - 1
 			}
+			return nil
 		}
 
 		for _, item := range aTyped {
-			addItem(item)
+			if err := addItem(item); err != nil {
+				return nil, err
+			}
 		}
 
 		for _, item := range bTyped {
-			addItem(item)
+			if err := addItem(item); err != nil {
+				return nil, err
+			}
 		}
 		return newValue, nil
 
@@ -105,27 +253,44 @@ func MergeValues(antiAffinityBuffer model.Time, a, b model.Value) (model.Value,
 		bTyped := b.(model.Matrix)
 
 		newValue := make(model.Matrix, 0, len(aTyped)+len(bTyped))
-		fingerPrintMap := make(map[model.Fingerprint]int)
+		fingerPrintMap := make(map[model.Fingerprint]int, len(aTyped))
 
-		addStream := func(stream *model.SampleStream) {
+		addStream := func(stream *model.SampleStream) error {
 			finger := stream.Metric.Fingerprint()
 
 			// If we've seen this fingerPrint before, lets make sure that a value exists
 			if index, ok := fingerPrintMap[finger]; ok {
-				// TODO: check this error? For now the only one is sig collision, which we check
-				newValue[index], _ = MergeSampleStream(antiAffinityBuffer, newValue[index], stream)
+				stats.SeriesMerged++
+				// Conflicts are counted with any policy, for the conflicts metric
+				if conflicts := countConflicts(newValue[index], stream, epsilon); conflicts > 0 {
+					stats.Conflicts += conflicts
+					if policy == ConflictPolicyError {
+						return &MergeConflictError{stream.Metric}
+					}
+				}
+				// The fingerprints already match, so skip re-checking them in MergeSampleStream
+				if policy == ConflictPolicyLast {
+					newValue[index] = mergeSampleStream(antiAffinityBuffer, stream, newValue[index])
+				} else {
+					newValue[index] = mergeSampleStream(antiAffinityBuffer, newValue[index], stream)
+				}
 			} else {
 				newValue = append(newValue, stream)
 				fingerPrintMap[finger] = len(newValue) - 1
 			}
+			return nil
 		}
 
 		for _, item := range aTyped {
-			addStream(item)
+			if err := addStream(item); err != nil {
+				return nil, err
+			}
 		}
 
 		for _, item := range bTyped {
-			addStream(item)
+			if err := addStream(item); err != nil {
+				return nil, err
+			}
 		}
 		return newValue, nil
 	}
@@ -146,7 +311,11 @@ func MergeSampleStream(antiAffinityBuffer model.Time, a, b *model.SampleStream)
 	if a.Metric.Fingerprint() != b.Metric.Fingerprint() {
 		return nil, fmt.Errorf("Cannot merge mismatch fingerprints")
 	}
+	return mergeSampleStream(antiAffinityBuffer, a, b), nil
+}
 
+// mergeSampleStream merges SampleStreams `a` and `b` (which must be the same series)
+func mergeSampleStream(antiAffinityBuffer model.Time, a, b *model.SampleStream) *model.SampleStream {
 	// TODO: really there should be a library method for this in prometheus IMO
 	// At this point we have 2 sorted lists of datapoints which we need to merge
 	newValues := make([]model.SamplePair, 0, len(a.Values))
@@ -203,5 +372,5 @@ func MergeSampleStream(antiAffinityBuffer model.Time, a, b *model.SampleStream)
 	return &model.SampleStream{
 		Metric: a.Metric,
 		Values: newValues,
-	}, nil
+	}
 }
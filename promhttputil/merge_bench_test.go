@@ -0,0 +1,166 @@
+package promhttputil
+
+import (
+	"encoding/json"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+const (
+	benchmarkMergeSeries   = 50000
+	benchmarkMergeReplicas = 3
+	// benchmarkInternSeries is the number of series of the interning benchmark
+	benchmarkInternSeries = 100000
+)
+
+// benchmarkReplicaMatrix returns the same `benchmarkMergeSeries` series as
+// each HA replica would (with slightly skewed timestamps)
+func benchmarkReplicaMatrix(replica int) model.Matrix {
+	m := make(model.Matrix, benchmarkMergeSeries)
+	for i := range m {
+		values := make([]model.SamplePair, 10)
+		for j := range values {
+			values[j] = model.SamplePair{
+				Timestamp: model.Time(j*15000 + replica*100),
+				Value:     model.SampleValue(j),
+			}
+		}
+		m[i] = &model.SampleStream{
+			Metric: model.Metric{
+				model.MetricNameLabel: "testmetric",
+				"instance":            model.LabelValue("host" + strconv.Itoa(i)),
+				"job":                 "bench",
+			},
+			Values: values,
+		}
+	}
+	return m
+}
+
+func benchmarkReplicaVector() model.Vector {
+	v := make(model.Vector, benchmarkMergeSeries)
+	for i := range v {
+		v[i] = &model.Sample{
+			Metric: model.Metric{
+				model.MetricNameLabel: "testmetric",
+				"instance":            model.LabelValue("host" + strconv.Itoa(i)),
+				"job":                 "bench",
+			},
+			Value: 1,
+		}
+	}
+	return v
+}
+
+func BenchmarkMergeValuesMatrix(b *testing.B) {
+	replicas := make([]model.Value, benchmarkMergeReplicas)
+	for i := range replicas {
+		replicas[i] = benchmarkReplicaMatrix(i)
+	}
+	benchmarkMergeValues(b, replicas)
+}
+
+func BenchmarkMergeValuesVector(b *testing.B) {
+	replicas := make([]model.Value, benchmarkMergeReplicas)
+	for i := range replicas {
+		replicas[i] = benchmarkReplicaVector()
+	}
+	benchmarkMergeValues(b, replicas)
+}
+
+func benchmarkMergeValues(b *testing.B, replicas []model.Value) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		var result model.Value
+		for _, v := range replicas {
+			var err error
+			if result, err = MergeValues(model.Time(1000), result, v); err != nil {
+				b.Fatal(err)
+			}
+		}
+		var l int
+		switch resultTyped := result.(type) {
+		case model.Matrix:
+			l = len(resultTyped)
+		case model.Vector:
+			l = len(resultTyped)
+		}
+		if l != benchmarkMergeSeries {
+			b.Fatalf("expected %d series, got %d", benchmarkMergeSeries, l)
+		}
+	}
+}
+
+// BenchmarkMergeValuesIntern reports the memory retained by the result of
+// merging the (JSON decoded, as from the downstreams) matrices of the HA
+// replicas, with and without interning the result's label strings
+func BenchmarkMergeValuesIntern(b *testing.B) {
+	replicas := make([][]byte, benchmarkMergeReplicas)
+	for i := range replicas {
+		m := make(model.Matrix, benchmarkInternSeries)
+		for j := range m {
+			m[j] = &model.SampleStream{
+				Metric: model.Metric{
+					model.MetricNameLabel: "testmetric",
+					"instance":            model.LabelValue("host" + strconv.Itoa(j%1000)),
+					"job":                 "bench",
+					"env":                 "production",
+					"shard":               model.LabelValue(strconv.Itoa(j)),
+				},
+				Values: []model.SamplePair{{Timestamp: model.Time(i * 100), Value: 1}},
+			}
+		}
+		var err error
+		if replicas[i], err = json.Marshal(m); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, intern := range []bool{false, true} {
+		b.Run("intern="+strconv.FormatBool(intern), func(b *testing.B) {
+			var retained uint64
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				var before runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				decoded := make([]model.Matrix, len(replicas))
+				for i, replica := range replicas {
+					if err := json.Unmarshal(replica, &decoded[i]); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StartTimer()
+
+				var result model.Value
+				for _, v := range decoded {
+					var err error
+					if result, err = MergeValues(model.Time(1000), result, v); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if intern {
+					NewInterner().InternValue(result)
+				}
+
+				b.StopTimer()
+				// Only the result is retained, as in the downstream requests
+				decoded = nil
+				var after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				retained += after.HeapAlloc - before.HeapAlloc
+				if len(result.(model.Matrix)) != benchmarkInternSeries {
+					b.Fatalf("expected %d series, got %d", benchmarkInternSeries, len(result.(model.Matrix)))
+				}
+				runtime.KeepAlive(result)
+				b.StartTimer()
+			}
+			b.Logf("%.0f retained-B/op", float64(retained)/float64(b.N))
+		})
+	}
+}
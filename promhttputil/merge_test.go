@@ -1,6 +1,7 @@
 package promhttputil
 
 import (
+	"math"
 	"reflect"
 	"testing"
 
@@ -522,3 +523,159 @@ func TestMergeValues(t *testing.T) {
 	}
 
 }
+
+func TestMergeValuesStats(t *testing.T) {
+	tests := []struct {
+		name  string
+		a     model.Value
+		b     model.Value
+		stats MergeStats
+	}{
+		{
+			name:  "scalar conflict",
+			a:     &model.Scalar{model.SampleValue(10), model.Time(100)},
+			b:     &model.Scalar{model.SampleValue(11), model.Time(100)},
+			stats: MergeStats{Conflicts: 1},
+		},
+		{
+			name: "vector dedupe",
+			a: model.Vector{
+				{Metric: model.Metric{model.MetricNameLabel: "hosta"}, Value: 1},
+				{Metric: model.Metric{model.MetricNameLabel: "hostb"}, Value: 1},
+			},
+			b: model.Vector{
+				{Metric: model.Metric{model.MetricNameLabel: "hosta"}, Value: 1},
+				{Metric: model.Metric{model.MetricNameLabel: "hostb"}, Value: 2},
+				{Metric: model.Metric{model.MetricNameLabel: "hostc"}, Value: 1},
+			},
+			stats: MergeStats{SeriesDropped: 2, Conflicts: 1},
+		},
+		{
+			name: "matrix merge",
+			a: model.Matrix{
+				{Metric: model.Metric{model.MetricNameLabel: "hosta"}, Values: []model.SamplePair{{100, 1}}},
+			},
+			b: model.Matrix{
+				{Metric: model.Metric{model.MetricNameLabel: "hosta"}, Values: []model.SamplePair{{200, 1}}},
+				{Metric: model.Metric{model.MetricNameLabel: "hostb"}, Values: []model.SamplePair{{200, 1}}},
+			},
+			stats: MergeStats{SeriesMerged: 1},
+		},
+		{
+			name: "matrix conflict",
+			a: model.Matrix{
+				{Metric: model.Metric{model.MetricNameLabel: "hosta"}, Values: []model.SamplePair{{100, 1}, {200, 1}, {300, 1}}},
+			},
+			b: model.Matrix{
+				{Metric: model.Metric{model.MetricNameLabel: "hosta"}, Values: []model.SamplePair{{100, 2}, {200, 1}, {300, 3}}},
+			},
+			stats: MergeStats{SeriesMerged: 1, Conflicts: 2},
+		},
+	}
+
+	for _, test := range tests {
+		stats := MergeStats{}
+		if _, err := MergeValuesWithStats(model.Time(2), test.a, test.b, &stats); err != nil {
+			t.Fatalf("unexpected error in %s: %v", test.name, err)
+		}
+		if stats != test.stats {
+			t.Fatalf("mismatch in %s \nexpected=%+v\nactual=%+v", test.name, test.stats, stats)
+		}
+	}
+}
+
+func TestMergeValuesEpsilonStats(t *testing.T) {
+	// With the default policy too, only the values beyond the epsilon are conflicts
+	a := model.Matrix{{Metric: model.Metric{model.MetricNameLabel: "hosta"}, Values: []model.SamplePair{{100, 0.3}, {200, 1}, {300, 1}}}}
+	b := model.Matrix{{Metric: model.Metric{model.MetricNameLabel: "hosta"}, Values: []model.SamplePair{{100, model.SampleValue(math.Nextafter(0.3, 1))}, {200, 1.5}, {300, 1}}}}
+	for _, test := range []struct {
+		epsilon   float64
+		conflicts int
+	}{
+		{epsilon: 0, conflicts: 2},
+		{epsilon: 1e-9, conflicts: 1},
+		{epsilon: 0.5, conflicts: 0},
+	} {
+		stats := MergeStats{}
+		if _, err := MergeValuesWithPolicy(model.Time(0), a, b, ConflictPolicyDefault, test.epsilon, &stats); err != nil {
+			t.Fatalf("unexpected error with epsilon %v: %v", test.epsilon, err)
+		}
+		if stats.Conflicts != test.conflicts {
+			t.Fatalf("mismatch in conflicts with epsilon %v expected=%d actual=%d", test.epsilon, test.conflicts, stats.Conflicts)
+		}
+	}
+}
+
+func TestMergeValuesConflictPolicy(t *testing.T) {
+	vectorA := model.Vector{{Metric: model.Metric{model.MetricNameLabel: "hosta"}, Value: 1, Timestamp: 100}}
+	vectorB := model.Vector{{Metric: model.Metric{model.MetricNameLabel: "hosta"}, Value: 2, Timestamp: 100}}
+	matrixA := model.Matrix{{Metric: model.Metric{model.MetricNameLabel: "hosta"}, Values: []model.SamplePair{{100, 1}, {200, 1}}}}
+	matrixB := model.Matrix{{Metric: model.Metric{model.MetricNameLabel: "hosta"}, Values: []model.SamplePair{{100, 2}, {200, 1}}}}
+	// Values which differ by a ULP, as HA replicas computing 0.1+0.2 and 0.3 would
+	vectorULPA := model.Vector{{Metric: model.Metric{model.MetricNameLabel: "hosta"}, Value: 0.3, Timestamp: 100}}
+	vectorULPB := model.Vector{{Metric: model.Metric{model.MetricNameLabel: "hosta"}, Value: model.SampleValue(math.Nextafter(0.3, 1)), Timestamp: 100}}
+	matrixULPA := model.Matrix{{Metric: model.Metric{model.MetricNameLabel: "hosta"}, Values: []model.SamplePair{{100, 0.3}}}}
+	matrixULPB := model.Matrix{{Metric: model.Metric{model.MetricNameLabel: "hosta"}, Values: []model.SamplePair{{100, model.SampleValue(math.Nextafter(0.3, 1))}}}}
+
+	tests := []struct {
+		name    string
+		policy  ConflictPolicy
+		epsilon float64
+		a       model.Value
+		b       model.Value
+		r       model.Value
+		err     bool
+	}{
+		{name: "vector default", a: vectorA, b: vectorB, r: vectorA},
+		{name: "vector first", policy: ConflictPolicyFirst, a: vectorA, b: vectorB, r: vectorA},
+		{name: "vector warn", policy: ConflictPolicyWarn, a: vectorA, b: vectorB, r: vectorA},
+		{name: "vector last", policy: ConflictPolicyLast, a: vectorA, b: vectorB, r: vectorB},
+		{name: "vector error", policy: ConflictPolicyError, a: vectorA, b: vectorB, err: true},
+		{name: "vector no conflict", policy: ConflictPolicyError, a: vectorA, b: vectorA, r: vectorA},
+		{
+			name:   "scalar last",
+			policy: ConflictPolicyLast,
+			a:      &model.Scalar{model.SampleValue(1), model.Time(100)},
+			b:      &model.Scalar{model.SampleValue(2), model.Time(100)},
+			r:      &model.Scalar{model.SampleValue(2), model.Time(100)},
+		},
+		{name: "matrix first", policy: ConflictPolicyFirst, a: matrixA, b: matrixB, r: matrixA},
+		{name: "matrix last", policy: ConflictPolicyLast, a: matrixA, b: matrixB, r: matrixB},
+		{name: "matrix error", policy: ConflictPolicyError, a: matrixA, b: matrixB, err: true},
+		{name: "vector ulp", policy: ConflictPolicyError, a: vectorULPA, b: vectorULPB, err: true},
+		{name: "vector ulp epsilon", policy: ConflictPolicyError, epsilon: 1e-9, a: vectorULPA, b: vectorULPB, r: vectorULPA},
+		{name: "vector epsilon last", policy: ConflictPolicyLast, epsilon: 1e-9, a: vectorULPA, b: vectorULPB, r: vectorULPA},
+		{name: "vector beyond epsilon", policy: ConflictPolicyError, epsilon: 0.1, a: vectorA, b: vectorB, err: true},
+		{name: "matrix ulp", policy: ConflictPolicyError, a: matrixULPA, b: matrixULPB, err: true},
+		{name: "matrix ulp epsilon", policy: ConflictPolicyError, epsilon: 1e-9, a: matrixULPA, b: matrixULPB, r: matrixULPA},
+		{
+			name:    "scalar inf epsilon",
+			policy:  ConflictPolicyError,
+			epsilon: 1e-9,
+			a:       &model.Scalar{model.SampleValue(math.Inf(1)), model.Time(100)},
+			b:       &model.Scalar{model.SampleValue(math.MaxFloat64), model.Time(100)},
+			err:     true,
+		},
+	}
+
+	for _, test := range tests {
+		stats := MergeStats{}
+		result, err := MergeValuesWithPolicy(model.Time(0), test.a, test.b, test.policy, test.epsilon, &stats)
+		if (err != nil) != test.err {
+			t.Fatalf("mismatch err in %s expected=%v actual=%v", test.name, test.err, err)
+		}
+		if err != nil {
+			if _, ok := err.(*MergeConflictError); !ok {
+				t.Fatalf("unexpected error type in %s: %v", test.name, err)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(result, test.r) {
+			t.Fatalf("mismatch in %s \nexpected=%v\nactual=%v", test.name, test.r, result)
+		}
+	}
+
+	if err := ConflictPolicy("newest").Validate(); err == nil {
+		t.Fatalf("expected an error for an unknown policy")
+	}
+}
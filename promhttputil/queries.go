@@ -0,0 +1,191 @@
+package promhttputil
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jacksontj/promxy/logging"
+)
+
+type activeQueryKey struct{}
+
+// ActiveQuery is a query being handled, as listed by a QueryRegistry
+type ActiveQuery struct {
+	// ID is the request ID of the query (see logging.RequestID)
+	ID    string    `json:"id"`
+	Path  string    `json:"path"`
+	Query string    `json:"query"`
+	Start time.Time `json:"start"`
+	// Age is how long (in seconds) the query has been running
+	Age float64 `json:"age"`
+	// Targets is the number of downstreams the query has sent requests to,
+	// and InFlight the number of its requests which haven't returned yet
+	Targets  int `json:"targets"`
+	InFlight int `json:"inFlight"`
+}
+
+// activeQuery is the state of a query in a QueryRegistry
+type activeQuery struct {
+	id     string
+	path   string
+	query  string
+	start  time.Time
+	cancel context.CancelFunc
+
+	l        sync.Mutex
+	targets  map[string]struct{}
+	inFlight int
+}
+
+// addRequest records a request to the downstream `host`, returning the func
+// to call once it returns
+func (q *activeQuery) addRequest(host string) func() {
+	q.l.Lock()
+	defer q.l.Unlock()
+	q.targets[host] = struct{}{}
+	q.inFlight++
+	return func() {
+		q.l.Lock()
+		defer q.l.Unlock()
+		q.inFlight--
+	}
+}
+
+// QueryRegistry tracks the queries being handled, so they can be listed and
+// canceled (e.g. a runaway query overwhelming the downstreams)
+type QueryRegistry struct {
+	l       sync.Mutex
+	queries map[*activeQuery]struct{}
+	// draining is set once the registry is drained (see Drain), and drained
+	// is closed once the last active query is done
+	draining bool
+	drained  chan struct{}
+}
+
+// NewQueryRegistry returns an empty QueryRegistry
+func NewQueryRegistry() *QueryRegistry {
+	return &QueryRegistry{queries: make(map[*activeQuery]struct{})}
+}
+
+// List returns the active queries, oldest first
+func (r *QueryRegistry) List() []ActiveQuery {
+	r.l.Lock()
+	defer r.l.Unlock()
+	now := time.Now()
+	queries := make([]ActiveQuery, 0, len(r.queries))
+	for q := range r.queries {
+		q.l.Lock()
+		queries = append(queries, ActiveQuery{
+			ID:       q.id,
+			Path:     q.path,
+			Query:    q.query,
+			Start:    q.start,
+			Age:      now.Sub(q.start).Seconds(),
+			Targets:  len(q.targets),
+			InFlight: q.inFlight,
+		})
+		q.l.Unlock()
+	}
+	sort.Slice(queries, func(i, j int) bool { return queries[i].Start.Before(queries[j].Start) })
+	return queries
+}
+
+// Cancel cancels the active queries with the request ID `id` (normally one,
+// unless clients reused the ID), returning how many were canceled
+func (r *QueryRegistry) Cancel(id string) int {
+	r.l.Lock()
+	defer r.l.Unlock()
+	canceled := 0
+	for q := range r.queries {
+		if q.id == id {
+			q.cancel()
+			canceled++
+		}
+	}
+	return canceled
+}
+
+// Drain rejects new queries (with a 503) and waits for the active queries to
+// complete, for a graceful shutdown. If `ctx` is done first the remaining
+// queries are canceled, Drain returns how many were.
+func (r *QueryRegistry) Drain(ctx context.Context) int {
+	r.l.Lock()
+	r.draining = true
+	if len(r.queries) == 0 {
+		r.l.Unlock()
+		return 0
+	}
+	if r.drained == nil {
+		r.drained = make(chan struct{})
+	}
+	drained := r.drained
+	r.l.Unlock()
+
+	select {
+	case <-drained:
+		return 0
+	case <-ctx.Done():
+	}
+	r.l.Lock()
+	defer r.l.Unlock()
+	for q := range r.queries {
+		q.cancel()
+	}
+	return len(r.queries)
+}
+
+// NewQueryRegistryHandler returns an http.Handler which tracks the requests
+// to the query endpoints (see IsQueryPath) in `registry` while they are
+// handled, with a context which is canceled if the query is. Queries are
+// rejected once the registry is drained.
+func NewQueryRegistryHandler(registry *QueryRegistry, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsQueryPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		q := &activeQuery{
+			id:      logging.RequestID(ctx),
+			path:    r.URL.Path,
+			query:   r.FormValue("query"),
+			start:   time.Now(),
+			cancel:  cancel,
+			targets: make(map[string]struct{}),
+		}
+		registry.l.Lock()
+		if registry.draining {
+			registry.l.Unlock()
+			http.Error(w, "promxy is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		registry.queries[q] = struct{}{}
+		registry.l.Unlock()
+		defer func() {
+			registry.l.Lock()
+			delete(registry.queries, q)
+			if len(registry.queries) == 0 && registry.drained != nil {
+				close(registry.drained)
+				registry.drained = nil
+			}
+			registry.l.Unlock()
+		}()
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, activeQueryKey{}, q)))
+	})
+}
+
+// AddDownstreamRequest records a request to the downstream `host` in the
+// active query of `ctx` (if it has one), returning the func to call once the
+// request returns
+func AddDownstreamRequest(ctx context.Context, host string) func() {
+	if q, ok := ctx.Value(activeQueryKey{}).(*activeQuery); ok {
+		return q.addRequest(host)
+	}
+	return func() {}
+}
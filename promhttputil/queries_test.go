@@ -0,0 +1,131 @@
+package promhttputil
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jacksontj/promxy/logging"
+)
+
+func TestQueryRegistry(t *testing.T) {
+	registry := NewQueryRegistry()
+	started := make(chan struct{})
+	h := NewQueryRegistryHandler(registry, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		done := AddDownstreamRequest(r.Context(), "a:9090")
+		AddDownstreamRequest(r.Context(), "b:9090")()
+		close(started)
+		// Run until the query is canceled
+		<-r.Context().Done()
+		done()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+
+	req := httptest.NewRequest("GET", "/api/v1/query?query=up", nil)
+	req = req.WithContext(logging.WithRequestID(req.Context(), "abc"))
+	rec := httptest.NewRecorder()
+	finished := make(chan struct{})
+	go func() {
+		h.ServeHTTP(rec, req)
+		close(finished)
+	}()
+	<-started
+
+	queries := registry.List()
+	if len(queries) != 1 {
+		t.Fatalf("expected 1 active query, got %v", queries)
+	}
+	if q := queries[0]; q.ID != "abc" || q.Query != "up" || q.Targets != 2 || q.InFlight != 1 {
+		t.Fatalf("mismatch in active query: %+v", q)
+	}
+
+	if canceled := registry.Cancel("other"); canceled != 0 {
+		t.Fatalf("canceled a query with another id")
+	}
+	if canceled := registry.Cancel("abc"); canceled != 1 {
+		t.Fatalf("expected 1 canceled query, got %d", canceled)
+	}
+	<-finished
+	if queries := registry.List(); len(queries) != 0 {
+		t.Fatalf("the finished query is still active: %v", queries)
+	}
+
+	// Other requests aren't tracked
+	h = NewQueryRegistryHandler(registry, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(registry.List()) != 0 {
+			t.Fatalf("a label request was tracked")
+		}
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/labels", nil))
+}
+
+func TestQueryRegistryDrain(t *testing.T) {
+	registry := NewQueryRegistry()
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	query := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		// The "up" query completes once released, the others run until they are canceled
+		if r.FormValue("query") == "up" {
+			<-release
+		} else {
+			<-r.Context().Done()
+		}
+	})
+	h := NewQueryRegistryHandler(registry, query)
+	serve := func(query string) <-chan *httptest.ResponseRecorder {
+		finished := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/query?query="+query, nil))
+			finished <- rec
+		}()
+		return finished
+	}
+
+	// Drain waits for the in-flight queries to complete
+	finished := serve("up")
+	<-started
+	drained := make(chan int)
+	go func() { drained <- registry.Drain(context.Background()) }()
+	for {
+		registry.l.Lock()
+		draining := registry.draining
+		registry.l.Unlock()
+		if draining {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// New queries are rejected while draining
+	if rec := <-serve("down"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("new query wasn't rejected while draining: %d", rec.Code)
+	}
+	select {
+	case <-drained:
+		t.Fatalf("drained with a query in flight")
+	default:
+	}
+	close(release)
+	if canceled := <-drained; canceled != 0 {
+		t.Fatalf("expected no canceled queries, got %d", canceled)
+	}
+	if rec := <-finished; rec.Code != http.StatusOK {
+		t.Fatalf("in-flight query failed: %d", rec.Code)
+	}
+
+	// The queries which don't complete in time are canceled
+	registry = NewQueryRegistry()
+	h = NewQueryRegistryHandler(registry, query)
+	finished = serve("slow")
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if canceled := registry.Drain(ctx); canceled != 1 {
+		t.Fatalf("expected 1 canceled query, got %d", canceled)
+	}
+	<-finished
+}
@@ -0,0 +1,80 @@
+package promhttputil
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Response is the envelope for all responses from the prometheus API
+type Response struct {
+	Status    Status      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType ErrorType   `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// APIError is an error (with type) to return to the client
+type APIError struct {
+	Typ ErrorType
+	Err error
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Typ, e.Err)
+}
+
+// Respond writes `data` to `w` as a successful prometheus API response
+func Respond(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(&Response{
+		Status: StatusSuccess,
+		Data:   data,
+	})
+}
+
+// RespondError writes `apiErr` to `w` as a prometheus API error response with
+// the same status codes that prometheus would return
+func RespondError(w http.ResponseWriter, apiErr *APIError, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var code int
+	switch apiErr.Typ {
+	case ErrorBadData:
+		code = http.StatusBadRequest
+	case ErrorExec:
+		code = 422
+	case ErrorCanceled, ErrorTimeout:
+		code = http.StatusServiceUnavailable
+	case ErrorInternal:
+		code = http.StatusInternalServerError
+	default:
+		code = http.StatusInternalServerError
+	}
+	w.WriteHeader(code)
+
+	json.NewEncoder(w).Encode(&Response{
+		Status:    StatusError,
+		ErrorType: apiErr.Typ,
+		Error:     apiErr.Err.Error(),
+		Data:      data,
+	})
+}
+
+// ParseTime parses a time in the same formats that the prometheus API accepts
+// (copy of the private method in prometheus' API)
+func ParseTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		s, ns := math.Modf(t)
+		return time.Unix(int64(s), int64(ns*float64(time.Second))), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
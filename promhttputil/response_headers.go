@@ -0,0 +1,145 @@
+package promhttputil
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// ResponseHeaderPolicy is how the values of a forwarded response header from
+// several downstream responses (of the fan-out of a request) are combined
+type ResponseHeaderPolicy string
+
+const (
+	// ResponseHeaderPolicyFirst keeps the values of the first response with the header (the default)
+	ResponseHeaderPolicyFirst ResponseHeaderPolicy = "first"
+	// ResponseHeaderPolicyConcat keeps the (distinct) values of all the responses with the header
+	ResponseHeaderPolicyConcat ResponseHeaderPolicy = "concat"
+)
+
+// Validate returns an error if the policy isn't a known ResponseHeaderPolicy
+func (p ResponseHeaderPolicy) Validate() error {
+	switch p {
+	case "", ResponseHeaderPolicyFirst, ResponseHeaderPolicyConcat:
+		return nil
+	}
+	return fmt.Errorf("unknown response header policy %q, must be one of first or concat", string(p))
+}
+
+type responseHeadersKey struct{}
+
+// ResponseHeaders collects the headers to forward to the client from the
+// downstream responses of a request
+type ResponseHeaders struct {
+	l      sync.Mutex
+	names  []string
+	policy ResponseHeaderPolicy
+	header http.Header
+}
+
+// Add adds the forwarded headers of the downstream response header `header`
+func (h *ResponseHeaders) Add(header http.Header) {
+	h.l.Lock()
+	defer h.l.Unlock()
+	for _, name := range h.names {
+		values := header[name]
+		if len(values) == 0 {
+			continue
+		}
+		existing, ok := h.header[name]
+		if !ok {
+			h.header[name] = append([]string(nil), values...)
+			continue
+		}
+		if h.policy != ResponseHeaderPolicyConcat {
+			continue
+		}
+		for _, value := range values {
+			if !containsString(existing, value) {
+				existing = append(existing, value)
+			}
+		}
+		h.header[name] = existing
+	}
+}
+
+// Header returns the headers collected so far
+func (h *ResponseHeaders) Header() http.Header {
+	h.l.Lock()
+	defer h.l.Unlock()
+	header := make(http.Header, len(h.header))
+	for name, values := range h.header {
+		header[name] = append([]string(nil), values...)
+	}
+	return header
+}
+
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
+
+// WithResponseHeaders returns a copy of `ctx` which collects the headers
+// `names` of its downstream responses, combined with `policy`
+func WithResponseHeaders(ctx context.Context, names []string, policy ResponseHeaderPolicy) (context.Context, *ResponseHeaders) {
+	h := &ResponseHeaders{policy: policy, header: make(http.Header)}
+	for _, name := range names {
+		h.names = append(h.names, http.CanonicalHeaderKey(name))
+	}
+	return context.WithValue(ctx, responseHeadersKey{}, h), h
+}
+
+// AddResponseHeaders adds the downstream response header `header` to the
+// ResponseHeaders of `ctx` (if there are any)
+func AddResponseHeaders(ctx context.Context, header http.Header) {
+	if h, ok := ctx.Value(responseHeadersKey{}).(*ResponseHeaders); ok {
+		h.Add(header)
+	}
+}
+
+// NewResponseHeadersWriter returns an http.ResponseWriter which sets the
+// headers collected in `headers` on the response before they are written.
+// Headers the response already has (set by promxy itself) are kept.
+func NewResponseHeadersWriter(w http.ResponseWriter, headers *ResponseHeaders) http.ResponseWriter {
+	return &responseHeadersWriter{w, headers, false}
+}
+
+type responseHeadersWriter struct {
+	http.ResponseWriter
+	headers       *ResponseHeaders
+	headerWritten bool
+}
+
+func (w *responseHeadersWriter) WriteHeader(code int) {
+	if !w.headerWritten {
+		w.headerWritten = true
+		for name, values := range w.headers.Header() {
+			if _, ok := w.Header()[name]; !ok {
+				w.Header()[name] = values
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseHeadersWriter) Write(b []byte) (int, error) {
+	if !w.headerWritten {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends the response written so far (with its headers) to the client
+func (w *responseHeadersWriter) Flush() {
+	if !w.headerWritten {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,52 @@
+package promhttputil
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestResponseHeaders(t *testing.T) {
+	responses := []http.Header{
+		{"Deprecation": []string{"true"}, "X-Other": []string{"a"}},
+		{"Deprecation": []string{"false"}},
+		{"Deprecation": []string{"true"}},
+	}
+	tests := []struct {
+		policy   ResponseHeaderPolicy
+		expected []string
+	}{
+		{"", []string{"true"}},
+		{ResponseHeaderPolicyFirst, []string{"true"}},
+		{ResponseHeaderPolicyConcat, []string{"true", "false"}},
+	}
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			ctx, headers := WithResponseHeaders(context.TODO(), []string{"deprecation"}, test.policy)
+			for _, header := range responses {
+				AddResponseHeaders(ctx, header)
+			}
+
+			rec := httptest.NewRecorder()
+			w := NewResponseHeadersWriter(rec, headers)
+			w.Write([]byte("{}"))
+			// Only the listed headers are forwarded
+			if expected := (http.Header{"Deprecation": test.expected}); !reflect.DeepEqual(rec.Header(), expected) {
+				t.Fatalf("mismatch in headers: expected=%v actual=%v", expected, rec.Header())
+			}
+		})
+	}
+
+	// Headers set by promxy itself are kept
+	ctx, headers := WithResponseHeaders(context.TODO(), []string{"Content-Type"}, ResponseHeaderPolicyFirst)
+	AddResponseHeaders(ctx, http.Header{"Content-Type": []string{"text/plain"}})
+	rec := httptest.NewRecorder()
+	w := NewResponseHeadersWriter(rec, headers)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("promxy's header was replaced: %v", ct)
+	}
+}
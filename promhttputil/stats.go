@@ -0,0 +1,204 @@
+package promhttputil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// StatsParam is the API parameter requesting the stats of a query
+const StatsParam = "stats"
+
+type statsKey struct{}
+
+// ServerGroupStats are the stats of the requests to a server group while
+// handling a request. The ExecQueueTime and EvalTotalTime are the (summed)
+// timings reported by the downstreams.
+type ServerGroupStats struct {
+	Requests      int     `json:"requests"`
+	RequestTime   float64 `json:"requestTime"`
+	ExecQueueTime float64 `json:"execQueueTime"`
+	EvalTotalTime float64 `json:"evalTotalTime"`
+}
+
+// Stats collects the stats of the fan-out (per server group) and the merging
+// of the results while handling a request
+type Stats struct {
+	l            sync.Mutex
+	totalTime    time.Duration
+	mergeTime    time.Duration
+	serverGroups map[string]*ServerGroupStats
+}
+
+// AddServerGroup adds a request to server group `name` which took `took`, and
+// the timings (in seconds) the downstream reported for it
+func (s *Stats) AddServerGroup(name string, took time.Duration, execQueueTime, evalTotalTime float64) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	sg, ok := s.serverGroups[name]
+	if !ok {
+		sg = &ServerGroupStats{}
+		s.serverGroups[name] = sg
+	}
+	sg.Requests++
+	sg.RequestTime += took.Seconds()
+	sg.ExecQueueTime += execQueueTime
+	sg.EvalTotalTime += evalTotalTime
+}
+
+// AddMergeTime adds `took` to the time spent merging results
+func (s *Stats) AddMergeTime(took time.Duration) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.mergeTime += took
+}
+
+// SetTotalTime sets the total time spent handling the request to `took`
+func (s *Stats) SetTotalTime(took time.Duration) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.totalTime = took
+}
+
+// Add adds the server group stats and merge time of `other` (not its total time)
+func (s *Stats) Add(other *Stats) {
+	serverGroups := other.ServerGroups()
+	other.l.Lock()
+	mergeTime := other.mergeTime
+	other.l.Unlock()
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.mergeTime += mergeTime
+	for name, otherSG := range serverGroups {
+		sg, ok := s.serverGroups[name]
+		if !ok {
+			sg = &ServerGroupStats{}
+			s.serverGroups[name] = sg
+		}
+		sg.Requests += otherSG.Requests
+		sg.RequestTime += otherSG.RequestTime
+		sg.ExecQueueTime += otherSG.ExecQueueTime
+		sg.EvalTotalTime += otherSG.EvalTotalTime
+	}
+}
+
+// ServerGroups returns the stats of each server group (by name) so far
+func (s *Stats) ServerGroups() map[string]ServerGroupStats {
+	s.l.Lock()
+	defer s.l.Unlock()
+	serverGroups := make(map[string]ServerGroupStats, len(s.serverGroups))
+	for name, sg := range s.serverGroups {
+		serverGroups[name] = *sg
+	}
+	return serverGroups
+}
+
+// MarshalJSON implements the json.Marshaler interface
+func (s *Stats) MarshalJSON() ([]byte, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return json.Marshal(struct {
+		TotalTime    float64                      `json:"totalTime"`
+		MergeTime    float64                      `json:"mergeTime"`
+		ServerGroups map[string]*ServerGroupStats `json:"serverGroups"`
+	}{s.totalTime.Seconds(), s.mergeTime.Seconds(), s.serverGroups})
+}
+
+// WithStats returns a copy of `ctx` which collects the stats of handling it
+func WithStats(ctx context.Context) (context.Context, *Stats) {
+	s := &Stats{serverGroups: make(map[string]*ServerGroupStats)}
+	return context.WithValue(ctx, statsKey{}, s), s
+}
+
+// GetStats returns the Stats of `ctx` (nil if stats weren't requested)
+func GetStats(ctx context.Context) *Stats {
+	s, _ := ctx.Value(statsKey{}).(*Stats)
+	return s
+}
+
+// AddMergeTime adds `took` to the merge time of the Stats of `ctx` (if there are any)
+func AddMergeTime(ctx context.Context, took time.Duration) {
+	if s := GetStats(ctx); s != nil {
+		s.AddMergeTime(took)
+	}
+}
+
+// NewStatsHandler returns an http.Handler which collects the Stats of handling
+// each request with the StatsParam set, and adds them to the stats of the
+// response (as data.stats.promxy). The vendored API doesn't marshal the stats
+// of its engine, so these are all the stats of the response.
+func NewStatsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue(StatsParam) == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, stats := WithStats(r.Context())
+		buf := &bufferedResponseWriter{ResponseWriter: w, code: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(buf, r.WithContext(ctx))
+		stats.SetTotalTime(time.Since(start))
+
+		body := buf.body.Bytes()
+		if buf.code == http.StatusOK && w.Header().Get("Content-Encoding") == "" {
+			if b, err := addStats(body, stats); err == nil {
+				body = b
+			}
+		}
+		w.WriteHeader(buf.code)
+		w.Write(body)
+	})
+}
+
+// addStats returns the API response `body` with `stats` added to its data.stats
+func addStats(body []byte, stats *Stats) ([]byte, error) {
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(resp["data"], &data); err != nil {
+		return nil, err
+	}
+	dataStats := make(map[string]json.RawMessage)
+	if raw, ok := data["stats"]; ok {
+		if err := json.Unmarshal(raw, &dataStats); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if dataStats["promxy"], err = json.Marshal(stats); err != nil {
+		return nil, err
+	}
+	if data["stats"], err = json.Marshal(dataStats); err != nil {
+		return nil, err
+	}
+	if resp["data"], err = json.Marshal(data); err != nil {
+		return nil, err
+	}
+	return json.Marshal(resp)
+}
+
+// bufferedResponseWriter buffers the response so it can be modified before it is written
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) WriteHeader(code int) {
+	w.code = code
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// Flush does nothing, the response is only written once it is complete
+func (w *bufferedResponseWriter) Flush() {}
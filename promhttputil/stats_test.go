@@ -0,0 +1,58 @@
+package promhttputil
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStatsHandler(t *testing.T) {
+	h := NewStatsHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if stats := GetStats(r.Context()); stats != nil {
+			stats.AddServerGroup("a", time.Second, 0.5, 0.25)
+			stats.AddServerGroup("a", time.Second, 0.5, 0.25)
+			AddMergeTime(r.Context(), time.Second)
+		}
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[],"stats":{"timings":{"evalTotalTime":1}}}}`))
+	}))
+
+	// Without the stats param the response is untouched
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/query?query=up", nil))
+	if body := rec.Body.String(); body != `{"status":"success","data":{"resultType":"vector","result":[],"stats":{"timings":{"evalTotalTime":1}}}}` {
+		t.Fatalf("unexpected body: %s", body)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/query?query=up&stats=all", nil))
+	var resp struct {
+		Data struct {
+			Stats struct {
+				Timings map[string]float64 `json:"timings"`
+				Promxy  struct {
+					TotalTime    float64                      `json:"totalTime"`
+					MergeTime    float64                      `json:"mergeTime"`
+					ServerGroups map[string]*ServerGroupStats `json:"serverGroups"`
+				} `json:"promxy"`
+			} `json:"stats"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	stats := resp.Data.Stats
+	if stats.Timings["evalTotalTime"] != 1 {
+		t.Fatalf("the existing stats weren't kept: %v", stats.Timings)
+	}
+	if stats.Promxy.TotalTime <= 0 {
+		t.Fatalf("mismatch in total time: %v", stats.Promxy.TotalTime)
+	}
+	if stats.Promxy.MergeTime != 1 {
+		t.Fatalf("mismatch in merge time: %v", stats.Promxy.MergeTime)
+	}
+	if sg := stats.Promxy.ServerGroups["a"]; sg == nil || *sg != (ServerGroupStats{2, 2, 1, 0.5}) {
+		t.Fatalf("mismatch in server group stats: %v", sg)
+	}
+}
@@ -0,0 +1,101 @@
+package promhttputil
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+// minAdaptiveSamples is the number of latencies needed for a range before the
+// adaptive timeout is derived from them
+const minAdaptiveSamples = 10
+
+// NewAdaptiveTimeout returns an AdaptiveTimeout whose timeouts are `multiplier`
+// times the `percentile` (0 < percentile <= 1) of the last `window` latencies
+// of queries covering a similar range, bounded by `min` and `max`
+func NewAdaptiveTimeout(percentile, multiplier float64, min, max time.Duration, window int) *AdaptiveTimeout {
+	return &AdaptiveTimeout{
+		percentile: percentile,
+		multiplier: multiplier,
+		min:        min,
+		max:        max,
+		window:     window,
+		buckets:    make(map[int]*latencyWindow),
+	}
+}
+
+// AdaptiveTimeout derives the timeout of queries from the recent latencies of
+// queries covering a similar range: a generous timeout for the range of slow
+// queries while queries of a fast range fail quickly (e.g. on a dead
+// downstream). Ranges are bucketed by powers of 2 of their duration in hours,
+// with instant queries in their own bucket. It is safe for concurrent use.
+type AdaptiveTimeout struct {
+	percentile float64
+	multiplier float64
+	min, max   time.Duration
+	window     int
+
+	l       sync.Mutex
+	buckets map[int]*latencyWindow
+}
+
+// latencyWindow is a ring buffer of the last latencies
+type latencyWindow struct {
+	latencies []time.Duration
+	next      int
+}
+
+// rangeBucket returns the bucket of queries covering `r` (0 for instant queries)
+func rangeBucket(r time.Duration) int {
+	if r <= 0 {
+		return 0
+	}
+	return bits.Len64(uint64(r/time.Hour)) + 1
+}
+
+// Observe records that a query covering `r` took `took`
+func (a *AdaptiveTimeout) Observe(r, took time.Duration) {
+	a.l.Lock()
+	defer a.l.Unlock()
+	bucket := rangeBucket(r)
+	w, ok := a.buckets[bucket]
+	if !ok {
+		w = &latencyWindow{latencies: make([]time.Duration, 0, a.window)}
+		a.buckets[bucket] = w
+	}
+	if len(w.latencies) < a.window {
+		w.latencies = append(w.latencies, took)
+		return
+	}
+	w.latencies[w.next] = took
+	w.next = (w.next + 1) % a.window
+}
+
+// Timeout returns the timeout for a query covering `r`
+func (a *AdaptiveTimeout) Timeout(r time.Duration) time.Duration {
+	a.l.Lock()
+	w, ok := a.buckets[rangeBucket(r)]
+	if !ok || len(w.latencies) < minAdaptiveSamples {
+		a.l.Unlock()
+		return a.max
+	}
+	latencies := append([]time.Duration(nil), w.latencies...)
+	a.l.Unlock()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	// The nearest-rank percentile
+	i := int(math.Ceil(float64(len(latencies))*a.percentile)) - 1
+	if i < 0 {
+		i = 0
+	}
+	timeout := time.Duration(float64(latencies[i]) * a.multiplier)
+	if timeout < a.min {
+		return a.min
+	}
+	if timeout > a.max {
+		return a.max
+	}
+	return timeout
+}
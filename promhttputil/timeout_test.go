@@ -0,0 +1,50 @@
+package promhttputil
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveTimeout(t *testing.T) {
+	a := NewAdaptiveTimeout(0.9, 2, time.Second, time.Minute, 20)
+
+	// Fast instant queries, slow long range queries
+	for i := 1; i <= 20; i++ {
+		a.Observe(0, time.Duration(i)*10*time.Millisecond)
+		a.Observe(7*24*time.Hour, time.Duration(i)*time.Second)
+	}
+	// A single slow query for a short range
+	a.Observe(30*time.Minute, time.Hour)
+
+	tests := []struct {
+		r       time.Duration
+		timeout time.Duration
+	}{
+		// p90 of 10ms..200ms is 180ms, *2 is under the min
+		{0, time.Second},
+		// p90 of 1s..20s is 18s, *2
+		{7 * 24 * time.Hour, 36 * time.Second},
+		// A similar range is in the same bucket
+		{6 * 24 * time.Hour, 36 * time.Second},
+		// Not enough latencies for the range
+		{30 * time.Minute, time.Minute},
+		{time.Hour, time.Minute},
+	}
+
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if timeout := a.Timeout(test.r); timeout != test.timeout {
+				t.Fatalf("mismatch in timeout expected=%s actual=%s", test.timeout, timeout)
+			}
+		})
+	}
+
+	// The window only keeps the latest latencies, which are capped at the max
+	for i := 0; i < 20; i++ {
+		a.Observe(7*24*time.Hour, time.Hour)
+	}
+	if timeout := a.Timeout(7 * 24 * time.Hour); timeout != time.Minute {
+		t.Fatalf("mismatch in timeout expected=%s actual=%s", time.Minute, timeout)
+	}
+}
@@ -0,0 +1,88 @@
+package promhttputil
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// WarningsHeader is the HTTP response header the warnings for a request are returned in
+const WarningsHeader = "X-Promxy-Warning"
+
+type warningsKey struct{}
+
+// Warnings collects the (non-fatal) warnings encountered while handling a request
+type Warnings struct {
+	l        sync.Mutex
+	warnings []string
+}
+
+// Add adds a warning
+func (w *Warnings) Add(warning string) {
+	w.l.Lock()
+	defer w.l.Unlock()
+	w.warnings = append(w.warnings, warning)
+}
+
+// Warnings returns all of the warnings added so far
+func (w *Warnings) Warnings() []string {
+	w.l.Lock()
+	defer w.l.Unlock()
+	return append([]string(nil), w.warnings...)
+}
+
+// WithWarnings returns a copy of `ctx` which collects any warnings added to it
+func WithWarnings(ctx context.Context) (context.Context, *Warnings) {
+	w := &Warnings{}
+	return context.WithValue(ctx, warningsKey{}, w), w
+}
+
+// AddWarning adds a warning to the Warnings of `ctx` (if there are any)
+func AddWarning(ctx context.Context, warning string) {
+	if w, ok := ctx.Value(warningsKey{}).(*Warnings); ok {
+		w.Add(warning)
+	}
+}
+
+// NewWarningsHandler returns an http.Handler which collects the warnings from
+// handling each request and returns them in the WarningsHeader of the response
+func NewWarningsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, warnings := WithWarnings(r.Context())
+		next.ServeHTTP(&warningsResponseWriter{w, warnings, false}, r.WithContext(ctx))
+	})
+}
+
+// warningsResponseWriter adds the warnings to the headers before they are written
+type warningsResponseWriter struct {
+	http.ResponseWriter
+	warnings      *Warnings
+	headerWritten bool
+}
+
+func (w *warningsResponseWriter) WriteHeader(code int) {
+	if !w.headerWritten {
+		w.headerWritten = true
+		for _, warning := range w.warnings.Warnings() {
+			w.Header().Add(WarningsHeader, warning)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *warningsResponseWriter) Write(b []byte) (int, error) {
+	if !w.headerWritten {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends the response written so far (with its headers) to the client
+func (w *warningsResponseWriter) Flush() {
+	if !w.headerWritten {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
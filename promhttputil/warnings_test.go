@@ -0,0 +1,23 @@
+package promhttputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestWarningsHandler(t *testing.T) {
+	h := NewWarningsHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		AddWarning(r.Context(), "a")
+		AddWarning(r.Context(), "b")
+		w.Write([]byte("{}"))
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/label/a/values", nil))
+
+	if warnings := rec.Header()[WarningsHeader]; !reflect.DeepEqual(warnings, []string{"a", "b"}) {
+		t.Fatalf("mismatch in warnings: %v", warnings)
+	}
+}
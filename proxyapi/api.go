@@ -0,0 +1,143 @@
+package proxyapi
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/common/route"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/rules"
+
+	"github.com/jacksontj/promxy/promclient"
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+type apiFunc func(r *http.Request) (interface{}, *promhttputil.APIError)
+
+// NewAPI returns an API which will use the promclient.API returned by `client`
+// for each request, and `ruleManager` for the rules promxy itself is evaluating
+func NewAPI(client func() promclient.API, ruleManager *rules.Manager) *API {
+	return &API{client: client, ruleManager: ruleManager}
+}
+
+// API implements the HTTP API endpoints that promxy serves itself (as opposed
+// to the ones served by the upstream prometheus API)
+type API struct {
+	client      func() promclient.API
+	ruleManager *rules.Manager
+}
+
+// Register the API's endpoints in the given router.
+func (a *API) Register(r *route.Router) {
+	wrap := func(f apiFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			data, err := f(r)
+			if err != nil {
+				promhttputil.RespondError(w, err, data)
+			} else {
+				promhttputil.Respond(w, data)
+			}
+		}
+	}
+
+	r.Get("/labels", wrap(a.labelNames))
+	r.Post("/labels", wrap(a.labelNames))
+
+	r.Get("/rules", wrap(a.rules))
+	r.Get("/alerts", wrap(a.alerts))
+}
+
+// labelNames implements the /api/v1/labels endpoint
+func (a *API) labelNames(r *http.Request) (interface{}, *promhttputil.APIError) {
+	if err := r.ParseForm(); err != nil {
+		return nil, &promhttputil.APIError{Typ: promhttputil.ErrorBadData, Err: err}
+	}
+
+	start, end, apiErr := parseTimeRange(r)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	// Validate the matchers before we fan them out
+	for _, s := range r.Form["match[]"] {
+		if _, err := promql.ParseMetricSelector(s); err != nil {
+			return nil, &promhttputil.APIError{Typ: promhttputil.ErrorBadData, Err: err}
+		}
+	}
+
+	names, err := a.client().LabelNames(r.Context(), r.Form["match[]"], start, end)
+	if err != nil {
+		return nil, execError(err)
+	}
+	if names == nil {
+		names = []string{}
+	}
+	return names, nil
+}
+
+// rules implements the /api/v1/rules endpoint, this includes both the rules
+// promxy is evaluating and the rules loaded on all of the downstreams
+func (a *API) rules(r *http.Request) (interface{}, *promhttputil.APIError) {
+	downstream, err := a.client().Rules(r.Context())
+	if err != nil {
+		return nil, execError(err)
+	}
+
+	result := ruleGroupsToResult(a.ruleManager.RuleGroups())
+	result.Groups = append(result.Groups, downstream.Groups...)
+	return rulesResultToResponse(result), nil
+}
+
+// alerts implements the /api/v1/alerts endpoint, this includes both the alerts
+// from rules promxy is evaluating and the alerts from all of the downstreams
+// (scoped to the matchers the request requires, see promclient.ScopeAlerts)
+func (a *API) alerts(r *http.Request) (interface{}, *promhttputil.APIError) {
+	downstream, err := a.client().Alerts(r.Context())
+	if err != nil {
+		return nil, execError(err)
+	}
+
+	result := alertingRulesToResult(a.ruleManager.AlertingRules())
+	result.Alerts = append(promclient.ScopeAlerts(r.Context(), result.Alerts), downstream.Alerts...)
+	return alertsResultToResponse(result), nil
+}
+
+// execError returns the APIError for an error encountered while executing a
+// request, so that timeouts etc. are returned as their proper error type
+func execError(err error) *promhttputil.APIError {
+	err = promclient.PromError(err)
+	switch err.(type) {
+	case promql.ErrQueryTimeout:
+		return &promhttputil.APIError{Typ: promhttputil.ErrorTimeout, Err: err}
+	case promql.ErrQueryCanceled:
+		return &promhttputil.APIError{Typ: promhttputil.ErrorCanceled, Err: err}
+	}
+	return &promhttputil.APIError{Typ: promhttputil.ErrorExec, Err: err}
+}
+
+// parseTimeRange parses the (optional) start/end parameters of the request. If
+// they aren't defined the zero time.Time is returned
+func parseTimeRange(r *http.Request) (start, end time.Time, apiErr *promhttputil.APIError) {
+	if t := r.FormValue("start"); t != "" {
+		var err error
+		start, err = promhttputil.ParseTime(t)
+		if err != nil {
+			return start, end, &promhttputil.APIError{Typ: promhttputil.ErrorBadData, Err: err}
+		}
+	}
+
+	if t := r.FormValue("end"); t != "" {
+		var err error
+		end, err = promhttputil.ParseTime(t)
+		if err != nil {
+			return start, end, &promhttputil.APIError{Typ: promhttputil.ErrorBadData, Err: err}
+		}
+	}
+
+	if !start.IsZero() && !end.IsZero() && end.Before(start) {
+		return start, end, &promhttputil.APIError{Typ: promhttputil.ErrorBadData, Err: fmt.Errorf("end timestamp must not be before start time")}
+	}
+
+	return start, end, nil
+}
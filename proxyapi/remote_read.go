@@ -0,0 +1,277 @@
+package proxyapi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/sirupsen/logrus"
+)
+
+// The response types a remote read client may accept (the ResponseType enum of
+// prometheus' remote.proto, which is newer than our vendored prompb)
+const (
+	responseTypeSamples           = 0
+	responseTypeStreamedXORChunks = 1
+)
+
+const (
+	// remoteReadLimit is the max size of a (compressed) remote read request
+	remoteReadLimit = 32 * 1024 * 1024
+	// samplesPerChunk is the max number of samples of a streamed chunk (the
+	// same as the chunks of prometheus' tsdb)
+	samplesPerChunk = 120
+	// streamedContentType is the content type of a streamed response
+	streamedContentType = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// RemoteRead implements the /api/v1/read endpoint, serving the merged data of
+// all server groups to other prometheus servers. Like prometheus, the
+// response is streamed as chunks if the client accepts them (prometheus 2.13+)
+// and is a single sampled response otherwise.
+func (a *API) RemoteRead(w http.ResponseWriter, r *http.Request) {
+	compressed, err := ioutil.ReadAll(io.LimitReader(r.Body, remoteReadLimit))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reqBuf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req prompb.ReadRequest
+	if err := proto.Unmarshal(reqBuf, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	accepted, err := acceptedResponseTypes(reqBuf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The first of the accepted types we support is used (in the client's order of preference)
+	streamed := false
+	for _, responseType := range accepted {
+		if responseType == responseTypeSamples || responseType == responseTypeStreamedXORChunks {
+			streamed = responseType == responseTypeStreamedXORChunks
+			break
+		}
+	}
+
+	// Once frames were streamed (with a 200) a failure can't be responded
+	// with, so the connection is aborted for the client to see it fail
+	streaming := false
+	fail := func(msg string, code int) {
+		if streaming {
+			logrus.Errorf("Aborting the streamed remote read response: %s", msg)
+			panic(http.ErrAbortHandler)
+		}
+		http.Error(w, msg, code)
+	}
+
+	client := a.client()
+	resp := prompb.ReadResponse{Results: make([]*prompb.QueryResult, len(req.Queries))}
+	for i, query := range req.Queries {
+		from, through, matchers, _, err := remote.FromQuery(query)
+		if err != nil {
+			fail(err.Error(), http.StatusBadRequest)
+			return
+		}
+		v, err := client.GetValue(r.Context(), timestamp(from), timestamp(through), matchers)
+		if err != nil {
+			fail(err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var matrix model.Matrix
+		if v != nil {
+			var ok bool
+			if matrix, ok = v.(model.Matrix); !ok {
+				fail(fmt.Sprintf("unexpected result type %s", v.Type()), http.StatusInternalServerError)
+				return
+			}
+		}
+		sort.Sort(matrix)
+
+		if !streamed {
+			resp.Results[i] = toQueryResult(matrix)
+			continue
+		}
+		if i == 0 {
+			w.Header().Set("Content-Type", streamedContentType)
+		}
+		for _, stream := range matrix {
+			// Each series is a frame, so the client can decode them as they arrive
+			streaming = true
+			if _, err := w.Write(chunkedReadResponseFrame(stream, int64(i))); err != nil {
+				return
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+	}
+
+	if !streamed {
+		if err := remote.EncodeReadResponse(&resp, w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// timestamp returns the time.Time of the prometheus timestamp `t` (in ms)
+func timestamp(t int64) time.Time {
+	return model.Time(t).Time()
+}
+
+// toQueryResult returns the sampled QueryResult of `matrix`
+func toQueryResult(matrix model.Matrix) *prompb.QueryResult {
+	result := &prompb.QueryResult{Timeseries: make([]*prompb.TimeSeries, len(matrix))}
+	for i, stream := range matrix {
+		samples := make([]*prompb.Sample, len(stream.Values))
+		for j, point := range stream.Values {
+			samples[j] = &prompb.Sample{Timestamp: int64(point.Timestamp), Value: float64(point.Value)}
+		}
+		result.Timeseries[i] = &prompb.TimeSeries{Labels: remote.MetricToLabelProtos(stream.Metric), Samples: samples}
+	}
+	return result
+}
+
+// acceptedResponseTypes returns the accepted_response_types (field 2) of the
+// ReadRequest `buf`. Our vendored prompb predates the field, so it is decoded
+// from the wire format.
+func acceptedResponseTypes(buf []byte) ([]uint64, error) {
+	var types []uint64
+	for len(buf) > 0 {
+		key, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid read request")
+		}
+		buf = buf[n:]
+		field, wireType := key>>3, key&7
+
+		var value uint64
+		var data []byte
+		switch wireType {
+		case 0: // varint
+			if value, n = binary.Uvarint(buf); n <= 0 {
+				return nil, fmt.Errorf("invalid read request")
+			}
+		case 1: // fixed64
+			n = 8
+		case 2: // length-delimited
+			length, m := binary.Uvarint(buf)
+			if m <= 0 || uint64(len(buf)-m) < length {
+				return nil, fmt.Errorf("invalid read request")
+			}
+			data = buf[m : m+int(length)]
+			n = m + int(length)
+		case 5: // fixed32
+			n = 4
+		default:
+			return nil, fmt.Errorf("invalid read request: unsupported wire type %d", wireType)
+		}
+		if len(buf) < n {
+			return nil, fmt.Errorf("invalid read request")
+		}
+		buf = buf[n:]
+
+		if field != 2 {
+			continue
+		}
+		if wireType == 0 {
+			types = append(types, value)
+			continue
+		}
+		// Packed repeated enum
+		for len(data) > 0 {
+			value, m := binary.Uvarint(data)
+			if m <= 0 {
+				return nil, fmt.Errorf("invalid read request")
+			}
+			types = append(types, value)
+			data = data[m:]
+		}
+	}
+	return types, nil
+}
+
+// chunkedReadResponseFrame returns the frame of the ChunkedReadResponse with
+// the series `stream` (as XOR chunks) of the query `queryIndex`: the size of
+// the message (uvarint) and its CRC32 (castagnoli, big endian) followed by the
+// message itself.
+func chunkedReadResponseFrame(stream *model.SampleStream, queryIndex int64) []byte {
+	var series []byte
+	for _, label := range remote.MetricToLabelProtos(stream.Metric) {
+		var l []byte
+		l = appendBytesField(l, 1, []byte(label.Name))
+		l = appendBytesField(l, 2, []byte(label.Value))
+		series = appendBytesField(series, 1, l)
+	}
+	for start := 0; start < len(stream.Values); start += samplesPerChunk {
+		end := start + samplesPerChunk
+		if end > len(stream.Values) {
+			end = len(stream.Values)
+		}
+		series = appendBytesField(series, 2, xorChunk(stream.Values[start:end]))
+	}
+
+	var msg []byte
+	msg = appendBytesField(msg, 1, series)
+	if queryIndex != 0 {
+		msg = appendVarintField(msg, 2, uint64(queryIndex))
+	}
+
+	var header [binary.MaxVarintLen64 + 4]byte
+	n := binary.PutUvarint(header[:], uint64(len(msg)))
+	binary.BigEndian.PutUint32(header[n:], crc32.Checksum(msg, castagnoliTable))
+	frame := make([]byte, 0, n+4+len(msg))
+	return append(append(frame, header[:n+4]...), msg...)
+}
+
+// xorChunk returns the Chunk message of the XOR chunk of `points`
+func xorChunk(points []model.SamplePair) []byte {
+	c := chunkenc.NewXORChunk()
+	app, _ := c.Appender()
+	for _, point := range points {
+		app.Append(int64(point.Timestamp), float64(point.Value))
+	}
+
+	var chunk []byte
+	chunk = appendVarintField(chunk, 1, uint64(points[0].Timestamp))
+	chunk = appendVarintField(chunk, 2, uint64(points[len(points)-1].Timestamp))
+	chunk = appendVarintField(chunk, 3, uint64(chunkenc.EncXOR))
+	return appendBytesField(chunk, 4, c.Bytes())
+}
+
+// appendUvarint appends the uvarint `v` to `b`
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// appendVarintField appends the varint field `field` with `v` to `b`
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = appendUvarint(b, uint64(field)<<3)
+	return appendUvarint(b, v)
+}
+
+// appendBytesField appends the length-delimited field `field` with `data` to `b`
+func appendBytesField(b []byte, field int, data []byte) []byte {
+	b = appendUvarint(b, uint64(field)<<3|2)
+	b = appendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
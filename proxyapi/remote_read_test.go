@@ -0,0 +1,265 @@
+package proxyapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/tsdb/chunkenc"
+
+	"github.com/jacksontj/promxy/logging"
+	"github.com/jacksontj/promxy/promclient"
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+// getValueAPI is a promclient.API which only implements GetValue
+type getValueAPI struct {
+	promclient.API
+	v model.Value
+}
+
+func (g *getValueAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	return g.v, nil
+}
+
+// testMatrix has a series long enough to be streamed as several chunks
+func testMatrix() model.Matrix {
+	long := &model.SampleStream{Metric: model.Metric{"__name__": "up", "job": "b"}}
+	for i := 0; i < 2*samplesPerChunk+1; i++ {
+		long.Values = append(long.Values, model.SamplePair{Timestamp: model.Time(i * 1000), Value: model.SampleValue(i)})
+	}
+	return model.Matrix{
+		long,
+		{Metric: model.Metric{"__name__": "up", "job": "a"}, Values: []model.SamplePair{{Timestamp: 1000, Value: 1}}},
+	}
+}
+
+func newRemoteReadServer() *httptest.Server {
+	api := NewAPI(func() promclient.API { return &getValueAPI{v: testMatrix()} }, nil)
+	return httptest.NewServer(http.HandlerFunc(api.RemoteRead))
+}
+
+func TestRemoteReadSampled(t *testing.T) {
+	srv := newRemoteReadServer()
+	defer srv.Close()
+
+	// A request without accepted response types (from a client predating them) gets a sampled response
+	data, err := proto.Marshal(&prompb.ReadRequest{Queries: []*prompb.Query{{EndTimestampMs: 1000000}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(srv.URL, "application/x-protobuf", bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	defer resp.Body.Close()
+	compressed, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncompressed, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var readResp prompb.ReadResponse
+	if err := proto.Unmarshal(uncompressed, &readResp); err != nil {
+		t.Fatal(err)
+	}
+	// The series are sorted
+	expected := testMatrix()
+	result := readResp.Results[0]
+	if len(result.Timeseries) != 2 || result.Timeseries[0].Labels[1].Value != "a" || len(result.Timeseries[1].Samples) != len(expected[0].Values) {
+		t.Fatalf("mismatch in result: %v", result)
+	}
+}
+
+// TestRemoteReadClient checks the streamed response is decoded by our client
+func TestRemoteReadClient(t *testing.T) {
+	srv := newRemoteReadServer()
+	defer srv.Close()
+
+	client := promclient.NewRemoteReadClient(srv.URL, http.DefaultClient, time.Minute)
+	v, err := client.GetValue(context.TODO(), time.Unix(0, 0), time.Unix(1000, 0), nil)
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	expected := testMatrix()
+	expected[0], expected[1] = expected[1], expected[0]
+	if !reflect.DeepEqual(v, expected) {
+		t.Fatalf("mismatch in result expected=%v actual=%v", expected, v)
+	}
+}
+
+// protoFields decodes the length-delimited and varint fields of the message
+// `b` (which is all the messages of a ChunkedReadResponse use)
+func protoFields(t *testing.T, b []byte) map[uint64][][]byte {
+	fields := make(map[uint64][][]byte)
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		b = b[n:]
+		switch key & 7 {
+		case 0:
+			_, n = binary.Uvarint(b)
+			fields[key>>3] = append(fields[key>>3], b[:n])
+			b = b[n:]
+		case 2:
+			length, n := binary.Uvarint(b)
+			fields[key>>3] = append(fields[key>>3], b[n:n+int(length)])
+			b = b[n+int(length):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+func TestRemoteReadStreamed(t *testing.T) {
+	srv := newRemoteReadServer()
+	defer srv.Close()
+
+	data, err := proto.Marshal(&prompb.ReadRequest{Queries: []*prompb.Query{{EndTimestampMs: 1000000}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Accept the streamed response (in the client's order of preference)
+	data = appendVarintField(data, 2, responseTypeStreamedXORChunks)
+	data = appendVarintField(data, 2, responseTypeSamples)
+	resp, err := http.Post(srv.URL, "application/x-protobuf", bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != streamedContentType {
+		t.Fatalf("unexpected content type: %s", resp.Header.Get("Content-Type"))
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var matrix model.Matrix
+	for len(body) > 0 {
+		size, n := binary.Uvarint(body)
+		checksum := binary.BigEndian.Uint32(body[n:])
+		msg := body[n+4 : n+4+int(size)]
+		body = body[n+4+int(size):]
+		if crc32.Checksum(msg, castagnoliTable) != checksum {
+			t.Fatalf("mismatch in frame checksum")
+		}
+
+		for _, series := range protoFields(t, msg)[1] {
+			fields := protoFields(t, series)
+			stream := &model.SampleStream{Metric: model.Metric{}}
+			for _, label := range fields[1] {
+				labelFields := protoFields(t, label)
+				stream.Metric[model.LabelName(labelFields[1][0])] = model.LabelValue(labelFields[2][0])
+			}
+			for _, chunk := range fields[2] {
+				chunkData := protoFields(t, chunk)[4][0]
+				c, err := chunkenc.FromData(chunkenc.EncXOR, chunkData)
+				if err != nil {
+					t.Fatal(err)
+				}
+				it := c.Iterator()
+				for it.Next() {
+					ts, v := it.At()
+					stream.Values = append(stream.Values, model.SamplePair{Timestamp: model.Time(ts), Value: model.SampleValue(v)})
+				}
+			}
+			matrix = append(matrix, stream)
+		}
+	}
+
+	expected := testMatrix()
+	expected[0], expected[1] = expected[1], expected[0]
+	if !reflect.DeepEqual(matrix, expected) {
+		t.Fatalf("mismatch in streamed matrix: expected=%v actual=%v", expected, matrix)
+	}
+}
+
+// streamAPI is a promclient.API whose first GetValue returns testMatrix, the
+// later ones wait for `next` and fail
+type streamAPI struct {
+	promclient.API
+	calls int
+	next  chan struct{}
+}
+
+func (s *streamAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
+	s.calls++
+	if s.calls == 1 {
+		return testMatrix(), nil
+	}
+	<-s.next
+	return nil, fmt.Errorf("connection refused")
+}
+
+func TestRemoteReadStreamedHandlers(t *testing.T) {
+	downstream := &streamAPI{next: make(chan struct{})}
+	api := NewAPI(func() promclient.API { return downstream }, nil)
+	// The ResponseWriter wrappers of promxy's handler chain
+	var handler http.Handler = http.HandlerFunc(api.RemoteRead)
+	handler = promhttputil.NewExplainHandler(handler)
+	handler = promhttputil.NewStatsHandler(handler)
+	handler = promhttputil.NewErrorStatusHandler(handler)
+	handler = promhttputil.NewWarningsHandler(handler)
+	responseHeaders := handler
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, headers := promhttputil.WithResponseHeaders(r.Context(), nil, promhttputil.ResponseHeaderPolicyFirst)
+		responseHeaders.ServeHTTP(promhttputil.NewResponseHeadersWriter(w, headers), r.WithContext(ctx))
+	})
+	handler = logging.NewApacheLoggingHandler(handler, logging.LogToWriter(ioutil.Discard))
+	srv := httptest.NewServer(logging.NewRequestIDHandler(handler))
+	defer srv.Close()
+
+	data, err := proto.Marshal(&prompb.ReadRequest{Queries: []*prompb.Query{{EndTimestampMs: 1000000}, {EndTimestampMs: 2000000}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = appendVarintField(data, 2, responseTypeStreamedXORChunks)
+
+	// The frames of the first query are flushed to the client while the second is still running
+	respChan := make(chan *http.Response)
+	go func() {
+		resp, err := http.Post(srv.URL, "application/x-protobuf", bytes.NewReader(snappy.Encode(nil, data)))
+		if err != nil {
+			t.Errorf("Unexpected Err: %v", err)
+			close(respChan)
+			return
+		}
+		respChan <- resp
+	}()
+	var resp *http.Response
+	select {
+	case resp = <-respChan:
+	case <-time.After(5 * time.Second):
+		close(downstream.next)
+		t.Fatalf("the streamed frames weren't flushed")
+	}
+	if resp == nil {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	if _, err := resp.Body.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+
+	// Once the second query fails the response is aborted, rather than the error appended to the frames
+	close(downstream.next)
+	if body, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Fatalf("expected the response to be aborted, got: %q", body)
+	}
+}
@@ -0,0 +1,201 @@
+package proxyapi
+
+import (
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/rulefmt"
+	"github.com/prometheus/prometheus/rules"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The v1 client's types don't marshal into the same JSON the prometheus API
+// returns (the client only unmarshals them) so these are the types we respond with
+type ruleDiscovery struct {
+	RuleGroups []*ruleGroup `json:"groups"`
+}
+
+type ruleGroup struct {
+	Name     string        `json:"name"`
+	File     string        `json:"file"`
+	Rules    []interface{} `json:"rules"`
+	Interval float64       `json:"interval"`
+}
+
+type alertingRule struct {
+	Name        string         `json:"name"`
+	Query       string         `json:"query"`
+	Duration    float64        `json:"duration"`
+	Labels      model.LabelSet `json:"labels"`
+	Annotations model.LabelSet `json:"annotations"`
+	Alerts      []*alert       `json:"alerts"`
+	Health      v1.RuleHealth  `json:"health"`
+	LastError   string         `json:"lastError,omitempty"`
+	Type        string         `json:"type"`
+}
+
+type recordingRule struct {
+	Name      string         `json:"name"`
+	Query     string         `json:"query"`
+	Labels    model.LabelSet `json:"labels,omitempty"`
+	Health    v1.RuleHealth  `json:"health"`
+	LastError string         `json:"lastError,omitempty"`
+	Type      string         `json:"type"`
+}
+
+type alertDiscovery struct {
+	Alerts []*alert `json:"alerts"`
+}
+
+type alert struct {
+	Labels      model.LabelSet `json:"labels"`
+	Annotations model.LabelSet `json:"annotations"`
+	State       v1.AlertState  `json:"state"`
+	ActiveAt    *time.Time     `json:"activeAt,omitempty"`
+	Value       float64        `json:"value"`
+}
+
+// rulesResultToResponse converts the RulesResult into the JSON the prometheus API responds with
+func rulesResultToResponse(result v1.RulesResult) *ruleDiscovery {
+	ret := &ruleDiscovery{RuleGroups: make([]*ruleGroup, len(result.Groups))}
+	for i, group := range result.Groups {
+		g := &ruleGroup{
+			Name:     group.Name,
+			File:     group.File,
+			Rules:    make([]interface{}, 0, len(group.Rules)),
+			Interval: group.Interval,
+		}
+		for _, rule := range group.Rules {
+			switch r := rule.(type) {
+			case v1.AlertingRule:
+				alerts := make([]*alert, len(r.Alerts))
+				for j, a := range r.Alerts {
+					activeAt := a.ActiveAt
+					alerts[j] = &alert{
+						Labels:      a.Labels,
+						Annotations: a.Annotations,
+						State:       a.State,
+						ActiveAt:    &activeAt,
+						Value:       a.Value,
+					}
+				}
+				g.Rules = append(g.Rules, alertingRule{
+					Name:        r.Name,
+					Query:       r.Query,
+					Duration:    r.Duration,
+					Labels:      r.Labels,
+					Annotations: r.Annotations,
+					Alerts:      alerts,
+					Health:      r.Health,
+					LastError:   r.LastError,
+					Type:        "alerting",
+				})
+			case v1.RecordingRule:
+				g.Rules = append(g.Rules, recordingRule{
+					Name:      r.Name,
+					Query:     r.Query,
+					Labels:    r.Labels,
+					Health:    r.Health,
+					LastError: r.LastError,
+					Type:      "recording",
+				})
+			}
+		}
+		ret.RuleGroups[i] = g
+	}
+	return ret
+}
+
+// ruleGroupsToResult converts the rule groups promxy is evaluating into a RulesResult
+func ruleGroupsToResult(groups []*rules.Group) v1.RulesResult {
+	result := v1.RulesResult{Groups: make([]v1.RuleGroup, 0, len(groups))}
+	for _, group := range groups {
+		g := v1.RuleGroup{
+			Name:  group.Name(),
+			File:  group.File(),
+			Rules: make(v1.Rules, 0, len(group.Rules())),
+		}
+		for _, rule := range group.Rules() {
+			// The rules don't expose their definition other than through
+			// String() which is the rule's YAML definition
+			var ruleDef rulefmt.Rule
+			if err := yaml.Unmarshal([]byte(rule.String()), &ruleDef); err != nil {
+				continue
+			}
+
+			switch r := rule.(type) {
+			case *rules.AlertingRule:
+				activeAlerts := r.ActiveAlerts()
+				alerts := make([]*v1.Alert, len(activeAlerts))
+				for i, a := range activeAlerts {
+					alert := convertAlert(a)
+					alerts[i] = &alert
+				}
+				g.Rules = append(g.Rules, v1.AlertingRule{
+					Name:        r.Name(),
+					Query:       ruleDef.Expr,
+					Duration:    time.Duration(ruleDef.For).Seconds(),
+					Labels:      labelMapToLabelSet(ruleDef.Labels),
+					Annotations: labelMapToLabelSet(ruleDef.Annotations),
+					Alerts:      alerts,
+					Health:      v1.RuleHealthUnknown,
+				})
+			case *rules.RecordingRule:
+				g.Rules = append(g.Rules, v1.RecordingRule{
+					Name:   r.Name(),
+					Query:  ruleDef.Expr,
+					Labels: labelMapToLabelSet(ruleDef.Labels),
+					Health: v1.RuleHealthUnknown,
+				})
+			}
+		}
+		result.Groups = append(result.Groups, g)
+	}
+	return result
+}
+
+// alertingRulesToResult converts the active alerts of the rules promxy is evaluating into an AlertsResult
+func alertingRulesToResult(alertingRules []*rules.AlertingRule) v1.AlertsResult {
+	result := v1.AlertsResult{Alerts: make([]v1.Alert, 0)}
+	for _, r := range alertingRules {
+		for _, a := range r.ActiveAlerts() {
+			result.Alerts = append(result.Alerts, convertAlert(a))
+		}
+	}
+	return result
+}
+
+// alertsResultToResponse converts the AlertsResult into the JSON the prometheus API responds with
+func alertsResultToResponse(result v1.AlertsResult) *alertDiscovery {
+	ret := &alertDiscovery{Alerts: make([]*alert, len(result.Alerts))}
+	for i, a := range result.Alerts {
+		activeAt := a.ActiveAt
+		ret.Alerts[i] = &alert{
+			Labels:      a.Labels,
+			Annotations: a.Annotations,
+			State:       a.State,
+			ActiveAt:    &activeAt,
+			Value:       a.Value,
+		}
+	}
+	return ret
+}
+
+func convertAlert(a *rules.Alert) v1.Alert {
+	return v1.Alert{
+		ActiveAt:    a.ActiveAt,
+		Annotations: labelMapToLabelSet(a.Annotations.Map()),
+		Labels:      labelMapToLabelSet(a.Labels.Map()),
+		State:       v1.AlertState(a.State.String()),
+		Value:       a.Value,
+	}
+}
+
+func labelMapToLabelSet(m map[string]string) model.LabelSet {
+	ls := make(model.LabelSet, len(m))
+	for k, v := range m {
+		ls[model.LabelName(k)] = model.LabelValue(v)
+	}
+	return ls
+}
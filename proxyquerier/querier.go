@@ -2,9 +2,9 @@ package proxyquerier
 
 import (
 	"context"
+	"fmt"
 	"time"
 
-	"github.com/pkg/errors"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/timestamp"
@@ -12,6 +12,7 @@ import (
 	"github.com/sirupsen/logrus"
 
 	proxyconfig "github.com/jacksontj/promxy/config"
+	"github.com/jacksontj/promxy/logging"
 	"github.com/jacksontj/promxy/promclient"
 	"github.com/jacksontj/promxy/promhttputil"
 )
@@ -25,17 +26,37 @@ type ProxyQuerier struct {
 	Cfg *proxyconfig.PromxyConfig
 }
 
+// CheckMaxLookback returns an error if `start` is further back than the max
+// lookback configured in `cfg`
+func CheckMaxLookback(cfg *proxyconfig.PromxyConfig, start time.Time) error {
+	if cfg == nil || cfg.MaxLookback <= 0 {
+		return nil
+	}
+	if limit := time.Now().Add(-time.Duration(cfg.MaxLookback)); start.Before(limit) {
+		return fmt.Errorf("query start %v is before the max lookback of %v", start, cfg.MaxLookback)
+	}
+	return nil
+}
+
 // Select returns a set of series that matches the given label matchers.
 func (h *ProxyQuerier) Select(selectParams *storage.SelectParams, matchers ...*labels.Matcher) (storage.SeriesSet, error) {
 	start := time.Now()
 	defer func() {
-		logrus.WithFields(logrus.Fields{
+		logging.FromContext(h.Ctx).WithFields(logrus.Fields{
 			"selectParams": selectParams,
 			"matchers":     matchers,
 			"took":         time.Now().Sub(start),
 		}).Debug("Select")
 	}()
 
+	queryStart := h.Start
+	if selectParams != nil {
+		queryStart = timestamp.Time(selectParams.Start)
+	}
+	if err := CheckMaxLookback(h.Cfg, queryStart); err != nil {
+		return nil, err
+	}
+
 	var result model.Value
 	var err error
 	// Select() is a combined API call for query/query_range/series.
@@ -50,7 +71,7 @@ func (h *ProxyQuerier) Select(selectParams *storage.SelectParams, matchers ...*l
 		}
 		labelsets, err := h.Client.Series(h.Ctx, []string{matcherString}, h.Start, h.End)
 		if err != nil {
-			return nil, errors.Cause(err)
+			return nil, promclient.PromError(err)
 		}
 		// Convert labelsets to vectors
 		// convert to vector (there aren't points, but this way we don't have to make more merging functions)
@@ -65,24 +86,17 @@ func (h *ProxyQuerier) Select(selectParams *storage.SelectParams, matchers ...*l
 		result, err = h.Client.GetValue(h.Ctx, timestamp.Time(selectParams.Start), timestamp.Time(selectParams.End), matchers)
 	}
 	if err != nil {
-		return nil, errors.Cause(err)
-	}
-
-	iterators := promclient.IteratorsForValue(result)
-
-	series := make([]storage.Series, len(iterators))
-	for i, iterator := range iterators {
-		series[i] = &Series{iterator}
+		return nil, promclient.PromError(err)
 	}
 
-	return NewSeriesSet(series), nil
+	return NewSeriesSet(result), nil
 }
 
 // LabelValues returns all potential values for a label name.
 func (h *ProxyQuerier) LabelValues(name string) ([]string, error) {
 	start := time.Now()
 	defer func() {
-		logrus.WithFields(logrus.Fields{
+		logging.FromContext(h.Ctx).WithFields(logrus.Fields{
 			"name": name,
 			"took": time.Now().Sub(start),
 		}).Debug("LabelValues")
@@ -90,7 +104,7 @@ func (h *ProxyQuerier) LabelValues(name string) ([]string, error) {
 
 	result, err := h.Client.LabelValues(h.Ctx, name)
 	if err != nil {
-		return nil, errors.Cause(err)
+		return nil, promclient.PromError(err)
 	}
 
 	ret := make([]string, len(result))
@@ -1,30 +1,37 @@
 package proxyquerier
 
 import (
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage"
+
+	"github.com/jacksontj/promxy/promclient"
 )
 
-func NewSeriesSet(series []storage.Series) *SeriesSet {
+// NewSeriesSet returns a SeriesSet of the series of `v`. The series are
+// created as the set is iterated rather than all upfront, so only the
+// downstream result itself (and not a copy of its series) is held in memory.
+func NewSeriesSet(v model.Value) *SeriesSet {
 	return &SeriesSet{
-		series: series,
+		iterators: promclient.NewValueIterators(v),
 	}
 }
 
 type SeriesSet struct {
-	offset int // 0 means we haven't seen anything
-	series []storage.Series
+	iterators *promclient.ValueIterators
+	current   storage.Series
 }
 
 func (s *SeriesSet) Next() bool {
-	if s.offset < len(s.series) {
-		s.offset++
+	if s.iterators.Next() {
+		s.current = &Series{s.iterators.At()}
 		return true
 	}
+	s.current = nil
 	return false
 }
 
 func (s *SeriesSet) At() storage.Series {
-	return s.series[s.offset-1]
+	return s.current
 }
 
 func (s *SeriesSet) Err() error {
@@ -7,7 +7,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/pkg/errors"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/timestamp"
@@ -17,7 +16,9 @@ import (
 	"github.com/sirupsen/logrus"
 
 	proxyconfig "github.com/jacksontj/promxy/config"
+	"github.com/jacksontj/promxy/logging"
 	"github.com/jacksontj/promxy/promclient"
+	"github.com/jacksontj/promxy/promhttputil"
 	"github.com/jacksontj/promxy/proxyquerier"
 	"github.com/jacksontj/promxy/servergroup"
 )
@@ -25,9 +26,15 @@ import (
 type proxyStorageState struct {
 	sgs            []*servergroup.ServerGroup
 	client         promclient.API
+	sgClients      map[string]promclient.API // client of each server group (by name) on its own
 	cfg            *proxyconfig.PromxyConfig
 	appender       storage.Appender
 	appenderCloser func() error
+
+	// disablePushdown is set if pushdown is disabled in the config, or any of
+	// the server groups can't evaluate queries (or transforms their values, or
+	// dedups their replicas)
+	disablePushdown bool
 }
 
 func (p *proxyStorageState) Ready() {
@@ -36,9 +43,16 @@ func (p *proxyStorageState) Ready() {
 	}
 }
 
+// Cancel cancels the state's server groups which aren't (re)used by `n`
 func (p *proxyStorageState) Cancel(n *proxyStorageState) {
-	if p.sgs != nil {
-		for _, sg := range p.sgs {
+	inUse := make(map[*servergroup.ServerGroup]struct{})
+	if n != nil {
+		for _, sg := range n.sgs {
+			inUse[sg] = struct{}{}
+		}
+	}
+	for _, sg := range p.sgs {
+		if _, ok := inUse[sg]; !ok {
 			sg.Cancel()
 		}
 	}
@@ -50,13 +64,16 @@ func (p *proxyStorageState) Cancel(n *proxyStorageState) {
 	}
 }
 
-func NewProxyStorage() (*ProxyStorage, error) {
-	return &ProxyStorage{}, nil
+// NewProxyStorage returns a ProxyStorage whose server groups share `workerPool`
+// to bound the concurrent requests to their targets (nil is unbounded)
+func NewProxyStorage(workerPool *promclient.WorkerPool) (*ProxyStorage, error) {
+	return &ProxyStorage{workerPool: workerPool}, nil
 }
 
 // TODO: rename?
 type ProxyStorage struct {
-	state atomic.Value
+	state      atomic.Value
+	workerPool *promclient.WorkerPool
 }
 
 func (p *ProxyStorage) GetState() *proxyStorageState {
@@ -68,6 +85,22 @@ func (p *ProxyStorage) GetState() *proxyStorageState {
 	}
 }
 
+// ServerGroups returns the ServerGroups currently in use
+func (p *ProxyStorage) ServerGroups() []*servergroup.ServerGroup {
+	return p.GetState().sgs
+}
+
+// Client returns the promclient.API for all of the current ServerGroups
+func (p *ProxyStorage) Client() promclient.API {
+	return p.GetState().client
+}
+
+// ServerGroupClient returns the promclient.API for only the ServerGroup named
+// `name` (nil if there is none), bypassing the aggregation across ServerGroups
+func (p *ProxyStorage) ServerGroupClient(name string) promclient.API {
+	return p.GetState().sgClients[name]
+}
+
 func (p *ProxyStorage) ApplyConfig(c *proxyconfig.Config) error {
 	oldState := p.GetState() // Fetch the old state
 
@@ -77,20 +110,98 @@ func (p *ProxyStorage) ApplyConfig(c *proxyconfig.Config) error {
 	newState := &proxyStorageState{
 		sgs: make([]*servergroup.ServerGroup, len(c.ServerGroups)),
 		cfg: &c.PromxyConfig,
+
+		disablePushdown: c.DisablePushdown,
 	}
+	// Server groups whose config is unchanged are reused, so a reload doesn't
+	// reset their discovery and connections
+	reused := make(map[*servergroup.ServerGroup]struct{})
 	for i, sgCfg := range c.ServerGroups {
-		tmp := servergroup.New()
-		if err := tmp.ApplyConfig(sgCfg); err != nil {
-			failed = true
-			logrus.Errorf("Error applying config to server group: %s", err)
+		var sg *servergroup.ServerGroup
+		for _, oldSG := range oldState.sgs {
+			if _, ok := reused[oldSG]; !ok && reflect.DeepEqual(oldSG.Cfg, sgCfg) {
+				sg = oldSG
+				reused[sg] = struct{}{}
+				break
+			}
+		}
+
+		if sg == nil {
+			sg = servergroup.New(p.workerPool)
+			if err := sg.ApplyConfig(sgCfg); err != nil {
+				failed = true
+				logrus.Errorf("Error applying config to server group: %s", err)
+			}
+		}
+		newState.sgs[i] = sg
+		apis[i] = sg
+		// Queries pushed down are evaluated before the values are transformed,
+		// and aggregate the replicas (if the hosts' data has the replica labels)
+		// before they are deduped
+		if sgCfg.RemoteReadOnly || len(sgCfg.ValueTransforms) > 0 || len(sgCfg.ReplicaLabels) > 0 {
+			newState.disablePushdown = true
 		}
-		newState.sgs[i] = tmp
-		apis[i] = tmp
 	}
-	newState.client = promclient.NewMultiAPI(apis, model.TimeFromUnix(0), nil, len(apis))
+	logrus.Debugf("Reusing %d of %d server groups with unchanged config", len(reused), len(c.ServerGroups))
+	newMultiAPI := func(apis []promclient.API) *promclient.MultiAPI {
+		multiAPI := promclient.NewMultiAPI(apis, model.TimeFromUnix(0), nil, len(apis))
+		multiAPI.SetMaxLabelValues(c.MaxLabelValues)
+		multiAPI.SetMaxSamples(c.MaxSamples)
+		multiAPI.SetConflictPolicy(c.MergeConflictPolicy)
+		multiAPI.SetValueEpsilon(c.MergeValueEpsilon)
+		multiAPI.SetInternLabels(c.InternLabels)
+		return multiAPI
+	}
+	var client promclient.API = newMultiAPI(apis)
+
+	// Route the data queries by their range, the queries not covered by a
+	// route go to the server groups without one
+	if len(c.RangeRoutes) > 0 {
+		routed := make(map[string]struct{}, len(c.RangeRoutes))
+		routes := make([]promclient.RangeRoute, len(c.RangeRoutes))
+		for i, route := range c.RangeRoutes {
+			routed[route.ServerGroup] = struct{}{}
+			for j, sgCfg := range c.ServerGroups {
+				if sgCfg.Name == route.ServerGroup {
+					routes[i] = promclient.RangeRoute{MinRange: time.Duration(route.MinRange), API: newMultiAPI([]promclient.API{apis[j]})}
+				}
+			}
+		}
+		defaultAPIs := make([]promclient.API, 0, len(apis))
+		for i, sgCfg := range c.ServerGroups {
+			if _, ok := routed[sgCfg.Name]; !ok {
+				defaultAPIs = append(defaultAPIs, apis[i])
+			}
+		}
+		client = promclient.NewRangeRouterAPI(client, newMultiAPI(defaultAPIs), routes)
+	}
+
+	// Requests can be restricted to a single server group (e.g. for debugging)
+	serverGroupAPIs := make(map[string]promclient.API, len(apis))
+	newState.sgClients = make(map[string]promclient.API, len(apis))
+	for i, sgCfg := range c.ServerGroups {
+		serverGroupAPIs[sgCfg.Name] = newMultiAPI([]promclient.API{apis[i]})
+		newState.sgClients[sgCfg.Name] = &promclient.EnforceMatchersAPI{API: serverGroupAPIs[sgCfg.Name]}
+	}
+	client = &promclient.ServerGroupRouterAPI{API: client, ServerGroups: serverGroupAPIs}
+
+	// Cap the series selected by the queries (pushing the limit down where possible)
+	client = &promclient.SelectLimitAPI{API: client, MaxSeries: c.MaxSelectSeries}
+
+	// Estimate the cost of data queries to enforce the max (or to explain them)
+	client = &promclient.CostLimitAPI{API: client, MaxCost: c.MaxQueryCost}
+	// Apply the limit of series and label requests to the merged results
+	client = &promclient.LimitAPI{API: client}
+	// Identical concurrent queries share their downstream requests
+	if c.CoalesceQueries {
+		client = &promclient.SingleFlightAPI{API: client, Flights: promclient.NewSingleFlight()}
+	}
+	// Enforce any matchers required by the request (e.g. the tenant) before fanning out
+	newState.client = &promclient.EnforceMatchersAPI{API: client}
 
 	if failed {
-		newState.Cancel(nil)
+		// Only cancel the server groups that were created for this config
+		newState.Cancel(oldState)
 		return fmt.Errorf("Error Applying Config to one or more server group(s)")
 	}
 
@@ -157,6 +268,12 @@ func (p *ProxyStorage) Close() error { return nil }
 //      - Children cannot be AggregateExpr: aggregates have their own combining logic, so its not safe to send a subquery with additional aggregations
 //      - offsets within the subtree must match: if they don't then we'll get mismatched data, so we wait until we are far enough down the tree that they converge
 //      - Don't reduce accuracy/granularity: the intention of this is to get the correct data faster, meaning correctness overrules speed.
+//
+// The aggregations pushed down are the associative ones, whose partial results
+// from each downstream aggregate into the same result: sum, min, max, topk and
+// bottomk are aggregated again as-is, count is summed and avg is split into
+// sum / count. The other aggregations (stddev, stdvar, count_values, quantile)
+// aren't associative, so they are evaluated here from the raw data.
 func (p *ProxyStorage) NodeReplacer(ctx context.Context, s *promql.EvalStmt, node promql.Node) (promql.Node, error) {
 
 	isAgg := func(node promql.Node) bool {
@@ -204,11 +321,22 @@ func (p *ProxyStorage) NodeReplacer(ctx context.Context, s *promql.EvalStmt, nod
 	}
 
 	state := p.GetState()
+	// Reject queries which reach further back than the configured max lookback
+	if err := proxyquerier.CheckMaxLookback(state.cfg, s.Start.Add(-offset-promql.LookbackDelta)); err != nil {
+		return nil, err
+	}
+
+	// If some server groups can't evaluate queries, everything is evaluated
+	// locally from the raw data
+	if state.disablePushdown {
+		return nil, nil
+	}
+
 	switch n := node.(type) {
 	// Some AggregateExprs can be composed (meaning they are "reentrant". If the aggregation op
 	// is reentrant/composable then we'll do so, otherwise we let it fall through to normal query mechanisms
 	case *promql.AggregateExpr:
-		logrus.Debugf("AggregateExpr %v", n)
+		logging.FromContext(ctx).Debugf("AggregateExpr %v", n)
 
 		var result model.Value
 		var err error
@@ -218,6 +346,7 @@ func (p *ProxyStorage) NodeReplacer(ctx context.Context, s *promql.EvalStmt, nod
 		// All "reentrant" cases (meaning they can be done repeatedly and the outcome doesn't change)
 		case "sum", "min", "max", "topk", "bottomk":
 			removeOffset()
+			promhttputil.AddPushdown(ctx, n.String())
 
 			if s.Interval > 0 {
 				result, err = state.client.QueryRange(ctx, n.String(), v1.Range{
@@ -230,7 +359,7 @@ func (p *ProxyStorage) NodeReplacer(ctx context.Context, s *promql.EvalStmt, nod
 			}
 
 			if err != nil {
-				return nil, errors.Cause(err)
+				return nil, promclient.PromError(err)
 			}
 
 		// Convert avg into sum() / count()
@@ -259,6 +388,7 @@ func (p *ProxyStorage) NodeReplacer(ctx context.Context, s *promql.EvalStmt, nod
 		// For count we simply need to change this to a sum over the data we get back
 		case "count":
 			removeOffset()
+			promhttputil.AddPushdown(ctx, n.String())
 
 			if s.Interval > 0 {
 				result, err = state.client.QueryRange(ctx, n.String(), v1.Range{
@@ -271,7 +401,7 @@ func (p *ProxyStorage) NodeReplacer(ctx context.Context, s *promql.EvalStmt, nod
 			}
 
 			if err != nil {
-				return nil, errors.Cause(err)
+				return nil, promclient.PromError(err)
 			}
 			// TODO: have a reverse method in promql/lex.go
 			n.Op = 41 // SUM
@@ -305,8 +435,9 @@ func (p *ProxyStorage) NodeReplacer(ctx context.Context, s *promql.EvalStmt, nod
 	// Call is for things such as rate() etc. This can be sent directly to the
 	// prometheus node to answer
 	case *promql.Call:
-		logrus.Debugf("call %v %v", n, n.Type())
+		logging.FromContext(ctx).Debugf("call %v %v", n, n.Type())
 		removeOffset()
+		promhttputil.AddPushdown(ctx, n.String())
 
 		var result model.Value
 		var err error
@@ -321,7 +452,7 @@ func (p *ProxyStorage) NodeReplacer(ctx context.Context, s *promql.EvalStmt, nod
 		}
 
 		if err != nil {
-			return nil, errors.Cause(err)
+			return nil, promclient.PromError(err)
 		}
 		iterators := promclient.IteratorsForValue(result)
 		series := make([]storage.Series, len(iterators))
@@ -347,7 +478,7 @@ func (p *ProxyStorage) NodeReplacer(ctx context.Context, s *promql.EvalStmt, nod
 		// DO NOTHING
 
 	default:
-		logrus.Debugf("default %v %s", n, reflect.TypeOf(n))
+		logging.FromContext(ctx).Debugf("default %v %s", n, reflect.TypeOf(n))
 
 	}
 	return nil, nil
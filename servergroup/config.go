@@ -1,18 +1,33 @@
 package servergroup
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
 	"time"
 
 	config_util "github.com/prometheus/common/config"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/config"
 	sd_config "github.com/prometheus/prometheus/discovery/config"
+	"github.com/prometheus/prometheus/discovery/consul"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/jacksontj/promxy/promclient"
 )
 
 var (
+	// DefaultUserAgent is the User-Agent promxy will send to downstreams if
+	// none is configured. This is set to include the version at startup
+	DefaultUserAgent = "promxy"
+
 	DefaultConfig = Config{
 		HTTPConfig: HTTPClientConfig{
-			DialTimeout: time.Millisecond * 2000, // Default dial timeout of 200ms
+			DialTimeout:      time.Millisecond * 2000, // Default dial timeout of 200ms
+			CloseGracePeriod: time.Minute,
 		},
 	}
 )
@@ -20,6 +35,10 @@ var (
 // Config is the configuration for a ServerGroup that promxy will talk to.
 // This is where the vast majority of options exist.
 type Config struct {
+	// Name identifies the server group (in metrics etc.), this should be
+	// unique and stable across config reloads. If unset it defaults to the
+	// index of the server group in the config.
+	Name string `yaml:"name"`
 	// RemoteRead directs promxy to load data (from the storage API) through the
 	// remoteread API on prom.
 	// Pros:
@@ -39,10 +58,18 @@ type Config struct {
 	// from the same memory-balooning problems that the HTTP+JSON API originally had.
 	// It has **less** of a problem (its 2x memory instead of 14x) so it is a viable option.
 	RemoteRead bool `yaml:"remote_read"`
+	// RemoteReadOnly is for hosts which *only* serve the remote_read API, such
+	// as prometheus agents. No v1 API client is created for the hosts, so only
+	// raw data (and series) can be fetched from them. Since they can't evaluate
+	// queries, promxy won't push any part of a query down to downstreams while a
+	// remote_read_only server group is configured.
+	RemoteReadOnly bool `yaml:"remote_read_only"`
 	// HTTP client config for promxy to use when connecting to the various server_groups
 	// this is the same config as prometheus
 	HTTPConfig HTTPClientConfig `yaml:"http_client"`
 	// Scheme defines how promxy talks to this server group (http, https, etc.)
+	// This can be overridden per-target by setting the `__scheme__` label
+	// (through SD or relabel_configs)
 	Scheme string `yaml:"scheme"`
 	// Labels is a set of labels that will be added to all metrics retrieved
 	// from this server group
@@ -74,10 +101,45 @@ type Config struct {
 	// So in reality its "the same", the difference is in prometheus these apply to the labels/targets of a scrape job,
 	// in promxy they apply to the prometheus hosts in the servergroup - but the behavior is the same.
 	RelabelConfigs []*config.RelabelConfig `yaml:"relabel_configs,omitempty"`
+	// ConsulRequiredTags (optionally) only keeps the hosts discovered through
+	// consul_sd_configs which have all of these tags. This is a shorthand for
+	// `keep` relabel_configs on `__meta_consul_tags` and is commonly used to only
+	// query instances tagged as healthy (consul SD returns all instances of a
+	// service, regardless of their health checks). Hosts discovered by other
+	// SD mechanisms are unaffected.
+	ConsulRequiredTags []string `yaml:"consul_required_tags,omitempty"`
+	// ResultRelabelConfigs are applied to the labelset of each series returned from
+	// the hosts in this servergroup (after the servergroup's labels are added) before
+	// the results are merged. This allows for normalizing labels across hosts (e.g.
+	// `instance` values that differ across clusters) so that series which should be
+	// identical are deduplicated.
+	// Note: these are only applied to results, so matchers in queries must still
+	// use the labels as they exist on the downstream hosts.
+	ResultRelabelConfigs []*config.RelabelConfig `yaml:"result_relabel_configs,omitempty"`
+	// ValueTransforms (optionally) transform the values of the series returned
+	// from the hosts in this servergroup (after ResultRelabelConfigs) before the
+	// results are merged and deduplicated. This allows for normalizing units
+	// across clusters (e.g. one reporting bytes and another kilobytes). See
+	// ValueTransformConfig. Queries aren't pushed down to the hosts with value
+	// transforms, as the data must be transformed before it is aggregated.
+	ValueTransforms []*ValueTransformConfig `yaml:"value_transforms,omitempty"`
 	// Hosts is a set of ServiceDiscoveryConfig options that allow promxy to discover
-	// all hosts in the server_group
+	// all hosts in the server_group.
+	// Each polling SD mechanism (dns, file, consul, ec2, etc.) has its own
+	// `refresh_interval` option which controls how often promxy will re-discover
+	// the hosts for this server_group. For example, to pick up changes in a DNS SRV
+	// record every 5s (instead of the upstream default of 30s):
+	//
+	//    dns_sd_configs:
+	//      - names: ['_prometheus._tcp.example.com']
+	//        refresh_interval: 5s
+	//
+	// Note: regardless of the refresh_interval the discovery manager will only
+	// send updates to the server_group at most every 5s.
 	Hosts sd_config.ServiceDiscoveryConfig `yaml:",inline"`
 	// PathPrefix to prepend to all queries to hosts in this servergroup
+	// This can be overridden per-target by setting the `__path_prefix__` label
+	// or, failing that, the `__metrics_path__` label (through SD or relabel_configs)
 	PathPrefix string `yaml:"path_prefix"`
 	// TODO cache this as a model.Time after unmarshal
 	// AntiAffinity defines how large of a gap in the timeseries will cause promxy
@@ -90,9 +152,126 @@ type Config struct {
 	// any one of these can cause the resulting data in prometheus to have the same time but in reality
 	// come from different points in time. Best practice for this value is to set it to your scrape interval
 	AntiAffinity *time.Duration `yaml:"anti_affinity,omitempty"`
+	// ReplicaLabels (optionally) are the labels (set by the target labels or
+	// relabeling, or in the hosts' data) which tell the HA replicas in this
+	// servergroup apart, like the replica labels of thanos. Only one of the
+	// replicas is then required to respond, and the series which are the same
+	// without the replica labels are deduplicated into one series, the gaps of
+	// the replica with the most points filled with the points of the others
+	// (merged by AntiAffinity, see promclient.ReplicaDedupAPI). The replica
+	// labels are removed from all results. Queries aren't pushed down while
+	// any servergroup has ReplicaLabels, as the replicas would be aggregated
+	// (e.g. summed) together before they are deduplicated.
+	ReplicaLabels []model.LabelName `yaml:"replica_labels,omitempty"`
 
-	// IgnoreError will hide all errors from this given servergroup
+	// IgnoreError will hide all errors from this given servergroup, adding
+	// them as warnings to the response instead
 	IgnoreError bool `yaml:"ignore_error"`
+
+	// Quorum is the number of hosts (with the same labels) in this servergroup
+	// which must respond before promxy returns the merged result. Once the quorum
+	// is reached the requests to the remaining hosts are cancelled. This trades
+	// completeness for latency (e.g. when one HA replica is slow). The default
+	// of 0 waits for all hosts to respond.
+	Quorum int `yaml:"quorum"`
+	// ReplicaFailover changes how the hosts in this servergroup are queried from
+	// "query all and merge" to "query one at a time until one succeeds". This
+	// should only be enabled if all hosts are replicas with the same data (e.g.
+	// an HA pair) as the data from the other hosts is never merged in. The
+	// hosts are tried fastest first, by the moving average of their latency.
+	ReplicaFailover bool `yaml:"replica_failover"`
+	// AffinityReplicas (optionally) sends the queries with an affinity key (see
+	// the affinity_header of the promxy config) to only this many of the hosts
+	// (with the same labels) in this servergroup, chosen by consistent hashing
+	// of the key. Queries sharing a key (e.g. the panels of a dashboard) then
+	// hit the same hosts, improving the hit rate of their query caches. With
+	// ReplicaFailover the hosts are tried in the order chosen for the key.
+	AffinityReplicas int `yaml:"affinity_replicas"`
+	// MinStep is the minimum step range queries are sent to the hosts in this
+	// servergroup with (e.g. their scrape interval). Queries with a finer step
+	// are queried with MinStep and forward-filled into the requested step: each
+	// requested timestamp gets the value of the latest point before it, if that
+	// point is less than MinStep old. See promclient.MinStepAPI.
+	MinStep time.Duration `yaml:"min_step"`
+	// Retention (optionally) is how far back the hosts in this servergroup
+	// have data. Requests for time ranges ending before the retention window
+	// aren't sent to the hosts (see promclient.RetentionAPI): their lack of data
+	// is expected, so it is neither a failure nor a warning with IgnoreError.
+	Retention time.Duration `yaml:"retention"`
+	// MaxConcurrentQueries (optionally) bounds the number of data queries this
+	// servergroup handles concurrently (each query counts once, however many
+	// hosts it is sent to), protecting a small cluster independently of the
+	// global limits. Queries over the limit are queued until there is capacity
+	// or they time out, the server_group_queued_queries gauge is the queue depth.
+	MaxConcurrentQueries int `yaml:"max_concurrent_queries"`
+	// MaxRequestsPerSecond (optionally) limits the rate of requests promxy
+	// sends to each host in this servergroup, protecting fragile hosts from
+	// query storms. Requests over the limit wait for capacity (up to the query
+	// timeout) unless RateLimitFailFast is set, in which case they fail.
+	MaxRequestsPerSecond float64 `yaml:"max_requests_per_second"`
+	RateLimitFailFast    bool    `yaml:"rate_limit_fail_fast"`
+	// DropStaleMarkers drops the staleness markers (see value.StaleNaN) from the
+	// data returned by the hosts in this servergroup before it is merged. These
+	// are returned in raw data (e.g. over remote_read) and confuse some clients,
+	// ordinary NaN values are kept.
+	DropStaleMarkers bool `yaml:"drop_stale_markers"`
+	// RetainTargets (optionally) keeps using the last non-empty set of targets
+	// for up to this long when service discovery returns none, so a transient
+	// service discovery blip (e.g. a consul leader election) doesn't empty the
+	// servergroup. The server_group_retained_targets metric is 1 while the
+	// retained targets are in use.
+	RetainTargets time.Duration `yaml:"retain_targets"`
+	// MinTargets (optionally) is the number of targets service discovery must
+	// find before the servergroup is ready, so promxy doesn't report ready (and
+	// serve partial data) while discovery is still warming up
+	MinTargets int `yaml:"min_targets"`
+	// MaxTargets (optionally) caps the number of targets of the servergroup, so
+	// a misconfigured service discovery (e.g. matching an entire cluster)
+	// doesn't fan queries out to thousands of hosts. A discovery round finding
+	// more targets is rejected (keeping the previous targets, so the servergroup
+	// isn't ready until a round is within the cap if the first one is rejected),
+	// and the server_group_max_targets_exceeded metric is 1 while it is over.
+	MaxTargets int `yaml:"max_targets"`
+	// Warmup (optionally) sends a cheap query to each target once service
+	// discovery first finds them, before the servergroup is ready, so the
+	// connections to the targets are established before real queries are
+	// served (avoiding the latency of their handshakes right after a deploy)
+	Warmup bool `yaml:"warmup"`
+	// StaleWhileError (optionally) serves the last successful result of a query
+	// (with a warning) when this servergroup fails the query (it couldn't be
+	// reached, timed out or returned a server error)
+	StaleWhileError *StaleWhileErrorConfig `yaml:"stale_while_error,omitempty"`
+	// Backoff (optionally) stops sending requests to a host which failed (it
+	// couldn't be reached or returned a server error) for a jittered backoff,
+	// so the hosts of a servergroup which failed together (e.g. a cluster
+	// reboot) are probed at spread out times as they recover
+	Backoff *BackoffConfig `yaml:"backoff,omitempty"`
+	// VerticalShards (optionally) splits the raw data requests to each host in
+	// this servergroup by series into parallel requests (see
+	// VerticalShardConfig).
+	VerticalShards *VerticalShardConfig `yaml:"vertical_shards,omitempty"`
+	// ErrorCodes (optionally) configures how the error responses of the hosts
+	// in this servergroup are handled by their HTTP status code (e.g. 503 is
+	// retried, 422 is returned to the client as 400). See ErrorCodeConfig.
+	ErrorCodes map[int]ErrorCodeConfig `yaml:"error_codes,omitempty"`
+}
+
+// GetShardMatchers returns the matchers of the VerticalShards (nil if the
+// requests aren't split)
+func (c *Config) GetShardMatchers() []*labels.Matcher {
+	if c.VerticalShards == nil {
+		return nil
+	}
+	return c.VerticalShards.matchers
+}
+
+// GetValueTransforms returns the ValueTransforms as promclient.ValueTransforms
+func (c *Config) GetValueTransforms() []*promclient.ValueTransform {
+	transforms := make([]*promclient.ValueTransform, len(c.ValueTransforms))
+	for i, transformConfig := range c.ValueTransforms {
+		transforms[i] = transformConfig.transform
+	}
+	return transforms
 }
 
 func (c *Config) GetScheme() string {
@@ -116,10 +295,459 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	// To make unmarshal fill the plain data struct rather than calling UnmarshalYAML
 	// again, we have to hide it using a type indirection.
 	type plain Config
-	return unmarshal((*plain)(c))
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Quorum < 0 {
+		return fmt.Errorf("quorum must not be negative, got %d", c.Quorum)
+	}
+	if c.AffinityReplicas < 0 {
+		return fmt.Errorf("affinity_replicas must not be negative, got %d", c.AffinityReplicas)
+	}
+	if c.MinTargets < 0 {
+		return fmt.Errorf("min_targets must not be negative, got %d", c.MinTargets)
+	}
+	if c.MaxTargets < 0 {
+		return fmt.Errorf("max_targets must not be negative, got %d", c.MaxTargets)
+	}
+	if c.MaxTargets > 0 && c.MinTargets > c.MaxTargets {
+		return fmt.Errorf("min_targets (%d) must not be greater than max_targets (%d)", c.MinTargets, c.MaxTargets)
+	}
+	if c.Warmup && c.RemoteReadOnly {
+		return fmt.Errorf("warmup is not supported with remote_read_only")
+	}
+	if c.MaxConcurrentQueries < 0 {
+		return fmt.Errorf("max_concurrent_queries must not be negative, got %d", c.MaxConcurrentQueries)
+	}
+	if c.Retention < 0 {
+		return fmt.Errorf("retention must not be negative, got %s", c.Retention)
+	}
+	for code, errorCode := range c.ErrorCodes {
+		if code < 400 || code > 599 {
+			return fmt.Errorf("error_codes must be 4xx or 5xx status codes, got %d", code)
+		}
+		if errorCode.Status != 0 && (errorCode.Status < 400 || errorCode.Status > 599) {
+			return fmt.Errorf("error_codes %d status must be a 4xx or 5xx status code, got %d", code, errorCode.Status)
+		}
+		if errorCode.Retries < 0 {
+			return fmt.Errorf("error_codes %d retries must not be negative, got %d", code, errorCode.Retries)
+		}
+	}
+	if err := c.HTTPConfig.RedirectPolicy.Validate(); err != nil {
+		return err
+	}
+	if err := validateConsulSDConfigs(c.Hosts.ConsulSDConfigs, c.ConsulRequiredTags); err != nil {
+		return err
+	}
+	return validateSDRefreshIntervals(c.Hosts)
+}
+
+// Validate checks the parts of the config which can't be checked while
+// unmarshaling, such as the files it references (TLS certs, auth files)
+func (c *Config) Validate() error {
+	if scheme := c.GetScheme(); scheme != "http" && scheme != "https" {
+		return fmt.Errorf("invalid scheme %q", scheme)
+	}
+	if _, err := url.Parse(c.GetScheme() + "://localhost" + c.PathPrefix); err != nil {
+		return fmt.Errorf("invalid path_prefix %q: %v", c.PathPrefix, err)
+	}
+	if _, err := config_util.NewTLSConfig(&c.HTTPConfig.HTTPConfig.TLSConfig); err != nil {
+		return fmt.Errorf("error loading TLS client config: %v", err)
+	}
+	if f := c.HTTPConfig.HTTPConfig.BearerTokenFile; f != "" {
+		if _, err := ioutil.ReadFile(f); err != nil {
+			return fmt.Errorf("unable to read bearer_token_file: %v", err)
+		}
+	}
+	if basicAuth := c.HTTPConfig.HTTPConfig.BasicAuth; basicAuth != nil && basicAuth.PasswordFile != "" {
+		if _, err := ioutil.ReadFile(basicAuth.PasswordFile); err != nil {
+			return fmt.Errorf("unable to read basic_auth password_file: %v", err)
+		}
+	}
+	return nil
+}
+
+// StaleWhileErrorConfig configures serving the last successful result of a
+// query when it fails. Queries are the same if they have the same query, range
+// duration and step (see promclient.StaleCacheAPI).
+type StaleWhileErrorConfig struct {
+	// MaxStaleness is how old a result may be and still be served
+	MaxStaleness time.Duration `yaml:"max_staleness"`
+	// Size is the max number of results to cache (defaults to 1000)
+	Size int `yaml:"size"`
+	// Calls are the calls whose results are cached, any of "query",
+	// "query_range" and "get_value" (defaults to "query" and "query_range")
+	Calls []string `yaml:"calls"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *StaleWhileErrorConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = StaleWhileErrorConfig{
+		Size:  1000,
+		Calls: []string{"query", "query_range"},
+	}
+	type plain StaleWhileErrorConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.MaxStaleness <= 0 {
+		return fmt.Errorf("stale_while_error max_staleness must be greater than 0")
+	}
+	if c.Size <= 0 {
+		return fmt.Errorf("stale_while_error size must be greater than 0")
+	}
+	for _, call := range c.Calls {
+		switch call {
+		case "query", "query_range", "get_value":
+		default:
+			return fmt.Errorf("invalid stale_while_error call %q", call)
+		}
+	}
+	return nil
+}
+
+// BackoffConfig configures the backoff of the hosts of a servergroup after they
+// fail (see promclient.Backoff)
+type BackoffConfig struct {
+	// MinBackoff is the backoff after a first failure, doubling with each
+	// consecutive failure up to MaxBackoff
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	// Jitter is the max fraction (between 0 and 1) of each backoff which is
+	// randomly taken off it
+	Jitter float64 `yaml:"jitter"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *BackoffConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = BackoffConfig{
+		MinBackoff: time.Second,
+		MaxBackoff: time.Minute,
+		Jitter:     0.5,
+	}
+	type plain BackoffConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.MinBackoff <= 0 {
+		return fmt.Errorf("backoff min_backoff must be greater than 0")
+	}
+	if c.MaxBackoff < c.MinBackoff {
+		return fmt.Errorf("backoff max_backoff must be at least min_backoff")
+	}
+	if !(c.Jitter >= 0 && c.Jitter <= 1) {
+		return fmt.Errorf("backoff jitter must be between 0 and 1")
+	}
+	return nil
+}
+
+// VerticalShardConfig configures splitting the raw data requests (of the
+// selectors of a query) to a host by series: each is sent as Count requests
+// in parallel, each selecting a disjoint shard of the values of Label (see
+// promclient.ShardMatchers).
+//
+// This helps when a selector matches huge numbers of series on a single host,
+// as the host encodes them (and promxy decodes them) in parallel. It hurts
+// small requests (which pay for Count requests) and loaded hosts, as each
+// shard repeats the index lookup of the selector. Label should be a label of
+// the series on the host (rather than one added by promxy) whose values are
+// spread evenly, e.g. `instance`. Queries which are pushed down aren't split.
+//
+// The shards of a request share the one slot it takes of the
+// --downstream.max-concurrency capacity, so the concurrent requests to the
+// hosts of this servergroup can be up to Count times that.
+type VerticalShardConfig struct {
+	Label model.LabelName `yaml:"label"`
+	Count int             `yaml:"count"`
+
+	matchers []*labels.Matcher
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *VerticalShardConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain VerticalShardConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if !c.Label.IsValid() {
+		return fmt.Errorf("vertical_shards label %q is invalid", c.Label)
+	}
+	matchers, err := promclient.ShardMatchers(c.Label, c.Count)
+	if err != nil {
+		return fmt.Errorf("vertical_shards count: %v", err)
+	}
+	c.matchers = matchers
+	return nil
+}
+
+// ValueTransformConfig configures the transformation of the values of the
+// series matching a selector (see promclient.ValueTransform). Each series is
+// transformed by the first of the ValueTransforms it matches.
+type ValueTransformConfig struct {
+	// Match is the series selector (e.g. `{__name__=~".*_kilobytes"}`) the
+	// series must match to be transformed, all series match if it is empty
+	Match string `yaml:"match,omitempty"`
+	// Expr is the arithmetic expression of the sample `value` computing its new
+	// value (e.g. `value * 1024`), see promclient.ValueExpr
+	Expr string `yaml:"expr"`
+
+	transform *promclient.ValueTransform
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *ValueTransformConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ValueTransformConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Expr == "" {
+		return fmt.Errorf("value_transforms expr is required")
+	}
+	expr, err := promclient.ParseValueExpr(c.Expr)
+	if err != nil {
+		return fmt.Errorf("value_transforms expr: %v", err)
+	}
+	c.transform = &promclient.ValueTransform{Expr: expr}
+	if c.Match != "" {
+		matchers, err := promql.ParseMetricSelector(c.Match)
+		if err != nil {
+			return fmt.Errorf("value_transforms match %q: %v", c.Match, err)
+		}
+		c.transform.Matchers = matchers
+	}
+	return nil
+}
+
+// ErrorCodeConfig configures the handling of the error responses with an
+// HTTP status code from the hosts of a servergroup (see promclient.ErrorCode)
+type ErrorCodeConfig struct {
+	// Status (optionally) is the status promxy responds with when a query
+	// fails with the error, instead of the status of the error
+	Status int `yaml:"status"`
+	// Retries is the number of times the request is retried (with a doubling
+	// delay from 100ms) before it fails with the error
+	Retries int `yaml:"retries"`
+}
+
+// ErrorCodeMap returns the ErrorCodes for promclient.NewErrorCodesRoundTripper
+func (c *Config) ErrorCodeMap() map[int]promclient.ErrorCode {
+	if len(c.ErrorCodes) == 0 {
+		return nil
+	}
+	codes := make(map[int]promclient.ErrorCode, len(c.ErrorCodes))
+	for code, errorCode := range c.ErrorCodes {
+		codes[code] = promclient.ErrorCode{Status: errorCode.Status, Retries: errorCode.Retries}
+	}
+	return codes
+}
+
+// CallSet returns the Calls as a set
+func (c *StaleWhileErrorConfig) CallSet() map[string]struct{} {
+	calls := make(map[string]struct{}, len(c.Calls))
+	for _, call := range c.Calls {
+		calls[call] = struct{}{}
+	}
+	return calls
+}
+
+// TargetRelabelConfigs returns the relabel configs to apply to the discovered
+// hosts, which is the RelabelConfigs preceded by any generated from the config
+// (e.g. ConsulRequiredTags)
+func (c *Config) TargetRelabelConfigs() []*config.RelabelConfig {
+	if len(c.ConsulRequiredTags) == 0 {
+		return c.RelabelConfigs
+	}
+
+	// The tags are joined with (and surrounded by) the separator, which is
+	// validated to be the same across all consul_sd_configs
+	sep := regexp.QuoteMeta(c.Hosts.ConsulSDConfigs[0].TagSeparator)
+	relabelConfigs := make([]*config.RelabelConfig, 0, len(c.ConsulRequiredTags)+len(c.RelabelConfigs))
+	for _, tag := range c.ConsulRequiredTags {
+		relabelConfigs = append(relabelConfigs, &config.RelabelConfig{
+			SourceLabels: model.LabelNames{consulTagsLabel},
+			Separator:    ";",
+			// Hosts which weren't discovered through consul have no tags label
+			Regex:  config.MustNewRegexp("|.*" + sep + regexp.QuoteMeta(tag) + sep + ".*"),
+			Action: config.RelabelKeep,
+		})
+	}
+	return append(relabelConfigs, c.RelabelConfigs...)
+}
+
+// consulTagsLabel is the label consul SD sets to the (separator joined) tags of the service
+const consulTagsLabel = model.MetaLabelPrefix + "consul_tags"
+
+// validateConsulSDConfigs checks the consul_sd_configs for mistakes that
+// upstream allows but which don't make sense for discovering prometheus hosts
+func validateConsulSDConfigs(sdConfigs []*consul.SDConfig, requiredTags []string) error {
+	if len(requiredTags) > 0 && len(sdConfigs) == 0 {
+		return fmt.Errorf("consul_required_tags requires consul_sd_configs")
+	}
+	for i, c := range sdConfigs {
+		// Without services consul SD discovers every service in consul
+		if len(c.Services) == 0 {
+			return fmt.Errorf("consul_sd_configs[%d]: services must be set", i)
+		}
+		if c.Scheme != "http" && c.Scheme != "https" {
+			return fmt.Errorf("consul_sd_configs[%d]: invalid scheme %q", i, c.Scheme)
+		}
+		if c.TagSeparator == "" {
+			return fmt.Errorf("consul_sd_configs[%d]: tag_separator must not be empty", i)
+		}
+		if len(requiredTags) > 0 && c.TagSeparator != sdConfigs[0].TagSeparator {
+			return fmt.Errorf("consul_sd_configs[%d]: tag_separator must match across consul_sd_configs to use consul_required_tags", i)
+		}
+	}
+	return nil
+}
+
+// validateSDRefreshIntervals checks that all polling service discovery mechanisms
+// have a positive refresh_interval. Upstream doesn't validate most of these, and
+// a non-positive interval will panic when the discoverer creates its ticker
+func validateSDRefreshIntervals(sd sd_config.ServiceDiscoveryConfig) error {
+	check := func(sdType string, i int, interval model.Duration) error {
+		if interval <= 0 {
+			return fmt.Errorf("%s[%d]: refresh_interval must be positive, got %v", sdType, i, interval)
+		}
+		return nil
+	}
+
+	for i, c := range sd.DNSSDConfigs {
+		if err := check("dns_sd_configs", i, c.RefreshInterval); err != nil {
+			return err
+		}
+	}
+	for i, c := range sd.FileSDConfigs {
+		if err := check("file_sd_configs", i, c.RefreshInterval); err != nil {
+			return err
+		}
+	}
+	for i, c := range sd.ConsulSDConfigs {
+		if err := check("consul_sd_configs", i, c.RefreshInterval); err != nil {
+			return err
+		}
+	}
+	for i, c := range sd.MarathonSDConfigs {
+		if err := check("marathon_sd_configs", i, c.RefreshInterval); err != nil {
+			return err
+		}
+	}
+	for i, c := range sd.GCESDConfigs {
+		if err := check("gce_sd_configs", i, c.RefreshInterval); err != nil {
+			return err
+		}
+	}
+	for i, c := range sd.EC2SDConfigs {
+		if err := check("ec2_sd_configs", i, c.RefreshInterval); err != nil {
+			return err
+		}
+	}
+	for i, c := range sd.OpenstackSDConfigs {
+		if err := check("openstack_sd_configs", i, c.RefreshInterval); err != nil {
+			return err
+		}
+	}
+	for i, c := range sd.AzureSDConfigs {
+		if err := check("azure_sd_configs", i, c.RefreshInterval); err != nil {
+			return err
+		}
+	}
+	for i, c := range sd.TritonSDConfigs {
+		if err := check("triton_sd_configs", i, c.RefreshInterval); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type HTTPClientConfig struct {
 	DialTimeout time.Duration                `yaml:"dial_timeout"`
 	HTTPConfig  config_util.HTTPClientConfig `yaml:",inline"`
+	// TLSHandshakeTimeout is how long promxy waits for the TLS handshake with
+	// a downstream to complete. The default of 0 has no limit (other than the
+	// request's own timeout).
+	TLSHandshakeTimeout time.Duration `yaml:"tls_handshake_timeout"`
+	// ResponseHeaderTimeout is how long promxy waits for the response headers
+	// after sending a request to a downstream (which for queries includes the
+	// downstream's evaluation time). The default of 0 has no limit.
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout"`
+	// UserAgent is the User-Agent header promxy sends to the downstreams
+	// in this servergroup (defaults to promxy/<version>)
+	UserAgent string `yaml:"user_agent"`
+	// Headers is a set of static headers to add to all requests to the
+	// downstreams in this servergroup
+	Headers map[string]string `yaml:"headers"`
+	// QueryParams is a set of static query parameters to add to all requests
+	// to the downstreams in this servergroup (e.g. a tenant for a multi-tenant
+	// backend), overriding any parameter of the same name set by promxy
+	QueryParams map[string]string `yaml:"query_params"`
+	// SeriesLimitParam is the query parameter the downstreams in this
+	// servergroup accept as a limit of the series of a query's result (e.g.
+	// `limit`). When set, the max_select_series limit is sent with the raw
+	// data requests so the downstreams don't return more series than can be
+	// used. Without it the limit is only applied once the results are merged.
+	SeriesLimitParam string `yaml:"series_limit_param"`
+	// MaxResponseSize is the max size (in bytes) of a response promxy will read
+	// from the downstreams in this servergroup. Requests with larger responses
+	// fail instead of being buffered into memory. The default of 0 is unlimited.
+	MaxResponseSize int64 `yaml:"max_response_size"`
+	// ConditionalCacheSize is the number of metadata (series, labels) responses
+	// to cache from the downstreams in this servergroup. Cached responses are
+	// revalidated with the downstream's ETag/Last-Modified on each request.
+	// The default of 0 disables the cache.
+	ConditionalCacheSize int `yaml:"conditional_cache_size"`
+	// CloseGracePeriod is how long the connections of a replaced client (e.g.
+	// after a config reload) are kept before its idle connections are closed,
+	// giving the requests in-flight on the old client time to complete.
+	CloseGracePeriod time.Duration `yaml:"close_grace_period"`
+	// RedirectPolicy is how redirects from the downstreams in this servergroup
+	// are handled. By default they are followed, but the auth (Authorization
+	// header) is only sent to the host of the target, not to other hosts.
+	RedirectPolicy RedirectPolicy `yaml:"redirect_policy"`
+}
+
+// RedirectPolicy is how the redirects of a servergroup's downstreams are handled
+type RedirectPolicy string
+
+const (
+	// RedirectPolicyFollow follows redirects, sending the auth to any host
+	RedirectPolicyFollow RedirectPolicy = "follow"
+	// RedirectPolicyError fails the requests which are redirected
+	RedirectPolicyError RedirectPolicy = "error"
+	// RedirectPolicyFollowWithoutAuth follows redirects, only sending the auth
+	// to the host of the target (the default)
+	RedirectPolicyFollowWithoutAuth RedirectPolicy = "follow-without-auth"
+)
+
+// maxRedirects is the max number of redirects followed (the same as the default http.Client)
+const maxRedirects = 10
+
+// Validate returns an error if the policy isn't a known RedirectPolicy
+func (p RedirectPolicy) Validate() error {
+	switch p {
+	case "", RedirectPolicyFollow, RedirectPolicyError, RedirectPolicyFollowWithoutAuth:
+		return nil
+	}
+	return fmt.Errorf("unknown redirect_policy %q, must be one of follow, error or follow-without-auth", string(p))
+}
+
+// CheckRedirect is the http.Client CheckRedirect of the policy, returning an
+// error if the redirected request `req` (redirected `via` the requests so far,
+// oldest first) shouldn't be sent
+func (p RedirectPolicy) CheckRedirect(req *http.Request, via []*http.Request) error {
+	if p == RedirectPolicyError {
+		return fmt.Errorf("redirected to %s, which the redirect_policy %q doesn't follow", req.URL, string(p))
+	}
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	return nil
+}
+
+// GetUserAgent returns the User-Agent to send to downstreams
+func (c *HTTPClientConfig) GetUserAgent() string {
+	if c.UserAgent == "" {
+		return DefaultUserAgent
+	}
+	return c.UserAgent
 }
@@ -0,0 +1,270 @@
+package servergroup
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	connActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "server_group_conn_active",
+		Help: "Number of connections to servergroup instances in use by a request",
+	}, []string{"host"})
+	connIdle = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "server_group_conn_idle",
+		Help: "Number of idle (pooled) connections to servergroup instances",
+	}, []string{"host"})
+)
+
+func init() {
+	prometheus.MustRegister(connActive)
+	prometheus.MustRegister(connIdle)
+}
+
+// targetConns tracks the connections of all the ServerGroups (which can share hosts)
+var targetConns = newConnTracker(connActive, connIdle)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// connTracker tracks the connections to the targets, counting the connections
+// to each host (by the address dialed) which are in use by a request and those
+// which are idle in the transport's pool. This shows whether the pool is
+// saturated (few idle connections while many are in use).
+type connTracker struct {
+	l      sync.Mutex
+	active *prometheus.GaugeVec
+	idle   *prometheus.GaugeVec
+	// conns are the open connections, by their addresses (see connAddrs)
+	conns map[connAddrs]*trackedConn
+}
+
+func newConnTracker(active, idle *prometheus.GaugeVec) *connTracker {
+	return &connTracker{active: active, idle: idle, conns: make(map[connAddrs]*trackedConn)}
+}
+
+// connAddrs are the local and remote addresses identifying a connection. The
+// transport wraps TLS connections in a tls.Conn, which has the addresses of
+// the connection it wraps, so they find the trackedConn of either.
+type connAddrs struct {
+	local, remote string
+}
+
+func addrsOf(conn net.Conn) connAddrs {
+	return connAddrs{conn.LocalAddr().String(), conn.RemoteAddr().String()}
+}
+
+// dial returns `dial` with the connections it dials tracked
+func (t *connTracker) dial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		t.l.Lock()
+		defer t.l.Unlock()
+		// New connections are idle until the transport gives them to a request
+		t.idle.WithLabelValues(addr).Inc()
+		tracked := &trackedConn{Conn: conn, tracker: t, host: addr}
+		t.conns[addrsOf(conn)] = tracked
+		return tracked, nil
+	}
+}
+
+// use adds `delta` to the requests using `conn`, which is active while any do.
+// The transport can hand a connection to the next request before the previous
+// one is done with it, so requests are counted rather than flagged.
+func (t *connTracker) use(conn *trackedConn, delta int) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	if conn.closed {
+		return
+	}
+	wasActive := conn.requests > 0
+	conn.requests += delta
+	switch active := conn.requests > 0; {
+	case active && !wasActive:
+		t.idle.WithLabelValues(conn.host).Dec()
+		t.active.WithLabelValues(conn.host).Inc()
+	case !active && wasActive:
+		t.active.WithLabelValues(conn.host).Dec()
+		t.idle.WithLabelValues(conn.host).Inc()
+	}
+}
+
+// closed removes the closed `conn` from the counts
+func (t *connTracker) closed(conn *trackedConn) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	if conn.closed {
+		return
+	}
+	conn.closed = true
+	delete(t.conns, addrsOf(conn))
+	if conn.requests > 0 {
+		t.active.WithLabelValues(conn.host).Dec()
+	} else {
+		t.idle.WithLabelValues(conn.host).Dec()
+	}
+}
+
+// trackedConn is a connection tracked by a connTracker. Its state is guarded
+// by the tracker's lock.
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+	host    string
+	// requests is the number of requests using the connection
+	requests int
+	closed   bool
+}
+
+func (c *trackedConn) Close() error {
+	c.tracker.closed(c)
+	return c.Conn.Close()
+}
+
+// lookup returns the trackedConn of the connection `conn` the transport uses
+// (which is wrapped in a tls.Conn for TLS), or nil if it isn't tracked
+func (t *connTracker) lookup(conn net.Conn) *trackedConn {
+	if tracked, ok := conn.(*trackedConn); ok {
+		return tracked
+	}
+	t.l.Lock()
+	defer t.l.Unlock()
+	return t.conns[addrsOf(conn)]
+}
+
+// roundTripper returns an http.RoundTripper which counts the connections (dialed
+// with the connTracker's dial) used by the requests to `rt` as in use by them,
+// until the transport returns them to its pool
+func (t *connTracker) roundTripper(rt http.RoundTripper) http.RoundTripper {
+	return &connTrackingRoundTripper{t, rt}
+}
+
+type connTrackingRoundTripper struct {
+	tracker *connTracker
+	rt      http.RoundTripper
+}
+
+func (rt *connTrackingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	var conn *trackedConn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if conn = rt.tracker.lookup(info.Conn); conn != nil {
+				rt.tracker.use(conn, 1)
+			}
+		},
+		// Connections which aren't returned to the pool are closed
+		PutIdleConn: func(err error) {
+			if conn != nil && err == nil {
+				rt.tracker.use(conn, -1)
+			}
+		},
+	}
+	return rt.rt.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// connWaiters counts the requests waiting for a connection to each target (by
+// the address dialed). The transport's DialTLS has no context, so a TLS dial
+// uses one which is cancelled once no request is waiting for a connection to
+// its target (e.g. the queries waiting for it were cancelled).
+type connWaiters struct {
+	l       sync.Mutex
+	waiting map[string]*addrWaiters
+}
+
+// addrWaiters are the requests waiting for a connection to an address, done
+// is closed once there are none
+type addrWaiters struct {
+	n    int
+	done chan struct{}
+}
+
+func newConnWaiters() *connWaiters {
+	return &connWaiters{waiting: make(map[string]*addrWaiters)}
+}
+
+// wait counts a request waiting for a connection to `addr`, until the
+// returned func is called
+func (w *connWaiters) wait(addr string) func() {
+	w.l.Lock()
+	defer w.l.Unlock()
+	waiting, ok := w.waiting[addr]
+	if !ok {
+		waiting = &addrWaiters{done: make(chan struct{})}
+		w.waiting[addr] = waiting
+	}
+	waiting.n++
+	return func() {
+		w.l.Lock()
+		defer w.l.Unlock()
+		waiting.n--
+		if waiting.n == 0 {
+			close(waiting.done)
+			delete(w.waiting, addr)
+		}
+	}
+}
+
+// context returns the context of a dial to `addr`, which is cancelled once no
+// request is waiting for a connection to it (if any were when it was called)
+func (w *connWaiters) context(addr string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w.l.Lock()
+	waiting, ok := w.waiting[addr]
+	w.l.Unlock()
+	if ok {
+		go func() {
+			select {
+			case <-waiting.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
+
+// roundTripper returns an http.RoundTripper which counts the requests to `rt`
+// as waiting for a connection from when the transport starts getting one for
+// them until they have one (or are done)
+func (w *connWaiters) roundTripper(rt http.RoundTripper) http.RoundTripper {
+	return &connWaitingRoundTripper{w, rt}
+}
+
+type connWaitingRoundTripper struct {
+	waiters *connWaiters
+	rt      http.RoundTripper
+}
+
+func (rt *connWaitingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	var l sync.Mutex
+	var done func()
+	stopWaiting := func() {
+		l.Lock()
+		defer l.Unlock()
+		if done != nil {
+			done()
+			done = nil
+		}
+	}
+	defer stopWaiting()
+	trace := &httptrace.ClientTrace{
+		// The transport gets a connection again for retried requests
+		GetConn: func(hostPort string) {
+			stopWaiting()
+			l.Lock()
+			defer l.Unlock()
+			done = rt.waiters.wait(hostPort)
+		},
+		GotConn: func(httptrace.GotConnInfo) {
+			stopWaiting()
+		},
+	}
+	return rt.rt.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
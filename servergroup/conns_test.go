@@ -0,0 +1,95 @@
+package servergroup
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func gaugeValue(t *testing.T, vec *prometheus.GaugeVec, host string) float64 {
+	var m dto.Metric
+	if err := vec.WithLabelValues(host).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestConnTracker(t *testing.T) {
+	active := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "active"}, []string{"host"})
+	idle := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "idle"}, []string{"host"})
+	tracker := newConnTracker(active, idle)
+
+	var host string
+	// Counts seen while handling a request
+	var inRequest [2]float64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inRequest = [2]float64{gaugeValue(t, active, host), gaugeValue(t, idle, host)}
+	}))
+	defer srv.Close()
+	host = strings.TrimPrefix(srv.URL, "http://")
+
+	transport := &http.Transport{DialContext: tracker.dial((&net.Dialer{}).DialContext)}
+	client := &http.Client{Transport: tracker.roundTripper(transport)}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("Unexpected Err: %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if inRequest != [2]float64{1, 0} {
+			t.Fatalf("mismatch in counts during request: active=%v idle=%v", inRequest[0], inRequest[1])
+		}
+		// The connection is returned to the pool (and reused by the next request)
+		if a, i := gaugeValue(t, active, host), gaugeValue(t, idle, host); a != 0 || i != 1 {
+			t.Fatalf("mismatch in counts after request: active=%v idle=%v", a, i)
+		}
+	}
+
+	transport.CloseIdleConnections()
+	if a, i := gaugeValue(t, active, host), gaugeValue(t, idle, host); a != 0 || i != 0 {
+		t.Fatalf("mismatch in counts after close: active=%v idle=%v", a, i)
+	}
+}
+
+func TestConnTrackerTLS(t *testing.T) {
+	active := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "active"}, []string{"host"})
+	idle := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "idle"}, []string{"host"})
+	tracker := newConnTracker(active, idle)
+
+	var host string
+	var inRequest [2]float64
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inRequest = [2]float64{gaugeValue(t, active, host), gaugeValue(t, idle, host)}
+	}))
+	defer srv.Close()
+	host = strings.TrimPrefix(srv.URL, "https://")
+
+	// The transport wraps the tracked connections in a tls.Conn
+	transport := &http.Transport{
+		DialContext:     tracker.dial((&net.Dialer{}).DialContext),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	client := &http.Client{Transport: tracker.roundTripper(transport)}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if inRequest != [2]float64{1, 0} {
+		t.Fatalf("mismatch in counts during request: active=%v idle=%v", inRequest[0], inRequest[1])
+	}
+	if a, i := gaugeValue(t, active, host), gaugeValue(t, idle, host); a != 0 || i != 1 {
+		t.Fatalf("mismatch in counts after request: active=%v idle=%v", a, i)
+	}
+}
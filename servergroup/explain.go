@@ -0,0 +1,64 @@
+package servergroup
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/jacksontj/promxy/promclient"
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+// explain adds the request `req` to `e` without sending it, along with the
+// targets it would be sent to. `filter` returns the query sent to a target
+// with the labels `ls`, and whether the target's series can match it at all.
+func (s *ServerGroup) explain(e *promhttputil.Explain, req promhttputil.ExplainRequest, filter func(ls model.LabelSet) (string, bool, error)) error {
+	sg := promhttputil.ExplainServerGroup{
+		Name:         s.Cfg.Name,
+		Failover:     s.Cfg.ReplicaFailover,
+		Quorum:       s.Cfg.Quorum,
+		AntiAffinity: float64(s.Cfg.GetAntiAffinity().Unix()),
+	}
+	req.Targets = make([]promhttputil.ExplainTarget, 0)
+	if state := s.State(); state != nil {
+		sg.Targets = len(state.TargetInfos)
+		for _, targetInfo := range state.TargetInfos {
+			query, ok, err := filter(targetInfo.Labels)
+			if err != nil {
+				return err
+			}
+			if ok {
+				req.Targets = append(req.Targets, promhttputil.ExplainTarget{URL: targetInfo.URL, Query: query})
+			}
+		}
+	}
+	e.AddRequest(sg, req)
+	return nil
+}
+
+// explainQuery explains the request `api` for `query` (see explain)
+func (s *ServerGroup) explainQuery(ctx context.Context, e *promhttputil.Explain, api, query string, start, end time.Time, step time.Duration) error {
+	req := promhttputil.ExplainRequest{API: api, Query: query, Start: start, End: end, Step: step.Seconds()}
+	return s.explain(e, req, func(ls model.LabelSet) (string, bool, error) {
+		return promclient.FilterQuery(ctx, ls, query)
+	})
+}
+
+// explainGetValue explains the get_value request for `matchers` (see explain)
+func (s *ServerGroup) explainGetValue(e *promhttputil.Explain, start, end time.Time, matchers []*labels.Matcher) error {
+	selector, err := promhttputil.MatcherToString(matchers)
+	if err != nil {
+		return err
+	}
+	req := promhttputil.ExplainRequest{API: "get_value", Query: selector, Start: start, End: end}
+	return s.explain(e, req, func(ls model.LabelSet) (string, bool, error) {
+		filtered, ok := promclient.FilterMatchers(ls, matchers)
+		if !ok {
+			return "", false, nil
+		}
+		selector, err := promhttputil.MatcherToString(filtered)
+		return selector, true, err
+	})
+}
@@ -0,0 +1,235 @@
+package servergroup
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/jacksontj/promxy/promclient"
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+// serverGroupDebug is the debug representation of a single ServerGroup
+type serverGroupDebug struct {
+	Name     string       `json:"name"`
+	Targets  []TargetInfo `json:"targets"`
+	Disabled []string     `json:"disabled"`
+}
+
+// NewDebugHandler returns an http.Handler which renders the currently discovered
+// targets of all ServerGroups (as returned by `sgs`) as JSON
+func NewDebugHandler(sgs func() []*ServerGroup) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverGroups := sgs()
+		ret := make([]serverGroupDebug, len(serverGroups))
+		for i, sg := range serverGroups {
+			if sg.Cfg != nil {
+				ret[i].Name = sg.Cfg.Name
+			}
+			ret[i].Targets = make([]TargetInfo, 0)
+			ret[i].Disabled = make([]string, 0)
+			if state := sg.State(); state != nil {
+				ret[i].Targets = state.TargetInfos
+				ret[i].Disabled = state.Disabled
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(ret); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// NewHealthHandler returns an http.Handler which renders the health summary of
+// all ServerGroups (as returned by `sgs`) as JSON, see ServerGroup.Health
+func NewHealthHandler(sgs func() []*ServerGroup) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverGroups := sgs()
+		ret := make([]Health, len(serverGroups))
+		for i, sg := range serverGroups {
+			ret[i] = sg.Health()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(ret); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// targetValueDebug is the raw (unmerged) data returned by a single target
+type targetValueDebug struct {
+	Target TargetInfo  `json:"target"`
+	Value  model.Value `json:"value,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// serverGroupValueDebug is the raw data returned by each target of a ServerGroup
+type serverGroupValueDebug struct {
+	Name    string             `json:"name"`
+	Targets []targetValueDebug `json:"targets"`
+}
+
+// NewDebugQueryHandler returns an http.Handler which fetches the raw data for
+// the `match` selector (between the optional `start` and `end` params, defaulting
+// to the last 5m) from each target of all ServerGroups, without merging them.
+// This allows diffing the data returned by replicas when debugging dedup.
+// Any matchers required by the request's context (e.g. the tenant) are enforced.
+func NewDebugQueryHandler(sgs func() []*ServerGroup) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		matchers, err := promql.ParseMetricSelector(r.FormValue("match"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		end := time.Now()
+		if t := r.FormValue("end"); t != "" {
+			if end, err = promhttputil.ParseTime(t); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		start := end.Add(-5 * time.Minute)
+		if t := r.FormValue("start"); t != "" {
+			if start, err = promhttputil.ParseTime(t); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		serverGroups := sgs()
+		ret := make([]serverGroupValueDebug, len(serverGroups))
+		var wg sync.WaitGroup
+		for i, sg := range serverGroups {
+			if sg.Cfg != nil {
+				ret[i].Name = sg.Cfg.Name
+			}
+			ret[i].Targets = make([]targetValueDebug, 0)
+			state := sg.State()
+			if state == nil {
+				continue
+			}
+			ret[i].Targets = make([]targetValueDebug, len(state.apiClients))
+			for j, apiClient := range state.apiClients {
+				ret[i].Targets[j].Target = state.TargetInfos[j]
+				wg.Add(1)
+				go func(target *targetValueDebug, apiClient promclient.API) {
+					apiClient = &promclient.EnforceMatchersAPI{API: apiClient}
+					defer wg.Done()
+					v, err := apiClient.GetValue(r.Context(), start, end, matchers)
+					if err != nil {
+						target.Error = err.Error()
+					} else {
+						target.Value = v
+					}
+				}(&ret[i].Targets[j], apiClient)
+			}
+		}
+		wg.Wait()
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(ret); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// serverGroupFlushed is the caches flushed for a single ServerGroup
+type serverGroupFlushed struct {
+	Name    string   `json:"name"`
+	Flushed []string `json:"flushed"`
+}
+
+// NewCacheFlushHandler returns an http.Handler which flushes the caches of all
+// ServerGroups. The optional `server_group` and `cache` params limit the flush
+// to the named server group and cache respectively.
+func NewCacheFlushHandler(sgs func() []*ServerGroup) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverGroupName := r.FormValue("server_group")
+		cacheName := r.FormValue("cache")
+
+		ret := make([]serverGroupFlushed, 0)
+		for _, sg := range sgs() {
+			if sg.Cfg == nil || (serverGroupName != "" && sg.Cfg.Name != serverGroupName) {
+				continue
+			}
+			ret = append(ret, serverGroupFlushed{
+				Name:    sg.Cfg.Name,
+				Flushed: sg.FlushCaches(cacheName),
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(ret); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// serverGroupTargets is the disabled targets of a single ServerGroup
+type serverGroupTargets struct {
+	Name     string   `json:"name"`
+	Disabled []string `json:"disabled"`
+}
+
+// NewTargetAdminHandler returns an httprouter.Handle which disables (if
+// `disable` is set, otherwise enables) the target with the `host` param in
+// all ServerGroups that have it (see ServerGroup.DisableTarget), returning the
+// targets each of those ServerGroups now has disabled.
+func NewTargetAdminHandler(sgs func() []*ServerGroup, disable bool) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		host := p.ByName("host")
+
+		ret := make([]serverGroupTargets, 0)
+		for _, sg := range sgs() {
+			if sg.Cfg == nil {
+				continue
+			}
+			var ok bool
+			if disable {
+				ok = sg.DisableTarget(host)
+			} else {
+				ok = sg.EnableTarget(host)
+			}
+			if !ok {
+				continue
+			}
+			disabled := make([]string, 0)
+			if state := sg.State(); state != nil {
+				disabled = state.Disabled
+			}
+			ret = append(ret, serverGroupTargets{Name: sg.Cfg.Name, Disabled: disabled})
+		}
+		if len(ret) == 0 {
+			if disable {
+				http.Error(w, fmt.Sprintf("no server group has the target %q", host), http.StatusNotFound)
+			} else {
+				http.Error(w, fmt.Sprintf("no server group has the target %q disabled", host), http.StatusNotFound)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(ret); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
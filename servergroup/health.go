@@ -0,0 +1,160 @@
+package servergroup
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/jacksontj/promxy/promclient"
+)
+
+// targetHealth is the result of the last request to a target
+type targetHealth struct {
+	time   time.Time
+	status string
+	err    string
+}
+
+// HealthError is an error of a ServerGroup, either of a request to one of its
+// targets or (with an api of "sync") of service discovery
+type HealthError struct {
+	Time   time.Time `json:"time"`
+	Target string    `json:"target"`
+	API    string    `json:"api"`
+	Error  string    `json:"error"`
+}
+
+// TargetHealth is the health of a target of a ServerGroup. A target is healthy
+// unless its last request failed (those with no requests yet are healthy).
+type TargetHealth struct {
+	URL         string     `json:"url"`
+	Healthy     bool       `json:"healthy"`
+	LastRequest *time.Time `json:"last_request,omitempty"`
+	LastStatus  string     `json:"last_status,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	// BackoffUntil is when the target's backoff ends, while it is backing off
+	// after failing (see BackoffConfig)
+	BackoffUntil *time.Time `json:"backoff_until,omitempty"`
+}
+
+// Health is the health summary of a ServerGroup
+type Health struct {
+	Name  string `json:"name"`
+	Ready bool   `json:"ready"`
+	// Targets is the number of targets queried (excluding the disabled ones)
+	Targets  int `json:"targets"`
+	Healthy  int `json:"healthy"`
+	Disabled int `json:"disabled"`
+	// LastSync is when service discovery last updated the targets
+	LastSync     *time.Time     `json:"last_sync,omitempty"`
+	LastError    *HealthError   `json:"last_error,omitempty"`
+	TargetHealth []TargetHealth `json:"target_health"`
+}
+
+// recordRequest records the `status` of a request to the target with `url`,
+// canceled requests were cut short by us so they don't change its health
+func (s *ServerGroup) recordRequest(url, status string) {
+	if status == promclient.MetricStatusCanceled {
+		return
+	}
+	s.healthL.Lock()
+	defer s.healthL.Unlock()
+	h := s.health[url]
+	h.time = time.Now()
+	h.status = status
+	if status == promclient.MetricStatusSuccess {
+		h.err = ""
+	}
+	s.health[url] = h
+}
+
+// recordError records the `err` of a request to (or the sync of) the target with `url`
+func (s *ServerGroup) recordError(url, api string, err error) {
+	// The requests skipped while the target backs off keep the error it failed with
+	if errors.Cause(err) == promclient.ErrBackoff {
+		return
+	}
+	s.healthL.Lock()
+	defer s.healthL.Unlock()
+	s.lastError = &HealthError{Time: time.Now(), Target: url, API: api, Error: err.Error()}
+	if h, ok := s.health[url]; ok {
+		h.err = err.Error()
+		s.health[url] = h
+	}
+}
+
+// recordSync records a service discovery round and the `backoffs` of its
+// targets, forgetting the health of the targets which are no longer in
+// `targetInfos` nor in the current state
+func (s *ServerGroup) recordSync(targetInfos []TargetInfo, backoffs map[string]*promclient.Backoff) {
+	keep := make(map[string]struct{}, len(targetInfos))
+	for _, targetInfo := range targetInfos {
+		keep[targetInfo.URL] = struct{}{}
+	}
+	if state := s.State(); state != nil {
+		for _, targetInfo := range state.TargetInfos {
+			keep[targetInfo.URL] = struct{}{}
+		}
+	}
+
+	s.healthL.Lock()
+	defer s.healthL.Unlock()
+	s.lastSync = time.Now()
+	s.backoffs = backoffs
+	for url := range s.health {
+		if _, ok := keep[url]; !ok {
+			delete(s.health, url)
+		}
+	}
+}
+
+// Health returns the health summary of the ServerGroup
+func (s *ServerGroup) Health() Health {
+	h := Health{TargetHealth: make([]TargetHealth, 0)}
+	if s.Cfg != nil {
+		h.Name = s.Cfg.Name
+	}
+	select {
+	case <-s.Ready:
+		h.Ready = true
+	default:
+	}
+	state := s.State()
+
+	s.healthL.Lock()
+	defer s.healthL.Unlock()
+	if !s.lastSync.IsZero() {
+		lastSync := s.lastSync
+		h.LastSync = &lastSync
+	}
+	if s.lastError != nil {
+		lastError := *s.lastError
+		h.LastError = &lastError
+	}
+	if state == nil {
+		return h
+	}
+
+	h.Targets = len(state.Targets)
+	h.Disabled = len(state.Disabled)
+	for _, targetInfo := range state.TargetInfos {
+		targetHealth := TargetHealth{URL: targetInfo.URL, Healthy: true}
+		if last, ok := s.health[targetInfo.URL]; ok && !last.time.IsZero() {
+			lastRequest := last.time
+			targetHealth.LastRequest = &lastRequest
+			targetHealth.LastStatus = last.status
+			targetHealth.LastError = last.err
+			targetHealth.Healthy = last.status == promclient.MetricStatusSuccess
+		}
+		if backoff, ok := s.backoffs[targetInfo.URL]; ok {
+			if until := backoff.Until(); time.Now().Before(until) {
+				targetHealth.BackoffUntil = &until
+			}
+		}
+		if targetHealth.Healthy {
+			h.Healthy++
+		}
+		h.TargetHealth = append(h.TargetHealth, targetHealth)
+	}
+	return h
+}
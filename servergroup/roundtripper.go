@@ -0,0 +1,166 @@
+package servergroup
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/jacksontj/promxy/promclient"
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+// NewHeaderRoundTripper returns an http.RoundTripper that sets the User-Agent
+// and the given static headers on each request before passing it on to `rt`
+func NewHeaderRoundTripper(userAgent string, headers map[string]string, rt http.RoundTripper) http.RoundTripper {
+	return &headerRoundTripper{userAgent, headers, rt}
+}
+
+type headerRoundTripper struct {
+	userAgent string
+	headers   map[string]string
+	rt        http.RoundTripper
+}
+
+func (rt *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = cloneRequest(req)
+	if rt.userAgent != "" {
+		req.Header.Set("User-Agent", rt.userAgent)
+	}
+	// Static headers are applied last so they can override anything (including
+	// the User-Agent) if the user really wants to
+	for k, v := range rt.headers {
+		req.Header.Set(k, v)
+	}
+	return rt.rt.RoundTrip(req)
+}
+
+// NewQueryParamsRoundTripper returns an http.RoundTripper that sets the given
+// static query parameters on each request before passing it on to `rt`
+func NewQueryParamsRoundTripper(params map[string]string, rt http.RoundTripper) http.RoundTripper {
+	if len(params) == 0 {
+		return rt
+	}
+	return &queryParamsRoundTripper{params, rt}
+}
+
+type queryParamsRoundTripper struct {
+	params map[string]string
+	rt     http.RoundTripper
+}
+
+func (rt *queryParamsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = cloneRequest(req)
+	// The URL is shared with the original request, so copy it before modifying it
+	u := *req.URL
+	q := u.Query()
+	for k, v := range rt.params {
+		q.Set(k, v)
+	}
+	u.RawQuery = q.Encode()
+	req.URL = &u
+	return rt.rt.RoundTrip(req)
+}
+
+// NewSeriesLimitRoundTripper returns an http.RoundTripper that sets the query
+// parameter `param` to the series limit of the request's context (see
+// promclient.WithSelectLimit) on query requests before passing them on to `rt`
+func NewSeriesLimitRoundTripper(param string, rt http.RoundTripper) http.RoundTripper {
+	if param == "" {
+		return rt
+	}
+	return &seriesLimitRoundTripper{param, rt}
+}
+
+type seriesLimitRoundTripper struct {
+	param string
+	rt    http.RoundTripper
+}
+
+func (rt *seriesLimitRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	limit := promclient.SelectLimit(req.Context())
+	if limit <= 0 || !promhttputil.IsQueryPath(req.URL.Path) {
+		return rt.rt.RoundTrip(req)
+	}
+	req = cloneRequest(req)
+	// The URL is shared with the original request, so copy it before modifying it
+	u := *req.URL
+	q := u.Query()
+	q.Set(rt.param, strconv.Itoa(limit))
+	u.RawQuery = q.Encode()
+	req.URL = &u
+	return rt.rt.RoundTrip(req)
+}
+
+// NewTargetBearerTokenRoundTripper returns an http.RoundTripper that sets the
+// Authorization header of each request to the bearer token `token` returns
+// for the host of the request (if any) before passing it on to `rt`
+func NewTargetBearerTokenRoundTripper(token func(host string) string, rt http.RoundTripper) http.RoundTripper {
+	return &targetBearerTokenRoundTripper{token, rt}
+}
+
+type targetBearerTokenRoundTripper struct {
+	token func(host string) string
+	rt    http.RoundTripper
+}
+
+func (rt *targetBearerTokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	token := rt.token(req.URL.Host)
+	if token == "" {
+		return rt.rt.RoundTrip(req)
+	}
+	req = cloneRequest(req)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return rt.rt.RoundTrip(req)
+}
+
+// NewRedirectRoundTripper returns an http.RoundTripper which applies the
+// redirect policy `policy` to the redirected requests (those with the
+// Response that caused them) before passing them on to `rt`. It is in the
+// RoundTripper chain (inside the auth RoundTrippers, which set the auth on
+// every request) as the clients of the downstreams don't all use our
+// http.Client and its CheckRedirect.
+func NewRedirectRoundTripper(policy RedirectPolicy, rt http.RoundTripper) http.RoundTripper {
+	return &redirectRoundTripper{policy, rt}
+}
+
+type redirectRoundTripper struct {
+	policy RedirectPolicy
+	rt     http.RoundTripper
+}
+
+func (rt *redirectRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Response == nil {
+		return rt.rt.RoundTrip(req)
+	}
+	// The requests the redirects came via, oldest (the request to the target) first
+	var via []*http.Request
+	for r := req.Response.Request; r != nil; {
+		via = append([]*http.Request{r}, via...)
+		if r.Response == nil {
+			break
+		}
+		r = r.Response.Request
+	}
+	if err := rt.policy.CheckRedirect(req, via); err != nil {
+		return nil, err
+	}
+	if rt.policy != RedirectPolicyFollow && len(via) > 0 && req.URL.Host != via[0].URL.Host {
+		req = cloneRequest(req)
+		req.Header.Del("Authorization")
+	}
+	return rt.rt.RoundTrip(req)
+}
+
+// cloneRequest returns a clone of the provided *http.Request.
+// The clone is a shallow copy of the struct and its Header map.
+// (copy of the same method in prometheus/common/config)
+func cloneRequest(r *http.Request) *http.Request {
+	// Shallow copy of the struct.
+	r2 := new(http.Request)
+	*r2 = *r
+	// Deep copy of the Header.
+	r2.Header = make(http.Header)
+	for k, s := range r.Header {
+		r2.Header[k] = s
+	}
+	return r2
+}
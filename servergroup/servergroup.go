@@ -2,11 +2,14 @@ package servergroup
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -20,32 +23,93 @@ import (
 	"github.com/prometheus/prometheus/discovery"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/relabel"
-	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 
 	"github.com/jacksontj/promxy/promclient"
+	"github.com/jacksontj/promxy/promhttputil"
 
 	sd_config "github.com/prometheus/prometheus/discovery/config"
 )
 
+// PathPrefixLabel is the label which (optionally) overrides the path prefix
+// of a target in the servergroup
+const PathPrefixLabel model.LabelName = "__path_prefix__"
+
+// TLSServerNameLabel is the label which (optionally) overrides the TLS server
+// name (SNI, and the name the certificate is verified against) of a target in
+// the servergroup, e.g. when targets are discovered by IP but their
+// certificates are issued for a hostname. It isn't supported with a proxy_url.
+const TLSServerNameLabel model.LabelName = "__tls_servername__"
+
+// TLSInsecureLabel is the label which (optionally) overrides the
+// insecure_skip_verify of the servergroup's TLS config for a target: "true"
+// skips the verification of the target's certificate (e.g. a self-signed one)
+// and "false" verifies it. It isn't supported with a proxy_url.
+const TLSInsecureLabel model.LabelName = "__tls_insecure__"
+
+// BearerTokenLabel is the label which (optionally) sets the bearer token of a
+// target in the servergroup, overriding the bearer_token (or
+// bearer_token_file) of the servergroup, e.g. for downstreams which each
+// require their own token. Like all the private labels it is removed from the
+// target's labels, so the token isn't exposed.
+const BearerTokenLabel model.LabelName = "__bearer_token__"
+
+// ServerGroupAnnotation is the annotation added to alerts to identify the
+// servergroup the alert came from
+const ServerGroupAnnotation = "promxy_server_group"
+
 var (
-	// TODO: have a marker for "which" servergroup
 	serverGroupSummary = prometheus.NewSummaryVec(prometheus.SummaryOpts{
 		Name: "server_group_request_duration_seconds",
 		Help: "Summary of calls to servergroup instances",
-	}, []string{"host", "call", "status"})
+	}, []string{"server_group", "host", "call", "status"})
+	targetLatencyEMA = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "server_group_target_latency_ema_seconds",
+		Help: "Exponential moving average of the latency of calls to servergroup instances",
+	}, []string{"host"})
+	throttledRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "server_group_throttled_requests_total",
+		Help: "Number of requests to servergroup instances which were over the max_requests_per_second limit",
+	}, []string{"server_group", "host"})
+	queuedQueries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "server_group_queued_queries",
+		Help: "Number of queries waiting for the servergroup's max_concurrent_queries capacity",
+	}, []string{"server_group"})
+	retainedTargets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "server_group_retained_targets",
+		Help: "Whether the servergroup is using its last non-empty set of targets as service discovery returned none (see retain_targets)",
+	}, []string{"server_group"})
+	maxTargetsExceeded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "server_group_max_targets_exceeded",
+		Help: "Whether the servergroup is keeping its previous targets as service discovery found more than max_targets",
+	}, []string{"server_group"})
 )
 
 func init() {
 	prometheus.MustRegister(serverGroupSummary)
+	prometheus.MustRegister(targetLatencyEMA)
+	prometheus.MustRegister(throttledRequests)
+	prometheus.MustRegister(retainedTargets)
+	prometheus.MustRegister(queuedQueries)
+	prometheus.MustRegister(maxTargetsExceeded)
 }
 
-func New() *ServerGroup {
+// targetLatency is the latency of each host, used to prefer faster replicas
+// with ReplicaFailover. This is by host (not servergroup) as the latency is a
+// property of the host.
+var targetLatency = promclient.NewLatencyEMA(0.2)
+
+// New returns a ServerGroup whose requests to its targets are bounded by `workerPool`
+func New(workerPool *promclient.WorkerPool) *ServerGroup {
 	ctx, ctxCancel := context.WithCancel(context.Background())
 	// Create the targetSet (which will maintain all of the updating etc. in the background)
 	sg := &ServerGroup{
-		ctx:       ctx,
-		ctxCancel: ctxCancel,
-		Ready:     make(chan struct{}),
+		ctx:        ctx,
+		ctxCancel:  ctxCancel,
+		Ready:      make(chan struct{}),
+		workerPool: workerPool,
+		health:     make(map[string]targetHealth),
 	}
 
 	lvl := promlog.AllowedLevel{}
@@ -64,8 +128,33 @@ func New() *ServerGroup {
 // Encapsulate the state of a serverGroup from service discovery
 type ServerGroupState struct {
 	// Targets is the list of target URLs for this discovery round
-	Targets   []string
+	Targets []string
+	// TargetInfos is the detailed state of each target in `Targets`
+	TargetInfos []TargetInfo
+	// Disabled are the targets of this discovery round excluded by DisableTarget
+	Disabled  []string
 	apiClient promclient.API
+	// apiClients are the clients for each target in `Targets` (before merging)
+	apiClients []promclient.API
+}
+
+// discoveredTargets are the targets of a discovery round, before any disabled
+// targets are excluded
+type discoveredTargets struct {
+	targets     []string
+	targetInfos []TargetInfo
+	apiClients  []promclient.API
+}
+
+// TargetInfo describes a single target that was discovered (and relabeled)
+// for a ServerGroup
+type TargetInfo struct {
+	// URL is the final URL used to talk to the target
+	URL string `json:"url"`
+	// Labels are the labels that will be added to all data from this target
+	Labels model.LabelSet `json:"labels"`
+	// RemoteRead is whether data is fetched from this target using remote_read
+	RemoteRead bool `json:"remote_read"`
 }
 
 type ServerGroup struct {
@@ -80,62 +169,202 @@ type ServerGroup struct {
 	Client        *http.Client
 	targetManager *discovery.Manager
 
+	// transport is the base transport of Client, kept to close its connections once it is replaced
+	transport *http.Transport
+	// caches are the (flushable) caches of the ServerGroup by name
+	caches map[string]promclient.Flusher
+	// staleCache is the cache of results for StaleWhileError (if configured)
+	staleCache *promclient.StaleCache
+	// queryPool bounds the concurrent queries for MaxConcurrentQueries (nil is unbounded)
+	queryPool *promclient.WorkerPool
+
+	// limiters are the rate limiters of each target (by URL), kept across
+	// discovery rounds so the targets' limits aren't reset by each round
+	limiters map[string]*rate.Limiter
+	// backoffs are the backoffs of each target (by URL), kept across discovery
+	// rounds like the limiters. Guarded by healthL.
+	backoffs map[string]*promclient.Backoff
+	// serverNames are the TLS server names of the targets (by address) with a
+	// TLSServerNameLabel, used when dialing them
+	serverNames atomic.Value
+	// insecureTargets are whether the certificates of the targets (by address)
+	// with a TLSInsecureLabel are verified, used when dialing them
+	insecureTargets atomic.Value
+	// bearerTokens are the bearer tokens of the targets (by host) with a
+	// BearerTokenLabel, set on their requests
+	bearerTokens atomic.Value
+
+	// disabledL guards the disabled targets and the targets they are excluded from
+	disabledL sync.Mutex
+	// disabled are the hosts of the targets excluded by DisableTarget, kept
+	// across discovery rounds until they are enabled again
+	disabled map[string]struct{}
+	// discovered are the targets of the last discovery round
+	discovered *discoveredTargets
+
+	// retainL guards the retaining of the last non-empty state (see RetainTargets)
+	retainL sync.Mutex
+	// emptySince is when service discovery started returning no targets
+	emptySince time.Time
+	// retainTimer stores the (empty) state once the retain window has passed
+	retainTimer *time.Timer
+
 	OriginalURLs []string
 
+	// workerPool bounds the concurrent requests to the targets (shared by all server groups)
+	workerPool *promclient.WorkerPool
+
+	// healthL guards the health of the targets, and the last sync and error (see Health)
+	healthL sync.Mutex
+	// health is the result of the last request to each target (by URL)
+	health    map[string]targetHealth
+	lastSync  time.Time
+	lastError *HealthError
+
 	state atomic.Value
 }
 
-func (s *ServerGroup) Cancel() {
+// StopDiscovery stops the service discovery of the ServerGroup, its current
+// targets are kept (e.g. to complete the in-flight queries while shutting down)
+func (s *ServerGroup) StopDiscovery() {
 	s.ctxCancel()
+	s.retainL.Lock()
+	if s.retainTimer != nil {
+		s.retainTimer.Stop()
+	}
+	s.retainL.Unlock()
+}
+
+func (s *ServerGroup) Cancel() {
+	s.StopDiscovery()
+	if s.transport != nil {
+		closeIdleConnectionsAfter(s.transport, s.Cfg.HTTPConfig.CloseGracePeriod)
+	}
 }
 
 func (s *ServerGroup) Sync() {
 	syncCh := s.targetManager.SyncCh()
 
 	for targetGroupMap := range syncCh {
+		limiters := make(map[string]*rate.Limiter)
+		backoffs := make(map[string]*promclient.Backoff)
+		serverNames := make(map[string]string)
+		insecureTargets := make(map[string]bool)
+		oldServerNames, _ := s.serverNames.Load().(map[string]string)
+		oldInsecureTargets, _ := s.insecureTargets.Load().(map[string]bool)
+		// The transport connects through a proxy itself (without dialTLS), so
+		// the TLS settings of the targets' labels can't be applied
+		proxied := s.Cfg.HTTPConfig.HTTPConfig.ProxyURL.URL != nil
+		bearerTokens := make(map[string]string)
 		targets := make([]string, 0)
+		targetInfos := make([]TargetInfo, 0)
 		apiClients := make([]promclient.API, 0)
+		relabelConfigs := s.Cfg.TargetRelabelConfigs()
 
 		for _, targetGroupList := range targetGroupMap {
 			for _, targetGroup := range targetGroupList {
 				for _, target := range targetGroup.Targets {
 
-					target = relabel.Process(target, s.Cfg.RelabelConfigs...)
+					// Default the per-target scheme to that of the servergroup, this
+					// can be set by SD or relabeling to override the servergroup
+					// default (similar to prometheus' scrape configs)
+					target = model.LabelSet{
+						model.SchemeLabel: model.LabelValue(s.Cfg.GetScheme()),
+					}.Merge(target)
+
+					target = relabel.Process(target, relabelConfigs...)
 					// Check if the target was dropped, if so we skip it
 					if target == nil {
 						continue
 					}
 
+					scheme := string(target[model.SchemeLabel])
+					if scheme == "" {
+						scheme = s.Cfg.GetScheme()
+					}
 					u := &url.URL{
-						Scheme: string(s.Cfg.GetScheme()),
-						Host:   string(target[model.AddressLabel]),
-						Path:   s.Cfg.PathPrefix,
+						Scheme: scheme,
+						Host:   targetHost(string(target[model.AddressLabel])),
+						Path:   targetPathPrefix(target, s.Cfg.PathPrefix),
 					}
-					targets = append(targets, u.Host)
-
-					client, err := api.NewClient(api.Config{Address: u.String(), RoundTripper: s.Client.Transport})
-					if err != nil {
-						panic(err) // TODO: shouldn't be possible? If this happens I guess we log and skip?
+					targetURL := u.String()
+					if serverName := string(target[TLSServerNameLabel]); serverName != "" {
+						addr := canonicalAddr(scheme, u.Host)
+						serverNames[addr] = serverName
+						if _, ok := oldServerNames[addr]; proxied && !ok {
+							logrus.Warnf("Ignoring the %s of target %s of server group %s, it isn't supported with a proxy_url", TLSServerNameLabel, targetURL, s.Cfg.Name)
+						}
+					}
+					if insecureValue := string(target[TLSInsecureLabel]); insecureValue != "" {
+						insecure, err := strconv.ParseBool(insecureValue)
+						if err != nil {
+							logrus.Errorf("Ignoring invalid %s %q of target %s of server group %s: %v", TLSInsecureLabel, insecureValue, targetURL, s.Cfg.Name, err)
+						} else {
+							addr := canonicalAddr(scheme, u.Host)
+							_, wasSet := oldInsecureTargets[addr]
+							insecureTargets[addr] = insecure
+							if proxied {
+								if !wasSet {
+									logrus.Warnf("Ignoring the %s of target %s of server group %s, it isn't supported with a proxy_url", TLSInsecureLabel, targetURL, s.Cfg.Name)
+								}
+							} else if insecure && scheme == "https" && !oldInsecureTargets[addr] {
+								logrus.Warnf("Skipping TLS certificate verification of target %s of server group %s", targetURL, s.Cfg.Name)
+							}
+						}
 					}
 
-					promAPIClient := v1.NewAPI(client)
+					if bearerToken := string(target[BearerTokenLabel]); bearerToken != "" {
+						bearerTokens[u.Host] = bearerToken
+					}
 
 					var apiClient promclient.API
-					if s.Cfg.RemoteRead {
+					if s.Cfg.RemoteReadOnly {
+						// No v1 API client is created, the target only serves remote_read
 						u.Path = path.Join(u.Path, "api/v1/read")
-						cfg := &remote.ClientConfig{
-							URL: &config_util.URL{u},
-							// TODO: from context?
-							Timeout: model.Duration(time.Minute * 2),
-						}
-						remoteStorageClient, err := remote.NewClient(1, cfg)
+						apiClient = &promclient.PromAPIRemoteReadOnly{RemoteReadClient: promclient.NewRemoteReadClient(u.String(), s.Client, time.Minute*2)}
+					} else {
+						client, err := api.NewClient(api.Config{Address: targetURL, RoundTripper: s.Client.Transport})
 						if err != nil {
-							panic(err)
+							logrus.Errorf("Skipping target %s of server group %s with an invalid address: %v", targetURL, s.Cfg.Name, err)
+							s.recordError(targetURL, "sync", err)
+							continue
 						}
 
-						apiClient = &promclient.PromAPIRemoteRead{promAPIClient, remoteStorageClient}
-					} else {
-						apiClient = &promclient.PromAPIV1{promAPIClient}
+						promAPIClient := &promclient.PromAPIV1{v1.NewAPI(client), client}
+
+						if s.Cfg.RemoteRead {
+							u.Path = path.Join(u.Path, "api/v1/read")
+							// TODO: timeout from context?
+							remoteStorageClient := promclient.NewRemoteReadClient(u.String(), s.Client, time.Minute*2)
+
+							apiClient = &promclient.PromAPIRemoteRead{promAPIClient, remoteStorageClient}
+						} else {
+							apiClient = promAPIClient
+						}
+					}
+
+					if s.Cfg.Backoff != nil {
+						backoff, ok := s.backoffs[targetURL]
+						if !ok {
+							backoff = promclient.NewBackoff(s.Cfg.Backoff.MinBackoff, s.Cfg.Backoff.MaxBackoff, s.Cfg.Backoff.Jitter)
+						}
+						backoffs[targetURL] = backoff
+						apiClient = &promclient.BackoffAPI{API: apiClient, Backoff: backoff}
+					}
+
+					if s.Cfg.MaxRequestsPerSecond > 0 {
+						limiter, ok := s.limiters[targetURL]
+						if !ok {
+							limiter = promclient.NewRateLimiter(s.Cfg.MaxRequestsPerSecond)
+						}
+						limiters[targetURL] = limiter
+						throttled := throttledRequests.WithLabelValues(s.Cfg.Name, u.Host)
+						apiClient = &promclient.RateLimitAPI{API: apiClient, Limiter: limiter, FailFast: s.Cfg.RateLimitFailFast, Throttled: throttled.Inc}
+					}
+
+					// Each shard is a request to the host, which is rate limited and backed off
+					if shards := s.Cfg.GetShardMatchers(); len(shards) > 0 {
+						apiClient = &promclient.VerticalShardAPI{API: apiClient, Shards: shards}
 					}
 
 					// We remove all private labels after we set the target entry
@@ -145,33 +374,391 @@ func (s *ServerGroup) Sync() {
 						}
 					}
 
-					apiClients = append(apiClients, &promclient.AddLabelClient{apiClient, target.Merge(s.Cfg.Labels)})
+					targetLabels := target.Merge(s.Cfg.Labels)
+					targets = append(targets, u.Host)
+					targetInfos = append(targetInfos, TargetInfo{
+						URL:        targetURL,
+						Labels:     targetLabels,
+						RemoteRead: s.Cfg.RemoteRead || s.Cfg.RemoteReadOnly,
+					})
+					apiClient = &promclient.AddLabelClient{apiClient, targetLabels}
+					if len(s.Cfg.ResultRelabelConfigs) > 0 {
+						apiClient = &promclient.RelabelClient{API: apiClient, RelabelConfigs: s.Cfg.ResultRelabelConfigs}
+					}
+					if len(s.Cfg.ValueTransforms) > 0 {
+						apiClient = &promclient.ValueTransformAPI{API: apiClient, Transforms: s.Cfg.GetValueTransforms()}
+					}
+					if s.Cfg.DropStaleMarkers {
+						apiClient = &promclient.DropStaleMarkersAPI{API: apiClient}
+					}
+					if len(s.Cfg.ReplicaLabels) > 0 {
+						apiClient = &promclient.ReplicaKeyAPI{API: apiClient, ReplicaLabels: s.Cfg.ReplicaLabels}
+					}
+					apiClients = append(apiClients, apiClient)
 				}
 			}
 		}
 
-		apiClientMetricFunc := func(i int, api, status string, took float64) {
-			serverGroupSummary.WithLabelValues(targets[i], api, status).Observe(took)
-		}
-
-		newState := &ServerGroupState{
-			Targets:   targets,
-			apiClient: promclient.NewMultiAPI(apiClients, s.Cfg.GetAntiAffinity(), apiClientMetricFunc, 1),
+		if !s.withinMaxTargets(len(targets)) {
+			continue
 		}
 
-		if s.Cfg.IgnoreError {
-			newState.apiClient = &promclient.IgnoreErrorAPI{newState.apiClient}
+		s.limiters = limiters
+		// With no targets there is nothing to dial, and the names are kept for any retained targets
+		if len(targets) > 0 {
+			s.serverNames.Store(serverNames)
+			s.insecureTargets.Store(insecureTargets)
+			s.bearerTokens.Store(bearerTokens)
 		}
 
-		s.state.Store(newState)
+		s.recordSync(targetInfos, backoffs)
+		s.disabledL.Lock()
+		s.discovered = &discoveredTargets{targets, targetInfos, apiClients}
+		s.storeState(s.newState(s.discovered))
+		s.disabledL.Unlock()
 
 		if !s.loaded {
+			if len(targets) < s.Cfg.MinTargets {
+				logrus.Infof("Server group %s has %d of min_targets %d targets, waiting for service discovery before it is ready", s.Cfg.Name, len(targets), s.Cfg.MinTargets)
+				continue
+			}
+			if s.Cfg.MinTargets > 0 {
+				logrus.Infof("Server group %s has %d targets, reaching min_targets %d, it is ready", s.Cfg.Name, len(targets), s.Cfg.MinTargets)
+			}
+			if s.Cfg.Warmup {
+				s.warmup(s.State())
+			}
 			s.loaded = true
 			close(s.Ready)
 		}
 	}
 }
 
+// newState returns the state of the ServerGroup for the `discovered` targets,
+// excluding the disabled targets. The caller must hold disabledL.
+func (s *ServerGroup) newState(discovered *discoveredTargets) *ServerGroupState {
+	targets := make([]string, 0, len(discovered.targets))
+	targetInfos := make([]TargetInfo, 0, len(discovered.targets))
+	apiClients := make([]promclient.API, 0, len(discovered.targets))
+	disabled := make([]string, 0)
+	for i, target := range discovered.targets {
+		if _, ok := s.disabled[target]; ok {
+			disabled = append(disabled, target)
+			continue
+		}
+		targets = append(targets, target)
+		targetInfos = append(targetInfos, discovered.targetInfos[i])
+		apiClients = append(apiClients, discovered.apiClients[i])
+	}
+
+	apiClientMetricFunc := func(i int, api, status string, took float64) {
+		serverGroupSummary.WithLabelValues(s.Cfg.Name, targets[i], api, status).Observe(took)
+		// Canceled requests were cut short by us, so they don't reflect the host's latency
+		if status != promclient.MetricStatusCanceled {
+			targetLatencyEMA.WithLabelValues(targets[i]).Set(targetLatency.Observe(targets[i], took))
+		}
+		s.recordRequest(targetInfos[i].URL, status)
+	}
+
+	multiAPI := promclient.NewMultiAPI(apiClients, s.Cfg.GetAntiAffinity(), apiClientMetricFunc, 1)
+	multiAPI.SetQuorum(s.Cfg.Quorum)
+	multiAPI.SetWorkerPool(s.workerPool)
+	multiAPI.SetFailover(s.Cfg.ReplicaFailover)
+	multiAPI.SetAffinity(s.Cfg.AffinityReplicas)
+	targetURLs := make([]string, len(targetInfos))
+	for i, targetInfo := range targetInfos {
+		targetURLs[i] = targetInfo.URL
+	}
+	multiAPI.SetNames(targetURLs)
+	multiAPI.SetErrorFunc(func(i int, api string, err error) {
+		s.recordError(targetURLs[i], api, err)
+	})
+	multiAPI.SetFailoverLatency(func(i int) float64 {
+		return targetLatency.Get(targets[i])
+	})
+
+	newState := &ServerGroupState{
+		Targets:     targets,
+		TargetInfos: targetInfos,
+		Disabled:    disabled,
+		apiClient:   multiAPI,
+		apiClients:  apiClients,
+	}
+
+	if len(s.Cfg.ReplicaLabels) > 0 {
+		newState.apiClient = &promclient.ReplicaDedupAPI{API: newState.apiClient, ReplicaLabels: s.Cfg.ReplicaLabels, AntiAffinity: s.Cfg.GetAntiAffinity()}
+	}
+
+	if s.Cfg.MinStep > 0 {
+		newState.apiClient = &promclient.MinStepAPI{API: newState.apiClient, MinStep: s.Cfg.MinStep}
+	}
+
+	if s.Cfg.Retention > 0 {
+		newState.apiClient = &promclient.RetentionAPI{API: newState.apiClient, Retention: s.Cfg.Retention}
+	}
+
+	// The pool is shared by all states, so a discovery round doesn't reset the limit
+	if s.queryPool != nil {
+		newState.apiClient = &promclient.QueryLimitAPI{API: newState.apiClient, Pool: s.queryPool, Queued: queuedQueries.WithLabelValues(s.Cfg.Name).Add}
+	}
+
+	if s.staleCache != nil {
+		newState.apiClient = &promclient.StaleCacheAPI{API: newState.apiClient, Cache: s.staleCache, Calls: s.Cfg.StaleWhileError.CallSet()}
+	}
+
+	if s.Cfg.IgnoreError {
+		newState.apiClient = &promclient.IgnoreErrorAPI{newState.apiClient}
+	}
+	return newState
+}
+
+// DisableTarget excludes the target with `host` (e.g. for maintenance) from
+// the requests of the ServerGroup until it is enabled with EnableTarget, also
+// across discovery rounds. It returns whether the ServerGroup has the target.
+func (s *ServerGroup) DisableTarget(host string) bool {
+	s.disabledL.Lock()
+	defer s.disabledL.Unlock()
+	if s.discovered == nil {
+		return false
+	}
+	found := false
+	for _, target := range s.discovered.targets {
+		if target == host {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+
+	if _, ok := s.disabled[host]; !ok {
+		if s.disabled == nil {
+			s.disabled = make(map[string]struct{})
+		}
+		s.disabled[host] = struct{}{}
+		logrus.Infof("Disabled target %s of server group %s", host, s.Cfg.Name)
+		s.storeState(s.newState(s.discovered))
+	}
+	return true
+}
+
+// EnableTarget includes the target with `host` (disabled with DisableTarget)
+// in the requests of the ServerGroup again. It returns whether the target was disabled.
+func (s *ServerGroup) EnableTarget(host string) bool {
+	s.disabledL.Lock()
+	defer s.disabledL.Unlock()
+	if _, ok := s.disabled[host]; !ok {
+		return false
+	}
+	delete(s.disabled, host)
+	logrus.Infof("Enabled target %s of server group %s", host, s.Cfg.Name)
+	if s.discovered != nil {
+		s.storeState(s.newState(s.discovered))
+	}
+	return true
+}
+
+// withinMaxTargets returns whether the `discovered` targets of a discovery
+// round are within the MaxTargets of the ServerGroup, the round is rejected
+// (keeping the previous targets) otherwise
+func (s *ServerGroup) withinMaxTargets(discovered int) bool {
+	if s.Cfg.MaxTargets > 0 && discovered > s.Cfg.MaxTargets {
+		var previous int
+		if state := s.State(); state != nil {
+			previous = len(state.Targets) + len(state.Disabled)
+		}
+		logrus.Errorf("Service discovery for server group %s found %d targets, more than max_targets %d, keeping the previous %d targets", s.Cfg.Name, discovered, s.Cfg.MaxTargets, previous)
+		maxTargetsExceeded.WithLabelValues(s.Cfg.Name).Set(1)
+		return false
+	}
+	maxTargetsExceeded.WithLabelValues(s.Cfg.Name).Set(0)
+	return true
+}
+
+// storeState stores `newState` as the state of the ServerGroup. If `newState`
+// has no targets (e.g. during a service discovery blip) and RetainTargets is
+// set the current (non-empty) state is kept for up to RetainTargets instead.
+// Targets which are only missing as they are disabled aren't retained.
+func (s *ServerGroup) storeState(newState *ServerGroupState) {
+	s.retainL.Lock()
+	defer s.retainL.Unlock()
+	if s.retainTimer != nil {
+		s.retainTimer.Stop()
+		s.retainTimer = nil
+	}
+
+	discovered := len(newState.Targets) + len(newState.Disabled)
+	if discovered == 0 && s.Cfg.RetainTargets > 0 {
+		if s.emptySince.IsZero() {
+			s.emptySince = time.Now()
+		}
+		oldState, _ := s.state.Load().(*ServerGroupState)
+		remaining := s.Cfg.RetainTargets - time.Since(s.emptySince)
+		if oldState != nil && len(oldState.Targets) > 0 && remaining > 0 {
+			logrus.Warnf("Service discovery for server group %s returned no targets, retaining the last %d targets for up to %s", s.Cfg.Name, len(oldState.Targets), remaining.Round(time.Second))
+			retainedTargets.WithLabelValues(s.Cfg.Name).Set(1)
+			var timer *time.Timer
+			timer = time.AfterFunc(remaining, func() {
+				s.retainL.Lock()
+				defer s.retainL.Unlock()
+				// The timer may have fired while a newer state was being stored
+				if s.retainTimer != timer {
+					return
+				}
+				s.retainTimer = nil
+				logrus.Warnf("Service discovery for server group %s still returns no targets after %s, dropping the retained targets", s.Cfg.Name, s.Cfg.RetainTargets)
+				retainedTargets.WithLabelValues(s.Cfg.Name).Set(0)
+				s.state.Store(newState)
+			})
+			s.retainTimer = timer
+			return
+		}
+	} else if discovered > 0 {
+		s.emptySince = time.Time{}
+	}
+
+	retainedTargets.WithLabelValues(s.Cfg.Name).Set(0)
+	s.state.Store(newState)
+}
+
+// FlushCaches flushes the cache named `name` (or all caches if `name` is empty)
+// of the ServerGroup, returning the names of the caches flushed
+func (s *ServerGroup) FlushCaches(name string) []string {
+	flushed := make([]string, 0)
+	for cacheName, cache := range s.caches {
+		if name == "" || name == cacheName {
+			cache.Flush()
+			flushed = append(flushed, cacheName)
+		}
+	}
+	return flushed
+}
+
+// closeIdleConnectionsAfter closes the idle connections of `transport` after
+// `gracePeriod`. The transport must no longer be in use for new requests, so
+// by then the connections of any in-flight requests are idle.
+func closeIdleConnectionsAfter(transport *http.Transport, gracePeriod time.Duration) {
+	time.AfterFunc(gracePeriod, transport.CloseIdleConnections)
+}
+
+// targetHost returns the host (as in url.URL.Host) of a target's `address`.
+// IPv6 literals must be bracketed in URLs, so a bare IPv6 address (which
+// can't have a port) such as "::1" is bracketed as "[::1]". Addresses which
+// are already bracketed (such as "[::1]:9090") are returned as is.
+func targetHost(address string) string {
+	if strings.HasPrefix(address, "[") {
+		return address
+	}
+	// Link-local addresses may have a zone (e.g. "fe80::1%eth0")
+	ip := address
+	if i := strings.LastIndex(ip, "%"); i >= 0 {
+		ip = ip[:i]
+	}
+	if strings.Contains(ip, ":") && net.ParseIP(ip) != nil {
+		return "[" + address + "]"
+	}
+	return address
+}
+
+// targetPathPrefix returns the path prefix of `target`: its PathPrefixLabel,
+// or else the `__metrics_path__` of prometheus' scrape configs, or else the
+// `defaultPrefix` of the servergroup
+func targetPathPrefix(target model.LabelSet, defaultPrefix string) string {
+	if prefix := target[PathPrefixLabel]; prefix != "" {
+		return string(prefix)
+	}
+	if prefix := target[model.MetricsPathLabel]; prefix != "" {
+		return string(prefix)
+	}
+	return defaultPrefix
+}
+
+// targetBearerToken returns the bearer token set by the BearerTokenLabel of
+// the target with `host` ("" if it has none)
+func (s *ServerGroup) targetBearerToken(host string) string {
+	bearerTokens, _ := s.bearerTokens.Load().(map[string]string)
+	return bearerTokens[host]
+}
+
+// canonicalAddr returns the address the transport dials for `host`: with the
+// default port of `scheme` if it has none
+func canonicalAddr(scheme, host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if scheme == "https" {
+		return net.JoinHostPort(host, "443")
+	}
+	return net.JoinHostPort(host, "80")
+}
+
+// dialTLS returns the DialTLS of the transport, which connects to the targets
+// using `tlsConfig` with the server name of the target (if it has a
+// TLSServerNameLabel) overriding that of the config, the verification of its
+// certificate skipped or not as set by its TLSInsecureLabel (if it has one),
+// and the current CAs of `cas` (if the config has a CA file). The dial is
+// abandoned once none of the requests counted by `waiters` are waiting for a
+// connection to the target.
+func (s *ServerGroup) dialTLS(dial dialFunc, waiters *connWaiters, tlsConfig *tls.Config, cas *caReloader, handshakeTimeout time.Duration) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		cfg := tlsConfig.Clone()
+		if cas != nil {
+			cfg.RootCAs = cas.RootCAs()
+		}
+		serverNames, _ := s.serverNames.Load().(map[string]string)
+		if serverName, ok := serverNames[addr]; ok {
+			cfg.ServerName = serverName
+		} else if cfg.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			cfg.ServerName = host
+		}
+		insecureTargets, _ := s.insecureTargets.Load().(map[string]bool)
+		if insecure, ok := insecureTargets[addr]; ok {
+			cfg.InsecureSkipVerify = insecure
+		}
+
+		// The dial is abandoned once no request is waiting for it
+		ctx, cancel := waiters.context(addr)
+		defer cancel()
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		// The transport doesn't apply its TLSHandshakeTimeout to a DialTLS
+		if handshakeTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		}
+		handshakeDone, watchDone := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(watchDone)
+			select {
+			case <-ctx.Done():
+				// A deadline in the past interrupts the handshake
+				conn.SetDeadline(time.Unix(1, 0))
+			case <-handshakeDone:
+			}
+		}()
+		tlsConn := tls.Client(conn, cfg)
+		err = tlsConn.Handshake()
+		close(handshakeDone)
+		<-watchDone
+		if err != nil {
+			conn.Close()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	}
+}
+
 // TODO: move config + client into state object to be swapped with atomics
 func (s *ServerGroup) ApplyConfig(cfg *Config) error {
 	s.Cfg = cfg
@@ -181,9 +768,17 @@ func (s *ServerGroup) ApplyConfig(cfg *Config) error {
 	if err != nil {
 		return errors.Wrap(err, "error loading TLS client config")
 	}
+	var cas *caReloader
+	if caFile := cfg.HTTPConfig.HTTPConfig.TLSConfig.CAFile; caFile != "" {
+		cas = newCAReloader(caFile, tlsConfig.RootCAs)
+	}
+	dialer := &net.Dialer{Timeout: cfg.HTTPConfig.DialTimeout}
+	// The connections are tracked for the server_group_conn_* metrics
+	dial := targetConns.dial(dialer.DialContext)
+	waiters := newConnWaiters()
 	// The only timeout we care about is the configured scrape timeout.
 	// It is applied on request. So we leave out any timings here.
-	var rt http.RoundTripper = &http.Transport{
+	transport := &http.Transport{
 		Proxy:               http.ProxyURL(cfg.HTTPConfig.HTTPConfig.ProxyURL.URL),
 		MaxIdleConns:        20000,
 		MaxIdleConnsPerHost: 1000, // see https://github.com/golang/go/issues/13801
@@ -193,8 +788,18 @@ func (s *ServerGroup) ApplyConfig(cfg *Config) error {
 		// 5 minutes is typically above the maximum sane scrape interval. So we can
 		// use keepalive for all configurations.
 		IdleConnTimeout: 5 * time.Minute,
-		DialContext:     (&net.Dialer{Timeout: cfg.HTTPConfig.DialTimeout}).DialContext,
+		DialContext:     dial,
+		// TLS connections are dialed by the ServerGroup to set each target's server name
+		DialTLS: s.dialTLS(dial, waiters, tlsConfig, cas, cfg.HTTPConfig.TLSHandshakeTimeout),
+
+		TLSHandshakeTimeout:   cfg.HTTPConfig.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.HTTPConfig.ResponseHeaderTimeout,
 	}
+	var rt http.RoundTripper = targetConns.roundTripper(transport)
+	rt = waiters.roundTripper(rt)
+	// Every response is measured, including those of retried requests
+	rt = promclient.NewResponseSizeRoundTripper(rt)
+	rt = NewRedirectRoundTripper(cfg.HTTPConfig.RedirectPolicy, rt)
 
 	// If a bearer token is provided, create a round tripper that will set the
 	// Authorization header correctly on each request.
@@ -207,8 +812,37 @@ func (s *ServerGroup) ApplyConfig(cfg *Config) error {
 	if cfg.HTTPConfig.HTTPConfig.BasicAuth != nil {
 		rt = config_util.NewBasicAuthRoundTripper(cfg.HTTPConfig.HTTPConfig.BasicAuth.Username, cfg.HTTPConfig.HTTPConfig.BasicAuth.Password, cfg.HTTPConfig.HTTPConfig.BasicAuth.PasswordFile, rt)
 	}
-
-	s.Client = &http.Client{Transport: rt}
+	// The per-target tokens are set first, so the servergroup's auth doesn't override them
+	rt = NewTargetBearerTokenRoundTripper(s.targetBearerToken, rt)
+
+	rt = NewHeaderRoundTripper(cfg.HTTPConfig.GetUserAgent(), cfg.HTTPConfig.Headers, rt)
+	rt = NewQueryParamsRoundTripper(cfg.HTTPConfig.QueryParams, rt)
+	rt = NewSeriesLimitRoundTripper(cfg.HTTPConfig.SeriesLimitParam, rt)
+	// Forwarded headers are set before the static headers, so those take precedence
+	rt = promclient.NewForwardHeadersRoundTripper(rt)
+	rt = promclient.NewHopsRoundTripper(rt)
+	rt = promclient.NewActiveQueryRoundTripper(rt)
+	rt = promclient.NewMaxResponseSizeRoundTripper(cfg.HTTPConfig.MaxResponseSize, rt)
+	rt = promclient.NewErrorCodesRoundTripper(cfg.ErrorCodeMap(), rt)
+	rt = promclient.NewStatsRoundTripper(cfg.Name, rt)
+	rt = promclient.NewConditionalCacheRoundTripper(cfg.HTTPConfig.ConditionalCacheSize, rt)
+
+	// The old client may still have requests in-flight, so its connections are
+	// only closed after the grace period
+	if s.transport != nil {
+		closeIdleConnectionsAfter(s.transport, cfg.HTTPConfig.CloseGracePeriod)
+	}
+	s.Client = &http.Client{Transport: rt, CheckRedirect: cfg.HTTPConfig.RedirectPolicy.CheckRedirect}
+	s.transport = transport
+	s.caches = make(map[string]promclient.Flusher)
+	if cache, ok := rt.(promclient.Flusher); ok {
+		s.caches[promclient.ConditionalCacheName] = cache
+	}
+	if cfg.StaleWhileError != nil {
+		s.staleCache = promclient.NewStaleCache(cfg.StaleWhileError.Size, cfg.StaleWhileError.MaxStaleness)
+		s.caches[promclient.StaleCacheName] = s.staleCache
+	}
+	s.queryPool = promclient.NewWorkerPool(cfg.MaxConcurrentQueries)
 
 	if err := s.targetManager.ApplyConfig(map[string]sd_config.ServiceDiscoveryConfig{"foo": cfg.Hosts}); err != nil {
 		return err
@@ -225,27 +859,100 @@ func (s *ServerGroup) State() *ServerGroupState {
 	}
 }
 
+// selectState returns the state of the requests of `ctx`: if they are
+// restricted to the targets matching a selector (see
+// promclient.WithTargetSelector) the state of only those targets (by their
+// labels, including those of the ServerGroup), otherwise the current state
+func (s *ServerGroup) selectState(ctx context.Context) *ServerGroupState {
+	state := s.State()
+	selector := promclient.TargetSelector(ctx)
+	if len(selector) == 0 {
+		return state
+	}
+
+	selected := &discoveredTargets{}
+TARGETS:
+	for i, targetInfo := range state.TargetInfos {
+		for _, matcher := range selector {
+			if !matcher.Matches(string(targetInfo.Labels[model.LabelName(matcher.Name)])) {
+				continue TARGETS
+			}
+		}
+		selected.targets = append(selected.targets, state.Targets[i])
+		selected.targetInfos = append(selected.targetInfos, targetInfo)
+		selected.apiClients = append(selected.apiClients, state.apiClients[i])
+	}
+	s.disabledL.Lock()
+	defer s.disabledL.Unlock()
+	return s.newState(selected)
+}
+
+// Targets returns the list of targets currently discovered for this ServerGroup
+func (s *ServerGroup) Targets() []string {
+	state := s.State()
+	if state == nil {
+		return nil
+	}
+	return state.Targets
+}
+
 // GetValue loads the raw data for a given set of matchers in the time range
 func (s *ServerGroup) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, error) {
-	return s.State().apiClient.GetValue(ctx, start, end, matchers)
+	if e := promhttputil.GetExplain(ctx); e != nil {
+		return model.Matrix{}, s.explainGetValue(e, start, end, matchers)
+	}
+	return s.selectState(ctx).apiClient.GetValue(ctx, start, end, matchers)
+}
+
+// Rules returns a list of alerting and recording rules that are currently loaded.
+func (s *ServerGroup) Rules(ctx context.Context) (v1.RulesResult, error) {
+	return s.selectState(ctx).apiClient.Rules(ctx)
+}
+
+// Alerts returns a list of all active alerts.
+// Each alert is annotated with the servergroup it came from
+func (s *ServerGroup) Alerts(ctx context.Context) (v1.AlertsResult, error) {
+	result, err := s.selectState(ctx).apiClient.Alerts(ctx)
+	if err != nil {
+		return result, err
+	}
+	for i, alert := range result.Alerts {
+		if alert.Annotations == nil {
+			alert.Annotations = make(model.LabelSet)
+		}
+		alert.Annotations[ServerGroupAnnotation] = model.LabelValue(s.Cfg.Name)
+		result.Alerts[i] = alert
+	}
+	return result, nil
+}
+
+// LabelNames returns the label names (optionally scoped by matchers and time range).
+func (s *ServerGroup) LabelNames(ctx context.Context, matchers []string, startTime, endTime time.Time) ([]string, error) {
+	return s.selectState(ctx).apiClient.LabelNames(ctx, matchers, startTime, endTime)
 }
 
 // Query performs a query for the given time.
 func (s *ServerGroup) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
-	return s.State().apiClient.Query(ctx, query, ts)
+	if e := promhttputil.GetExplain(ctx); e != nil {
+		return model.Vector{}, s.explainQuery(ctx, e, "query", query, ts, ts, 0)
+	}
+	return s.selectState(ctx).apiClient.Query(ctx, query, ts)
 }
 
 // QueryRange performs a query for the given range.
 func (s *ServerGroup) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, error) {
-	return s.State().apiClient.QueryRange(ctx, query, r)
+	if e := promhttputil.GetExplain(ctx); e != nil {
+		return model.Matrix{}, s.explainQuery(ctx, e, "query_range", query, r.Start, r.End, r.Step)
+	}
+	return s.selectState(ctx).apiClient.QueryRange(ctx, query, r)
 }
 
 // LabelValues performs a query for the values of the given label.
 func (s *ServerGroup) LabelValues(ctx context.Context, label string) (model.LabelValues, error) {
-	return s.State().apiClient.LabelValues(ctx, label)
+	return s.selectState(ctx).apiClient.LabelValues(ctx, label)
 }
 
 // Series finds series by label matchers.
 func (s *ServerGroup) Series(ctx context.Context, matches []string, startTime, endTime time.Time) ([]model.LabelSet, error) {
-	return s.State().apiClient.Series(ctx, matches, startTime, endTime)
+	return s.selectState(ctx).apiClient.Series(ctx, matches, startTime, endTime)
 }
@@ -0,0 +1,354 @@
+package servergroup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	config_util "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/jacksontj/promxy/promclient"
+	"github.com/jacksontj/promxy/promhttputil"
+)
+
+func TestTargetHost(t *testing.T) {
+	tests := []struct {
+		address string
+		host    string
+	}{
+		{address: "localhost:9090", host: "localhost:9090"},
+		{address: "127.0.0.1:9090", host: "127.0.0.1:9090"},
+		{address: "127.0.0.1", host: "127.0.0.1"},
+		{address: "[::1]:9090", host: "[::1]:9090"},
+		{address: "[::1]", host: "[::1]"},
+		{address: "::1", host: "[::1]"},
+		{address: "2001:db8::1", host: "[2001:db8::1]"},
+		{address: "::ffff:127.0.0.1", host: "[::ffff:127.0.0.1]"},
+		{address: "fe80::1%eth0", host: "[fe80::1%eth0]"},
+		{address: "[fe80::1%eth0]:9090", host: "[fe80::1%eth0]:9090"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			host := targetHost(test.address)
+			if host != test.host {
+				t.Fatalf("mismatch in host expected=%s actual=%s", test.host, host)
+			}
+
+			// The URL of the target must be valid, and keep the host
+			u := &url.URL{Scheme: "http", Host: host, Path: "/prefix"}
+			parsed, err := url.Parse(u.String())
+			if err != nil {
+				t.Fatalf("invalid URL %s: %v", u, err)
+			}
+			if parsed.Host != host {
+				t.Fatalf("mismatch in parsed host expected=%s actual=%s", host, parsed.Host)
+			}
+		})
+	}
+}
+
+func TestTargetPathPrefix(t *testing.T) {
+	tests := []struct {
+		target model.LabelSet
+		prefix string
+	}{
+		{target: model.LabelSet{}, prefix: "/default"},
+		{target: model.LabelSet{model.MetricsPathLabel: "/metrics-path"}, prefix: "/metrics-path"},
+		{target: model.LabelSet{PathPrefixLabel: "/path-prefix"}, prefix: "/path-prefix"},
+		{target: model.LabelSet{PathPrefixLabel: "/path-prefix", model.MetricsPathLabel: "/metrics-path"}, prefix: "/path-prefix"},
+	}
+
+	for _, test := range tests {
+		if prefix := targetPathPrefix(test.target, "/default"); prefix != test.prefix {
+			t.Fatalf("mismatch in path prefix of %v expected=%s actual=%s", test.target, test.prefix, prefix)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	sg := &ServerGroup{
+		Cfg:    &Config{Name: "sg"},
+		Ready:  make(chan struct{}),
+		health: make(map[string]targetHealth),
+	}
+	if h := sg.Health(); h.Ready || h.Targets != 0 || h.LastSync != nil || h.LastError != nil {
+		t.Fatalf("unexpected health before the first sync: %+v", h)
+	}
+
+	targetInfos := []TargetInfo{{URL: "http://a:9090"}, {URL: "http://b:9090"}, {URL: "http://c:9090"}}
+	sg.recordSync(targetInfos, nil)
+	sg.state.Store(&ServerGroupState{
+		Targets:     []string{"a:9090", "b:9090"},
+		TargetInfos: targetInfos[:2],
+		Disabled:    []string{"c:9090"},
+	})
+	close(sg.Ready)
+
+	sg.recordRequest("http://a:9090", promclient.MetricStatusSuccess)
+	sg.recordRequest("http://b:9090", promclient.MetricStatusError)
+	sg.recordError("http://b:9090", "query", fmt.Errorf("connection refused"))
+	// Canceled requests don't reflect the health of the target
+	sg.recordRequest("http://a:9090", promclient.MetricStatusCanceled)
+
+	h := sg.Health()
+	if h.Name != "sg" || !h.Ready || h.Targets != 2 || h.Healthy != 1 || h.Disabled != 1 || h.LastSync == nil {
+		t.Fatalf("unexpected health: %+v", h)
+	}
+	if h.LastError == nil || h.LastError.Target != "http://b:9090" || h.LastError.API != "query" || h.LastError.Error != "connection refused" {
+		t.Fatalf("unexpected last error: %+v", h.LastError)
+	}
+	if len(h.TargetHealth) != 2 || !h.TargetHealth[0].Healthy || h.TargetHealth[1].Healthy || h.TargetHealth[1].LastError != "connection refused" {
+		t.Fatalf("unexpected target health: %+v", h.TargetHealth)
+	}
+
+	// A successful request makes the target healthy again, the last error of
+	// the server group is kept
+	sg.recordRequest("http://b:9090", promclient.MetricStatusSuccess)
+	if h := sg.Health(); h.Healthy != 2 || h.TargetHealth[1].LastError != "" || h.LastError == nil {
+		t.Fatalf("unexpected health after recovery: %+v", h)
+	}
+
+	// The health of targets which are gone is forgotten
+	sg.state.Store(&ServerGroupState{Targets: []string{"a:9090"}, TargetInfos: targetInfos[:1]})
+	sg.recordSync(targetInfos[:1], nil)
+	if _, ok := sg.health["http://b:9090"]; ok {
+		t.Fatalf("health of a removed target was kept")
+	}
+}
+
+func TestExplain(t *testing.T) {
+	sg := &ServerGroup{Cfg: &Config{Name: "sg", ReplicaFailover: true}}
+	// The state has no apiClient, any request sent while explaining would panic
+	sg.state.Store(&ServerGroupState{
+		Targets: []string{"a:9090", "b:9090"},
+		TargetInfos: []TargetInfo{
+			{URL: "http://a:9090", Labels: model.LabelSet{"region": "a"}},
+			{URL: "http://b:9090", Labels: model.LabelSet{"region": "b"}},
+		},
+	})
+
+	ctx, explain := promhttputil.WithExplain(context.Background(), `sum(up{region="a"})`)
+	if _, err := sg.Query(ctx, `sum(up{region="a"})`, time.Unix(100, 0)); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	matchers := []*labels.Matcher{{Type: labels.MatchEqual, Name: "__name__", Value: "up"}}
+	if _, err := sg.GetValue(ctx, time.Unix(0, 0), time.Unix(100, 0), matchers); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+
+	b, err := json.Marshal(explain)
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	var plan struct {
+		ServerGroups []promhttputil.ExplainServerGroup `json:"serverGroups"`
+	}
+	if err := json.Unmarshal(b, &plan); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if len(plan.ServerGroups) != 1 || plan.ServerGroups[0].Name != "sg" || !plan.ServerGroups[0].Failover || plan.ServerGroups[0].Targets != 2 {
+		t.Fatalf("unexpected server groups: %s", b)
+	}
+	requests := plan.ServerGroups[0].Requests
+	if len(requests) != 2 {
+		t.Fatalf("unexpected requests: %s", b)
+	}
+	// Only the target whose labels match is queried, without the matchers its labels satisfy
+	if targets := requests[0].Targets; len(targets) != 1 || targets[0].URL != "http://a:9090" || targets[0].Query != "sum(up)" {
+		t.Fatalf("unexpected query targets: %+v", targets)
+	}
+	if targets := requests[1].Targets; requests[1].API != "get_value" || len(targets) != 2 || targets[1].Query != `{__name__="up"}` {
+		t.Fatalf("unexpected get_value targets: %+v", targets)
+	}
+}
+
+// queryAPI is a promclient.API whose Query returns `err` (other calls panic)
+type queryAPI struct {
+	promclient.API
+	queries int
+	err     error
+}
+
+func (q *queryAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	q.queries++
+	return model.Vector{}, q.err
+}
+
+func TestWarmup(t *testing.T) {
+	sg := &ServerGroup{
+		ctx:    context.TODO(),
+		Cfg:    &Config{Name: "sg"},
+		health: make(map[string]targetHealth),
+	}
+	a, b := &queryAPI{}, &queryAPI{err: fmt.Errorf("connection refused")}
+	targetInfos := []TargetInfo{{URL: "http://a:9090"}, {URL: "http://b:9090"}}
+	sg.recordSync(targetInfos, nil)
+	sg.warmup(&ServerGroupState{
+		Targets:     []string{"a:9090", "b:9090"},
+		TargetInfos: targetInfos,
+		apiClients:  []promclient.API{a, b},
+	})
+
+	// Each target is queried once, failures are recorded in its health
+	if a.queries != 1 || b.queries != 1 {
+		t.Fatalf("mismatch in warmup queries: a=%d b=%d", a.queries, b.queries)
+	}
+	if h := sg.health["http://b:9090"]; h.err != "connection refused" {
+		t.Fatalf("warmup error wasn't recorded: %+v", h)
+	}
+}
+
+func TestTargetSelector(t *testing.T) {
+	sg := &ServerGroup{
+		Cfg:    &Config{Name: "sg"},
+		health: make(map[string]targetHealth),
+	}
+	a, b := &queryAPI{}, &queryAPI{}
+	sg.state.Store(sg.newState(&discoveredTargets{
+		targets: []string{"a:9090", "b:9090"},
+		targetInfos: []TargetInfo{
+			{URL: "http://a:9090", Labels: model.LabelSet{"region": "us-east"}},
+			{URL: "http://b:9090", Labels: model.LabelSet{"region": "us-west"}},
+		},
+		apiClients: []promclient.API{a, b},
+	}))
+
+	// Only the targets whose labels match the selector are queried
+	matcher, err := labels.NewMatcher(labels.MatchRegexp, "region", "us-w.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := promclient.WithTargetSelector(context.Background(), []*labels.Matcher{matcher})
+	if _, err := sg.Query(ctx, "up", time.Unix(100, 0)); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if a.queries != 0 || b.queries != 1 {
+		t.Fatalf("mismatch in queries: a=%d b=%d", a.queries, b.queries)
+	}
+
+	// Without a selector all the targets are queried
+	if _, err := sg.Query(context.Background(), "up", time.Unix(100, 0)); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if a.queries != 1 || b.queries != 2 {
+		t.Fatalf("mismatch in queries: a=%d b=%d", a.queries, b.queries)
+	}
+}
+
+func TestWithinMaxTargets(t *testing.T) {
+	sg := &ServerGroup{Cfg: &Config{Name: "max-targets", MaxTargets: 2}}
+	sg.state.Store(&ServerGroupState{Targets: []string{"a:9090"}})
+
+	if sg.withinMaxTargets(3) || gaugeValue(t, maxTargetsExceeded, "max-targets") != 1 {
+		t.Fatalf("discovery round over max_targets wasn't rejected")
+	}
+	if !sg.withinMaxTargets(2) || gaugeValue(t, maxTargetsExceeded, "max-targets") != 0 {
+		t.Fatalf("discovery round within max_targets was rejected")
+	}
+
+	// Without max_targets any number of targets is accepted
+	sg.Cfg.MaxTargets = 0
+	if !sg.withinMaxTargets(1000) {
+		t.Fatalf("discovery round without max_targets was rejected")
+	}
+}
+
+func TestTargetBearerToken(t *testing.T) {
+	var authorization string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name         string
+		bearerTokens map[string]string
+		expected     string
+	}{
+		{name: "group token", expected: "Bearer group"},
+		{name: "target token", bearerTokens: map[string]string{u.Host: "target"}, expected: "Bearer target"},
+		{name: "other target token", bearerTokens: map[string]string{"127.0.0.1:1": "target"}, expected: "Bearer group"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sg := &ServerGroup{}
+			if test.bearerTokens != nil {
+				sg.bearerTokens.Store(test.bearerTokens)
+			}
+			rt := config_util.NewBearerAuthRoundTripper("group", http.DefaultTransport)
+			rt = NewTargetBearerTokenRoundTripper(sg.targetBearerToken, rt)
+			resp, err := (&http.Client{Transport: rt}).Get(srv.URL)
+			if err != nil {
+				t.Fatalf("Unexpected Err: %v", err)
+			}
+			resp.Body.Close()
+			if authorization != test.expected {
+				t.Fatalf("mismatch in Authorization expected=%q actual=%q", test.expected, authorization)
+			}
+		})
+	}
+}
+
+func TestRedirectRoundTripper(t *testing.T) {
+	// The Authorization header received by each host
+	authorization := make(map[string]string)
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization["other"] = r.Header.Get("Authorization")
+	}))
+	defer other.Close()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/same":
+			http.Redirect(w, r, "/done", http.StatusFound)
+		case "/other":
+			http.Redirect(w, r, other.URL+"/done", http.StatusFound)
+		default:
+			authorization["target"] = r.Header.Get("Authorization")
+		}
+	}))
+	defer target.Close()
+
+	for _, test := range []struct {
+		policy   RedirectPolicy
+		path     string
+		err      bool
+		expected map[string]string
+	}{
+		{policy: "", path: "/same", expected: map[string]string{"target": "Bearer token"}},
+		{policy: "", path: "/other", expected: map[string]string{"other": ""}},
+		{policy: RedirectPolicyFollowWithoutAuth, path: "/other", expected: map[string]string{"other": ""}},
+		{policy: RedirectPolicyFollow, path: "/other", expected: map[string]string{"other": "Bearer token"}},
+		{policy: RedirectPolicyError, path: "/same", err: true, expected: map[string]string{}},
+	} {
+		t.Run(string(test.policy)+test.path, func(t *testing.T) {
+			for k := range authorization {
+				delete(authorization, k)
+			}
+			rt := NewRedirectRoundTripper(test.policy, http.DefaultTransport)
+			rt = config_util.NewBearerAuthRoundTripper("token", rt)
+			// Like the prometheus API client, the client has no CheckRedirect
+			resp, err := (&http.Client{Transport: rt}).Get(target.URL + test.path)
+			if test.err != (err != nil) {
+				t.Fatalf("unexpected error, expected err=%v got: %v", test.err, err)
+			}
+			if err == nil {
+				resp.Body.Close()
+			}
+			if !reflect.DeepEqual(authorization, test.expected) {
+				t.Fatalf("mismatch in Authorization expected=%v actual=%v", test.expected, authorization)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package servergroup
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// caReloader reloads the CA bundle the targets' certificates are verified
+// against from its file when the file changes, so re-issued certificates of
+// a rotated CA are trusted without a restart. The file is checked each time a
+// connection is dialed, existing connections are unaffected.
+type caReloader struct {
+	file string
+
+	l       sync.Mutex
+	modTime time.Time
+	size    int64
+	pool    *x509.CertPool
+}
+
+// newCAReloader returns a caReloader for the CA bundle `file`, which starts
+// with `pool` (the bundle loaded with the TLS config)
+func newCAReloader(file string, pool *x509.CertPool) *caReloader {
+	r := &caReloader{file: file, pool: pool}
+	if info, err := os.Stat(file); err == nil {
+		r.modTime, r.size = info.ModTime(), info.Size()
+	}
+	return r
+}
+
+// RootCAs returns the current CA pool, reloading the file if it changed. If
+// the file can't be loaded (e.g. it is being rewritten) the previous pool is
+// kept, and the file is loaded again on the next check.
+func (r *caReloader) RootCAs() *x509.CertPool {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	info, err := os.Stat(r.file)
+	if err != nil {
+		logrus.Warnf("Error checking CA file %s, keeping the loaded CAs: %v", r.file, err)
+		return r.pool
+	}
+	if info.ModTime().Equal(r.modTime) && info.Size() == r.size {
+		return r.pool
+	}
+
+	caCert, err := ioutil.ReadFile(r.file)
+	if err != nil {
+		logrus.Warnf("Error reloading CA file %s, keeping the loaded CAs: %v", r.file, err)
+		return r.pool
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		logrus.Warnf("No certificates in CA file %s, keeping the loaded CAs", r.file)
+		return r.pool
+	}
+	logrus.Infof("Reloaded CA file %s", r.file)
+	r.pool = pool
+	r.modTime, r.size = info.ModTime(), info.Size()
+	return r.pool
+}
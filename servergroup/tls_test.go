@@ -0,0 +1,223 @@
+package servergroup
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a CA issuing the certificates of test servers
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// newServer returns a TLS server for 127.0.0.1 with a certificate issued by the CA
+func (ca *testCA) newServer(t *testing.T) *httptest.Server {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	srv.StartTLS()
+	return srv
+}
+
+func TestCAReload(t *testing.T) {
+	oldCA, newCA := newTestCA(t, "old"), newTestCA(t, "new")
+	dir, err := ioutil.TempDir("", "promxy-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, oldCA.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sg := &ServerGroup{}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(oldCA.pem)
+	cas := newCAReloader(caFile, pool)
+	dial := sg.dialTLS((&net.Dialer{}).DialContext, newConnWaiters(), &tls.Config{RootCAs: pool}, cas, 0)
+	dialServer := func(srv *httptest.Server) error {
+		conn, err := dial("tcp", strings.TrimPrefix(srv.URL, "https://"))
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	oldSrv, newSrv := oldCA.newServer(t), newCA.newServer(t)
+	defer oldSrv.Close()
+	defer newSrv.Close()
+	if err := dialServer(oldSrv); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	if err := dialServer(newSrv); err == nil {
+		t.Fatalf("the certificate of the new CA was trusted before the rotation")
+	}
+
+	// A partially written file keeps the loaded CAs
+	if err := ioutil.WriteFile(caFile, []byte("-----BEGIN"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := dialServer(oldSrv); err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+
+	// Rotate the CA, the certificates it issues are trusted without a reload of the config
+	if err := ioutil.WriteFile(caFile, newCA.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(caFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := dialServer(newSrv); err != nil {
+		t.Fatalf("the certificate of the new CA wasn't trusted after the rotation: %v", err)
+	}
+	if err := dialServer(oldSrv); err == nil {
+		t.Fatalf("the certificate of the old CA was trusted after the rotation")
+	}
+}
+
+func TestTLSInsecureLabel(t *testing.T) {
+	// The certificate of the test server is self-signed
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "https://")
+
+	for _, test := range []struct {
+		name            string
+		insecureTargets map[string]bool
+		groupInsecure   bool
+		ok              bool
+	}{
+		{name: "verified"},
+		{name: "insecure target", insecureTargets: map[string]bool{addr: true}, ok: true},
+		{name: "other insecure target", insecureTargets: map[string]bool{"127.0.0.1:1": true}},
+		{name: "insecure group", groupInsecure: true, ok: true},
+		{name: "verified target of insecure group", insecureTargets: map[string]bool{addr: false}, groupInsecure: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sg := &ServerGroup{}
+			if test.insecureTargets != nil {
+				sg.insecureTargets.Store(test.insecureTargets)
+			}
+			dial := sg.dialTLS((&net.Dialer{}).DialContext, newConnWaiters(), &tls.Config{InsecureSkipVerify: test.groupInsecure}, nil, 0)
+			conn, err := dial("tcp", addr)
+			if err == nil {
+				conn.Close()
+			}
+			if test.ok != (err == nil) {
+				t.Fatalf("unexpected dial result, expected ok=%v got: %v", test.ok, err)
+			}
+		})
+	}
+}
+
+func TestDialTLSCancel(t *testing.T) {
+	// The server accepts connections but never completes a TLS handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	sg := &ServerGroup{}
+	waiters := newConnWaiters()
+	transport := &http.Transport{DialTLS: sg.dialTLS((&net.Dialer{}).DialContext, waiters, &tls.Config{}, nil, time.Minute)}
+	client := &http.Client{Transport: waiters.roundTripper(transport)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequest("GET", "https://"+l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := client.Do(req.WithContext(ctx))
+		errc <- err
+	}()
+
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the target wasn't dialed")
+	}
+	defer conn.Close()
+	cancel()
+	if err := <-errc; err == nil {
+		t.Fatalf("the request succeeded after it was cancelled")
+	}
+
+	// The handshake is abandoned (closing the connection) rather than waiting
+	// out the handshake timeout
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatalf("the connection wasn't closed after the request was cancelled: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package servergroup
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/jacksontj/promxy/promclient"
+)
+
+// warmupQuery is the (cheap) query sent to each target to warm it up
+const warmupQuery = "up"
+
+// warmupTimeout bounds how long the warmup delays the servergroup being ready
+const warmupTimeout = 10 * time.Second
+
+var warmupDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "server_group_warmup_duration_seconds",
+	Help: "How long the warmup of the servergroup's targets took once they were first discovered (see warmup)",
+}, []string{"server_group"})
+
+func init() {
+	prometheus.MustRegister(warmupDuration)
+}
+
+// warmup sends the warmupQuery to each target of `state` concurrently, so the
+// connections to the targets (including their TCP and TLS handshakes) are in
+// the client's pool before the servergroup serves real queries. Failures are
+// only logged (and recorded in the targets' health): the targets are still
+// queried once the servergroup is ready.
+func (s *ServerGroup) warmup(state *ServerGroupState) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(s.ctx, warmupTimeout)
+	defer cancel()
+
+	var warm int64
+	var wg sync.WaitGroup
+	for i, apiClient := range state.apiClients {
+		wg.Add(1)
+		go func(url string, apiClient promclient.API) {
+			defer wg.Done()
+			if _, err := apiClient.Query(ctx, warmupQuery, time.Now()); err != nil {
+				logrus.Debugf("Error warming up target %s of server group %s: %v", url, s.Cfg.Name, err)
+				s.recordRequest(url, promclient.MetricStatusError)
+				s.recordError(url, "warmup", err)
+				return
+			}
+			s.recordRequest(url, promclient.MetricStatusSuccess)
+			atomic.AddInt64(&warm, 1)
+		}(state.TargetInfos[i].URL, apiClient)
+	}
+	wg.Wait()
+
+	took := time.Since(start)
+	warmupDuration.WithLabelValues(s.Cfg.Name).Set(took.Seconds())
+	logrus.Infof("Warmed up %d of %d targets of server group %s in %s", warm, len(state.apiClients), s.Cfg.Name, took)
+}
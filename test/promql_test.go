@@ -2,9 +2,11 @@ package test
 
 import (
 	"context"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
@@ -21,6 +23,8 @@ import (
 	"github.com/sirupsen/logrus"
 
 	proxyconfig "github.com/jacksontj/promxy/config"
+	"github.com/jacksontj/promxy/promclient"
+	"github.com/jacksontj/promxy/promhttputil"
 	"github.com/jacksontj/promxy/proxystorage"
 )
 
@@ -91,8 +95,48 @@ promxy:
           insecure_skip_verify: true
 `
 
+// rawDoublePSConfigNoPushdown evaluates everything in promxy from the raw data
+const rawDoublePSConfigNoPushdown = `
+promxy:
+  disable_pushdown: true
+  server_groups:
+    - static_configs:
+        - targets:
+          - localhost:8083
+      labels:
+        az: a
+      http_client:
+        tls_config:
+          insecure_skip_verify: true
+    - static_configs:
+        - targets:
+          - localhost:8084
+      labels:
+        az: b
+      http_client:
+        tls_config:
+          insecure_skip_verify: true
+`
+
+// rawLimitedPSConfig is rawDoublePSConfig with a max_samples of 1
+const rawLimitedPSConfig = `
+promxy:
+  max_samples: 1
+  server_groups:
+    - static_configs:
+        - targets:
+          - localhost:8083
+      labels:
+        az: a
+    - static_configs:
+        - targets:
+          - localhost:8084
+      labels:
+        az: b
+`
+
 func getProxyStorage(cfg string) *proxystorage.ProxyStorage {
-	ps, err := proxystorage.NewProxyStorage()
+	ps, err := proxystorage.NewProxyStorage(nil)
 	if err != nil {
 		logrus.Fatalf("Error creating proxy: %v", err)
 	}
@@ -131,7 +175,8 @@ func startAPIForTest(storage storage.Storage, listen string) (*http.Server, chan
 
 	startChan := make(chan struct{})
 	stopChan := make(chan struct{})
-	srv := &http.Server{Addr: listen, Handler: apiRouter}
+	// Failed requests respond with their ErrorStatus, as they do in promxy
+	srv := &http.Server{Addr: listen, Handler: promhttputil.NewErrorStatusHandler(apiRouter)}
 
 	go func() {
 		defer close(stopChan)
@@ -198,7 +243,7 @@ func TestEvaluations(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	for i, psConfig := range []string{rawDoublePSConfig, rawDoublePSConfigRR} {
+	for i, psConfig := range []string{rawDoublePSConfig, rawDoublePSConfigRR, rawDoublePSConfigNoPushdown} {
 		for _, fn := range files {
 			t.Run(strconv.Itoa(i)+fn, func(t *testing.T) {
 				test, err := newTestFromFile(t, fn)
@@ -236,6 +281,71 @@ func TestEvaluations(t *testing.T) {
 	}
 }
 
+// TestLimitExceeded checks that queries exceeding a limit get the same status
+// as a prometheus limit error: a 422
+func TestLimitExceeded(t *testing.T) {
+	test, err := promql.NewTest(t, `
+load 10s
+	metric{job="api-server"}	0+10x100
+`)
+	if err != nil {
+		t.Fatalf("error creating test: %v", err)
+	}
+	defer test.Close()
+	if err := test.Run(); err != nil {
+		t.Fatalf("error loading test data: %v", err)
+	}
+
+	srv, stopChan := startAPIForTest(test.Storage(), ":8083")
+	srv2, stopChan2 := startAPIForTest(test.Storage(), ":8084")
+	ps := getProxyStorage(rawLimitedPSConfig)
+	srv3, stopChan3 := startAPIForTest(ps, ":8085")
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+		srv2.Shutdown(ctx)
+		srv3.Shutdown(ctx)
+		<-stopChan
+		<-stopChan2
+		<-stopChan3
+	}()
+
+	// The queries fail with the body prometheus responds with when exceeding its own limits
+	expected := map[string]string{
+		"status":    "error",
+		"errorType": "execution",
+		"error":     promclient.ErrTooManySamples.Error(),
+	}
+	for _, path := range []string{
+		// Each downstream returns a single sample, the limit is exceeded merging them
+		"/api/v1/query?query=metric&time=500",
+		"/api/v1/query_range?query=metric&start=100&end=500&step=10",
+	} {
+		t.Run(path, func(t *testing.T) {
+			resp, err := http.Get("http://localhost:8085" + path)
+			if err != nil {
+				t.Fatalf("Unexpected Err: %v", err)
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusUnprocessableEntity {
+				t.Fatalf("expected status 422, got %d: %s", resp.StatusCode, body)
+			}
+			var actual map[string]string
+			if err := json.Unmarshal(body, &actual); err != nil {
+				t.Fatalf("error decoding body %s: %v", body, err)
+			}
+			if !reflect.DeepEqual(actual, expected) {
+				t.Fatalf("mismatch in body expected=%v actual=%v", expected, actual)
+			}
+		})
+	}
+}
+
 func newTestFromFile(t testutil.T, filename string) (*promql.Test, error) {
 	content, err := ioutil.ReadFile(filename)
 	if err != nil {